@@ -3,8 +3,23 @@
 // SPDX-License-Identifier: MPL-2.0
 //
 
+extern crate chrono;
 extern crate git_version;
 
+use chrono::{TimeZone, Utc};
+use std::env;
+
 fn main() {
     git_version::set_env();
+
+    // Honor SOURCE_DATE_EPOCH so reproducible builds get a stable
+    // build time.
+    let build_time = env::var("SOURCE_DATE_EPOCH")
+        .ok()
+        .and_then(|s| s.parse::<i64>().ok())
+        .map(|epoch| Utc.timestamp(epoch, 0))
+        .unwrap_or_else(Utc::now);
+
+    println!("cargo:rustc-env=BUILD_TIME={}", build_time.to_rfc3339());
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
 }
@@ -0,0 +1,270 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Embedding of the update engine
+//!
+//! `Agent` does the setup the `updatehub` binary does before running
+//! the state machine: it holds the instance lock, checks the paths it
+//! writes to, redacts the secrets, opens the audit log and loads the
+//! runtime settings and firmware metadata. A product supervising the
+//! update engine from its own binary uses it as well, either running
+//! the state machine as the agent does or stepping it, acting on the
+//! states in between.
+
+use Result;
+
+use cancel;
+use crash::{self, CrashError, CrashRecord};
+use firmware::Metadata;
+use health::Watchdog;
+use hooks;
+use limits::{self, Limits};
+use lock::InstanceLock;
+use memory;
+use process;
+use redact;
+use report::Fanout;
+use runtime_settings::RuntimeSettings;
+use settings::{self, Settings};
+use states::StateMachine;
+#[cfg(feature = "mode-agent")]
+use update_package;
+
+use std::panic::{self, AssertUnwindSafe};
+
+/// Starts a new agent binary, installed by an update, has to reach the
+/// server before it is rolled back to the previous one.
+#[cfg(feature = "mode-agent")]
+const MAX_PENDING_AGENT_STARTS: usize = 3;
+
+/// Update engine ready to run.
+#[derive(Debug)]
+pub struct Agent {
+    pub settings: Settings,
+    pub runtime_settings: RuntimeSettings,
+    pub firmware: Metadata,
+    _lock: InstanceLock,
+}
+
+impl Agent {
+    /// Sets up the update engine using `settings`, failing if another
+    /// instance is already running.
+    pub fn new(settings: Settings) -> Result<Agent> {
+        let lock = InstanceLock::acquire(&settings.storage.lock_file)?;
+        match CrashRecord::take(&settings.storage.crash_record) {
+            Ok(Some(r)) => warn!(
+                "Agent stopped at {} on a {} error: {}",
+                r.timestamp, r.code, r.message
+            ),
+            Ok(None) => {}
+            Err(e) => error!("Failed to read the crash record: {}", e),
+        }
+        for warning in settings::check_paths(&settings)? {
+            warn!("{}", warning);
+        }
+        redact::set_keys(&settings.firmware.redacted_keys);
+        memory::set_limit(settings.update.memory_limit);
+        memory::set_decompressor_limit(settings.update.decompressor_memory_limit);
+        limits::set(Limits::from_settings(&settings.update));
+        process::set_audit_log(
+            settings.storage.audit_log.as_ref().map(|p| p.as_path()),
+            settings.storage.audit_log_key.as_ref().map(|p| p.as_path()),
+        )?;
+
+        let mut runtime_settings =
+            RuntimeSettings::new().load(&settings.storage.runtime_settings)?;
+        #[cfg(feature = "mode-agent")]
+        check_pending_agent(&mut runtime_settings, settings.storage.read_only)?;
+        for secret in settings
+            .network
+            .provisioning_token
+            .iter()
+            .chain(runtime_settings.enrollment.device_token.iter())
+        {
+            redact::add_secret(secret);
+        }
+        hooks::set_manifest(
+            settings.storage.hook_manifest.as_ref().map(|p| p.as_path()),
+            settings.update.temp_dir(),
+        )?;
+        let firmware = Metadata::new(&settings.firmware.metadata_path)?;
+
+        let reports = Fanout::from_settings(&settings.report)?;
+        if !reports.is_empty() {
+            reports.subscribe()?;
+        }
+
+        Ok(Agent {
+            settings,
+            runtime_settings,
+            firmware,
+            _lock: lock,
+        })
+    }
+
+    /// Runs the state machine until it is parked or cancelled. When it
+    /// stops on an error or a panic instead, or is cancelled by the
+    /// watchdog as stuck, the reason is written to the crash record
+    /// before being returned.
+    pub fn run(self) -> Result<()> {
+        let Agent {
+            settings,
+            runtime_settings,
+            firmware,
+            _lock,
+        } = self;
+
+        let crash_record = settings.storage.crash_record.clone();
+        let watchdog = Watchdog::start(cancel::current());
+
+        let machine = StateMachine::new(settings, runtime_settings, firmware);
+        let mut result = panic::catch_unwind(AssertUnwindSafe(|| machine.run()))
+            .unwrap_or_else(|p| Err(CrashError::Panicked(crash::panic_message(&*p)).into()));
+        if let Some(e) = watchdog.stop() {
+            result = Err(e.into());
+        }
+
+        if let Err(ref e) = result {
+            if let Err(e) = CrashRecord::new(e).save(&crash_record) {
+                error!("Failed to write the crash record: {}", e);
+            }
+        }
+
+        result
+    }
+
+    /// Runs the state machine until it is parked or cancelled, passing
+    /// each state to `supervise` before it is handled. It may act on
+    /// the state or return another one in its place, so the product can
+    /// add states of its own around the update engine's.
+    pub fn run_with<F>(self, mut supervise: F) -> Result<()>
+    where
+        F: FnMut(StateMachine) -> Result<StateMachine>,
+    {
+        let Agent {
+            settings,
+            runtime_settings,
+            firmware,
+            _lock,
+        } = self;
+
+        let mut machine = StateMachine::new(settings, runtime_settings, firmware);
+        loop {
+            cancel::check()?;
+            machine = supervise(machine)?.step()?;
+            if let StateMachine::Park(_) = machine {
+                debug!("Parking state machine.");
+                return Ok(());
+            }
+        }
+    }
+}
+
+/// Counts the starts of the agent binary installed by an update until
+/// it reaches the server. Once it was started too many times without
+/// reaching it, the previous binary is restored and an error returned,
+/// so the supervisor of the agent starts that one instead.
+#[cfg(feature = "mode-agent")]
+fn check_pending_agent(runtime_settings: &mut RuntimeSettings, read_only: bool) -> Result<()> {
+    let target = match runtime_settings.update.pending_agent.clone() {
+        Some(target) => target,
+        None => return Ok(()),
+    };
+
+    let starts = runtime_settings.update.pending_agent_starts;
+    if starts < MAX_PENDING_AGENT_STARTS {
+        runtime_settings.update.pending_agent_starts += 1;
+    } else {
+        runtime_settings.update.pending_agent = None;
+        runtime_settings.update.pending_agent_starts = 0;
+    }
+    if !read_only {
+        runtime_settings.save()?;
+    }
+    if starts < MAX_PENDING_AGENT_STARTS {
+        return Ok(());
+    }
+
+    match update_package::rollback_agent(&target) {
+        Ok(()) => bail!(
+            "New agent did not reach the server in {} starts, restored the previous one at '{}'",
+            starts,
+            target.display()
+        ),
+        Err(e) => {
+            error!("Failed to restore the previous agent: {}", e);
+            Ok(())
+        }
+    }
+}
+
+#[test]
+fn supervised_run() {
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let metadata_path = create_fake_metadata(FakeDevice::NoUpdate);
+    let settings = || {
+        let mut settings = Settings::default();
+        settings.firmware.metadata_path = metadata_path.clone();
+        settings.storage.lock_file = dir.path().join("updatehub.lock");
+        settings.storage.crash_record = dir.path().join("crash");
+        settings.storage.runtime_settings = dir.path().join("state").to_string_lossy().into();
+        settings
+    };
+
+    let agent = Agent::new(settings()).unwrap();
+    assert!(Agent::new(settings()).is_err());
+
+    let mut states = Vec::new();
+    agent
+        .run_with(|s| {
+            let s = match s {
+                StateMachine::Idle(s) => StateMachine::Park(s.into()),
+                s => s,
+            };
+            states.push(format!("{:?}", s));
+            Ok(s)
+        }).unwrap();
+
+    assert_eq!(states.len(), 1);
+    assert!(states[0].starts_with("Park"));
+}
+
+#[test]
+#[cfg(feature = "mode-agent")]
+fn pending_agent_rollback() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let target = dir.path().join("updatehub");
+    fs::write(&target, "new").unwrap();
+    fs::write(dir.path().join("updatehub.previous"), "old").unwrap();
+
+    let path = dir.path().join("state");
+    let mut runtime_settings = RuntimeSettings::new()
+        .load(&path.to_string_lossy())
+        .unwrap();
+    check_pending_agent(&mut runtime_settings, false).unwrap();
+    assert_eq!(runtime_settings.update.pending_agent_starts, 0);
+
+    runtime_settings.update.pending_agent = Some(target.clone());
+    for start in 1..MAX_PENDING_AGENT_STARTS + 1 {
+        check_pending_agent(&mut runtime_settings, false).unwrap();
+        assert_eq!(runtime_settings.update.pending_agent_starts, start);
+    }
+    assert_eq!(fs::read_to_string(&target).unwrap(), "new");
+
+    // Started once more without reaching the server
+    assert!(check_pending_agent(&mut runtime_settings, false).is_err());
+    assert_eq!(fs::read_to_string(&target).unwrap(), "old");
+    let saved = RuntimeSettings::new()
+        .load(&path.to_string_lossy())
+        .unwrap();
+    assert_eq!(saved.update.pending_agent, None);
+    check_pending_agent(&mut runtime_settings, false).unwrap();
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Characterization of the device
+//!
+//! `updatehub benchmark` measures how fast the device writes to its
+//! storage, hashes the objects and downloads from the server, so the
+//! timeouts and the install windows of a product are set from real
+//! figures. The writes go to a scratch file in each of the given
+//! directories, the download directory by default, never to an install
+//! target.
+
+use Result;
+
+use crypto_hash::{Algorithm, Hasher};
+use reqwest::Client;
+
+use std::cmp;
+use std::fs::{self, File};
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+
+use memory;
+use usage;
+
+/// Name of the scratch file written in the benchmarked directories.
+const SCRATCH_FILE: &str = ".updatehub-benchmark";
+
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct WriteSpeed {
+    pub dir: PathBuf,
+    /// Bytes per second, synced to the storage.
+    pub speed: u64,
+}
+
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct DownloadSpeed {
+    pub url: String,
+    /// Time until the reply of the server, in milliseconds.
+    pub latency_ms: u64,
+    pub size: u64,
+    /// Bytes per second.
+    pub speed: u64,
+}
+
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Report {
+    pub write: Vec<WriteSpeed>,
+    /// SHA256 bytes per second.
+    pub sha256: u64,
+    pub download: Option<DownloadSpeed>,
+}
+
+fn millis(duration: Duration) -> u64 {
+    duration.as_secs() * 1000 + u64::from(duration.subsec_millis())
+}
+
+/// Returns the speed, in bytes per second, of `size` bytes done in
+/// `duration`.
+fn speed(size: u64, duration: Duration) -> u64 {
+    match millis(duration) {
+        0 => size * 1000,
+        ms => size * 1000 / ms,
+    }
+}
+
+/// Measures the sequential write of `size` bytes to a scratch file in
+/// `dir`, including the sync to the storage.
+pub fn write(dir: &Path, size: u64) -> Result<WriteSpeed> {
+    let path = dir.join(SCRATCH_FILE);
+    let buf = memory::buffer();
+
+    let start = Instant::now();
+    let result = File::create(&path).and_then(|mut file| {
+        let mut written = 0;
+        while written < size {
+            let len = cmp::min(buf.len() as u64, size - written) as usize;
+            file.write_all(&buf[..len])?;
+            written += len as u64;
+        }
+        file.sync_all()
+    });
+    let elapsed = start.elapsed();
+    let _ = fs::remove_file(&path);
+    result?;
+
+    Ok(WriteSpeed {
+        dir: dir.to_path_buf(),
+        speed: speed(size, elapsed),
+    })
+}
+
+/// Measures the SHA256 of `size` bytes in memory, in bytes per second.
+pub fn sha256(size: u64) -> Result<u64> {
+    let buf = memory::buffer();
+    let mut hasher = Hasher::new(Algorithm::SHA256);
+
+    let start = Instant::now();
+    let mut hashed = 0;
+    while hashed < size {
+        let len = cmp::min(buf.len() as u64, size - hashed) as usize;
+        hasher.write_all(&buf[..len])?;
+        hashed += len as u64;
+    }
+    hasher.finish();
+
+    Ok(speed(size, start.elapsed()))
+}
+
+/// Measures the download of `url`, which is to be a large file for the
+/// speed to be meaningful.
+pub fn download(url: &str) -> Result<DownloadSpeed> {
+    let client = Client::builder().timeout(Duration::from_secs(60)).build()?;
+
+    let start = Instant::now();
+    let mut response = client.get(url).send()?;
+    let latency = start.elapsed();
+    if !response.status().is_success() {
+        bail!(
+            "Download of {} replied with status {}",
+            url,
+            response.status()
+        );
+    }
+
+    let mut buf = memory::buffer();
+    let mut size = 0;
+    loop {
+        let len = response.read(&mut buf)?;
+        if len == 0 {
+            break;
+        }
+        usage::received(len);
+        size += len as u64;
+    }
+
+    Ok(DownloadSpeed {
+        url: url.to_string(),
+        latency_ms: millis(latency),
+        size,
+        speed: speed(size, start.elapsed() - latency),
+    })
+}
+
+/// Runs the benchmarks, writing and hashing `size` bytes in each of the
+/// `dirs` and downloading `url`, when given.
+pub fn run(dirs: &[PathBuf], size: u64, url: Option<&str>) -> Result<Report> {
+    let mut report = Report {
+        write: Vec::new(),
+        sha256: sha256(size)?,
+        download: None,
+    };
+
+    for dir in dirs {
+        info!("Measuring the write speed to '{}'", dir.display());
+        report.write.push(write(dir, size)?);
+    }
+
+    if let Some(url) = url {
+        info!("Measuring the download speed from {}", url);
+        report.download = Some(download(url)?);
+    }
+
+    Ok(report)
+}
+
+#[test]
+fn benchmarks() {
+    use mockito::{mock, SERVER_URL};
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let _mock = mock("GET", "/benchmark")
+        .with_body(&"x".repeat(4096))
+        .create();
+
+    let report = run(
+        &[dir.path().to_path_buf()],
+        1024 * 1024,
+        Some(&format!("{}/benchmark", SERVER_URL)),
+    ).unwrap();
+    assert_eq!(report.write.len(), 1);
+    assert!(report.write[0].speed > 0);
+    assert!(report.sha256 > 0);
+    assert_eq!(report.download.unwrap().size, 4096);
+    assert!(!dir.path().join(SCRATCH_FILE).exists());
+
+    assert!(write(&dir.path().join("missing"), 1024).is_err());
+}
@@ -0,0 +1,492 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Serves update packages as the server does, so agents can be
+//! exercised during development and QA without the whole backend.
+//!
+//! The packages are the directories, written by `updatehub-pkg`, found
+//! in the packages directory, which is looked up again on every probe.
+//! A device is offered the package of its product and hardware whose
+//! version differs from its own, and whose install modes it advertises.
+//! The extra polls, the phases of the rollouts and the failures of the
+//! server are enabled by the options.
+//! The events the agents send to `Report/Webhook`, when it is set to
+//! `http://<address>/report`, are logged.
+
+#[macro_use]
+extern crate failure;
+#[macro_use]
+extern crate log;
+extern crate rand;
+#[macro_use]
+extern crate serde_json;
+extern crate stderrlog;
+#[macro_use]
+extern crate structopt;
+extern crate updatehub;
+
+use rand::Rng;
+use serde_json::Value;
+use structopt::StructOpt;
+
+use std::collections::HashSet;
+use std::fs::{self, File};
+use std::io::{self, BufRead, BufReader, Read, Seek, SeekFrom, Write};
+use std::net::{TcpListener, TcpStream};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::thread;
+
+use updatehub::update_package::UpdatePackage;
+
+/// Name of the metadata file in the package directories.
+const METADATA_FILE: &str = "metadata.json";
+
+/// Largest request accepted, as the agents only send their metadata.
+const MAX_BODY: usize = 1024 * 1024;
+
+#[derive(StructOpt, Debug)]
+#[structopt(
+    name = "updatehub-mock-server",
+    author = "O.S. Systems Software LTDA. <contact@ossystems.com.br>",
+    about = "Serves UpdateHub update packages for development and testing."
+)]
+struct Opt {
+    /// Increase the verboseness level
+    #[structopt(short = "v", long = "verbose", parse(from_occurrences))]
+    verbose: u8,
+
+    /// Address the server listens on
+    #[structopt(short = "l", long = "listen", default_value = "127.0.0.1:8080")]
+    listen: String,
+
+    /// Asks the devices to poll again after this many seconds, on their
+    /// first probe finding a package
+    #[structopt(long = "extra-poll")]
+    extra_poll: Option<i64>,
+
+    /// Rollout groups the packages are offered to, the others being
+    /// asked to wait for their phase
+    #[structopt(long = "rollout-group")]
+    rollout_groups: Vec<String>,
+
+    /// Name of the phase the devices outside the rollout groups wait for
+    #[structopt(long = "rollout-phase", default_value = "canary")]
+    rollout_phase: String,
+
+    /// Time, in seconds, the devices outside the rollout groups wait
+    #[structopt(long = "rollout-wait", default_value = "3600")]
+    rollout_wait: i64,
+
+    /// Status every probe is answered with, as 500
+    #[structopt(long = "probe-status")]
+    probe_status: Option<u16>,
+
+    /// Status every download is answered with, as 404
+    #[structopt(long = "download-status")]
+    download_status: Option<u16>,
+
+    /// Percentage of the requests which fail with an internal server
+    /// error
+    #[structopt(long = "error-rate", default_value = "0")]
+    error_rate: u32,
+
+    /// Directory of the packages
+    #[structopt(parse(from_os_str))]
+    packages: PathBuf,
+}
+
+/// Package, stored in `dir`.
+struct Package {
+    dir: PathBuf,
+    metadata: UpdatePackage,
+}
+
+struct Server {
+    opt: Opt,
+    /// Devices already asked for an extra poll, by their identity.
+    extra_polled: Mutex<HashSet<String>>,
+    enrolled: AtomicUsize,
+}
+
+struct Request {
+    method: String,
+    path: String,
+    headers: Vec<(String, String)>,
+    body: String,
+}
+
+impl Request {
+    fn read(stream: &TcpStream) -> updatehub::Result<Request> {
+        let mut reader = BufReader::new(stream);
+
+        let mut line = String::new();
+        reader.read_line(&mut line)?;
+        let mut parts = line.split_whitespace();
+        let (method, path) = match (parts.next(), parts.next()) {
+            (Some(m), Some(p)) => (m.to_string(), p.to_string()),
+            _ => bail!("Invalid request line '{}'", line.trim()),
+        };
+
+        let mut headers = Vec::new();
+        loop {
+            let mut line = String::new();
+            if reader.read_line(&mut line)? == 0 || line.trim().is_empty() {
+                break;
+            }
+
+            let mut parts = line.splitn(2, ':');
+            if let (Some(name), Some(value)) = (parts.next(), parts.next()) {
+                headers.push((name.trim().to_lowercase(), value.trim().to_string()));
+            }
+        }
+
+        let mut request = Request {
+            method,
+            path,
+            headers,
+            body: String::new(),
+        };
+
+        let len = request
+            .header("content-length")
+            .and_then(|l| l.parse::<usize>().ok())
+            .unwrap_or(0);
+        if len > MAX_BODY {
+            bail!("Request of {} bytes is too large", len);
+        }
+        let mut body = vec![0; len];
+        reader.read_exact(&mut body)?;
+        request.body = String::from_utf8_lossy(&body).into_owned();
+
+        Ok(request)
+    }
+
+    fn header(&self, name: &str) -> Option<&str> {
+        self.headers
+            .iter()
+            .find(|&&(ref n, _)| n == name)
+            .map(|&(_, ref v)| v.as_str())
+    }
+}
+
+struct Response {
+    status: u16,
+    headers: Vec<(String, String)>,
+    body: Body,
+}
+
+enum Body {
+    Text(String),
+    /// Part of a file, from the offset, of the length.
+    File(File, u64, u64),
+}
+
+impl Response {
+    fn new(status: u16) -> Response {
+        Response::text(status, "")
+    }
+
+    fn text(status: u16, body: &str) -> Response {
+        Response {
+            status,
+            headers: Vec::new(),
+            body: Body::Text(body.to_string()),
+        }
+    }
+
+    fn header(mut self, name: &str, value: &str) -> Response {
+        self.headers.push((name.to_string(), value.to_string()));
+        self
+    }
+
+    fn write(self, stream: &mut TcpStream) -> io::Result<()> {
+        let len = match self.body {
+            Body::Text(ref text) => text.len() as u64,
+            Body::File(_, _, len) => len,
+        };
+
+        write!(
+            stream,
+            "HTTP/1.1 {} {}\r\n",
+            self.status,
+            reason(self.status)
+        )?;
+        for (name, value) in self.headers {
+            write!(stream, "{}: {}\r\n", name, value)?;
+        }
+        write!(
+            stream,
+            "Content-Length: {}\r\nConnection: close\r\n\r\n",
+            len
+        )?;
+
+        match self.body {
+            Body::Text(text) => stream.write_all(text.as_bytes())?,
+            Body::File(mut file, offset, len) => {
+                file.seek(SeekFrom::Start(offset))?;
+                io::copy(&mut file.take(len), stream)?;
+            }
+        }
+        stream.flush()
+    }
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        201 => "Created",
+        206 => "Partial Content",
+        400 => "Bad Request",
+        404 => "Not Found",
+        500 => "Internal Server Error",
+        503 => "Service Unavailable",
+        _ => "Unknown",
+    }
+}
+
+/// Returns the packages stored in `dir`, or `dir` itself when it is a
+/// package.
+fn packages(dir: &Path) -> updatehub::Result<Vec<Package>> {
+    let mut dirs = vec![dir.to_path_buf()];
+    for entry in fs::read_dir(dir)? {
+        dirs.push(entry?.path());
+    }
+
+    let mut packages = Vec::new();
+    for dir in dirs {
+        let metadata = dir.join(METADATA_FILE);
+        if !metadata.is_file() {
+            continue;
+        }
+
+        match UpdatePackage::load(&metadata) {
+            Ok(metadata) => packages.push(Package { dir, metadata }),
+            Err(e) => warn!("Skipping package '{}': {}", dir.display(), e),
+        }
+    }
+
+    Ok(packages)
+}
+
+impl Server {
+    fn handle(&self, request: &Request) -> updatehub::Result<Response> {
+        if rand::thread_rng().gen_range(0, 100) < self.opt.error_rate {
+            info!("Failing {} {} on purpose", request.method, request.path);
+            return Ok(Response::new(500));
+        }
+
+        let path = request.path.split('?').next().unwrap_or_default();
+        let parts = path.split('/').skip(1).collect::<Vec<_>>();
+        match (request.method.as_str(), parts.as_slice()) {
+            ("POST", ["upgrades"]) => self.probe(request),
+            ("POST", ["devices", "enroll"]) => Ok(self.enroll()),
+            ("GET", ["products", _, "settings"]) => Ok(Response::new(404)),
+            ("GET", ["products", product_uid, "packages", package_uid, "objects", object]) => {
+                self.download(request, product_uid, package_uid, object)
+            }
+            ("POST", ["report"]) => {
+                info!("Report: {}", request.body);
+                Ok(Response::new(200))
+            }
+            _ => Ok(Response::new(404)),
+        }
+    }
+
+    fn probe(&self, request: &Request) -> updatehub::Result<Response> {
+        if let Some(status) = self.opt.probe_status {
+            return Ok(Response::new(status));
+        }
+
+        let device: Value = match serde_json::from_str(&request.body) {
+            Ok(device) => device,
+            Err(_) => return Ok(Response::text(400, "Invalid device metadata")),
+        };
+        let field = |name| device[name].as_str().unwrap_or_default().to_string();
+        let (product_uid, version, hardware) =
+            (field("product_uid"), field("version"), field("hardware"));
+
+        // Agents advertise their install modes, as `test=1, agent=1`
+        let modes = request.header("install-modes").map(|m| {
+            m.split(',')
+                .filter_map(|m| m.split('=').next())
+                .map(|m| m.trim().to_string())
+                .collect::<Vec<_>>()
+        });
+        let installable = |p: &Package| match modes {
+            Some(ref modes) => p
+                .metadata
+                .objects()
+                .iter()
+                .all(|o| modes.iter().any(|m| m == o.mode())),
+            None => true,
+        };
+
+        let package = packages(&self.opt.packages)?.into_iter().find(|p| {
+            p.metadata.product_uid() == product_uid
+                && p.metadata.version() != version
+                && p.metadata
+                    .supported_hardware()
+                    .map_or(true, |h| h.contains(&hardware))
+                && installable(p)
+        });
+        let package = match package {
+            Some(p) => p,
+            None => return Ok(Response::new(404)),
+        };
+
+        let group = request.header("rollout-group").unwrap_or_default();
+        if !self.opt.rollout_groups.is_empty()
+            && !self.opt.rollout_groups.iter().any(|g| g == group)
+        {
+            info!("Device of rollout group '{}' waits for its phase", group);
+            return Ok(Response::new(200)
+                .header("Rollout-Phase", &self.opt.rollout_phase)
+                .header("Rollout-Wait", &self.opt.rollout_wait.to_string()));
+        }
+
+        if let Some(extra_poll) = self.opt.extra_poll {
+            let identity = device["device_identity"].to_string();
+            if self.extra_polled.lock().unwrap().insert(identity) {
+                return Ok(Response::new(200).header("Add-Extra-Poll", &extra_poll.to_string()));
+            }
+        }
+
+        info!(
+            "Offering package {} ({}) to a device of {}",
+            package.metadata.package_uid(),
+            package.metadata.version(),
+            version
+        );
+        Ok(Response::text(
+            200,
+            &fs::read_to_string(package.dir.join(METADATA_FILE))?,
+        ))
+    }
+
+    fn enroll(&self) -> Response {
+        let n = self.enrolled.fetch_add(1, Ordering::SeqCst);
+        let body = json!({ "device_token": format!("mock-device-{}", n) });
+        Response::text(201, &body.to_string())
+    }
+
+    fn download(
+        &self,
+        request: &Request,
+        product_uid: &str,
+        package_uid: &str,
+        object: &str,
+    ) -> updatehub::Result<Response> {
+        if let Some(status) = self.opt.download_status {
+            return Ok(Response::new(status));
+        }
+
+        let source = packages(&self.opt.packages)?
+            .into_iter()
+            .filter(|p| {
+                p.metadata.product_uid() == product_uid && p.metadata.package_uid() == package_uid
+            }).filter_map(|p| {
+                p.metadata
+                    .objects()
+                    .iter()
+                    .find(|o| o.sha256sum() == object)
+                    .and_then(|o| o.source(&p.dir).ok())
+            }).next();
+        let source = match source {
+            Some(s) => s,
+            None => return Ok(Response::new(404)),
+        };
+
+        let file = File::open(&source)?;
+        let len = file.metadata()?.len();
+
+        // Resumed downloads ask for the rest of the object
+        let offset = request
+            .header("range")
+            .and_then(|r| r.trim_left_matches("bytes=").split('-').next())
+            .and_then(|o| o.parse::<u64>().ok())
+            .filter(|&o| o < len);
+        let response = match offset {
+            Some(offset) => Response {
+                status: 206,
+                headers: Vec::new(),
+                body: Body::File(file, offset, len - offset),
+            }.header(
+                "Content-Range",
+                &format!("bytes {}-{}/{}", offset, len - 1, len),
+            ),
+            None => Response {
+                status: 200,
+                headers: Vec::new(),
+                body: Body::File(file, 0, len),
+            },
+        };
+
+        Ok(response)
+    }
+
+    fn serve(&self, mut stream: TcpStream) {
+        let response = Request::read(&stream).and_then(|request| {
+            let response = self.handle(&request)?;
+            info!("{} {} -> {}", request.method, request.path, response.status);
+            Ok(response)
+        });
+
+        let response = response.unwrap_or_else(|e| {
+            error!("Failed to handle the request: {}", e);
+            Response::new(500)
+        });
+        if let Err(e) = response.write(&mut stream) {
+            warn!("Failed to send the response: {}", e);
+        }
+    }
+}
+
+fn run() -> updatehub::Result<()> {
+    let opt = Opt::from_args();
+    stderrlog::new()
+        .verbosity(opt.verbose as usize + 1)
+        .init()?;
+
+    let listener = TcpListener::bind(&opt.listen)?;
+    info!(
+        "Serving the packages of '{}' on {}",
+        opt.packages.display(),
+        opt.listen
+    );
+
+    let server = Arc::new(Server {
+        opt,
+        extra_polled: Mutex::new(HashSet::new()),
+        enrolled: AtomicUsize::new(0),
+    });
+    // A connection which failed to be accepted, such as one reset by
+    // the client meanwhile, does not stop the server
+    for stream in listener.incoming() {
+        let stream = match stream {
+            Ok(stream) => stream,
+            Err(e) => {
+                warn!("Failed to accept a connection: {}", e);
+                continue;
+            }
+        };
+        let server = server.clone();
+        thread::spawn(move || server.serve(stream));
+    }
+
+    Ok(())
+}
+
+fn main() {
+    if let Err(ref e) = run() {
+        error!("{}", e);
+        e.iter_causes()
+            .skip(1)
+            .for_each(|e| error!(" caused by: {}\n", e));
+
+        std::process::exit(1);
+    }
+}
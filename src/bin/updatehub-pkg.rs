@@ -0,0 +1,145 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Creates update packages, so build pipelines do not depend on
+//! external tooling.
+//!
+//! The package metadata is made of a template, giving the product UID,
+//! version and supported hardware, and of the objects, each given as
+//! `<mode>:<target>:<file>`. The metadata and the objects, named by
+//! their SHA256, are written to the output directory, as expected by
+//! `updatehub install`. The packages of the local sources must also
+//! be signed, with `--sign`.
+
+extern crate crypto_hash;
+#[macro_use]
+extern crate failure;
+extern crate hex;
+#[macro_use]
+extern crate log;
+#[macro_use]
+extern crate serde_json;
+extern crate stderrlog;
+#[macro_use]
+extern crate structopt;
+extern crate updatehub;
+
+use crypto_hash::{Algorithm, Hasher};
+use serde_json::Value;
+use structopt::StructOpt;
+
+use std::fs::{self, File};
+use std::io;
+use std::path::{Path, PathBuf};
+
+use updatehub::update_package::UpdatePackage;
+use updatehub::usb;
+
+/// Name of the metadata file in the output directory.
+const METADATA_FILE: &str = "metadata.json";
+
+#[derive(StructOpt, Debug)]
+#[structopt(
+    name = "updatehub-pkg",
+    author = "O.S. Systems Software LTDA. <contact@ossystems.com.br>",
+    about = "Creates UpdateHub update packages."
+)]
+struct Opt {
+    /// Increase the verboseness level
+    #[structopt(short = "v", long = "verbose", parse(from_occurrences))]
+    verbose: u8,
+
+    /// Metadata template, in JSON, without the objects
+    #[structopt(short = "t", long = "template", parse(from_os_str))]
+    template: PathBuf,
+
+    /// Directory where the package is written
+    #[structopt(short = "o", long = "output", parse(from_os_str))]
+    output: PathBuf,
+
+    /// Private key, in PEM, the metadata is signed with, as required
+    /// by the local sources
+    #[structopt(long = "sign", parse(from_os_str))]
+    sign: Option<PathBuf>,
+
+    /// Objects of the package, as <mode>:<target>:<file>
+    #[structopt(raw(required = "true"))]
+    objects: Vec<String>,
+}
+
+/// Returns the metadata of the object described by `spec`, copying its
+/// file to `output`.
+fn add_object(spec: &str, output: &Path) -> updatehub::Result<Value> {
+    let mut parts = spec.splitn(3, ':');
+    let (mode, target, file) = match (parts.next(), parts.next(), parts.next()) {
+        (Some(m), Some(t), Some(f)) => (m, t, Path::new(f)),
+        _ => bail!("Invalid object '{}', expected <mode>:<target>:<file>", spec),
+    };
+
+    let filename = file
+        .file_name()
+        .ok_or_else(|| format_err!("Invalid object file '{}'", file.display()))?;
+
+    let mut hasher = Hasher::new(Algorithm::SHA256);
+    let size = io::copy(&mut File::open(file)?, &mut hasher)?;
+    let sha256sum = hex::encode(hasher.finish());
+
+    debug!("Adding object {} ({})", file.display(), sha256sum);
+    fs::copy(file, output.join(&sha256sum))?;
+
+    Ok(json!({
+        "mode": mode,
+        "filename": filename.to_string_lossy(),
+        "target": target,
+        "sha256sum": sha256sum,
+        "size": size,
+    }))
+}
+
+fn run() -> updatehub::Result<()> {
+    let opt = Opt::from_args();
+    stderrlog::new()
+        .verbosity(opt.verbose as usize + 1)
+        .init()?;
+
+    let mut metadata: Value = serde_json::from_reader(File::open(&opt.template)?)?;
+    if !metadata.is_object() {
+        bail!("Template '{}' is not a JSON object", opt.template.display());
+    }
+
+    fs::create_dir_all(&opt.output)?;
+    let objects = opt
+        .objects
+        .iter()
+        .map(|o| add_object(o, &opt.output))
+        .collect::<updatehub::Result<Vec<_>>>()?;
+    metadata["objects"] = Value::Array(objects);
+
+    // The package must be usable by the agent as written
+    let content = serde_json::to_string_pretty(&metadata)?;
+    let package = UpdatePackage::parse(&content)?;
+    fs::write(opt.output.join(METADATA_FILE), &content)?;
+    if let Some(ref key) = opt.sign {
+        usb::sign(&opt.output.join(METADATA_FILE), key)?;
+    }
+
+    info!(
+        "Package {} written to '{}'",
+        package.package_uid(),
+        opt.output.display()
+    );
+    Ok(())
+}
+
+fn main() {
+    if let Err(ref e) = run() {
+        error!("{}", e);
+        e.iter_causes()
+            .skip(1)
+            .for_each(|e| error!(" caused by: {}\n", e));
+
+        std::process::exit(1);
+    }
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Simulates a fleet of devices running the agent, for load testing
+//! servers before production rollouts.
+//!
+//! Each virtual device runs the agent state machine in its own thread,
+//! with its own runtime settings and download directory, a distinct
+//! device identity and randomized attributes. The installation is done
+//! in dry-run mode, so nothing is written besides the scratch files.
+
+extern crate chrono;
+#[macro_use]
+extern crate log;
+extern crate rand;
+#[macro_use]
+extern crate serde_json;
+extern crate stderrlog;
+#[macro_use]
+extern crate structopt;
+extern crate updatehub;
+
+use rand::Rng;
+use structopt::StructOpt;
+
+use std::fs;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use updatehub::firmware::Metadata;
+use updatehub::runtime_settings::RuntimeSettings;
+use updatehub::settings::Settings;
+use updatehub::states::StateMachine;
+
+#[derive(StructOpt, Debug)]
+#[structopt(
+    name = "updatehub-sim",
+    author = "O.S. Systems Software LTDA. <contact@ossystems.com.br>",
+    about = "Simulates a fleet of UpdateHub devices for load testing."
+)]
+struct Opt {
+    /// Increase the verboseness level
+    #[structopt(short = "v", long = "verbose", parse(from_occurrences))]
+    verbose: u8,
+
+    /// Server address the devices use
+    #[structopt(short = "s", long = "server")]
+    server: String,
+
+    /// Product UID of the simulated devices
+    #[structopt(short = "p", long = "product-uid")]
+    product_uid: String,
+
+    /// Number of simulated devices
+    #[structopt(short = "n", long = "devices", default_value = "100")]
+    devices: usize,
+
+    /// Firmware version of the devices
+    #[structopt(long = "version", default_value = "1.0")]
+    version: String,
+
+    /// Hardware of the devices
+    #[structopt(long = "hardware", default_value = "board")]
+    hardware: String,
+
+    /// Polling interval, in seconds, of the devices
+    #[structopt(long = "interval", default_value = "60")]
+    interval: i64,
+
+    /// Percentage of the state transitions which fail, restarting
+    /// the device agent
+    #[structopt(long = "failure-rate", default_value = "0")]
+    failure_rate: u32,
+
+    /// Time, in seconds, to run the simulation for
+    #[structopt(long = "duration", default_value = "300")]
+    duration: u64,
+
+    /// Directory where the devices store their data
+    #[structopt(
+        long = "work-dir",
+        parse(from_os_str),
+        default_value = "/tmp/updatehub-sim"
+    )]
+    work_dir: PathBuf,
+}
+
+/// Counters shared by the simulated devices.
+#[derive(Default)]
+struct Stats {
+    probes: AtomicUsize,
+    downloads: AtomicUsize,
+    installs: AtomicUsize,
+    errors: AtomicUsize,
+    injected_failures: AtomicUsize,
+}
+
+/// Simulated device, identified by its index in the fleet.
+struct Device {
+    id: usize,
+    dir: PathBuf,
+    attributes: String,
+}
+
+impl Device {
+    fn new(opt: &Opt, id: usize) -> updatehub::Result<Device> {
+        let dir = opt.work_dir.join(format!("device-{}", id));
+        fs::create_dir_all(&dir)?;
+
+        let mut rnd = rand::thread_rng();
+        let attributes = format!(
+            "region=region{}\nbattery={}\nuptime={}",
+            rnd.gen_range(0, 10),
+            rnd.gen_range(0, 101),
+            rnd.gen_range(0, 1_000_000)
+        );
+
+        Ok(Device {
+            id,
+            dir,
+            attributes,
+        })
+    }
+
+    /// Starts the agent of the device, as after booting it.
+    fn boot(&self, opt: &Opt) -> updatehub::Result<StateMachine> {
+        let mut settings = Settings::default();
+        settings.network.server_address = opt.server.clone();
+        settings.polling.interval = chrono::Duration::seconds(opt.interval);
+        settings.polling.allow_short_interval = true;
+        settings.update.download_dir = self.dir.join("download");
+        settings.update.dry_run = true;
+
+        let runtime_settings =
+            RuntimeSettings::new().load(&self.dir.join("runtime.conf").to_string_lossy())?;
+        let firmware = Metadata::from_values(
+            &opt.product_uid,
+            &opt.version,
+            &opt.hardware,
+            &format!("serial=sim-{:08}", self.id),
+            &self.attributes,
+        )?;
+
+        Ok(StateMachine::new(settings, runtime_settings, firmware))
+    }
+
+    fn run(self, opt: &Opt, stats: &Stats) -> updatehub::Result<()> {
+        let mut machine = self.boot(opt)?;
+
+        loop {
+            if rand::thread_rng().gen_range(0, 100) < opt.failure_rate {
+                debug!("Injecting failure on device {}", self.id);
+                stats.injected_failures.fetch_add(1, Ordering::Relaxed);
+                machine = self.boot(opt)?;
+                continue;
+            }
+
+            machine = match machine.step() {
+                Ok(m) => m,
+                Err(e) => {
+                    warn!("Device {} failed: {}", self.id, e);
+                    stats.errors.fetch_add(1, Ordering::Relaxed);
+                    self.boot(opt)?
+                }
+            };
+
+            let counter = match machine {
+                StateMachine::Probe(_) => &stats.probes,
+                StateMachine::Download(_) => &stats.downloads,
+                StateMachine::Install(_) => &stats.installs,
+                _ => continue,
+            };
+            counter.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+}
+
+fn run() -> updatehub::Result<()> {
+    let opt = Arc::new(Opt::from_args());
+    stderrlog::new()
+        .verbosity(opt.verbose as usize + 1)
+        .init()?;
+
+    let stats = Arc::new(Stats::default());
+    for id in 0..opt.devices {
+        let device = Device::new(&opt, id)?;
+        let (opt, stats) = (opt.clone(), stats.clone());
+
+        thread::Builder::new()
+            .name(format!("device-{}", id))
+            .spawn(move || {
+                if let Err(e) = device.run(&opt, &stats) {
+                    error!("Device {} stopped: {}", id, e);
+                }
+            })?;
+    }
+
+    info!("Simulating {} devices for {}s", opt.devices, opt.duration);
+    let start = Instant::now();
+    thread::sleep(Duration::from_secs(opt.duration));
+
+    let count = |c: &AtomicUsize| c.load(Ordering::Relaxed);
+    println!(
+        "{}",
+        json!({
+            "devices": opt.devices,
+            "duration": start.elapsed().as_secs(),
+            "probes": count(&stats.probes),
+            "downloads": count(&stats.downloads),
+            "installs": count(&stats.installs),
+            "errors": count(&stats.errors),
+            "injected-failures": count(&stats.injected_failures),
+        })
+    );
+
+    Ok(())
+}
+
+fn main() {
+    if let Err(ref e) = run() {
+        error!("{}", e);
+        e.iter_causes()
+            .skip(1)
+            .for_each(|e| error!(" caused by: {}\n", e));
+
+        std::process::exit(1);
+    }
+}
@@ -6,6 +6,8 @@
 //! Build information module
 
 const VERSION: &str = env!("VERSION");
+const BUILD_TIME: &str = env!("BUILD_TIME");
+const FULL_VERSION: &str = concat!(env!("VERSION"), " (built ", env!("BUILD_TIME"), ")");
 
 /// Returns the version in use, including the commit and if there is
 /// uncommited modification in the source.
@@ -22,3 +24,17 @@ const VERSION: &str = env!("VERSION");
 pub fn version() -> &'static str {
     VERSION
 }
+
+/// Returns the time the agent has been built, in RFC 3339 format.
+///
+/// When `SOURCE_DATE_EPOCH` is set during the build, it is used
+/// instead of the current time so reproducible builds are possible.
+pub fn build_time() -> &'static str {
+    BUILD_TIME
+}
+
+/// Returns the version followed by the build time, as shown by
+/// `--version`.
+pub fn full_version() -> &'static str {
+    FULL_VERSION
+}
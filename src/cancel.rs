@@ -0,0 +1,196 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Cancellation of the running operations
+//!
+//! The long running operations (waiting for the next probe, fetching
+//! and installing the objects, running external commands) check for a
+//! cancellation at each step and give up with `CancelError`, so the
+//! state machine stops once the current state returns.
+//!
+//! The operations are cancelled by the token of the thread running
+//! them, which a program embedding the agent cancels from any thread,
+//! or by a termination signal once `handle_signals` is called. Cancelling
+//! the token also wakes the thread up if it is sleeping.
+
+use Result;
+
+use libc;
+
+use std::cell::RefCell;
+use std::cmp;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Condvar, Mutex};
+use std::time::{Duration, Instant};
+
+static SIGNALLED: AtomicBool = AtomicBool::new(false);
+
+/// Longest a sleeping thread takes to notice a termination signal, as
+/// the signal handler can not wake it up.
+const SIGNAL_CHECK_INTERVAL: Duration = Duration::from_millis(100);
+
+#[derive(Debug, Fail)]
+pub enum CancelError {
+    #[fail(display = "Operation cancelled")]
+    Cancelled,
+}
+
+/// Cancels the operations of the threads it is set for. The clones
+/// are cancelled together.
+#[derive(Clone, Debug, Default)]
+pub struct Token(Arc<(Mutex<bool>, Condvar)>);
+
+impl Token {
+    pub fn new() -> Self {
+        Token::default()
+    }
+
+    pub fn cancel(&self) {
+        let (ref cancelled, ref wakeup) = *self.0;
+        *cancelled.lock().unwrap() = true;
+        wakeup.notify_all();
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        *(self.0).0.lock().unwrap()
+    }
+
+    /// Waits for `duration` to pass, returning early when the token is
+    /// cancelled.
+    fn sleep(&self, duration: Duration) {
+        let (ref cancelled, ref wakeup) = *self.0;
+        let deadline = Instant::now() + duration;
+        let mut guard = cancelled.lock().unwrap();
+
+        while !*guard && !SIGNALLED.load(Ordering::SeqCst) {
+            let now = Instant::now();
+            if now >= deadline {
+                break;
+            }
+
+            let timeout = cmp::min(deadline - now, SIGNAL_CHECK_INTERVAL);
+            guard = wakeup.wait_timeout(guard, timeout).unwrap().0;
+        }
+    }
+}
+
+thread_local! {
+    static TOKEN: RefCell<Token> = RefCell::new(Token::new());
+}
+
+/// Replaces the token of the current thread.
+pub fn set(token: Token) {
+    TOKEN.with(|t| *t.borrow_mut() = token);
+}
+
+/// Returns the token of the current thread.
+pub fn current() -> Token {
+    TOKEN.with(|t| t.borrow().clone())
+}
+
+/// Returns whether the operations of the current thread are
+/// cancelled.
+pub fn is_cancelled() -> bool {
+    SIGNALLED.load(Ordering::SeqCst) || TOKEN.with(|t| t.borrow().is_cancelled())
+}
+
+/// Waits for `duration` to pass, returning early when the operations
+/// of the current thread are cancelled through its token.
+pub fn sleep(duration: Duration) {
+    current().sleep(duration)
+}
+
+/// Fails with `CancelError` if the operations of the current thread
+/// are cancelled.
+pub fn check() -> Result<()> {
+    if is_cancelled() {
+        return Err(CancelError::Cancelled.into());
+    }
+
+    Ok(())
+}
+
+extern "C" fn on_signal(_: libc::c_int) {
+    SIGNALLED.store(true, Ordering::SeqCst);
+}
+
+/// Cancels the operations of every thread on `SIGTERM` or `SIGINT`,
+/// so the agent is stopped between two steps instead of in the middle
+/// of one.
+pub fn handle_signals() {
+    for &signal in &[libc::SIGTERM, libc::SIGINT] {
+        unsafe {
+            libc::signal(signal, on_signal as libc::sighandler_t);
+        }
+    }
+}
+
+#[test]
+fn cancelled_token() {
+    use std::thread;
+
+    let token = Token::new();
+    set(token.clone());
+    assert!(check().is_ok());
+
+    let other = token.clone();
+    thread::spawn(move || other.cancel()).join().unwrap();
+    assert!(is_cancelled());
+    assert!(check().is_err());
+
+    // Other threads have tokens of their own
+    assert!(!thread::spawn(is_cancelled).join().unwrap());
+}
+
+#[test]
+fn cancelled_while_sleeping() {
+    use std::thread;
+
+    let token = Token::new();
+    set(token.clone());
+
+    let start = Instant::now();
+    let other = token.clone();
+    let canceller = thread::spawn(move || {
+        thread::sleep(Duration::from_millis(50));
+        other.cancel()
+    });
+
+    sleep(Duration::from_secs(60));
+    assert!(start.elapsed() < Duration::from_secs(30));
+    canceller.join().unwrap();
+}
+
+#[test]
+fn signalled_while_sleeping() {
+    use clock;
+    use std::env;
+    use std::process::Command;
+    use std::thread;
+
+    // The signal cancels every thread, so it is sent to another run of
+    // this test only
+    if env::var_os("UPDATEHUB_SIGNAL_TEST").is_none() {
+        let status = Command::new(env::current_exe().unwrap())
+            .args(&["--exact", "cancel::signalled_while_sleeping"])
+            .env("UPDATEHUB_SIGNAL_TEST", "1")
+            .status()
+            .unwrap();
+        assert!(status.success());
+        return;
+    }
+
+    handle_signals();
+    let start = Instant::now();
+    let signaller = thread::spawn(|| {
+        thread::sleep(Duration::from_millis(50));
+        unsafe { libc::kill(libc::getpid(), libc::SIGTERM) };
+    });
+
+    clock::sleep(Duration::from_secs(60));
+    assert!(start.elapsed() < Duration::from_secs(30));
+    assert!(check().is_err());
+    signaller.join().unwrap();
+}
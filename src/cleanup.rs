@@ -0,0 +1,135 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Cleanup of the download directory
+//!
+//! The downloaded objects are removed as configured by the
+//! `Update/Cleanup` setting: right after the install, once the device
+//! reaches the server after the reboot, or kept according to the
+//! retention settings, possibly for forensic purposes.
+
+use Result;
+
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
+
+use settings::{Cleanup, Update};
+
+/// Removes every file from the download directory `dir`.
+pub fn clear(dir: &Path) -> Result<()> {
+    if !dir.exists() {
+        return Ok(());
+    }
+
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_file() {
+            debug!("Removing '{}'", path.display());
+            fs::remove_file(&path)?;
+        }
+    }
+
+    Ok(())
+}
+
+/// Removes the files of the download directory left over from the
+/// previous updates, besides the `kept` ones. When the objects are
+/// retained, only those older than the retention period are removed,
+/// then the oldest ones until the directory fits the retention size.
+/// Otherwise every one is, as they were meant to be removed already.
+pub fn prune(settings: &Update, kept: &[&str]) -> Result<()> {
+    let dir = &settings.download_dir;
+    if !dir.exists() {
+        return Ok(());
+    }
+
+    let mut files: Vec<(PathBuf, SystemTime, u64)> = Vec::new();
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let metadata = entry.metadata()?;
+        if !metadata.is_file() {
+            continue;
+        }
+
+        if kept.iter().any(|&k| entry.file_name() == k) {
+            continue;
+        }
+        if settings.cleanup != Cleanup::Retain {
+            debug!("Removing '{}'", entry.path().display());
+            fs::remove_file(entry.path())?;
+            continue;
+        }
+        files.push((entry.path(), metadata.modified()?, metadata.len()));
+    }
+    files.sort_by_key(|&(_, modified, _)| modified);
+
+    let max_age = settings
+        .retention_days
+        .map(|d| Duration::from_secs(d * 24 * 60 * 60));
+    let mut size: u64 = files.iter().map(|&(_, _, len)| len).sum();
+
+    for (path, modified, len) in files {
+        let expired = max_age.map_or(false, |max_age| {
+            modified.elapsed().map(|age| age > max_age).unwrap_or(false)
+        });
+        let oversized = settings.retention_max_size.map_or(false, |max| size > max);
+
+        if expired || oversized {
+            debug!("Removing '{}' from the retained objects", path.display());
+            fs::remove_file(&path)?;
+            size -= len;
+        }
+    }
+
+    Ok(())
+}
+
+#[test]
+fn clear_dir() {
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    fs::write(dir.path().join("object"), "1234567890").unwrap();
+    fs::create_dir(dir.path().join("subdir")).unwrap();
+
+    clear(dir.path()).unwrap();
+    assert!(!dir.path().join("object").exists());
+    assert!(dir.path().join("subdir").exists());
+    assert!(clear(&dir.path().join("missing")).is_ok());
+}
+
+#[test]
+fn prune_by_size() {
+    use std::thread;
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    for name in &["old", "new"] {
+        fs::write(dir.path().join(name), "1234567890").unwrap();
+        // Ensures the files have distinct modification times
+        thread::sleep(Duration::from_millis(50));
+    }
+
+    let mut settings = Update::default();
+    settings.download_dir = dir.path().to_path_buf();
+    settings.retention_days = Some(1);
+    settings.retention_max_size = Some(15);
+
+    prune(&settings, &[]).unwrap();
+    assert!(!dir.path().join("old").exists());
+    assert!(dir.path().join("new").exists());
+
+    settings.retention_max_size = None;
+    prune(&settings, &[]).unwrap();
+    assert!(dir.path().join("new").exists());
+
+    // The objects not retained are removed, besides the kept ones
+    fs::write(dir.path().join("object"), "1234567890").unwrap();
+    settings.cleanup = Cleanup::AfterInstall;
+    prune(&settings, &["object"]).unwrap();
+    assert!(!dir.path().join("new").exists());
+    assert!(dir.path().join("object").exists());
+}
@@ -3,18 +3,35 @@
 // SPDX-License-Identifier: MPL-2.0
 //
 
-use Result;
+use {Error, Result};
 
-use reqwest::header::{ByteRangeSpec, ContentType, Headers, Range, UserAgent};
-use reqwest::{Client, StatusCode};
+use crypto_hash::{hex_digest, Algorithm};
+use reqwest::header::{
+    Authorization, Bearer, ByteRangeSpec, ContentType, Headers, Range, UserAgent,
+};
+use reqwest::{Client, RequestBuilder, StatusCode};
+use serde::Serialize;
+use serde_json;
 
+use std::collections::BTreeMap;
+use std::io::Read;
 use std::time::Duration;
 
+use build_info;
+use cancel;
+use fault;
 use firmware::Metadata;
+use memory;
+use progress::Progress;
 use runtime_settings::RuntimeSettings;
-use settings::Settings;
+use settings::{self, Settings};
+use usage;
 
-use update_package::UpdatePackage;
+use update_package::{validate, UpdatePackage};
+
+pub mod record;
+use self::record::Reply;
+pub mod source;
 
 #[cfg(test)]
 pub mod tests;
@@ -22,6 +39,44 @@ pub mod tests;
 header! { (ApiContentType, "Api-Content-Type") => [String] }
 header! { (ApiRetries, "Api-Retries") => [usize] }
 header! { (AddExtraPoll, "Add-Extra-Poll") => [i64] }
+header! { (RemoteSettingsVersion, "Remote-Settings-Version") => [String] }
+header! { (RolloutGroup, "Rollout-Group") => [String] }
+header! { (RolloutPhase, "Rollout-Phase") => [String] }
+header! { (RolloutWait, "Rollout-Wait") => [i64] }
+header! { (AgentVersion, "Agent-Version") => [String] }
+header! { (SettingsSchemaVersion, "Settings-Schema-Version") => [u32] }
+header! { (InstallModes, "Install-Modes") => [String] }
+
+/// Rollout group reported by devices opted into the canary phase.
+pub const CANARY_GROUP: &str = "canary";
+
+/// Largest reply of the server read, besides the objects, as it may be
+/// compromised.
+const MAX_REPLY_SIZE: u64 = 1024 * 1024;
+
+/// Sets `body`, in JSON, as the body of `request`, counting it as sent.
+fn json<T: Serialize>(request: &mut RequestBuilder, body: &T) -> Result<()> {
+    let body = serde_json::to_vec(body)?;
+    usage::sent(body.len());
+    request.body(body);
+    Ok(())
+}
+
+/// Adds the `list` of headers, given as `<name>: <value>`, to
+/// `headers`.
+pub fn add_headers(headers: &mut Headers, list: &[String]) -> Result<()> {
+    for header in list {
+        let mut parts = header.splitn(2, ':');
+        match (parts.next(), parts.next()) {
+            (Some(name), Some(value)) => {
+                headers.set_raw(name.trim().to_string(), value.trim().to_string())
+            }
+            _ => bail!("Invalid header '{}', expected <name>: <value>", header),
+        }
+    }
+
+    Ok(())
+}
 
 pub struct Api<'a> {
     settings: &'a Settings,
@@ -34,6 +89,65 @@ pub enum ProbeResponse {
     NoUpdate,
     Update(UpdatePackage),
     ExtraPoll(i64),
+    /// The update is being rolled out in phases and the device must
+    /// wait, in seconds, for the phase it belongs to.
+    RolloutWait {
+        phase: Option<String>,
+        wait: i64,
+    },
+    /// The update package, identified by `package_uid`, has invalid
+    /// metadata, as an install mode the agent was built without, or is
+    /// not even valid JSON.
+    InvalidUpdate {
+        package_uid: String,
+        error: Error,
+    },
+}
+
+/// Reply of the server which is not the expected one.
+#[derive(Debug, Fail)]
+pub enum ServerError {
+    #[fail(display = "Invalid {}. Status: {}", _0, _1)]
+    InvalidResponse(&'static str, StatusCode),
+    #[fail(display = "Couldn't download the object {}", _0)]
+    ObjectUnavailable(String),
+    #[fail(display = "Reply to {} is over {} bytes", _0, _1)]
+    TooLarge(String, u64),
+}
+
+#[derive(Serialize)]
+struct EnrollRequest<'a> {
+    provisioning_token: &'a str,
+    #[serde(flatten)]
+    firmware: &'a Metadata,
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "kebab-case")]
+struct ReportRequest<'a> {
+    status: &'a str,
+    package_uid: &'a str,
+    error_message: &'a str,
+    #[serde(flatten)]
+    firmware: &'a Metadata,
+}
+
+#[derive(Deserialize)]
+struct EnrollResponse {
+    device_token: String,
+}
+
+#[derive(Debug, Fail)]
+pub enum EnrollError {
+    #[fail(display = "Enrollment rejected by the server. Status: {}", _0)]
+    Rejected(StatusCode),
+}
+
+/// Settings sent by the server, identified as `<Section>/<Key>`.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct RemoteSettings {
+    pub version: String,
+    pub settings: BTreeMap<String, String>,
 }
 
 impl<'a> Api<'a> {
@@ -52,9 +166,15 @@ impl<'a> Api<'a> {
     fn client(&self) -> Result<Client> {
         let mut headers = Headers::new();
 
-        headers.set(UserAgent::new("updatehub/next"));
+        add_headers(&mut headers, &self.settings.network.context_headers)?;
+        headers.set(UserAgent::new(self.user_agent()));
         headers.set(ContentType::json());
         headers.set(ApiContentType("application/vnd.updatehub-v1+json".into()));
+        if let Some(ref token) = self.runtime_settings.enrollment.device_token {
+            headers.set(Authorization(Bearer {
+                token: token.clone(),
+            }));
+        }
 
         Ok(Client::builder()
             .timeout(Duration::from_secs(10))
@@ -62,39 +182,190 @@ impl<'a> Api<'a> {
             .build()?)
     }
 
+    /// Sends the `request` for `path`, or returns its recorded reply
+    /// when replaying a recording.
+    fn send(&self, method: &str, path: &str, request: &mut RequestBuilder) -> Result<Reply> {
+        if let Some(reply) = record::replayed(method, path) {
+            return reply;
+        }
+
+        let mut response = request.send()?;
+        let mut body = String::new();
+        (&mut response)
+            .take(MAX_REPLY_SIZE + 1)
+            .read_to_string(&mut body)?;
+        if body.len() as u64 > MAX_REPLY_SIZE {
+            return Err(ServerError::TooLarge(path.to_string(), MAX_REPLY_SIZE).into());
+        }
+
+        let reply = Reply {
+            status: response.status(),
+            headers: response.headers().clone(),
+            body,
+        };
+        usage::received(reply.body.len());
+
+        record::record(method, path, &reply);
+        Ok(reply)
+    }
+
+    /// Returns the User-Agent of the requests: the agent version, with
+    /// the hardware and firmware version unless the details are
+    /// disabled by `Network/UserAgentDetails`.
+    fn user_agent(&self) -> String {
+        let agent = format!("updatehub/{}", build_info::version());
+        if !self.settings.network.user_agent_details {
+            return agent;
+        }
+
+        format!(
+            "{} ({}; firmware {})",
+            agent, self.firmware.hardware, self.firmware.version
+        )
+    }
+
+    fn url(&self, path: &str) -> String {
+        format!("{}{}", &self.settings.network.server_address, path)
+    }
+
     pub fn probe(&self) -> Result<ProbeResponse> {
-        let mut response = self
-            .client()?
-            .post(&format!(
-                "{}/upgrades",
-                &self.settings.network.server_address
-            )).header(ApiRetries(self.runtime_settings.polling.retries))
-            .json(&self.firmware)
-            .send()?;
-
-        match response.status() {
+        let path = "/upgrades";
+        let mut request = self.client()?.post(&self.url(path));
+        request
+            .header(ApiRetries(self.runtime_settings.polling.retries))
+            .header(AgentVersion(build_info::version().into()))
+            .header(SettingsSchemaVersion(settings::SCHEMA_VERSION))
+            .header(InstallModes(validate::advertised()));
+        json(&mut request, &self.firmware)?;
+
+        if let Some(group) = self.rollout_group() {
+            request.header(RolloutGroup(group));
+        }
+
+        // Reports the remote settings in use
+        if let Some(ref version) = self.runtime_settings.remote_settings {
+            request.header(RemoteSettingsVersion(version.clone()));
+        }
+
+        let response = self.send("POST", path, &mut request)?;
+
+        match response.status {
             StatusCode::NotFound => Ok(ProbeResponse::NoUpdate),
             StatusCode::Ok => {
-                if let Some(extra_poll) = response.headers().get::<AddExtraPoll>() {
+                if let Some(wait) = response.headers.get::<RolloutWait>() {
+                    let phase = response.headers.get::<RolloutPhase>();
+                    return Ok(ProbeResponse::RolloutWait {
+                        phase: phase.map(|p| p.0.clone()),
+                        wait: wait.0,
+                    });
+                }
+
+                if let Some(extra_poll) = response.headers.get::<AddExtraPoll>() {
                     return Ok(ProbeResponse::ExtraPoll(extra_poll.0));
                 }
 
-                Ok(ProbeResponse::Update(UpdatePackage::parse(
-                    &response.text()?,
-                )?))
+                // Retrying would get the same metadata again
+                match UpdatePackage::parse(&response.body) {
+                    Ok(u) => Ok(ProbeResponse::Update(u)),
+                    Err(error) => Ok(ProbeResponse::InvalidUpdate {
+                        package_uid: hex_digest(Algorithm::SHA256, response.body.as_bytes()),
+                        error,
+                    }),
+                }
             }
-            _ => bail!("Invalid response. Status: {}", response.status()),
+            s => Err(ServerError::InvalidResponse("response", s).into()),
+        }
+    }
+
+    /// Reports the `status` of the update package `package_uid` to the
+    /// server, as `error`, along with the `error` message.
+    pub fn report(&self, status: &str, package_uid: &str, error: &str) -> Result<()> {
+        let path = "/report";
+        let mut request = self.client()?.post(&self.url(path));
+        json(
+            &mut request,
+            &ReportRequest {
+                status,
+                package_uid,
+                error_message: error,
+                firmware: self.firmware,
+            },
+        )?;
+
+        let response = self.send("POST", path, &mut request)?;
+        match response.status {
+            StatusCode::Ok => Ok(()),
+            s => Err(ServerError::InvalidResponse("report response", s).into()),
+        }
+    }
+
+    /// Returns the rollout group of the device, if any.
+    pub fn rollout_group(&self) -> Option<String> {
+        if self.runtime_settings.rollout.canary {
+            return Some(CANARY_GROUP.to_string());
         }
+
+        self.settings.network.rollout_group.clone()
     }
 
-    pub fn download_object(&self, package_uid: &str, object: &str) -> Result<()> {
+    /// Enrolls the device using the `provisioning_token`, returning
+    /// the device token issued by the server.
+    pub fn enroll(&self, provisioning_token: &str) -> Result<String> {
+        let path = "/devices/enroll";
+        let mut request = self.client()?.post(&self.url(path));
+        json(
+            &mut request,
+            &EnrollRequest {
+                provisioning_token,
+                firmware: self.firmware,
+            },
+        )?;
+
+        let response = self.send("POST", path, &mut request)?;
+        match response.status {
+            StatusCode::Ok | StatusCode::Created => {
+                Ok(serde_json::from_str::<EnrollResponse>(&response.body)?.device_token)
+            }
+            s if s.is_client_error() => Err(EnrollError::Rejected(s).into()),
+            s => Err(ServerError::InvalidResponse("enrollment response", s).into()),
+        }
+    }
+
+    /// Fetches the settings managed by the server, returning `None`
+    /// when there are none or they match the ones in use.
+    pub fn remote_settings(&self) -> Result<Option<RemoteSettings>> {
+        let path = format!("/products/{}/settings", &self.firmware.product_uid);
+        let mut request = self.client()?.get(&self.url(&path));
+
+        if let Some(ref version) = self.runtime_settings.remote_settings {
+            request.header(RemoteSettingsVersion(version.clone()));
+        }
+
+        let response = self.send("GET", &path, &mut request)?;
+        match response.status {
+            StatusCode::NotFound | StatusCode::NotModified => Ok(None),
+            StatusCode::Ok => Ok(Some(serde_json::from_str(&response.body)?)),
+            s => Err(ServerError::InvalidResponse("remote settings response", s).into()),
+        }
+    }
+
+    /// Downloads `object`, resuming it when partially downloaded, and
+    /// accounts the received bytes in `progress`.
+    pub fn download_object(
+        &self,
+        package_uid: &str,
+        object: &str,
+        progress: &mut Progress,
+    ) -> Result<()> {
         use std::fs::{create_dir_all, OpenOptions};
+        use std::io::Write;
 
         // FIXME: Discuss the need of packages inside the route
-        let mut client = self.client()?.get(&format!(
-            "{}/products/{}/packages/{}/objects/{}",
-            &self.settings.network.server_address, &self.firmware.product_uid, package_uid, object
-        ));
+        let url_path = format!(
+            "/products/{}/packages/{}/objects/{}",
+            &self.firmware.product_uid, package_uid, object
+        );
+        let mut client = self.client()?.get(&self.url(&url_path));
 
         let path = &self.settings.update.download_dir;
         if !&path.exists() {
@@ -102,20 +373,64 @@ impl<'a> Api<'a> {
             create_dir_all(&path)?;
         }
 
+        // A failed attempt may leave an empty file behind
         let file = path.join(object);
-        if file.exists() {
-            client.header(Range::Bytes(vec![ByteRangeSpec::AllFrom(
-                file.metadata()?.len() - 1,
-            )]));
+        let downloaded = file.metadata().map(|m| m.len()).unwrap_or(0);
+        if downloaded > 0 {
+            client.header(Range::Bytes(vec![ByteRangeSpec::AllFrom(downloaded - 1)]));
+        }
+
+        // The content of the objects is not recorded, so they are
+        // expected to be in place already
+        if let Some(reply) = record::replayed("GET", &url_path) {
+            if reply?.status.is_success() && file.exists() {
+                return Ok(());
+            }
+
+            return Err(ServerError::ObjectUnavailable(object.to_string()).into());
         }
 
         let mut file = OpenOptions::new().create(true).append(true).open(&file)?;
         let mut response = client.send()?;
+        record::record(
+            "GET",
+            &url_path,
+            &Reply {
+                status: response.status(),
+                headers: response.headers().clone(),
+                body: String::new(),
+            },
+        );
+
         if response.status().is_success() {
-            response.copy_to(&mut file)?;
-            return Ok(());
+            // The size of the object is known from the metadata, as
+            // the server may not send the length of the content
+            let limit = fault::armed_value(fault::DOWNLOAD_TRUNCATE)
+                .map(|percent| progress.object_remaining() * percent / 100);
+
+            let mut buf = memory::buffer();
+            let mut written = 0;
+            loop {
+                cancel::check()?;
+                let len = response.read(&mut buf)?;
+                if len == 0 {
+                    return Ok(());
+                }
+
+                if let Some(limit) = limit {
+                    if written + len as u64 >= limit {
+                        file.write_all(&buf[..(limit - written) as usize])?;
+                        bail!("Download of the object {} truncated", object);
+                    }
+                }
+
+                file.write_all(&buf[..len])?;
+                usage::received(len);
+                written += len as u64;
+                progress.advance(len as u64);
+            }
         }
 
-        bail!("Couldn't download the object {}", object)
+        Err(ServerError::ObjectUnavailable(object.to_string()).into())
     }
 }
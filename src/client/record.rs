@@ -0,0 +1,208 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Record and replay of the server exchanges
+//!
+//! When recording, every reply of the server is appended to a bundle,
+//! one JSON entry per line, with the secrets redacted. The bundle can
+//! then be replayed in place of the server, so failures seen on a
+//! device can be reproduced offline.
+//!
+//! The content of the objects is not recorded, only their replies, so
+//! they must be copied to the download directory to replay an install.
+
+use Result;
+
+use reqwest::header::Headers;
+use reqwest::StatusCode;
+use serde_json;
+
+use std::collections::{BTreeMap, VecDeque};
+use std::fs::{File, OpenOptions};
+use std::io::{BufRead, BufReader, Write};
+use std::path::Path;
+use std::sync::Mutex;
+
+use redact::redact;
+
+lazy_static! {
+    static ref RECORDER: Mutex<Option<Recorder>> = Mutex::new(None);
+}
+
+#[derive(Debug, Fail)]
+pub enum ReplayError {
+    #[fail(display = "No recorded reply left for {} {}", _0, _1)]
+    Exhausted(String, String),
+    #[fail(display = "Expected {} {} but {} {} was recorded", _0, _1, _2, _3)]
+    Mismatch(String, String, String, String),
+}
+
+/// Reply of the server to a request.
+#[derive(Debug)]
+pub(super) struct Reply {
+    pub status: StatusCode,
+    pub headers: Headers,
+    pub body: String,
+}
+
+/// Recorded exchange with the server.
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+pub struct Exchange {
+    pub method: String,
+    pub path: String,
+    pub status: u16,
+    pub headers: BTreeMap<String, String>,
+    pub body: String,
+}
+
+pub enum Recorder {
+    Record(File),
+    Replay(VecDeque<Exchange>),
+}
+
+impl Recorder {
+    /// Creates the bundle at `path` where the exchanges are recorded.
+    pub fn create(path: &Path) -> Result<Recorder> {
+        Ok(Recorder::Record(
+            OpenOptions::new()
+                .create(true)
+                .write(true)
+                .truncate(true)
+                .open(path)?,
+        ))
+    }
+
+    /// Loads the exchanges recorded in the bundle at `path`.
+    pub fn open(path: &Path) -> Result<Recorder> {
+        let mut exchanges = VecDeque::new();
+        for line in BufReader::new(File::open(path)?).lines() {
+            exchanges.push_back(serde_json::from_str(&line?)?);
+        }
+
+        Ok(Recorder::Replay(exchanges))
+    }
+
+    fn save(&mut self, method: &str, path: &str, reply: &Reply) -> Result<()> {
+        let file = match *self {
+            Recorder::Record(ref mut f) => f,
+            Recorder::Replay(_) => return Ok(()),
+        };
+
+        let exchange = Exchange {
+            method: method.to_string(),
+            path: path.to_string(),
+            status: reply.status.as_u16(),
+            headers: reply
+                .headers
+                .iter()
+                .map(|h| (h.name().to_string(), redact(&h.value_string()).into_owned()))
+                .collect(),
+            body: redact(&reply.body).into_owned(),
+        };
+
+        writeln!(file, "{}", serde_json::to_string(&exchange)?)?;
+        Ok(())
+    }
+
+    fn next(&mut self, method: &str, path: &str) -> Option<Result<Reply>> {
+        let exchanges = match *self {
+            Recorder::Replay(ref mut e) => e,
+            Recorder::Record(_) => return None,
+        };
+
+        let exchange = match exchanges.pop_front() {
+            Some(e) => e,
+            None => {
+                let e = ReplayError::Exhausted(method.to_string(), path.to_string());
+                return Some(Err(e.into()));
+            }
+        };
+
+        if exchange.method != method || exchange.path != path {
+            let e = ReplayError::Mismatch(
+                method.to_string(),
+                path.to_string(),
+                exchange.method,
+                exchange.path,
+            );
+            return Some(Err(e.into()));
+        }
+
+        let Exchange {
+            status,
+            headers: recorded,
+            body,
+            ..
+        } = exchange;
+
+        let mut headers = Headers::new();
+        for (name, value) in recorded {
+            headers.set_raw(name, value);
+        }
+
+        Some(
+            StatusCode::try_from(status)
+                .map_err(|_| format_err!("Invalid recorded status: {}", status))
+                .map(|status| Reply {
+                    status,
+                    headers,
+                    body,
+                }),
+        )
+    }
+}
+
+/// Configures the recorder used by the client. Passing `None` talks
+/// to the server without recording.
+pub fn set_recorder(recorder: Option<Recorder>) {
+    *RECORDER.lock().unwrap() = recorder;
+}
+
+/// Returns the recorded reply to the request, when replaying.
+pub(super) fn replayed(method: &str, path: &str) -> Option<Result<Reply>> {
+    RECORDER
+        .lock()
+        .unwrap()
+        .as_mut()
+        .and_then(|r| r.next(method, path))
+}
+
+/// Records the `reply` to the request, when recording.
+pub(super) fn record(method: &str, path: &str, reply: &Reply) {
+    if let Some(ref mut recorder) = *RECORDER.lock().unwrap() {
+        if let Err(e) = recorder.save(method, path, reply) {
+            error!("Failed to record the reply to {} {}: {}", method, path, e);
+        }
+    }
+}
+
+#[test]
+fn record_and_replay() {
+    use tempfile::NamedTempFile;
+
+    let bundle = NamedTempFile::new().unwrap();
+    let mut headers = Headers::new();
+    headers.set_raw("Add-Extra-Poll", "10");
+    let reply = Reply {
+        status: StatusCode::Ok,
+        headers,
+        body: r#"{"version": "1.0"}"#.into(),
+    };
+
+    let mut recorder = Recorder::create(bundle.path()).unwrap();
+    recorder.save("POST", "/upgrades", &reply).unwrap();
+    recorder.save("GET", "/settings", &reply).unwrap();
+    assert!(recorder.next("POST", "/upgrades").is_none());
+
+    let mut recorder = Recorder::open(bundle.path()).unwrap();
+    let replayed = recorder.next("POST", "/upgrades").unwrap().unwrap();
+    assert_eq!(replayed.status, StatusCode::Ok);
+    let extra_poll = replayed.headers.get_raw("Add-Extra-Poll");
+    assert_eq!(extra_poll.and_then(|r| r.one()), Some(&b"10"[..]));
+    assert_eq!(replayed.body, reply.body);
+
+    assert!(recorder.next("POST", "/upgrades").unwrap().is_err());
+    assert!(recorder.next("GET", "/settings").unwrap().is_err());
+}
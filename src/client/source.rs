@@ -0,0 +1,237 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Sources of the objects
+//!
+//! The objects of the updates are downloaded from the server unless
+//! `Network/ObjectSource` points to another source, as an SFTP server
+//! for the products only exposing their artifacts over SSH.
+
+use Result;
+
+use reqwest::Url;
+
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use firmware::Metadata;
+use process;
+use progress::Progress;
+use runtime_settings::RuntimeSettings;
+use settings::Settings;
+use usage;
+
+use super::Api;
+
+/// Where the objects are downloaded from.
+pub trait ObjectSource {
+    /// Downloads `object`, of the package `package_uid`, to the
+    /// download directory and accounts the received bytes in
+    /// `progress`.
+    fn download_object(
+        &self,
+        package_uid: &str,
+        object: &str,
+        progress: &mut Progress,
+    ) -> Result<()>;
+}
+
+impl<'a> ObjectSource for Api<'a> {
+    fn download_object(
+        &self,
+        package_uid: &str,
+        object: &str,
+        progress: &mut Progress,
+    ) -> Result<()> {
+        Api::download_object(self, package_uid, object, progress)
+    }
+}
+
+/// Returns the source of the objects configured in `settings`.
+pub fn from_settings<'a>(
+    settings: &'a Settings,
+    runtime_settings: &'a RuntimeSettings,
+    firmware: &'a Metadata,
+) -> Result<Box<ObjectSource + 'a>> {
+    let network = &settings.network;
+    match network.object_source {
+        Some(ref url) => Ok(Box::new(Sftp::new(
+            url,
+            network.ssh_key.as_ref().map(|p| p.as_path()),
+            network.ssh_known_hosts.as_ref().map(|p| p.as_path()),
+            &settings.update.download_dir,
+        )?)),
+        None => Ok(Box::new(Api::new(settings, runtime_settings, firmware))),
+    }
+}
+
+/// Downloads the objects from an SFTP server, as
+/// `<path>/<package uid>/<sha256sum>`, through `scp`. The host key of
+/// the server must be known, from `known_hosts` when given, and the
+/// device authenticates with its `key`.
+#[derive(Debug)]
+pub struct Sftp {
+    destination: String,
+    port: Option<u16>,
+    path: String,
+    key: Option<PathBuf>,
+    known_hosts: Option<PathBuf>,
+    download_dir: PathBuf,
+}
+
+impl Sftp {
+    /// Creates the source for the server at `url`, as
+    /// `sftp://<user>@<host>[:<port>]/<path>`.
+    pub fn new(
+        url: &str,
+        key: Option<&Path>,
+        known_hosts: Option<&Path>,
+        download_dir: &Path,
+    ) -> Result<Self> {
+        let parsed = Url::parse(url)?;
+        if parsed.scheme() != "sftp" {
+            bail!(
+                "Unsupported object source '{}', expected an sftp:// URL",
+                url
+            );
+        }
+        let host = parsed
+            .host_str()
+            .ok_or_else(|| format_err!("Object source '{}' has no host", url))?;
+        let destination = match parsed.username() {
+            "" => host.to_string(),
+            user => format!("{}@{}", user, host),
+        };
+
+        Ok(Sftp {
+            destination,
+            port: parsed.port(),
+            path: parsed.path().trim_right_matches('/').to_string(),
+            key: key.map(|k| k.to_path_buf()),
+            known_hosts: known_hosts.map(|k| k.to_path_buf()),
+            download_dir: download_dir.to_path_buf(),
+        })
+    }
+
+    /// Returns the command copying the `object` of the package
+    /// `package_uid` to `file`.
+    fn command(&self, package_uid: &str, object: &str, file: &Path) -> String {
+        let mut cmd = "scp -B -q -o StrictHostKeyChecking=yes".to_string();
+        if let Some(ref known_hosts) = self.known_hosts {
+            cmd += &format!(
+                " -o {}",
+                process::quote(format!("UserKnownHostsFile={}", known_hosts.display()))
+            );
+        }
+        if let Some(ref key) = self.key {
+            cmd += &format!(" -i {}", process::quote(key));
+        }
+        if let Some(port) = self.port {
+            cmd += &format!(" -P {}", port);
+        }
+
+        let remote = format!(
+            "{}:{}/{}/{}",
+            self.destination, self.path, package_uid, object
+        );
+        format!(
+            "{} {} {}",
+            cmd,
+            process::quote(remote),
+            process::quote(file)
+        )
+    }
+}
+
+impl ObjectSource for Sftp {
+    fn download_object(
+        &self,
+        package_uid: &str,
+        object: &str,
+        progress: &mut Progress,
+    ) -> Result<()> {
+        if !self.download_dir.exists() {
+            debug!("Creating directory to store the downloads.");
+            fs::create_dir_all(&self.download_dir)?;
+        }
+
+        // The copy is not resumed: what a previous download left, which
+        // the progress already accounts, is replaced by the whole object,
+        // all of it counted as received
+        let file = self.download_dir.join(object);
+        let kept = file.metadata().map(|m| m.len()).unwrap_or(0);
+        if kept > 0 {
+            fs::remove_file(&file)?;
+        }
+        process::run(&self.command(package_uid, object, &file))?;
+        let received = file.metadata()?.len();
+        usage::received(received as usize);
+        progress.advance(received.saturating_sub(kept));
+
+        Ok(())
+    }
+}
+
+#[test]
+fn sftp_command() {
+    let sftp = Sftp::new(
+        "sftp://updates@artifacts.local:2222/srv/updatehub/",
+        Some(Path::new("/etc/updatehub/id_ed25519")),
+        Some(Path::new("/etc/updatehub/known_hosts")),
+        Path::new("/tmp/updatehub"),
+    ).unwrap();
+
+    assert_eq!(
+        sftp.command("pkg", "c775e7b7", Path::new("/tmp/updatehub/c775e7b7")),
+        "scp -B -q -o StrictHostKeyChecking=yes \
+         -o UserKnownHostsFile=/etc/updatehub/known_hosts -i /etc/updatehub/id_ed25519 -P 2222 \
+         updates@artifacts.local:/srv/updatehub/pkg/c775e7b7 /tmp/updatehub/c775e7b7"
+    );
+
+    // A path with a space is given as a single argument
+    let sftp = Sftp::new("sftp://artifacts.local/srv", None, None, Path::new("/tmp")).unwrap();
+    assert_eq!(
+        sftp.command("pkg", "c775e7b7", Path::new("/tmp/my downloads/c775e7b7")),
+        "scp -B -q -o StrictHostKeyChecking=yes \
+         artifacts.local:/srv/pkg/c775e7b7 '/tmp/my downloads/c775e7b7'"
+    );
+
+    let dir = Path::new("/tmp");
+    assert!(Sftp::new("http://artifacts.local/srv", None, None, dir).is_err());
+    assert!(Sftp::new("sftp:///srv", None, None, dir).is_err());
+}
+
+#[test]
+fn sftp_over_partial_file() {
+    use progress::Phase;
+    use std::env;
+    use std::os::unix::fs::PermissionsExt;
+    use tempfile::tempdir;
+
+    // A fake scp writing the whole object to its last argument
+    let bin = tempdir().unwrap();
+    let scp = bin.path().join("scp");
+    fs::write(
+        &scp,
+        "#!/bin/sh\nfor file; do :; done\nprintf 0123456789 > \"$file\"\n",
+    ).unwrap();
+    fs::set_permissions(&scp, fs::Permissions::from_mode(0o755)).unwrap();
+    let path = env::var("PATH").unwrap_or_default();
+    env::set_var("PATH", format!("{}:{}", bin.path().display(), path));
+
+    let dir = tempdir().unwrap();
+    let file = dir.path().join("c775e7b7");
+    fs::write(&file, "0123").unwrap();
+    let sftp = Sftp::new("sftp://artifacts.local/srv", None, None, dir.path()).unwrap();
+
+    // The partial file is accounted by the progress already
+    let mut progress = Progress::new(Phase::Download, 10);
+    progress.start_object("c775e7b7", 10, 4);
+    sftp.download_object("pkg", "c775e7b7", &mut progress)
+        .unwrap();
+    assert_eq!(fs::read_to_string(&file).unwrap(), "0123456789");
+    assert_eq!(progress.percent(), 100);
+    assert_eq!(progress.object_remaining(), 0);
+}
@@ -6,6 +6,7 @@
 use super::*;
 use firmware::tests::{create_fake_metadata, FakeDevice};
 use mockito::{mock, Mock};
+use progress::Phase;
 
 pub enum FakeServer {
     NoUpdate,
@@ -41,6 +42,9 @@ pub fn create_mock_server(server: FakeServer) -> Mock {
         FakeServer::NoUpdate => mock("POST", "/upgrades")
             .match_header("Content-Type", "application/json")
             .match_header("Api-Content-Type", "application/vnd.updatehub-v1+json")
+            .match_header("Agent-Version", build_info::version())
+            .match_header("Settings-Schema-Version", "1")
+            .match_header("Install-Modes", validate::advertised().as_str())
             .match_body(fake_device_reply_body(1, "board"))
             .with_status(404)
             .create(),
@@ -91,6 +95,75 @@ fn probe_requirements() {
     mock.assert();
 }
 
+#[test]
+fn rollout_wait() {
+    let metadata = Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap();
+    let mut settings = Settings::default();
+    settings.network.rollout_group = Some("lab".into());
+
+    let mock = mock("POST", "/upgrades")
+        .match_header("Rollout-Group", "canary")
+        .with_status(200)
+        .with_header("Rollout-Phase", "early-adopters")
+        .with_header("Rollout-Wait", "3600")
+        .create();
+
+    let mut runtime_settings = RuntimeSettings::default();
+    assert_eq!(
+        Api::new(&settings, &runtime_settings, &metadata).rollout_group(),
+        Some("lab".into())
+    );
+
+    runtime_settings.rollout.canary = true;
+    match Api::new(&settings, &runtime_settings, &metadata).probe() {
+        Ok(ProbeResponse::RolloutWait { phase, wait }) => {
+            assert_eq!(phase, Some("early-adopters".into()));
+            assert_eq!(wait, 3600);
+        }
+        r => panic!("Unexpected probe response: {:?}", r),
+    }
+
+    mock.assert();
+}
+
+#[test]
+fn remote_settings() {
+    let metadata = Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap();
+    let path = format!("/products/{}/settings", metadata.product_uid);
+
+    let m1 = mock("GET", path.as_str())
+        .with_status(200)
+        .with_body(
+            &json!({
+                "version": "2",
+                "settings": { "Polling/Interval": "2h" }
+            }).to_string(),
+        ).create();
+
+    let remote = Api::new(&Settings::default(), &RuntimeSettings::default(), &metadata)
+        .remote_settings()
+        .expect("Failed to fetch the remote settings")
+        .expect("Missing remote settings");
+
+    m1.assert();
+    assert_eq!(remote.version, "2");
+    assert_eq!(remote.settings["Polling/Interval"], "2h");
+
+    let m2 = mock("GET", path.as_str())
+        .match_header("Remote-Settings-Version", "2")
+        .with_status(304)
+        .create();
+
+    let mut runtime_settings = RuntimeSettings::default();
+    runtime_settings.remote_settings = Some(remote.version);
+    assert!(Api::new(&Settings::default(), &runtime_settings, &metadata)
+        .remote_settings()
+        .unwrap()
+        .is_none());
+
+    m2.assert();
+}
+
 #[test]
 fn download_object() {
     let metadata = Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap();
@@ -127,10 +200,11 @@ fn download_object() {
     let tempdir = tempdir().unwrap();
 
     settings.update.download_dir = tempdir.path().to_path_buf();
+    let mut progress = Progress::new(Phase::Download, 10);
 
     // Download the object.
     let _ = Api::new(&settings, &RuntimeSettings::default(), &metadata)
-        .download_object("package_id", "object")
+        .download_object("package_id", "object", &mut progress)
         .expect("Failed to download the object.");
 
     // Verify it has been downloaded successfully.
@@ -145,7 +219,7 @@ fn download_object() {
 
     // Download the remaining bytes of the object.
     let _ = Api::new(&settings, &RuntimeSettings::default(), &metadata)
-        .download_object("package_id", "object")
+        .download_object("package_id", "object", &mut progress)
         .expect("Failed to download the object.");
 
     // Verify it has been downloaded successfully.
@@ -157,6 +231,33 @@ fn download_object() {
     m2.assert();
 
     assert_eq!(downloaded, "1234567890".to_string());
+    assert_eq!(progress.percent(), 100);
 
     tempdir.close().expect("Fail to cleanup the tempdir");
 }
+
+#[test]
+fn user_agent() {
+    let metadata = Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap();
+    let runtime_settings = RuntimeSettings::default();
+    let mut settings = Settings::default();
+
+    assert_eq!(
+        Api::new(&settings, &runtime_settings, &metadata).user_agent(),
+        format!("updatehub/{} (board; firmware 1.1)", build_info::version())
+    );
+    settings.network.user_agent_details = false;
+    assert_eq!(
+        Api::new(&settings, &runtime_settings, &metadata).user_agent(),
+        format!("updatehub/{}", build_info::version())
+    );
+}
+
+#[test]
+fn context_headers() {
+    let mut headers = Headers::new();
+    add_headers(&mut headers, &["X-Fleet: lab".into(), "X-Site:north".into()]).unwrap();
+    assert_eq!(headers.get_raw("X-Fleet").unwrap().one(), Some(&b"lab"[..]));
+    assert_eq!(headers.get_raw("X-Site").unwrap().one(), Some(&b"north"[..]));
+    assert!(add_headers(&mut headers, &["X-Fleet".into()]).is_err());
+}
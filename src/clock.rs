@@ -0,0 +1,147 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Source of time of the agent
+//!
+//! The states get the current time, and wait, through the clock of
+//! the thread running them. It is the system clock unless replaced by
+//! `set`, so tests and simulated devices can use virtual time which
+//! advances instantly.
+//!
+//! Besides the wall-clock time, each clock provides a monotonic time,
+//! which is not affected by NTP corrections and so is used to measure
+//! how long was waited.
+
+use cancel;
+use chrono::{self, DateTime, Utc};
+
+use std::cell::{Cell, RefCell};
+use std::rc::Rc;
+use std::time::{Duration, Instant};
+
+lazy_static! {
+    static ref START: Instant = Instant::now();
+}
+
+pub trait Clock {
+    /// Returns the current time.
+    fn now(&self) -> DateTime<Utc>;
+
+    /// Returns the monotonic time, counted from an arbitrary point.
+    fn monotonic(&self) -> Duration;
+
+    /// Waits for `duration` to pass, or less if the operations of the
+    /// thread are cancelled meanwhile.
+    fn sleep(&self, duration: Duration);
+}
+
+/// Clock of the running system.
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    fn now(&self) -> DateTime<Utc> {
+        Utc::now()
+    }
+
+    fn monotonic(&self) -> Duration {
+        START.elapsed()
+    }
+
+    fn sleep(&self, duration: Duration) {
+        cancel::sleep(duration)
+    }
+}
+
+/// Clock whose time only advances by sleeping, which returns right
+/// away. The clones share the same time.
+#[derive(Clone)]
+pub struct VirtualClock {
+    wall: Rc<Cell<DateTime<Utc>>>,
+    monotonic: Rc<Cell<Duration>>,
+}
+
+impl VirtualClock {
+    pub fn new(now: DateTime<Utc>) -> Self {
+        VirtualClock {
+            wall: Rc::new(Cell::new(now)),
+            monotonic: Rc::new(Cell::new(Duration::from_secs(0))),
+        }
+    }
+
+    /// Moves the time forward by `duration`.
+    pub fn advance(&self, duration: Duration) {
+        self.monotonic.set(self.monotonic.get() + duration);
+        self.jump(chrono::Duration::from_std(duration).expect("Duration is too long"));
+    }
+
+    /// Moves only the wall-clock time by `offset`, as done by NTP
+    /// corrections or while the device is suspended.
+    pub fn jump(&self, offset: chrono::Duration) {
+        self.wall.set(self.wall.get() + offset);
+    }
+}
+
+impl Clock for VirtualClock {
+    fn now(&self) -> DateTime<Utc> {
+        self.wall.get()
+    }
+
+    fn monotonic(&self) -> Duration {
+        self.monotonic.get()
+    }
+
+    fn sleep(&self, duration: Duration) {
+        self.advance(duration)
+    }
+}
+
+thread_local! {
+    static CLOCK: RefCell<Box<Clock>> = RefCell::new(Box::new(SystemClock));
+}
+
+/// Replaces the clock used by the current thread.
+pub fn set(clock: Box<Clock>) {
+    CLOCK.with(|c| *c.borrow_mut() = clock);
+}
+
+/// Returns the current time, as given by the clock of the current
+/// thread.
+pub fn now() -> DateTime<Utc> {
+    CLOCK.with(|c| c.borrow().now())
+}
+
+/// Returns the monotonic time, as given by the clock of the current
+/// thread.
+pub fn monotonic() -> Duration {
+    CLOCK.with(|c| c.borrow().monotonic())
+}
+
+/// Waits for `duration` to pass, as given by the clock of the current
+/// thread.
+pub fn sleep(duration: Duration) {
+    CLOCK.with(|c| c.borrow().sleep(duration))
+}
+
+#[test]
+fn virtual_time() {
+    use std::thread;
+
+    let start = Utc::now();
+    let clock = VirtualClock::new(start);
+    set(Box::new(clock.clone()));
+
+    sleep(Duration::from_secs(3600));
+    assert_eq!(now(), start + chrono::Duration::hours(1));
+    assert_eq!(clock.now(), now());
+    assert_eq!(monotonic(), Duration::from_secs(3600));
+
+    clock.jump(-chrono::Duration::minutes(5));
+    assert_eq!(now(), start + chrono::Duration::minutes(55));
+    assert_eq!(monotonic(), Duration::from_secs(3600));
+
+    // Other threads keep using the system clock
+    let other = thread::spawn(now).join().unwrap();
+    assert!(other < start + chrono::Duration::hours(1));
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Record of the crashes
+//!
+//! When the agent stops on an error or a panic, the reason is written
+//! to the crash record, so it is still known once the agent is
+//! restarted, by systemd for instance. The record is logged and removed
+//! at the next start. Its message is redacted, as a panic may be raised
+//! with a secret in its message.
+
+use {Error, Result};
+
+use chrono::{DateTime, Utc};
+use serde_json;
+
+use std::any::Any;
+use std::fs::{self, File};
+use std::path::Path;
+
+use error_code::ErrorCode;
+use redact::redact;
+
+#[derive(Debug, Fail)]
+pub enum CrashError {
+    #[fail(display = "Agent panicked: {}", _0)]
+    Panicked(String),
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct CrashRecord {
+    pub timestamp: DateTime<Utc>,
+    pub code: String,
+    pub message: String,
+}
+
+impl CrashRecord {
+    /// Creates the record of the agent stopped by `error`.
+    pub fn new(error: &Error) -> Self {
+        CrashRecord {
+            timestamp: Utc::now(),
+            code: ErrorCode::of(error).to_string(),
+            message: redact(&error.to_string()).into_owned(),
+        }
+    }
+
+    pub fn save(&self, path: &Path) -> Result<()> {
+        serde_json::to_writer(File::create(path)?, self)?;
+        Ok(())
+    }
+
+    /// Returns the record stored in `path`, if any, removing it.
+    pub fn take(path: &Path) -> Result<Option<CrashRecord>> {
+        if !path.exists() {
+            return Ok(None);
+        }
+
+        let record = serde_json::from_reader(File::open(path)?);
+        fs::remove_file(path)?;
+        Ok(Some(record?))
+    }
+}
+
+/// Returns the message a panic was raised with, redacted.
+pub fn panic_message(payload: &(Any + Send)) -> String {
+    let message = match payload.downcast_ref::<&str>() {
+        Some(s) => s,
+        None => payload
+            .downcast_ref::<String>()
+            .map(String::as_str)
+            .unwrap_or("unknown cause"),
+    };
+
+    redact(message).into_owned()
+}
+
+#[test]
+fn save_and_take() {
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let path = dir.path().join("crash");
+    assert!(CrashRecord::take(&path).unwrap().is_none());
+
+    let record = CrashRecord::new(&CrashError::Panicked("boom".into()).into());
+    assert_eq!(record.code, "crashed");
+    record.save(&path).unwrap();
+
+    assert_eq!(CrashRecord::take(&path).unwrap(), Some(record));
+    assert!(!path.exists());
+}
+
+#[test]
+fn message() {
+    use redact::add_secret;
+    use std::panic;
+
+    let payload = panic::catch_unwind(|| panic!("static")).unwrap_err();
+    assert_eq!(panic_message(&*payload), "static");
+    let payload = panic::catch_unwind(|| panic!("formatted {}", 1)).unwrap_err();
+    assert_eq!(panic_message(&*payload), "formatted 1");
+
+    // The secrets are not written to the record
+    add_secret("crash-secret-token");
+    let payload = panic::catch_unwind(|| panic!("token crash-secret-token")).unwrap_err();
+    let message = panic_message(&*payload);
+    assert!(!message.contains("crash-secret-token"));
+    let record = CrashRecord::new(&format_err!("sent crash-secret-token"));
+    assert!(!record.message.contains("crash-secret-token"));
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Machine-readable classification of the errors
+//!
+//! The errors keep their own types and messages; `ErrorCode::of` sorts
+//! them, through their causes, so the logs and the exit status of the
+//! agent tell what kind of problem stopped it.
+
+use Error;
+
+use easy_process;
+use failure::Fail;
+use reqwest;
+
+use std::fmt;
+use std::io;
+
+use cancel::CancelError;
+use client::{EnrollError, ServerError};
+use crash::CrashError;
+use firmware::FirmwareError;
+use health::HealthError;
+use hooks::HookError;
+use libc;
+use lock::LockError;
+use runtime_settings::RuntimeSettingsError;
+use schema::SchemaError;
+use settings::SettingsError;
+use time_sanity::TimeError;
+use update_package::target::TargetError;
+use update_package::validate::MetadataError;
+use update_package::UpdatePackageError;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum ErrorCode {
+    /// The settings are invalid.
+    Settings,
+    /// Another instance of the agent is running.
+    AlreadyRunning,
+    /// The firmware metadata is invalid or incomplete.
+    Firmware,
+    /// The server could not be reached.
+    Network,
+    /// The server rejected the request or replied unexpectedly.
+    Server,
+    /// The update package metadata is invalid.
+    InvalidPackage,
+    /// The objects do not match their checksums.
+    Checksum,
+    /// The update package does not support the hardware.
+    IncompatibleHardware,
+    /// There is no space left on the storage.
+    StorageFull,
+    /// An external command, as a hook or install tool, failed.
+    CommandFailure,
+    /// An install target is not available.
+    TargetUnavailable,
+    /// The operation was cancelled.
+    Cancelled,
+    /// The agent panicked.
+    Crashed,
+    /// The agent got stuck.
+    Unhealthy,
+    /// The system clock is invalid.
+    ClockInvalid,
+    /// The settings are of a schema newer than the agent supports.
+    UnsupportedSchema,
+    /// Any other error.
+    Other,
+}
+
+impl ErrorCode {
+    /// Returns the code of `error`, as given by the innermost of its
+    /// causes which is known.
+    pub fn of(error: &Error) -> ErrorCode {
+        let causes = error.iter_chain().collect::<Vec<_>>();
+        causes
+            .into_iter()
+            .rev()
+            .filter_map(code)
+            .next()
+            .unwrap_or(ErrorCode::Other)
+    }
+
+    /// Returns the identifier of the code, as `storage-full`.
+    pub fn as_str(self) -> &'static str {
+        match self {
+            ErrorCode::Settings => "settings",
+            ErrorCode::AlreadyRunning => "already-running",
+            ErrorCode::Firmware => "firmware",
+            ErrorCode::Network => "network",
+            ErrorCode::Server => "server",
+            ErrorCode::InvalidPackage => "invalid-package",
+            ErrorCode::Checksum => "checksum",
+            ErrorCode::IncompatibleHardware => "incompatible-hardware",
+            ErrorCode::StorageFull => "storage-full",
+            ErrorCode::CommandFailure => "command-failure",
+            ErrorCode::TargetUnavailable => "target-unavailable",
+            ErrorCode::Cancelled => "cancelled",
+            ErrorCode::Crashed => "crashed",
+            ErrorCode::Unhealthy => "unhealthy",
+            ErrorCode::ClockInvalid => "clock-invalid",
+            ErrorCode::UnsupportedSchema => "unsupported-schema",
+            ErrorCode::Other => "other",
+        }
+    }
+
+    /// Returns the exit status of the agent when stopped by an error
+    /// of this code.
+    pub fn exit_code(self) -> i32 {
+        match self {
+            ErrorCode::Other => 1,
+            ErrorCode::Settings => 2,
+            ErrorCode::AlreadyRunning => 3,
+            ErrorCode::Firmware => 4,
+            ErrorCode::Network => 5,
+            ErrorCode::Server => 6,
+            ErrorCode::InvalidPackage => 7,
+            ErrorCode::Checksum => 8,
+            ErrorCode::IncompatibleHardware => 9,
+            ErrorCode::StorageFull => 10,
+            ErrorCode::CommandFailure => 11,
+            ErrorCode::TargetUnavailable => 12,
+            ErrorCode::Cancelled => 13,
+            ErrorCode::Crashed => 14,
+            ErrorCode::Unhealthy => 15,
+            ErrorCode::ClockInvalid => 16,
+            ErrorCode::UnsupportedSchema => 17,
+        }
+    }
+}
+
+fn code(f: &Fail) -> Option<ErrorCode> {
+    // Only a full storage is told apart from the other IO errors,
+    // which are left to the errors they are wrapped in
+    if let Some(e) = f.downcast_ref::<io::Error>() {
+        if e.raw_os_error() == Some(libc::ENOSPC) {
+            return Some(ErrorCode::StorageFull);
+        }
+        return None;
+    }
+    if let Some(e) = f.downcast_ref::<SchemaError>() {
+        return Some(match e {
+            SchemaError::Newer(..) => ErrorCode::UnsupportedSchema,
+            SchemaError::Invalid(..) => ErrorCode::Settings,
+        });
+    }
+    if f.downcast_ref::<SettingsError>().is_some()
+        || f.downcast_ref::<RuntimeSettingsError>().is_some()
+    {
+        return Some(ErrorCode::Settings);
+    }
+    if f.downcast_ref::<LockError>().is_some() {
+        return Some(ErrorCode::AlreadyRunning);
+    }
+    if f.downcast_ref::<FirmwareError>().is_some() {
+        return Some(ErrorCode::Firmware);
+    }
+    if f.downcast_ref::<reqwest::Error>().is_some() {
+        return Some(ErrorCode::Network);
+    }
+    if f.downcast_ref::<ServerError>().is_some() || f.downcast_ref::<EnrollError>().is_some() {
+        return Some(ErrorCode::Server);
+    }
+    if let Some(e) = f.downcast_ref::<UpdatePackageError>() {
+        return Some(match e {
+            UpdatePackageError::IncompatibleHardware(_) => ErrorCode::IncompatibleHardware,
+            UpdatePackageError::ObjectsNotReady => ErrorCode::Checksum,
+            _ => ErrorCode::InvalidPackage,
+        });
+    }
+    if f.downcast_ref::<MetadataError>().is_some() {
+        return Some(ErrorCode::InvalidPackage);
+    }
+    if f.downcast_ref::<easy_process::Error>().is_some() {
+        return Some(ErrorCode::CommandFailure);
+    }
+    if f.downcast_ref::<HookError>().is_some() {
+        return Some(ErrorCode::CommandFailure);
+    }
+    if f.downcast_ref::<TargetError>().is_some() {
+        return Some(ErrorCode::TargetUnavailable);
+    }
+    if f.downcast_ref::<CancelError>().is_some() {
+        return Some(ErrorCode::Cancelled);
+    }
+    if f.downcast_ref::<CrashError>().is_some() {
+        return Some(ErrorCode::Crashed);
+    }
+    if f.downcast_ref::<HealthError>().is_some() {
+        return Some(ErrorCode::Unhealthy);
+    }
+    if f.downcast_ref::<TimeError>().is_some() {
+        return Some(ErrorCode::ClockInvalid);
+    }
+
+    None
+}
+
+impl fmt::Display for ErrorCode {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{}", self.as_str())
+    }
+}
+
+#[test]
+fn codes() {
+    use failure::ResultExt;
+    use update_package::UpdatePackage;
+
+    let error: Error = UpdatePackageError::ObjectsNotReady.into();
+    assert_eq!(ErrorCode::of(&error), ErrorCode::Checksum);
+    assert_eq!(ErrorCode::of(&format_err!("unknown")), ErrorCode::Other);
+
+    let full: ::Result<()> = Err(io::Error::from_raw_os_error(libc::ENOSPC).into());
+    let error = full.context("Saving the object").unwrap_err().into();
+    assert_eq!(ErrorCode::of(&error), ErrorCode::StorageFull);
+    assert_eq!(ErrorCode::StorageFull.to_string(), "storage-full");
+    assert_eq!(ErrorCode::StorageFull.exit_code(), 10);
+
+    let error = SchemaError::Newer("System settings".into(), 2, 1).into();
+    assert_eq!(ErrorCode::of(&error), ErrorCode::UnsupportedSchema);
+
+    let error = HookError::NotPinned("/usr/share/updatehub/hook".into()).into();
+    assert_eq!(ErrorCode::of(&error), ErrorCode::CommandFailure);
+
+    let error = MetadataError::UnsupportedMode("objects[0]".into(), "raw".into(), "test".into());
+    let error = error.into();
+    assert_eq!(ErrorCode::of(&error), ErrorCode::InvalidPackage);
+
+    // Only the JSON of the package metadata is an invalid package
+    let error = UpdatePackage::parse("{").unwrap_err();
+    assert_eq!(ErrorCode::of(&error), ErrorCode::InvalidPackage);
+    let error = ::serde_json::from_str::<u32>("{").unwrap_err().into();
+    assert_eq!(ErrorCode::of(&error), ErrorCode::Other);
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Events of the update engine
+//!
+//! The state machine publishes its transitions and failures, and the
+//! download and write phases their progress, to the subscribers added
+//! by `subscribe`. Programs embedding the agent subscribe to follow the
+//! update, instead of the states knowing about each consumer.
+
+use progress::Phase;
+
+use std::sync::{Arc, Mutex};
+
+#[derive(Clone, Debug, PartialEq, Serialize)]
+#[serde(tag = "event", rename_all = "kebab-case")]
+pub enum Event {
+    /// The state machine moved from the state `from` to `to`.
+    StateChanged {
+        from: &'static str,
+        to: &'static str,
+    },
+    /// Handling the state `state` failed with `error`.
+    StateFailed { state: &'static str, error: String },
+    /// The `phase` progressed to `percent` of the update, processing
+    /// `object`.
+    Progress {
+        phase: Phase,
+        percent: u64,
+        object: String,
+    },
+}
+
+impl Event {
+    /// Returns the name of the event: the state entered for a state
+    /// change, as `install`, `error` for a failure and `progress`.
+    pub fn name(&self) -> &'static str {
+        match *self {
+            Event::StateChanged { to, .. } => to,
+            Event::StateFailed { .. } => "error",
+            Event::Progress { .. } => "progress",
+        }
+    }
+}
+
+/// Identifies a subscriber, for `unsubscribe`.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct Subscription(usize);
+
+type Subscriber = Arc<Mutex<Box<FnMut(&Event) + Send>>>;
+
+lazy_static! {
+    static ref SUBSCRIBERS: Mutex<(usize, Vec<(usize, Subscriber)>)> = Mutex::new((0, Vec::new()));
+}
+
+/// Calls `subscriber` for every event published from then on. It is
+/// called from the thread publishing the event, which waits for it, so
+/// it must return quickly, handing slow work as I/O to a thread of its
+/// own, and must not publish any event.
+pub fn subscribe<F>(subscriber: F) -> Subscription
+where
+    F: FnMut(&Event) + Send + 'static,
+{
+    let mut subscribers = SUBSCRIBERS.lock().unwrap();
+    subscribers.0 += 1;
+    let id = subscribers.0;
+    subscribers
+        .1
+        .push((id, Arc::new(Mutex::new(Box::new(subscriber)))));
+
+    Subscription(id)
+}
+
+pub fn unsubscribe(subscription: Subscription) {
+    SUBSCRIBERS
+        .lock()
+        .unwrap()
+        .1
+        .retain(|&(id, _)| id != subscription.0);
+}
+
+/// Passes `event` to every subscriber. The subscribers are called
+/// without holding the list, so other threads may publish or subscribe
+/// meanwhile.
+pub fn publish(event: &Event) {
+    let subscribers: Vec<Subscriber> = SUBSCRIBERS
+        .lock()
+        .unwrap()
+        .1
+        .iter()
+        .map(|&(_, ref subscriber)| subscriber.clone())
+        .collect();
+    for subscriber in subscribers {
+        // A subscriber which panicked before is not called anymore
+        if let Ok(mut subscriber) = subscriber.lock() {
+            (&mut *subscriber)(event);
+        }
+    }
+}
+
+#[test]
+fn subscribers() {
+    use std::sync::mpsc;
+
+    let (sender, received) = mpsc::channel();
+    let subscription = subscribe(move |e| {
+        if let Event::Progress { ref object, .. } = *e {
+            if object == "events-test" {
+                sender.send(e.clone()).unwrap();
+            }
+        }
+    });
+
+    let event = Event::Progress {
+        phase: Phase::Download,
+        percent: 10,
+        object: "events-test".into(),
+    };
+    publish(&event);
+    assert_eq!(received.try_recv().ok(), Some(event.clone()));
+
+    unsubscribe(subscription);
+    publish(&event);
+    assert!(received.try_recv().is_err());
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Failure injection, for qualifying the robustness of the agent
+//!
+//! Only available when built with the `failure-injection` feature,
+//! otherwise no point is ever armed. The points to arm are listed in
+//! the `UPDATEHUB_FAULTS` environment variable, as
+//! `<point>[=<value>]` separated by commas:
+//!
+//! - `download-truncate=<percent>`: stops the download of the objects
+//!   after the given percentage;
+//! - `sha-mismatch`: corrupts the downloaded objects;
+//! - `write-error=<object>`: fails writing the object with the given
+//!   index, starting at 0;
+//! - `power-loss`: aborts the agent right before the install is
+//!   committed.
+
+/// Environment variable listing the armed points.
+pub const FAULTS_ENV: &str = "UPDATEHUB_FAULTS";
+
+pub const DOWNLOAD_TRUNCATE: &str = "download-truncate";
+pub const SHA_MISMATCH: &str = "sha-mismatch";
+pub const WRITE_ERROR: &str = "write-error";
+pub const POWER_LOSS: &str = "power-loss";
+
+#[cfg(feature = "failure-injection")]
+lazy_static! {
+    static ref FAULTS: Vec<(String, String)> =
+        parse(&::std::env::var(FAULTS_ENV).unwrap_or_default());
+}
+
+#[cfg_attr(not(feature = "failure-injection"), allow(dead_code))]
+fn parse(faults: &str) -> Vec<(String, String)> {
+    faults
+        .split(',')
+        .map(|f| f.trim())
+        .filter(|f| !f.is_empty())
+        .map(|f| {
+            let mut parts = f.splitn(2, '=');
+            let point = parts.next().unwrap_or_default().to_string();
+            (point, parts.next().unwrap_or_default().to_string())
+        }).collect()
+}
+
+/// Returns the value of `point` when it is armed.
+#[cfg(feature = "failure-injection")]
+pub fn armed(point: &str) -> Option<&'static str> {
+    FAULTS
+        .iter()
+        .find(|&&(ref p, _)| p == point)
+        .map(|&(_, ref v)| {
+            warn!("Injecting failure at {}", point);
+            v.as_str()
+        })
+}
+
+/// Returns the value of `point` when it is armed.
+#[cfg(not(feature = "failure-injection"))]
+pub fn armed(_point: &str) -> Option<&'static str> {
+    None
+}
+
+/// Returns the numeric value of `point` when it is armed.
+pub fn armed_value(point: &str) -> Option<u64> {
+    armed(point).and_then(|v| v.parse().ok())
+}
+
+#[test]
+fn parse_points() {
+    assert_eq!(
+        parse("download-truncate=50, sha-mismatch,,power-loss"),
+        [
+            ("download-truncate".to_string(), "50".to_string()),
+            ("sha-mismatch".to_string(), "".to_string()),
+            ("power-loss".to_string(), "".to_string()),
+        ]
+    );
+    assert!(parse("").is_empty());
+}
@@ -10,15 +10,15 @@ use walkdir::WalkDir;
 use std::path::Path;
 use std::str::FromStr;
 
-use easy_process;
 use firmware::metadata_value::MetadataValue;
+use hooks;
 
 pub(crate) fn run_hook(path: &Path) -> Result<String> {
     if !path.exists() {
         return Ok("".into());
     }
 
-    Ok(run_script(path.to_str().expect("Invalid path for hook"))?)
+    Ok(hooks::run(path)?.stdout.trim().into())
 }
 
 pub(crate) fn run_hooks_from_dir(path: &Path) -> Result<MetadataValue> {
@@ -33,15 +33,3 @@ pub(crate) fn run_hooks_from_dir(path: &Path) -> Result<MetadataValue> {
 
     Ok(MetadataValue::from_str(&outputs.join("\n"))?)
 }
-
-pub(crate) fn run_script(cmd: &str) -> Result<String> {
-    let output = easy_process::run(cmd)?;
-    if !output.stderr.is_empty() {
-        output
-            .stderr
-            .lines()
-            .for_each(|err| error!("{} (stderr): {}", cmd, err))
-    }
-
-    Ok(output.stdout.trim().into())
-}
@@ -6,6 +6,7 @@
 use Result;
 
 use std::path::Path;
+use std::str::FromStr;
 
 mod metadata_value;
 use self::metadata_value::MetadataValue;
@@ -19,6 +20,7 @@ pub mod tests;
 const PRODUCT_UID_HOOK: &str = "product-uid";
 const VERSION_HOOK: &str = "version";
 const HARDWARE_HOOK: &str = "hardware";
+const BOOTLOADER_VERSION_HOOK: &str = "bootloader-version";
 const DEVICE_IDENTITY_DIR: &str = "device-identity.d";
 const DEVICE_ATTRIBUTES_DIR: &str = "device-attributes.d";
 
@@ -53,6 +55,10 @@ pub struct Metadata {
 
     /// Device Attributes
     pub device_attributes: MetadataValue,
+
+    /// Version of the bootloader, when its hook reports it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub bootloader_version: Option<String>,
 }
 
 impl Metadata {
@@ -60,29 +66,54 @@ impl Metadata {
         let product_uid_hook = path.join(PRODUCT_UID_HOOK);
         let version_hook = path.join(VERSION_HOOK);
         let hardware_hook = path.join(HARDWARE_HOOK);
+        let bootloader_version_hook = path.join(BOOTLOADER_VERSION_HOOK);
         let device_identity_dir = path.join(DEVICE_IDENTITY_DIR);
         let device_attributes_dir = path.join(DEVICE_ATTRIBUTES_DIR);
 
-        let metadata = Metadata {
+        Metadata {
             product_uid: run_hook(&product_uid_hook)?,
             version: run_hook(&version_hook)?,
             hardware: run_hook(&hardware_hook)?,
             device_identity: run_hooks_from_dir(&device_identity_dir)?,
             device_attributes: run_hooks_from_dir(&device_attributes_dir)?,
-        };
+            bootloader_version: Some(run_hook(&bootloader_version_hook)?).filter(|v| !v.is_empty()),
+        }.validate()
+    }
+
+    /// Creates the metadata from its values, with the device identity
+    /// and attributes given as the `<key>=<value>` lines output by
+    /// their hooks. It is used for devices which are not the running
+    /// one, as the simulated ones.
+    pub fn from_values(
+        product_uid: &str,
+        version: &str,
+        hardware: &str,
+        device_identity: &str,
+        device_attributes: &str,
+    ) -> Result<Metadata> {
+        Metadata {
+            product_uid: product_uid.to_string(),
+            version: version.to_string(),
+            hardware: hardware.to_string(),
+            device_identity: MetadataValue::from_str(device_identity)?,
+            device_attributes: MetadataValue::from_str(device_attributes)?,
+            bootloader_version: None,
+        }.validate()
+    }
 
-        if metadata.product_uid.is_empty() {
+    fn validate(self) -> Result<Metadata> {
+        if self.product_uid.is_empty() {
             return Err(FirmwareError::MissingProductUid.into());
         }
 
-        if metadata.product_uid.len() != 64 {
+        if self.product_uid.len() != 64 {
             return Err(FirmwareError::InvalidProductUid.into());
         }
 
-        if metadata.device_identity.is_empty() {
+        if self.device_identity.is_empty() {
             return Err(FirmwareError::MissingDeviceIdentity.into());
         }
 
-        Ok(metadata)
+        Ok(self)
     }
 }
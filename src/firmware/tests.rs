@@ -42,6 +42,10 @@ pub fn hardware_hook(path: &Path) -> PathBuf {
     path.join(HARDWARE_HOOK)
 }
 
+pub fn bootloader_version_hook(path: &Path) -> PathBuf {
+    path.join(BOOTLOADER_VERSION_HOOK)
+}
+
 pub fn device_identity_dir(path: &Path) -> PathBuf {
     path.join(DEVICE_IDENTITY_DIR).join("identity")
 }
@@ -173,5 +177,31 @@ fn check_load_metadata() {
         assert_eq!("board", metadata.hardware);
         assert_eq!(2, metadata.device_identity.len());
         assert_eq!(2, metadata.device_attributes.len());
+        assert_eq!(None, metadata.bootloader_version);
     }
+
+    {
+        // bootloader version reported by its hook
+        let metadata_dir = create_fake_metadata(FakeDevice::NoUpdate);
+        create_hook(
+            bootloader_version_hook(&metadata_dir),
+            "#!/bin/sh
+echo U-Boot 2018.03",
+        );
+        let metadata = Metadata::new(&metadata_dir).unwrap();
+        assert_eq!(Some("U-Boot 2018.03".into()), metadata.bootloader_version);
+    }
+}
+
+#[test]
+fn metadata_from_values() {
+    let product_uid = "229ffd7e08721d716163fc81a2dbaf6c90d449f0a3b009b6a2defe8a0b0d7381";
+
+    let metadata =
+        Metadata::from_values(product_uid, "1.1", "board", "id1=value1\nid2=value2", "").unwrap();
+    assert_eq!(2, metadata.device_identity.len());
+    assert_eq!(0, metadata.device_attributes.len());
+
+    assert!(Metadata::from_values(product_uid, "1.1", "board", "", "").is_err());
+    assert!(Metadata::from_values(product_uid, "1.1", "board", "invalid", "").is_err());
 }
@@ -0,0 +1,86 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Entry points for fuzzing the parsers of untrusted input
+//!
+//! The update metadata comes from the server, and the settings partly
+//! from it, so a compromised server must at most make their parsing
+//! fail. Each function parses arbitrary bytes, whether valid or not,
+//! and is meant to be called by the targets of a fuzzer, as cargo-fuzz
+//! or AFL, any panic being a bug:
+//!
+//! ```text
+//! fuzz_target!(|data: &[u8]| updatehub::fuzz::update_package(data));
+//! ```
+
+use std::str;
+
+use settings::{self, Settings};
+use update_package::UpdatePackage;
+
+/// Parses `data` as the metadata of an update package, computing the
+/// install order of its objects when it is valid.
+pub fn update_package(data: &[u8]) {
+    if let Ok(content) = str::from_utf8(data) {
+        if let Ok(package) = UpdatePackage::parse(content) {
+            let _ = package.install_order();
+        }
+    }
+}
+
+/// Parses `data` as an object of an update package, decoding its
+/// install mode and the options of the mode.
+pub fn object(data: &[u8]) {
+    if let Ok(object) = str::from_utf8(data) {
+        update_package(
+            format!(
+                r#"{{"product-uid": "{}", "version": "1.0", "objects": [{}]}}"#,
+                "0".repeat(64),
+                object
+            ).as_bytes(),
+        );
+    }
+}
+
+/// Parses and validates `data` as a system settings file.
+pub fn settings(data: &[u8]) {
+    if let Ok(content) = str::from_utf8(data) {
+        let _ = Settings::parse(content);
+        let _ = settings::validate(content);
+    }
+}
+
+#[test]
+fn hostile_input() {
+    let metadata = r#"{"product-uid": "0123456789", "version": "1.0", "objects": [
+        {"mode": "test", "filename": "a", "target": "/dev/device1",
+         "sha256sum": "0000000000000000000000000000000000000000000000000000000000000000",
+         "size": 10, "depends-on": ["a"]}]}"#;
+
+    for len in 0..metadata.len() {
+        update_package(metadata[..len].as_bytes());
+    }
+    update_package(metadata.as_bytes());
+    update_package(&[0xff, 0xfe, b'{']);
+    object(br#"{"mode": "agent"}]}, {"#);
+
+    let deep = format!(
+        r#"{{"objects": {}{}}}"#,
+        "[".repeat(100_000),
+        "]".repeat(100_000)
+    );
+    assert!(UpdatePackage::parse(&deep).is_err());
+    update_package(deep.as_bytes());
+    assert!(UpdatePackage::parse(&" ".repeat(2 * 1024 * 1024)).is_err());
+
+    // Brackets within strings are not nesting
+    if cfg!(feature = "mode-test") {
+        let quoted = metadata.replace("\"a\"", &format!("\"{}\\\"\"", "[".repeat(100)));
+        assert!(UpdatePackage::parse(&quoted).is_ok());
+    }
+
+    settings(b"[Polling]\nInterval=\n[[[\n=\xff");
+    assert!(Settings::parse(&"; comment\n".repeat(100_000)).is_err());
+}
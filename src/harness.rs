@@ -0,0 +1,262 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Harness for end-to-end tests of update packages and hooks
+//!
+//! Integrators test their packages, hooks and state change callbacks
+//! against the whole agent without the hardware: the harness runs the
+//! state machine with every file it writes kept in a scratch directory,
+//! the block devices the packages are installed to emulated by sparse
+//! files of that directory, and a virtual clock, so the polling waits
+//! take no time and the runs are deterministic.
+//!
+//! The reboot is simulated: the `Reboot` state is handled, along with
+//! its state change callbacks, without running the reboot command, and
+//! the state machine is restarted with the runtime settings saved on
+//! disk, as after booting the new firmware. The server is the one set in
+//! `settings.network.server_address`, usually a mock of the hub run
+//! by the test.
+
+use Result;
+
+use chrono::Utc;
+
+use std::fs::{self, OpenOptions};
+use std::path::{Path, PathBuf};
+use std::sync::mpsc::channel;
+use std::thread;
+
+use clock::{self, SystemClock, VirtualClock};
+use events::{self, Event};
+use firmware::Metadata;
+use runtime_settings::RuntimeSettings;
+use settings::Settings;
+use states::{self, StateMachine};
+use update_package::UpdatePackage;
+
+/// Name of the virtual devices directory, in the scratch directory.
+const DEVICES_DIR: &str = "dev";
+
+/// Emulated device running the agent.
+pub struct Harness {
+    dir: PathBuf,
+    /// Settings of the agent, with its paths in the scratch directory.
+    pub settings: Settings,
+    pub firmware: Metadata,
+    /// Clock of the agent, which starts at the current time.
+    pub clock: VirtualClock,
+}
+
+/// Outcome of running the agent.
+#[derive(Debug)]
+pub struct Run {
+    /// Names of the states entered, starting with the initial one.
+    pub states: Vec<&'static str>,
+    /// Events published by the state machine.
+    pub events: Vec<Event>,
+    /// Number of simulated reboots.
+    pub reboots: usize,
+    /// Error of the state the run stopped on, if any.
+    pub error: Option<String>,
+    /// Runtime settings saved on disk once the run is done.
+    pub runtime_settings: RuntimeSettings,
+}
+
+impl Harness {
+    /// Creates a device whose files are kept in `dir`, with the
+    /// `firmware` metadata, either given by `Metadata::from_values` or
+    /// by the hooks under test through `Metadata::new`.
+    pub fn new(dir: &Path, firmware: Metadata) -> Harness {
+        let mut settings = Settings::default();
+        settings.polling.allow_short_interval = true;
+        settings.storage.runtime_settings = dir.join("runtime.conf").to_string_lossy().into();
+        settings.storage.lock_file = dir.join("updatehub.lock");
+        settings.storage.crash_record = dir.join("crash.json");
+        settings.update.download_dir = dir.join("download");
+        settings.update.state_change_callback = dir.join("state-change-callback");
+
+        Harness {
+            dir: dir.to_path_buf(),
+            settings,
+            firmware,
+            clock: VirtualClock::new(Utc::now()),
+        }
+    }
+
+    /// Creates the virtual block device `name`, a sparse file of `size`
+    /// bytes, returning its path to be used as the target of objects.
+    pub fn block_device(&self, name: &str, size: u64) -> Result<PathBuf> {
+        let dir = self.dir.join(DEVICES_DIR);
+        fs::create_dir_all(&dir)?;
+
+        let path = dir.join(name);
+        OpenOptions::new()
+            .create(true)
+            .write(true)
+            .open(&path)?
+            .set_len(size)?;
+        Ok(path)
+    }
+
+    /// Boots the device and runs the agent until it enters the state
+    /// `until` or `max_steps` states were handled.
+    pub fn run(self, until: &str, max_steps: usize) -> Result<Run> {
+        let path = self.settings.storage.runtime_settings.clone();
+        let runtime_settings = RuntimeSettings::new().load(&path)?;
+        let machine = StateMachine::new(self.settings, runtime_settings, self.firmware);
+        run(machine, &path, &self.clock, until, max_steps)
+    }
+
+    /// Installs the local update package whose metadata is `package`,
+    /// as done by the one-shot install mode, and runs the agent until it
+    /// enters the state `until` or `max_steps` states were handled.
+    pub fn install(self, package: &Path, until: &str, max_steps: usize) -> Result<Run> {
+        let update_package = UpdatePackage::load(package)?;
+        update_package.compatible_with(&self.firmware)?;
+        let package_dir = package.parent().unwrap_or_else(|| Path::new(""));
+        update_package.fetch_local(package_dir, &self.settings.update.download_dir)?;
+
+        let path = self.settings.storage.runtime_settings.clone();
+        let runtime_settings = RuntimeSettings::new().load(&path)?;
+        let machine = StateMachine::new_install(
+            self.settings,
+            runtime_settings,
+            self.firmware,
+            update_package,
+        );
+        run(machine, &path, &self.clock, until, max_steps)
+    }
+}
+
+/// Replaces the clock and the reboots of the current thread while
+/// running, restoring them when dropped, even by a panicking state.
+struct Simulation;
+
+impl Simulation {
+    fn start(clock: &VirtualClock) -> Simulation {
+        clock::set(Box::new(clock.clone()));
+        states::simulate_reboots(true);
+        Simulation
+    }
+}
+
+impl Drop for Simulation {
+    fn drop(&mut self) {
+        states::simulate_reboots(false);
+        clock::set(Box::new(SystemClock));
+    }
+}
+
+/// Runs `machine` on the virtual `clock`, `path` being where its
+/// runtime settings are saved.
+fn run(
+    mut machine: StateMachine,
+    path: &str,
+    clock: &VirtualClock,
+    until: &str,
+    max_steps: usize,
+) -> Result<Run> {
+    // Other threads may be running agents of their own
+    let (sender, received) = channel();
+    let thread = thread::current().id();
+    let subscription = events::subscribe(move |e| {
+        if thread::current().id() == thread {
+            let _ = sender.send(e.clone());
+        }
+    });
+    let simulation = Simulation::start(clock);
+
+    let mut states = vec![machine.name()];
+    let mut reboots = 0;
+    let mut error = None;
+    for _ in 0..max_steps {
+        if machine.name() == until && states.len() > 1 {
+            break;
+        }
+
+        let simulated = states::simulated_reboots();
+        let mut next = machine.step();
+        if next.is_ok() && states::simulated_reboots() > simulated {
+            debug!("Booting the device after the simulated reboot");
+            reboots += 1;
+            next = next.and_then(|machine| {
+                let runtime_settings = RuntimeSettings::new().load(path)?;
+                let (settings, _, firmware) = machine.into_parts();
+                Ok(StateMachine::new(settings, runtime_settings, firmware))
+            });
+        }
+
+        match next {
+            Ok(m) => machine = m,
+            Err(e) => {
+                error = Some(e.to_string());
+                break;
+            }
+        }
+        states.push(machine.name());
+    }
+
+    drop(simulation);
+    events::unsubscribe(subscription);
+
+    Ok(Run {
+        states,
+        events: received.try_iter().collect(),
+        reboots,
+        error,
+        runtime_settings: RuntimeSettings::new().load(path)?,
+    })
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn install() {
+    use crypto_hash::{hex_digest, Algorithm};
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let firmware =
+        Metadata::from_values(&"1".repeat(64), "1.0", "board", "serial=harness", "").unwrap();
+    let harness = Harness::new(dir.path(), firmware);
+    let device = harness.block_device("mmcblk0p2", 1024 * 1024).unwrap();
+    assert_eq!(fs::metadata(&device).unwrap().len(), 1024 * 1024);
+
+    let package_dir = dir.path().join("package");
+    fs::create_dir(&package_dir).unwrap();
+    let sha256sum = hex_digest(Algorithm::SHA256, b"rootfs");
+    fs::write(package_dir.join(&sha256sum), "rootfs").unwrap();
+    fs::write(
+        package_dir.join("updatehub.json"),
+        json!({
+            "product-uid": "1".repeat(64),
+            "version": "2.0",
+            "supported-hardware": ["board"],
+            "objects": [{
+                "mode": "test",
+                "filename": "rootfs.img",
+                "target": device,
+                "sha256sum": sha256sum,
+                "size": 6,
+            }],
+        }).to_string(),
+    ).unwrap();
+
+    let run = harness
+        .install(&package_dir.join("updatehub.json"), "idle", 10)
+        .unwrap();
+    assert_eq!(run.error, None);
+    assert_eq!(run.states, ["install", "reboot", "idle"]);
+    assert_eq!(run.reboots, 1);
+    assert!(run.events.contains(&Event::StateChanged {
+        from: "install",
+        to: "reboot",
+    }));
+    // The reboot state itself is handled
+    assert!(run.events.contains(&Event::StateChanged {
+        from: "reboot",
+        to: "idle",
+    }));
+    assert!(run.runtime_settings.update.applied_package_uid.is_some());
+}
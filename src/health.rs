@@ -0,0 +1,195 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Health self-checks of the agent
+//!
+//! The agent marks its activity through `beat`: on each state change,
+//! on the progress of the download and write phases, around the
+//! external commands and while waiting for the next probe. The
+//! `Watchdog` checks from another thread that it keeps doing so; when
+//! nothing happened for longer than `STALL_TIMEOUT`, the agent is taken
+//! as stuck and its operations are cancelled.
+
+use cancel::Token;
+#[cfg(test)]
+use clock::{self, Clock, VirtualClock};
+
+#[cfg(test)]
+use chrono::{DateTime, Utc};
+#[cfg(test)]
+use std::cell::Cell;
+#[cfg(test)]
+use std::rc::Rc;
+use std::sync::mpsc::{self, RecvTimeoutError, Sender};
+use std::sync::{Arc, Mutex};
+use std::thread::{self, JoinHandle};
+use std::time::{Duration, Instant};
+
+/// Time without any activity after which the agent is stuck.
+pub const STALL_TIMEOUT: Duration = Duration::from_secs(30 * 60);
+
+/// Interval between two checks of the watchdog.
+const CHECK_INTERVAL: Duration = Duration::from_secs(60);
+
+lazy_static! {
+    static ref HEARTBEAT: Arc<Heartbeat> = Arc::new(Heartbeat::new());
+}
+
+#[cfg(test)]
+thread_local! {
+    /// Monotonic time of the last beat of the thread, by its clock.
+    static LAST_BEAT: Cell<Duration> = Cell::new(Duration::from_secs(0));
+}
+
+#[derive(Debug, Fail)]
+pub enum HealthError {
+    #[fail(display = "Agent stuck for {}s, last activity: {}", _0, _1)]
+    Stuck(u64, String),
+}
+
+/// Last activity of the agent.
+#[derive(Debug)]
+pub struct Heartbeat(Mutex<(Instant, String)>);
+
+impl Heartbeat {
+    fn new() -> Self {
+        Heartbeat(Mutex::new((Instant::now(), String::new())))
+    }
+
+    fn beat(&self, activity: &str) {
+        *self.0.lock().unwrap() = (Instant::now(), activity.to_string());
+    }
+
+    /// Returns how long ago, and what, the last activity was.
+    fn last(&self) -> (Duration, String) {
+        let last = self.0.lock().unwrap();
+        (last.0.elapsed(), last.1.clone())
+    }
+}
+
+/// Marks the agent as busy with `activity`.
+pub fn beat(activity: &str) {
+    #[cfg(test)]
+    LAST_BEAT.with(|b| b.set(clock::monotonic()));
+    HEARTBEAT.beat(activity)
+}
+
+/// Thread checking the agent is not stuck.
+pub struct Watchdog {
+    stop: Sender<()>,
+    thread: JoinHandle<Option<HealthError>>,
+}
+
+impl Watchdog {
+    /// Starts watching the agent, cancelling `token` if it gets stuck.
+    pub fn start(token: Token) -> Watchdog {
+        Watchdog::start_with(HEARTBEAT.clone(), token, STALL_TIMEOUT, CHECK_INTERVAL)
+    }
+
+    fn start_with(
+        heartbeat: Arc<Heartbeat>,
+        token: Token,
+        timeout: Duration,
+        interval: Duration,
+    ) -> Watchdog {
+        let (stop, stopped) = mpsc::channel();
+        heartbeat.beat("starting");
+
+        let thread = thread::spawn(move || loop {
+            match stopped.recv_timeout(interval) {
+                Err(RecvTimeoutError::Timeout) => {}
+                _ => return None,
+            }
+
+            let (idle, activity) = heartbeat.last();
+            if idle > timeout {
+                error!(
+                    "Agent unhealthy: nothing happened for {}s, last activity: {}",
+                    idle.as_secs(),
+                    activity
+                );
+                token.cancel();
+                return Some(HealthError::Stuck(idle.as_secs(), activity));
+            }
+        });
+
+        Watchdog { stop, thread }
+    }
+
+    /// Stops watching the agent, returning why it was cancelled, if it
+    /// was.
+    pub fn stop(self) -> Option<HealthError> {
+        let _ = self.stop.send(());
+        self.thread.join().unwrap_or(None)
+    }
+}
+
+/// Virtual clock recording the longest time the thread slept without
+/// a beat, which the watchdog would take as stuck above
+/// `STALL_TIMEOUT` on the system clock.
+#[cfg(test)]
+#[derive(Clone)]
+pub struct WatchedClock {
+    clock: VirtualClock,
+    longest_idle: Rc<Cell<Duration>>,
+}
+
+#[cfg(test)]
+impl WatchedClock {
+    pub fn new(clock: VirtualClock) -> Self {
+        WatchedClock {
+            clock,
+            longest_idle: Rc::new(Cell::new(Duration::from_secs(0))),
+        }
+    }
+
+    pub fn longest_idle(&self) -> Duration {
+        self.longest_idle.get()
+    }
+}
+
+#[cfg(test)]
+impl Clock for WatchedClock {
+    fn now(&self) -> DateTime<Utc> {
+        self.clock.now()
+    }
+
+    fn monotonic(&self) -> Duration {
+        self.clock.monotonic()
+    }
+
+    fn sleep(&self, duration: Duration) {
+        let idle = self.clock.monotonic() - LAST_BEAT.with(|b| b.get()) + duration;
+        if idle > self.longest_idle.get() {
+            self.longest_idle.set(idle);
+        }
+        self.clock.sleep(duration)
+    }
+}
+
+#[test]
+fn stuck_agent() {
+    let heartbeat = Arc::new(Heartbeat::new());
+    let token = Token::new();
+    let timeout = Duration::from_millis(100);
+    let interval = Duration::from_millis(10);
+
+    let watchdog = Watchdog::start_with(heartbeat.clone(), token.clone(), timeout, interval);
+    for _ in 0..20 {
+        heartbeat.beat("downloading");
+        thread::sleep(interval);
+    }
+    assert!(!token.is_cancelled());
+    thread::sleep(timeout * 3);
+
+    match watchdog.stop() {
+        Some(HealthError::Stuck(_, activity)) => assert_eq!(activity, "downloading"),
+        None => panic!("Stuck agent not detected"),
+    }
+    assert!(token.is_cancelled());
+
+    let watchdog = Watchdog::start_with(heartbeat, Token::new(), timeout, interval);
+    assert!(watchdog.stop().is_none());
+}
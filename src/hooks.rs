@@ -0,0 +1,292 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Pinning of the hooks run by the agent
+//!
+//! The firmware hooks and the factory reset script are run with the
+//! privileges of the agent, so anyone able to write to their
+//! directories gets code executed as the agent. When a manifest is set
+//! in `Storage/HookManifest` only the scripts it lists, with the same
+//! SHA256, are run. The manifest uses the `sha256sum` format, one
+//! `<sha256>  <path>` line per script, and is meant to be on storage
+//! the hooks' writers can not change, as a read-only rootfs. The
+//! content checked is run from a private copy in the directory given
+//! to `set_manifest`, the temporary directory of the agent, as `/tmp`
+//! may not allow executing files.
+//!
+//! The state change callback, `Update/StateChangeCallback`, follows the
+//! interface of the other updatehub agents: it is called as `<callback>
+//! enter <state>` and `<callback> leave <state>` around each state,
+//! and cancels the download, install or reboot by printing `cancel`
+//! when entering them. Those are named `downloading`, `installing` and
+//! `rebooting` for the callback, as the other agents name them. A
+//! failing callback is logged, and neither cancels nor stops the state.
+
+use Result;
+
+use crypto_hash::{hex_digest, Algorithm};
+use easy_process::Output;
+
+use std::collections::HashMap;
+use std::env;
+use std::fs::{self, DirBuilder, OpenOptions};
+use std::io::Write;
+use std::os::unix::fs::{DirBuilderExt, OpenOptionsExt};
+use std::path::{Path, PathBuf};
+use std::process as std_process;
+use std::sync::atomic::{AtomicUsize, Ordering, ATOMIC_USIZE_INIT};
+use std::sync::RwLock;
+
+use process;
+
+lazy_static! {
+    static ref MANIFEST: RwLock<Option<Manifest>> = RwLock::new(None);
+    /// Directory the copies of the pinned hooks are run from.
+    static ref COPY_DIR: RwLock<PathBuf> = RwLock::new(env::temp_dir());
+}
+
+/// Copies of the pinned hooks made so far, naming the next one.
+static COPIES: AtomicUsize = ATOMIC_USIZE_INIT;
+
+#[derive(Debug, Fail)]
+pub enum HookError {
+    #[fail(display = "Hook {} is not pinned in the hook manifest", _0)]
+    NotPinned(String),
+    #[fail(display = "Hook {} does not match the hook manifest", _0)]
+    Modified(String),
+    #[fail(display = "Invalid line {} in the hook manifest {}", _1, _0)]
+    InvalidManifest(String, usize),
+}
+
+/// SHA256 of the scripts allowed to run, by their path.
+#[derive(Debug, Default, PartialEq)]
+pub struct Manifest {
+    hashes: HashMap<PathBuf, String>,
+}
+
+impl Manifest {
+    /// Loads the manifest stored in `path`.
+    pub fn load(path: &Path) -> Result<Manifest> {
+        Manifest::parse(&path.to_string_lossy(), &fs::read_to_string(path)?)
+    }
+
+    fn parse(name: &str, content: &str) -> Result<Manifest> {
+        let mut hashes = HashMap::new();
+
+        for (n, line) in content.lines().enumerate() {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+
+            let mut parts = line.splitn(2, char::is_whitespace);
+            match (parts.next(), parts.next().map(|p| p.trim_left())) {
+                // A `*` marks the binary mode of sha256sum
+                (Some(hash), Some(path)) if hash.len() == 64 && !path.is_empty() => {
+                    let path = path.trim_left_matches('*');
+                    hashes.insert(PathBuf::from(path), hash.to_lowercase());
+                }
+                _ => return Err(HookError::InvalidManifest(name.to_string(), n + 1).into()),
+            }
+        }
+
+        Ok(Manifest { hashes })
+    }
+
+    /// Checks the `hook` script is pinned, with its current content.
+    pub fn check(&self, hook: &Path) -> Result<()> {
+        self.check_content(hook, &fs::read(hook)?)
+    }
+
+    /// Checks the `hook` script is pinned, with `content`.
+    fn check_content(&self, hook: &Path, content: &[u8]) -> Result<()> {
+        let pinned = self
+            .hashes
+            .get(hook)
+            .or_else(|| hook.canonicalize().ok().and_then(|p| self.hashes.get(&p)));
+
+        match pinned {
+            None => Err(HookError::NotPinned(hook.display().to_string()).into()),
+            Some(hash) => {
+                if hex_digest(Algorithm::SHA256, content) != *hash {
+                    return Err(HookError::Modified(hook.display().to_string()).into());
+                }
+                Ok(())
+            }
+        }
+    }
+}
+
+/// Sets the manifest of the hooks allowed to run, the hooks checked
+/// being run from copies in `copy_dir`. Passing `None` lets every hook
+/// run.
+pub fn set_manifest(path: Option<&Path>, copy_dir: &Path) -> Result<()> {
+    let manifest = match path {
+        Some(p) => Some(Manifest::load(p)?),
+        None => None,
+    };
+
+    *MANIFEST.write().unwrap() = manifest;
+    *COPY_DIR.write().unwrap() = copy_dir.to_path_buf();
+    Ok(())
+}
+
+/// Checks the `hook` script is allowed to run.
+pub fn check(hook: &Path) -> Result<()> {
+    match *MANIFEST.read().unwrap() {
+        Some(ref manifest) => manifest.check(hook),
+        None => Ok(()),
+    }
+}
+
+/// Runs the `hook` script, once checked against the manifest.
+pub(crate) fn run(hook: &Path) -> Result<Output> {
+    run_with(hook, &[])
+}
+
+/// Runs the `hook` script with `args`, once checked against the
+/// manifest. The content checked is run from a private copy, so the
+/// script can not be replaced once checked.
+fn run_with(hook: &Path, args: &[&str]) -> Result<Output> {
+    let content = match *MANIFEST.read().unwrap() {
+        Some(ref manifest) => {
+            let content = fs::read(hook)?;
+            manifest.check_content(hook, &content)?;
+            content
+        }
+        None => return process::run_limited(&command(hook, args)),
+    };
+
+    let copy_dir = COPY_DIR.read().unwrap().clone();
+    run_copy(&copy_dir, hook, &content, args)
+}
+
+/// Runs `content`, checked as the content of the `hook` script, with
+/// `args` from a copy in a directory of `copy_dir` only the agent can
+/// access.
+fn run_copy(copy_dir: &Path, hook: &Path, content: &[u8], args: &[&str]) -> Result<Output> {
+    fs::create_dir_all(copy_dir)?;
+    let dir = copy_dir.join(format!(
+        "updatehub-hook-{}-{}",
+        std_process::id(),
+        COPIES.fetch_add(1, Ordering::SeqCst)
+    ));
+    DirBuilder::new().mode(0o700).create(&dir)?;
+    let copy = dir.join(hook.file_name().unwrap_or_else(|| "hook".as_ref()));
+    let output = OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .mode(0o700)
+        .open(&copy)
+        .and_then(|mut file| file.write_all(content))
+        .map_err(|e| e.into())
+        .and_then(|_| process::run_limited(&command(&copy, args)));
+
+    if let Err(e) = fs::remove_dir_all(&dir) {
+        warn!(
+            "Failed to remove the copy of the hook {}: {}",
+            hook.display(),
+            e
+        );
+    }
+    output
+}
+
+/// Returns the command line running `script` with `args`.
+fn command(script: &Path, args: &[&str]) -> String {
+    let mut command = process::quote(script);
+    for arg in args {
+        command.push(' ');
+        command.push_str(&process::quote(arg));
+    }
+    command
+}
+
+/// Side of a state the state change callback is called on.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Transition {
+    Enter,
+    Leave,
+}
+
+/// Calls the state change `callback`, when there is one, on the
+/// `transition` of `state`, returning whether it asked to cancel.
+pub(crate) fn state_change(callback: &Path, transition: Transition, state: &str) -> Result<bool> {
+    if !callback.exists() {
+        return Ok(false);
+    }
+
+    let transition = match transition {
+        Transition::Enter => "enter",
+        Transition::Leave => "leave",
+    };
+    let state = match state {
+        "download" => "downloading",
+        "install" => "installing",
+        "reboot" => "rebooting",
+        state => state,
+    };
+
+    let output = run_with(callback, &[transition, state])?;
+    Ok(output.stdout.trim() == "cancel")
+}
+
+#[test]
+fn pinned() {
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let hook = dir.path().join("hook");
+    fs::write(&hook, "#!/bin/sh\necho 1\n").unwrap();
+    let hash = hex_digest(Algorithm::SHA256, b"#!/bin/sh\necho 1\n");
+
+    let manifest = Manifest::parse(
+        "manifest",
+        &format!("# hooks\n{}  {}\n", hash, hook.display()),
+    ).unwrap();
+    assert!(manifest.check(&hook).is_ok());
+    assert!(manifest.check(&dir.path().join("other")).is_err());
+
+    fs::write(&hook, "#!/bin/sh\necho 2\n").unwrap();
+    assert!(manifest.check(&hook).is_err());
+
+    assert!(Manifest::parse("manifest", "1234 /usr/bin/hook\n").is_err());
+    assert!(Manifest::parse("manifest", &format!("{} *{}\n", hash, hook.display())).is_ok());
+}
+
+#[test]
+fn checked_content() {
+    use std::os::unix::fs::PermissionsExt;
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let hook = dir.path().join("hook");
+    let content = b"#!/bin/sh\necho \"$0 $1\"\n";
+    fs::write(&hook, "#!/bin/sh\necho replaced\n").unwrap();
+    fs::set_permissions(&hook, fs::Permissions::from_mode(0o755)).unwrap();
+
+    // The content checked runs, although the hook is replaced since
+    let output = run_copy(dir.path(), &hook, content, &["arg"]).unwrap();
+    let mut words = output.stdout.split_whitespace();
+    let copy = PathBuf::from(words.next().unwrap());
+    assert_eq!(words.next(), Some("arg"));
+    assert_ne!(copy, hook);
+    assert!(copy.starts_with(dir.path()));
+    assert_eq!(copy.file_name(), hook.file_name());
+    assert!(!copy.parent().unwrap().exists());
+}
+
+#[test]
+fn quoted_arguments() {
+    use tempfile::tempdir;
+
+    // The copy keeps the name of the hook, space included
+    let dir = tempdir().unwrap();
+    let hook = dir.path().join("my hook");
+    let content = b"#!/bin/sh\nprintf '%s|' \"$@\"\n";
+
+    let output = run_copy(dir.path(), &hook, content, &["a b", "it's", ""]).unwrap();
+    assert_eq!(output.stdout, "a b|it's||");
+}
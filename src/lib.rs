@@ -5,6 +5,7 @@ extern crate core;
 extern crate crypto_hash;
 extern crate easy_process;
 extern crate hex;
+extern crate libc;
 extern crate parse_duration;
 extern crate rand;
 extern crate reqwest;
@@ -17,6 +18,8 @@ extern crate failure;
 #[macro_use]
 extern crate failure_derive;
 
+#[macro_use]
+extern crate lazy_static;
 #[macro_use]
 extern crate log;
 
@@ -35,14 +38,39 @@ extern crate tempfile;
 #[macro_use]
 extern crate serde_json;
 
+pub mod agent;
+pub mod benchmark;
 pub mod build_info;
+pub mod cancel;
+pub mod cleanup;
 pub mod client;
+pub mod clock;
+pub mod crash;
+pub mod error_code;
+pub mod events;
+pub mod fault;
 pub mod firmware;
+pub mod fuzz;
+pub mod harness;
+pub mod health;
+pub mod hooks;
+pub mod limits;
+pub mod lock;
+pub mod memory;
+pub mod metered;
+pub mod process;
+pub mod progress;
+pub mod redact;
+pub mod report;
 pub mod runtime_settings;
+pub mod schema;
 mod serde_helpers;
 pub mod settings;
 pub mod states;
-mod update_package;
+pub mod time_sanity;
+pub mod update_package;
+pub mod usage;
+pub mod usb;
 pub use failure::Error;
 
 use std::result;
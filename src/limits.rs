@@ -0,0 +1,640 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Resource limits of the hooks and install tools
+//!
+//! A runaway post-install script or decompressor must not starve the
+//! product application nor hang the update forever. The hooks and the
+//! install tools are run in a cgroup of their own, created under the
+//! cgroup v2 hierarchy delegated to the agent in `Update/HookCgroup`,
+//! bounded by `Update/HookMemoryLimit` and `Update/HookCpuQuota`, and
+//! are stopped once running for longer than `Update/HookTimeout`. The
+//! commands enter the cgroup before they are executed, and whatever is
+//! left in it is killed once they exit. When the cgroup can not be
+//! created only the timeout applies. The other external commands are
+//! only bounded by `Update/CommandTimeout`.
+//!
+//! A command keeps the agent marked as busy while it has a timeout, or
+//! otherwise while it outputs, so a hung command is stopped by the
+//! watchdog.
+//!
+//! The output of the commands is handed line by line to the caller as
+//! they run, and only its last lines are kept, around `MAX_KEPT_OUTPUT`
+//! bytes.
+//!
+//! The command lines are split into words as a POSIX shell does,
+//! honouring the single and double quotes and the backslashes, so the
+//! arguments holding spaces are given quoted, see `process::quote`.
+//!
+//! The commands run in a process group of their own. A command which
+//! times out, or whose update is cancelled, gets its whole group sent
+//! SIGTERM, and SIGKILL when it is still running `KILL_GRACE` later.
+
+use easy_process::{self, Output};
+use libc;
+
+use std::ffi::CString;
+use std::fs;
+use std::io::{self, BufRead, BufReader, Read};
+use std::os::unix::ffi::OsStringExt;
+use std::os::unix::process::CommandExt;
+use std::path::PathBuf;
+use std::process::{self, Child, Command, ExitStatus, Stdio};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::mpsc::{channel, RecvTimeoutError, Sender};
+use std::sync::RwLock;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use cancel;
+use health;
+use progress::{self, PROGRESS_ENV};
+use redact::redact;
+use settings::Update;
+
+/// Period, in microseconds, the CPU quota is given for.
+const CPU_PERIOD: u64 = 100_000;
+
+/// Interval the limited commands are checked at.
+const POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+/// Time the output of a killed command is waited for, as processes it
+/// started may keep it open.
+const OUTPUT_TIMEOUT: Duration = Duration::from_secs(1);
+
+/// Time a command is given to exit after SIGTERM, before SIGKILL.
+const KILL_GRACE: Duration = Duration::from_secs(5);
+
+/// Number of bytes of the last lines of stdout and stderr kept for each
+/// command.
+const MAX_KEPT_OUTPUT: usize = 64 * 1024;
+
+lazy_static! {
+    static ref LIMITS: RwLock<Limits> = RwLock::new(Limits::default());
+    static ref CGROUPS: AtomicUsize = AtomicUsize::new(0);
+}
+
+/// Resources the hooks and install tools may use.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct Limits {
+    /// Memory, in bytes.
+    pub memory: Option<u64>,
+    /// Percentage of a CPU.
+    pub cpu_quota: Option<u64>,
+    pub timeout: Option<Duration>,
+    /// Cgroup the cgroups of the commands are created in.
+    pub cgroup: PathBuf,
+    /// Timeout of the commands which are not hooks nor install tools.
+    pub command_timeout: Option<Duration>,
+}
+
+impl Limits {
+    pub fn from_settings(settings: &Update) -> Limits {
+        Limits {
+            memory: settings.hook_memory_limit,
+            cpu_quota: settings.hook_cpu_quota,
+            timeout: seconds(settings.hook_timeout),
+            cgroup: settings.hook_cgroup.clone(),
+            command_timeout: seconds(settings.command_timeout),
+        }
+    }
+
+    fn needs_cgroup(&self) -> bool {
+        self.memory.is_some() || self.cpu_quota.is_some()
+    }
+}
+
+/// A timeout of 0 seconds disables it.
+fn seconds(secs: u64) -> Option<Duration> {
+    match secs {
+        0 => None,
+        secs => Some(Duration::from_secs(secs)),
+    }
+}
+
+/// Cgroup of a single command, removed when dropped.
+struct Cgroup {
+    path: PathBuf,
+}
+
+impl Cgroup {
+    fn create(limits: &Limits) -> io::Result<Cgroup> {
+        // The controllers may already be enabled, or not be ours to
+        // enable, so failing to is only noticed through the limits
+        let _ = fs::write(limits.cgroup.join("cgroup.subtree_control"), "+memory +cpu");
+
+        let n = CGROUPS.fetch_add(1, Ordering::SeqCst);
+        let path = limits.cgroup.join(format!("hook-{}-{}", process::id(), n));
+        fs::create_dir(&path)?;
+        let cgroup = Cgroup { path };
+
+        if let Some(memory) = limits.memory {
+            fs::write(cgroup.path.join("memory.max"), memory.to_string())?;
+            let _ = fs::write(cgroup.path.join("memory.swap.max"), "0");
+        }
+        if let Some(quota) = limits.cpu_quota {
+            let max = format!("{} {}", quota * CPU_PERIOD / 100, CPU_PERIOD);
+            fs::write(cgroup.path.join("cpu.max"), max)?;
+        }
+
+        Ok(cgroup)
+    }
+
+    /// Returns the path of the `cgroup.procs` file of the cgroup, which
+    /// a process enters it by writing 0 to.
+    fn procs(&self) -> io::Result<CString> {
+        CString::new(self.path.join("cgroup.procs").into_os_string().into_vec())
+            .map_err(|e| io::Error::new(io::ErrorKind::InvalidInput, e))
+    }
+
+    /// Kills every process of the cgroup, one by one on kernels without
+    /// `cgroup.kill`.
+    fn kill(&self) {
+        if fs::write(self.path.join("cgroup.kill"), "1").is_ok() {
+            return;
+        }
+
+        let procs = fs::read_to_string(self.path.join("cgroup.procs")).unwrap_or_default();
+        for pid in procs.lines().filter_map(|l| l.parse::<libc::pid_t>().ok()) {
+            unsafe {
+                libc::kill(pid, libc::SIGKILL);
+            }
+        }
+    }
+}
+
+impl Drop for Cgroup {
+    fn drop(&mut self) {
+        // A cgroup which still has processes, as the ones left behind by
+        // the command, can not be removed until they exit
+        self.kill();
+        let start = Instant::now();
+        while let Err(e) = fs::remove_dir(&self.path) {
+            if e.raw_os_error() != Some(libc::EBUSY) || start.elapsed() >= KILL_GRACE {
+                warn!("Failed to remove the cgroup {:?}: {}", self.path, e);
+                break;
+            }
+            thread::sleep(POLL_INTERVAL);
+        }
+    }
+}
+
+/// Sets the limits of the hooks and install tools.
+pub fn set(limits: Limits) {
+    *LIMITS.write().unwrap() = limits;
+}
+
+/// Callback given each line `cmd` outputs, along with the name of its
+/// stream, `"stdout"` or `"stderr"`.
+pub(crate) type OnLine<'a> = &'a mut FnMut(&'static str, &str);
+
+/// Sends the lines read from `reader` to `sender`, along with `stream`.
+fn read_lines<R: Read + Send + 'static>(
+    stream: &'static str,
+    reader: Option<R>,
+    sender: Sender<(&'static str, String)>,
+) {
+    thread::spawn(move || {
+        let mut reader = match reader {
+            Some(reader) => BufReader::new(reader),
+            None => return,
+        };
+        let mut buf = Vec::new();
+        while let Ok(n) = reader.read_until(b'\n', &mut buf) {
+            if n == 0 {
+                break;
+            }
+            let line = String::from_utf8_lossy(&buf).into_owned();
+            if sender.send((stream, line)).is_err() {
+                break;
+            }
+            buf.clear();
+        }
+    });
+}
+
+/// Appends `line` to `kept`. Once longer than twice `MAX_KEPT_OUTPUT`,
+/// its first lines are dropped down to `MAX_KEPT_OUTPUT`, so the kept
+/// output is not moved for every line.
+fn keep(kept: &mut String, line: &str) {
+    kept.push_str(line);
+    if kept.len() <= 2 * MAX_KEPT_OUTPUT {
+        return;
+    }
+
+    let mut start = kept.len() - MAX_KEPT_OUTPUT;
+    match kept[start..].find('\n') {
+        Some(end) if start + end + 1 < kept.len() => start += end + 1,
+        _ => {
+            while !kept.is_char_boundary(start) {
+                start += 1;
+            }
+        }
+    }
+    kept.drain(..start);
+}
+
+/// Runs `cmd` within the limits of the hooks and install tools.
+pub(crate) fn run(
+    cmd: &str,
+    on_line: OnLine,
+) -> ::std::result::Result<Output, easy_process::Error> {
+    let limits = LIMITS.read().unwrap().clone();
+    run_with(cmd, &limits, on_line)
+}
+
+/// Runs `cmd`, which is neither a hook nor an install tool, within the
+/// command timeout.
+pub(crate) fn run_command(
+    cmd: &str,
+    on_line: OnLine,
+) -> ::std::result::Result<Output, easy_process::Error> {
+    let limits = Limits {
+        timeout: LIMITS.read().unwrap().command_timeout,
+        ..Limits::default()
+    };
+    run_with(cmd, &limits, on_line)
+}
+
+/// Spawns `cmd`, which enters `cgroup`, if any, before it is executed
+/// so it is limited from its start.
+fn spawn(cmd: &str, cgroup: Option<&Cgroup>) -> io::Result<Child> {
+    let words = words(cmd);
+    let (program, args) = match words.split_first() {
+        Some((program, args)) => (program.as_str(), args),
+        None => ("", &[][..]),
+    };
+    let mut command = Command::new(program);
+    command
+        .args(args)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped());
+    if let Some(progress) = progress::current() {
+        command.env(PROGRESS_ENV, progress);
+    }
+
+    // A process group of its own lets the processes the command starts
+    // be stopped along with it
+    let procs = match cgroup {
+        Some(cgroup) => Some(cgroup.procs()?),
+        None => None,
+    };
+    unsafe {
+        command.before_exec(move || {
+            libc::setpgid(0, 0);
+            if let Some(ref procs) = procs {
+                enter(procs)?;
+            }
+            Ok(())
+        });
+    }
+
+    command.spawn()
+}
+
+/// Splits the `cmd` command line into words, as a POSIX shell does
+/// without expanding anything.
+pub(crate) fn words(cmd: &str) -> Vec<String> {
+    let mut words = Vec::new();
+    // The word being read, if one was started, as '' is an empty one
+    let mut word: Option<String> = None;
+    let mut chars = cmd.chars();
+
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' => {
+                if let Some(c) = chars.next() {
+                    word.get_or_insert_with(String::new).push(c);
+                }
+            }
+            '\'' => {
+                let word = word.get_or_insert_with(String::new);
+                word.extend(chars.by_ref().take_while(|&c| c != '\''));
+            }
+            '"' => {
+                let word = word.get_or_insert_with(String::new);
+                while let Some(c) = chars.next() {
+                    match c {
+                        '"' => break,
+                        '\\' => match chars.next() {
+                            Some(c @ '"') | Some(c @ '\\') | Some(c @ '$') | Some(c @ '`') => {
+                                word.push(c)
+                            }
+                            Some(c) => {
+                                word.push('\\');
+                                word.push(c);
+                            }
+                            None => word.push('\\'),
+                        },
+                        c => word.push(c),
+                    }
+                }
+            }
+            c if c.is_whitespace() => {
+                if let Some(word) = word.take() {
+                    words.push(word);
+                }
+            }
+            c => word.get_or_insert_with(String::new).push(c),
+        }
+    }
+    words.extend(word);
+
+    words
+}
+
+/// Makes the calling process enter the cgroup of the `procs` file. It
+/// runs between fork and exec, so it only calls into libc.
+fn enter(procs: &CString) -> io::Result<()> {
+    unsafe {
+        let fd = libc::open(procs.as_ptr(), libc::O_WRONLY | libc::O_CLOEXEC);
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+        let written = libc::write(fd, b"0".as_ptr() as *const libc::c_void, 1);
+        let error = io::Error::last_os_error();
+        libc::close(fd);
+        if written != 1 {
+            return Err(error);
+        }
+    }
+    Ok(())
+}
+
+/// Sends `signal` to the process group of `child`.
+fn signal_group(child: &Child, signal: libc::c_int) {
+    unsafe {
+        libc::kill(-(child.id() as libc::pid_t), signal);
+    }
+}
+
+/// Stops `child`, with SIGTERM and then with SIGKILL, returning its
+/// status.
+fn stop(child: &mut Child, cgroup: Option<&Cgroup>) -> io::Result<ExitStatus> {
+    signal_group(child, libc::SIGTERM);
+
+    let start = Instant::now();
+    while start.elapsed() < KILL_GRACE {
+        if let Some(status) = child.try_wait()? {
+            return Ok(status);
+        }
+        thread::sleep(POLL_INTERVAL);
+    }
+
+    warn!("Killing process {}, as it ignored SIGTERM", child.id());
+    if let Some(cgroup) = cgroup {
+        cgroup.kill();
+    }
+    signal_group(child, libc::SIGKILL);
+    let _ = child.kill();
+    child.wait()
+}
+
+fn run_with(
+    cmd: &str,
+    limits: &Limits,
+    on_line: OnLine,
+) -> ::std::result::Result<Output, easy_process::Error> {
+    let cgroup = if limits.needs_cgroup() {
+        Cgroup::create(limits)
+            .map_err(|e| warn!("Running '{}' without a cgroup: {}", redact(cmd), e))
+            .ok()
+    } else {
+        None
+    };
+
+    let mut child = spawn(cmd, cgroup.as_ref())?;
+    let (sender, lines) = channel();
+    read_lines("stdout", child.stdout.take(), sender.clone());
+    read_lines("stderr", child.stderr.take(), sender);
+
+    let mut output = Output {
+        stdout: String::new(),
+        stderr: String::new(),
+    };
+    let mut handle = |(stream, line): (&'static str, String)| {
+        on_line(stream, &line);
+        match stream {
+            "stderr" => keep(&mut output.stderr, &line),
+            _ => keep(&mut output.stdout, &line),
+        }
+    };
+
+    let start = Instant::now();
+    let mut killed = false;
+    let status = loop {
+        let mut active = false;
+        while let Ok(line) = lines.try_recv() {
+            handle(line);
+            active = true;
+        }
+
+        if let Some(status) = child.try_wait()? {
+            break status;
+        }
+
+        let timed_out = limits.timeout.map_or(false, |t| start.elapsed() >= t);
+        if timed_out || cancel::is_cancelled() {
+            if timed_out {
+                error!("Stopping '{}' as it ran for too long", redact(cmd));
+            } else {
+                info!("Stopping '{}' as the update was cancelled", redact(cmd));
+            }
+            killed = true;
+            break stop(&mut child, cgroup.as_ref())?;
+        }
+
+        // A command without a timeout is only alive while it outputs, so
+        // a hung one is noticed by the watchdog
+        if active || limits.timeout.is_some() {
+            health::beat(&format!("running '{}'", redact(cmd)));
+        }
+        thread::sleep(POLL_INTERVAL);
+    };
+
+    let deadline = Instant::now() + OUTPUT_TIMEOUT;
+    loop {
+        let line = if killed {
+            let now = Instant::now();
+            if now >= deadline {
+                break;
+            }
+            lines.recv_timeout(deadline - now)
+        } else {
+            lines.recv().map_err(|_| RecvTimeoutError::Disconnected)
+        };
+        match line {
+            Ok(line) => handle(line),
+            Err(_) => break,
+        }
+    }
+
+    if status.success() {
+        Ok(output)
+    } else {
+        Err(easy_process::Error::Failure(status, output))
+    }
+}
+
+#[test]
+fn timeout() {
+    use std::os::unix::fs::PermissionsExt;
+    use tempfile::tempdir;
+
+    let limits = Limits {
+        timeout: Some(Duration::from_millis(200)),
+        ..Limits::default()
+    };
+
+    let start = Instant::now();
+    assert!(run_with("sleep 5", &limits, &mut |_, _| {}).is_err());
+    assert!(start.elapsed() < Duration::from_secs(5));
+    assert_eq!(
+        run_with("echo ok", &limits, &mut |_, _| {}).unwrap().stdout,
+        "ok\n"
+    );
+
+    // The processes started by the command are stopped along with it
+    let dir = tempdir().unwrap();
+    let script = dir.path().join("script");
+    fs::write(&script, "#!/bin/sh\nsleep 10 &\nsleep 10\n").unwrap();
+    fs::set_permissions(&script, fs::Permissions::from_mode(0o755)).unwrap();
+    let start = Instant::now();
+    assert!(run_with(&script.to_string_lossy(), &limits, &mut |_, _| {}).is_err());
+    assert!(start.elapsed() < Duration::from_secs(5));
+}
+
+#[test]
+fn quoted_words() {
+    assert_eq!(words("  echo a   b "), ["echo", "a", "b"]);
+    assert_eq!(
+        words(r#"blkid -t 'LABEL=my disk' "/media/usb 0" a\ b"#),
+        ["blkid", "-t", "LABEL=my disk", "/media/usb 0", "a b"]
+    );
+    assert_eq!(
+        words(r#"echo '' "a \"b\" \x" 'it'\''s'"#),
+        ["echo", "", r#"a "b" \x"#, "it's"]
+    );
+
+    let output = run_with(
+        r#"printf '%s|' 'a b' "c  d""#,
+        &Limits::default(),
+        &mut |_, _| {},
+    );
+    assert_eq!(output.unwrap().stdout, "a b|c  d|");
+}
+
+#[test]
+fn default_timeouts() {
+    let mut settings = Update::default();
+    let limits = Limits::from_settings(&settings);
+    assert_eq!(limits.timeout, Some(Duration::from_secs(1800)));
+    assert_eq!(limits.command_timeout, Some(Duration::from_secs(300)));
+
+    settings.hook_timeout = 0;
+    settings.command_timeout = 0;
+    let limits = Limits::from_settings(&settings);
+    assert_eq!(limits.timeout, None);
+    assert_eq!(limits.command_timeout, None);
+}
+
+#[test]
+fn streamed_output() {
+    use std::os::unix::fs::PermissionsExt;
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let script = dir.path().join("script");
+    fs::write(&script, "#!/bin/sh\necho first\nsleep 1\necho last >&2\n").unwrap();
+    fs::set_permissions(&script, fs::Permissions::from_mode(0o755)).unwrap();
+
+    // The lines are handed over as they are output, not at the exit
+    let start = Instant::now();
+    let mut lines = Vec::new();
+    let output = run_with(
+        &script.to_string_lossy(),
+        &Limits::default(),
+        &mut |stream, line| lines.push((stream, line.to_string(), start.elapsed())),
+    ).unwrap();
+    assert_eq!(lines.len(), 2);
+    assert_eq!((lines[0].0, lines[0].1.as_str()), ("stdout", "first\n"));
+    assert!(lines[0].2 < Duration::from_millis(500));
+    assert_eq!((lines[1].0, lines[1].1.as_str()), ("stderr", "last\n"));
+    assert_eq!(output.stdout, "first\n");
+    assert_eq!(output.stderr, "last\n");
+
+    // Only the tail of a long output is kept
+    let mut kept = String::new();
+    for n in 0..100_000 {
+        keep(&mut kept, &format!("line {}\n", n));
+    }
+    assert!(kept.len() <= 2 * MAX_KEPT_OUTPUT);
+    assert!(kept.starts_with("line "));
+    assert!(kept.ends_with("line 99999\n"));
+}
+
+#[test]
+fn progress_env() {
+    use progress::{Phase, Progress};
+
+    let mut progress = Progress::new(Phase::Write, 10);
+    progress.start_object("object", 10, 5);
+    assert_eq!(
+        run_with(
+            "printenv UPDATEHUB_PROGRESS",
+            &Limits::default(),
+            &mut |_, _| {}
+        ).unwrap()
+        .stdout,
+        "write 50 object\n"
+    );
+}
+
+#[test]
+fn cgroup() {
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let limits = Limits {
+        memory: Some(8 * 1024 * 1024),
+        cpu_quota: Some(50),
+        timeout: None,
+        cgroup: dir.path().to_path_buf(),
+        command_timeout: None,
+    };
+
+    let cgroup = Cgroup::create(&limits).unwrap();
+    assert_eq!(
+        fs::read_to_string(cgroup.path.join("memory.max")).unwrap(),
+        "8388608"
+    );
+    assert_eq!(
+        fs::read_to_string(cgroup.path.join("cpu.max")).unwrap(),
+        "50000 100000"
+    );
+
+    // The commands enter the cgroup before they are executed
+    fs::write(cgroup.path.join("cgroup.procs"), "").unwrap();
+    let mut child = spawn("true", Some(&cgroup)).unwrap();
+    assert!(child.wait().unwrap().success());
+    assert_eq!(
+        fs::read_to_string(cgroup.path.join("cgroup.procs")).unwrap(),
+        "0"
+    );
+    fs::remove_file(cgroup.path.join("cgroup.procs")).unwrap();
+    assert!(spawn("true", Some(&cgroup)).is_err());
+    drop(cgroup);
+
+    // Without a cgroup hierarchy the commands still run
+    let limits = Limits {
+        cgroup: dir.path().join("missing"),
+        ..limits
+    };
+    assert_eq!(
+        run_with("echo ok", &limits, &mut |_, _| {}).unwrap().stdout,
+        "ok\n"
+    );
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Single instance enforcement
+//!
+//! The agent holds an exclusive `flock` on its lock file for as long
+//! as it runs. The lock is released by the kernel when the process
+//! exits, so a stale file left by a crash does not prevent a new
+//! start.
+
+use Result;
+
+use libc;
+
+use std::fs::{File, OpenOptions};
+use std::io::{Read, Write};
+use std::os::unix::io::AsRawFd;
+use std::path::{Path, PathBuf};
+
+#[derive(Debug, Fail)]
+pub enum LockError {
+    #[fail(
+        display = "Another instance is already running (pid: {}, lock: {:?})",
+        _1, _0
+    )]
+    AlreadyRunning(PathBuf, String),
+}
+
+/// Exclusive lock held while the agent is running.
+#[derive(Debug)]
+pub struct InstanceLock {
+    _file: File,
+}
+
+impl InstanceLock {
+    /// Acquires the lock stored in `path`, failing immediately if it
+    /// is held by another process.
+    pub fn acquire(path: &Path) -> Result<InstanceLock> {
+        use std::process;
+
+        let mut file = OpenOptions::new()
+            .read(true)
+            .write(true)
+            .create(true)
+            .open(path)?;
+
+        if unsafe { libc::flock(file.as_raw_fd(), libc::LOCK_EX | libc::LOCK_NB) } != 0 {
+            let mut pid = String::new();
+            let _ = file.read_to_string(&mut pid);
+            return Err(
+                LockError::AlreadyRunning(path.to_path_buf(), pid.trim().to_string()).into(),
+            );
+        }
+
+        file.set_len(0)?;
+        write!(file, "{}", process::id())?;
+
+        debug!("Holding instance lock on '{}'", path.to_string_lossy());
+        Ok(InstanceLock { _file: file })
+    }
+}
+
+#[test]
+fn exclusive() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let tmpdir = tempdir().unwrap();
+    let path = tmpdir.path().join("updatehub.lock");
+
+    let lock = InstanceLock::acquire(&path).expect("Failed to acquire the instance lock");
+    assert_eq!(
+        fs::read_to_string(&path).unwrap(),
+        format!("{}", ::std::process::id())
+    );
+    assert!(InstanceLock::acquire(&path).is_err(), "Lock acquired twice");
+
+    drop(lock);
+    assert!(InstanceLock::acquire(&path).is_ok());
+}
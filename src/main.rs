@@ -5,55 +5,616 @@
 
 #[macro_use]
 extern crate log;
+#[macro_use]
+extern crate serde_json;
 extern crate stderrlog;
 #[macro_use]
 extern crate structopt;
 extern crate updatehub;
 
+use std::cmp;
+use std::path::{Path, PathBuf};
 use structopt::StructOpt;
 
+use updatehub::agent::Agent;
+use updatehub::client::record::{self, Recorder};
+use updatehub::client::{Api, ProbeResponse};
+use updatehub::error_code::ErrorCode;
+use updatehub::firmware::Metadata;
+use updatehub::hooks;
+use updatehub::process;
+use updatehub::redact::{self, redact};
+use updatehub::runtime_settings::RuntimeSettings;
+use updatehub::settings::Settings;
+use updatehub::states::StateMachine;
+use updatehub::update_package::{space, validate, UpdatePackage};
+
+const LOG_LEVELS: &[&str] = &["error", "warn", "info", "debug", "trace"];
+
 #[derive(StructOpt, Debug)]
 #[structopt(
     name = "updatehub",
     author = "O.S. Systems Software LTDA. <contact@ossystems.com.br>",
     about = "A generic and safe Firmware Over-The-Air agent."
 )]
-#[structopt(raw(version = "updatehub::build_info::version()"))]
+#[structopt(raw(version = "updatehub::build_info::full_version()"))]
 struct Opt {
     /// Increase the verboseness level
     #[structopt(short = "v", long = "verbose", parse(from_occurrences))]
     verbose: u8,
+
+    /// Sets the log level, overriding the verboseness level
+    #[structopt(long = "log-level", raw(possible_values = "LOG_LEVELS"))]
+    log_level: Option<String>,
+
+    /// System settings file to use
+    #[structopt(
+        short = "c",
+        long = "config",
+        parse(from_os_str),
+        raw(default_value = "updatehub::settings::SYSTEM_SETTINGS_PATH")
+    )]
+    config: PathBuf,
+
+    /// Simulates the installation, writing the objects to a scratch
+    /// file and skipping the reboot
+    #[structopt(long = "dry-run")]
+    dry_run: bool,
+
+    /// Records the replies of the server in a bundle, for debugging
+    #[structopt(long = "record", parse(from_os_str))]
+    record: Option<PathBuf>,
+
+    /// Replays the replies recorded in a bundle instead of reaching
+    /// the server
+    #[structopt(long = "replay", parse(from_os_str), conflicts_with = "record")]
+    replay: Option<PathBuf>,
+
+    /// Lists the install modes built in, with the version and the
+    /// fields of their objects, in JSON
+    #[structopt(long = "list-modes")]
+    list_modes: bool,
+
+    #[structopt(subcommand)]
+    cmd: Option<Command>,
+}
+
+#[derive(StructOpt, Debug)]
+enum Command {
+    /// Probes the server once, printing the result as JSON
+    #[structopt(name = "probe")]
+    Probe,
+
+    /// Checks the server is reached, without taking the instance lock,
+    /// as done by the running agent on a new binary of itself before
+    /// installing it
+    #[structopt(name = "health-check")]
+    HealthCheck,
+
+    /// Installs a local update package and exits
+    #[structopt(name = "install")]
+    Install {
+        /// Update package metadata, with its objects stored alongside
+        #[structopt(parse(from_os_str))]
+        package: PathBuf,
+    },
+
+    /// Wipes the runtime settings, downloads and data, so the device is
+    /// enrolled again as a new one
+    #[structopt(name = "factory-reset")]
+    FactoryReset,
+
+    /// Opts the device into the canary phase of the rollouts
+    #[structopt(name = "canary")]
+    Canary {
+        /// Leaves the canary phase, using the configured rollout group
+        #[structopt(long = "leave")]
+        leave: bool,
+    },
+
+    /// Checks or shows the settings in use
+    #[structopt(name = "settings")]
+    Settings {
+        #[structopt(subcommand)]
+        cmd: SettingsCommand,
+    },
+
+    /// Prints the agent version, the firmware metadata, as sent to the
+    /// server, the data usage of the month and the space available for
+    /// the downloads, in JSON
+    #[structopt(name = "info")]
+    Info,
+
+    /// Measures the write speed to the storage, the SHA256 throughput
+    /// and the download speed from the server, printing them in JSON
+    #[structopt(name = "benchmark")]
+    Benchmark {
+        /// Directories to measure the write speed to, through a scratch
+        /// file; the download directory by default
+        #[structopt(long = "dir", parse(from_os_str))]
+        dirs: Vec<PathBuf>,
+
+        /// Bytes written and hashed
+        #[structopt(long = "size", default_value = "67108864")]
+        size: u64,
+
+        /// File to download, rather than the root of the server
+        #[structopt(long = "url")]
+        url: Option<String>,
+
+        /// Skips the download
+        #[structopt(long = "offline")]
+        offline: bool,
+    },
+
+    /// Inspects local update packages
+    #[structopt(name = "pkg")]
+    Pkg {
+        #[structopt(subcommand)]
+        cmd: PkgCommand,
+    },
+
+    /// Checks the audit log of the external commands
+    #[structopt(name = "audit")]
+    Audit {
+        #[structopt(subcommand)]
+        cmd: AuditCommand,
+    },
+}
+
+#[derive(StructOpt, Debug)]
+enum SettingsCommand {
+    /// Validates the system and runtime settings, failing on any problem
+    #[structopt(name = "validate")]
+    Validate,
+
+    /// Prints the effective system settings
+    #[structopt(name = "dump")]
+    Dump,
+}
+
+#[derive(StructOpt, Debug)]
+enum PkgCommand {
+    /// Prints the metadata and objects of an update package, and the
+    /// space it needs on the device
+    #[structopt(name = "info")]
+    Info {
+        /// Update package metadata
+        #[structopt(parse(from_os_str))]
+        package: PathBuf,
+
+        /// Prints the information as JSON
+        #[structopt(long = "json")]
+        json: bool,
+    },
+}
+
+#[derive(StructOpt, Debug)]
+enum AuditCommand {
+    /// Verifies the chain of the audit log, failing when an entry was
+    /// changed or removed
+    #[structopt(name = "verify")]
+    Verify {
+        /// Audit log to verify, rather than the configured one
+        #[structopt(parse(from_os_str))]
+        log: Option<PathBuf>,
+    },
+}
+
+fn settings(cmd: &SettingsCommand, path: &Path) -> updatehub::Result<()> {
+    use std::fs::File;
+    use std::io::Read;
+
+    match cmd {
+        SettingsCommand::Validate => {
+            let mut valid = true;
+
+            if path.exists() {
+                let mut content = String::new();
+                File::open(path)?.read_to_string(&mut content)?;
+
+                for issue in updatehub::settings::validate(&content) {
+                    println!("{}: {}", path.display(), issue);
+                    valid = false;
+                }
+            }
+
+            if valid {
+                let settings = Settings::new().load(path)?;
+                if let Err(e) = RuntimeSettings::new().load(&settings.storage.runtime_settings) {
+                    println!("{}: {}", settings.storage.runtime_settings, e);
+                    valid = false;
+                }
+            }
+
+            if !valid {
+                std::process::exit(1);
+            }
+        }
+        SettingsCommand::Dump => {
+            let settings = Settings::new().load(path)?;
+            if let Some(ref token) = settings.network.provisioning_token {
+                redact::add_secret(token);
+            }
+
+            print!("{}", redact(&settings.dump()?));
+        }
+    }
+
+    Ok(())
+}
+
+fn audit(cmd: &AuditCommand, config: &Path) -> updatehub::Result<()> {
+    match cmd {
+        AuditCommand::Verify { log } => {
+            let settings = Settings::new().load(config)?;
+            let path = match log.as_ref().or_else(|| settings.storage.audit_log.as_ref()) {
+                Some(path) => path,
+                None => {
+                    error!("No audit log is configured, nor given");
+                    std::process::exit(1);
+                }
+            };
+            let key = match settings.storage.audit_log_key {
+                Some(ref key) => Some(process::read_key(key)?),
+                None => None,
+            };
+
+            let entries = process::verify(path, key.as_ref().map(|k| k.as_slice()))?;
+            println!("{}: {} entries, chain intact", path.display(), entries);
+        }
+    }
+
+    Ok(())
+}
+
+fn pkg(cmd: &PkgCommand, config: &Path) -> updatehub::Result<()> {
+    match cmd {
+        PkgCommand::Info { package, json } => pkg_info(package, *json, config),
+    }
+}
+
+fn pkg_info(package: &Path, json: bool, config: &Path) -> updatehub::Result<()> {
+    let update_package = UpdatePackage::load(package)?;
+
+    // The compatibility and the space are only known on the device
+    let settings = Settings::new().load(config).ok();
+    let firmware = match settings {
+        Some(ref s) => {
+            hooks::set_manifest(
+                s.storage.hook_manifest.as_ref().map(|p| p.as_path()),
+                s.update.temp_dir(),
+            )?;
+            Metadata::new(&s.firmware.metadata_path).ok()
+        }
+        None => None,
+    };
+    let compatible = firmware.map(|f| update_package.compatible_with(&f).is_ok());
+    let forecast = settings
+        .as_ref()
+        .and_then(|s| space::forecast(&update_package, &s.update.download_dir).ok());
+    let hardware = update_package
+        .supported_hardware()
+        .map_or_else(|| "any".to_string(), |l| l.join(", "));
+
+    if json {
+        let objects: Vec<_> = update_package
+            .objects()
+            .iter()
+            .map(|o| {
+                json!({
+                    "filename": o.filename(),
+                    "mode": o.mode(),
+                    "target": o.target(),
+                    "size": o.len(),
+                    "sha256sum": o.sha256sum(),
+                })
+            }).collect();
+
+        println!(
+            "{}",
+            json!({
+                "package-uid": update_package.package_uid(),
+                "product-uid": update_package.product_uid(),
+                "version": update_package.version(),
+                "supported-hardware": update_package.supported_hardware(),
+                "compatible": compatible,
+                "space": forecast,
+                "objects": objects,
+            })
+        );
+        return Ok(());
+    }
+
+    println!("Package UID:        {}", update_package.package_uid());
+    println!("Product UID:        {}", update_package.product_uid());
+    println!("Version:            {}", update_package.version());
+    println!("Supported hardware: {}", hardware);
+    println!(
+        "Compatible:         {}",
+        compatible.map_or("unknown", |c| if c { "yes" } else { "no" })
+    );
+    if let Some(ref f) = forecast {
+        let (required, available) = (f.required, f.available);
+        println!(
+            "Space required:     {} bytes, {} inodes",
+            required.bytes, required.inodes
+        );
+        println!(
+            "Space available:    {} bytes, {} inodes",
+            available.bytes, available.inodes
+        );
+    }
+    println!();
+    println!(
+        "{:<24} {:<8} {:>12} {:<24} SHA256SUM",
+        "FILENAME", "MODE", "SIZE", "TARGET"
+    );
+    for o in update_package.objects() {
+        println!(
+            "{:<24} {:<8} {:>12} {:<24} {}",
+            o.filename(),
+            o.mode(),
+            o.len(),
+            o.target().display(),
+            o.sha256sum()
+        );
+    }
+
+    Ok(())
+}
+
+fn info(config: &Path) -> updatehub::Result<()> {
+    let settings = Settings::new().load(config)?;
+    let runtime_settings = RuntimeSettings::new().load(&settings.storage.runtime_settings)?;
+    hooks::set_manifest(
+        settings.storage.hook_manifest.as_ref().map(|p| p.as_path()),
+        settings.update.temp_dir(),
+    )?;
+    let firmware = Metadata::new(&settings.firmware.metadata_path)?;
+
+    println!(
+        "{}",
+        json!({
+            "agent-version": updatehub::build_info::version(),
+            "build-time": updatehub::build_info::build_time(),
+            "firmware": firmware,
+            "data-usage": runtime_settings.usage,
+            "download-space": space::available(&settings.update.download_dir)?,
+        })
+    );
+    Ok(())
+}
+
+fn list_modes() -> updatehub::Result<()> {
+    let modes: Vec<_> = validate::modes()
+        .map(|m| {
+            let fields: Vec<_> = m
+                .fields
+                .iter()
+                .map(|f| {
+                    json!({
+                        "name": f.name,
+                        "type": f.kind.description(),
+                        "required": f.required,
+                    })
+                }).collect();
+            json!({
+                "mode": m.name,
+                "version": m.version,
+                "fields": fields,
+            })
+        }).collect();
+
+    println!("{}", json!(modes));
+    Ok(())
+}
+
+fn benchmark(
+    config: &Path,
+    dirs: &[PathBuf],
+    size: u64,
+    url: Option<&str>,
+    offline: bool,
+) -> updatehub::Result<()> {
+    let settings = Settings::new().load(config)?;
+    let dirs = if dirs.is_empty() {
+        vec![settings.update.download_dir.clone()]
+    } else {
+        dirs.to_vec()
+    };
+    let url = match url {
+        _ if offline => None,
+        Some(url) => Some(url),
+        None => Some(settings.network.server_address.as_str()),
+    };
+
+    let report = updatehub::benchmark::run(&dirs, size, url)?;
+    println!("{}", serde_json::to_string(&report)?);
+    Ok(())
+}
+
+fn probe(
+    settings: &Settings,
+    runtime_settings: &RuntimeSettings,
+    firmware: &Metadata,
+) -> updatehub::Result<()> {
+    let result = match Api::new(settings, runtime_settings, firmware).probe()? {
+        ProbeResponse::NoUpdate => json!({ "update-available": false }),
+        ProbeResponse::ExtraPoll(s) => json!({ "update-available": false, "extra-poll": s }),
+        ProbeResponse::RolloutWait { phase, wait } => json!({
+            "update-available": false,
+            "rollout-phase": phase,
+            "rollout-wait": wait,
+        }),
+        ProbeResponse::Update(u) => json!({
+            "update-available": true,
+            "package-uid": u.package_uid(),
+            "version": u.version(),
+        }),
+        ProbeResponse::InvalidUpdate { error, .. } => return Err(error),
+    };
+
+    println!("{}", result);
+    Ok(())
+}
+
+fn health_check(config: &Path) -> updatehub::Result<()> {
+    let settings = Settings::new().load(config)?;
+    let runtime_settings = RuntimeSettings::new().load(&settings.storage.runtime_settings)?;
+    hooks::set_manifest(
+        settings.storage.hook_manifest.as_ref().map(|p| p.as_path()),
+        settings.update.temp_dir(),
+    )?;
+    let firmware = Metadata::new(&settings.firmware.metadata_path)?;
+
+    Api::new(&settings, &runtime_settings, &firmware).probe()?;
+    info!("Server reached, the agent is healthy");
+    Ok(())
+}
+
+fn install(
+    settings: Settings,
+    runtime_settings: RuntimeSettings,
+    firmware: Metadata,
+    package: &Path,
+) -> updatehub::Result<()> {
+    let update_package = UpdatePackage::load(package)?;
+    update_package.compatible_with(&firmware)?;
+
+    // The objects are looked up next to the metadata file
+    let package_dir = package.parent().unwrap_or_else(|| Path::new(""));
+    update_package.fetch_local(package_dir, &settings.update.download_dir)?;
+
+    StateMachine::new_install(settings, runtime_settings, firmware, update_package).step()?;
+    info!("Update package installed; it will be used after the next reboot.");
+
+    Ok(())
+}
+
+fn canary(mut runtime_settings: RuntimeSettings, leave: bool) -> updatehub::Result<()> {
+    runtime_settings.rollout.canary = !leave;
+    runtime_settings.save()?;
+
+    if leave {
+        info!("Device left the canary phase of the rollouts.");
+    } else {
+        info!("Device opted into the canary phase of the rollouts.");
+    }
+
+    Ok(())
 }
 
 fn run() -> updatehub::Result<()> {
     let opt = Opt::from_args();
 
-    stderrlog::new()
-        .verbosity(opt.verbose as usize + 1)
-        .init()?;
+    let verbosity = opt
+        .log_level
+        .and_then(|l| LOG_LEVELS.iter().position(|&v| v == l))
+        .unwrap_or(opt.verbose as usize + 1);
+
+    // The logger lets every record through, filtered by the maximum
+    // level only, so the server can raise the level as well
+    stderrlog::new().verbosity(LOG_LEVELS.len() - 1).init()?;
+    let level = LOG_LEVELS[cmp::min(verbosity, LOG_LEVELS.len() - 1)];
+    log::set_max_level(level.parse().unwrap_or(log::LevelFilter::Info));
 
     info!(
         "Starting UpdateHub Agent {}",
         updatehub::build_info::version()
     );
 
-    let settings = updatehub::settings::Settings::new().load()?;
-    let runtime_settings = updatehub::runtime_settings::RuntimeSettings::new()
-        .load(&settings.storage.runtime_settings)?;
-    let firmware = updatehub::firmware::Metadata::new(&settings.firmware.metadata_path)?;
+    if opt.list_modes {
+        return list_modes();
+    }
 
-    updatehub::states::StateMachine::new(settings, runtime_settings, firmware).run();
+    if let Some(Command::Settings { ref cmd }) = opt.cmd {
+        return settings(cmd, &opt.config);
+    }
 
-    Ok(())
+    if let Some(Command::Pkg { ref cmd }) = opt.cmd {
+        return pkg(cmd, &opt.config);
+    }
+
+    if let Some(Command::Audit { ref cmd }) = opt.cmd {
+        return audit(cmd, &opt.config);
+    }
+
+    if let Some(Command::Info) = opt.cmd {
+        return info(&opt.config);
+    }
+
+    if let Some(Command::HealthCheck) = opt.cmd {
+        return health_check(&opt.config);
+    }
+
+    if let Some(Command::Benchmark {
+        ref dirs,
+        size,
+        ref url,
+        offline,
+    }) = opt.cmd
+    {
+        let url = url.as_ref().map(|u| u.as_str());
+        return benchmark(&opt.config, dirs, size, url, offline);
+    }
+
+    let mut settings = Settings::new().load(&opt.config)?;
+    if opt.dry_run {
+        settings.update.dry_run = true;
+    }
+    let agent = Agent::new(settings)?;
+
+    if let Some(ref bundle) = opt.record {
+        info!("Recording the server replies in '{}'", bundle.display());
+        record::set_recorder(Some(Recorder::create(bundle)?));
+    } else if let Some(ref bundle) = opt.replay {
+        info!("Replaying the server replies from '{}'", bundle.display());
+        record::set_recorder(Some(Recorder::open(bundle)?));
+    }
+
+    match opt.cmd {
+        Some(Command::Probe) => probe(&agent.settings, &agent.runtime_settings, &agent.firmware),
+        Some(Command::Install { package }) => install(
+            agent.settings,
+            agent.runtime_settings,
+            agent.firmware,
+            &package,
+        ),
+        Some(Command::FactoryReset) => {
+            StateMachine::new_factory_reset(agent.settings, agent.runtime_settings, agent.firmware)
+                .step()?;
+            info!("Device reset; it will be enrolled again on the next start.");
+            Ok(())
+        }
+        Some(Command::Canary { leave }) => canary(agent.runtime_settings, leave),
+        Some(Command::Settings { .. })
+        | Some(Command::Pkg { .. })
+        | Some(Command::Audit { .. })
+        | Some(Command::Info)
+        | Some(Command::HealthCheck)
+        | Some(Command::Benchmark { .. }) => unreachable!(),
+        None => {
+            updatehub::update_package::tools::preflight(&agent.settings.update.install_modes)?;
+            updatehub::cancel::handle_signals();
+            if let Err(e) = updatehub::settings::watch(&opt.config) {
+                warn!("Settings changes will only be used after a restart: {}", e);
+            }
+
+            agent.run()
+        }
+    }
 }
 
 fn main() {
     if let Err(ref e) = run() {
-        error!("{}", e);
+        let code = ErrorCode::of(e);
+        // The errors of the client may carry the tokens it sent
+        error!("{} [{}]", redact(&e.to_string()), code);
         e.iter_causes()
             .skip(1)
-            .for_each(|e| error!(" caused by: {}\n", e));
+            .for_each(|e| error!(" caused by: {}\n", redact(&e.to_string())));
 
-        std::process::exit(1);
+        std::process::exit(code.exit_code());
     }
 }
@@ -0,0 +1,228 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Memory budget of the update
+//!
+//! Devices with 64 or 128MB of RAM get the agent killed when an update
+//! takes more than what is left by the applications. The buffers used
+//! to download, copy and hash the objects are taken from a pool bound
+//! by `Update/MemoryLimit`: they are reused, and taking one waits for
+//! another to be given back when the budget is used up. A thread which
+//! already holds a buffer gets one over the budget instead, as it would
+//! wait for itself otherwise.
+//!
+//! The decompressors which honor a limit are given the one set by
+//! `Update/DecompressorMemoryLimit`, so an object needing more memory
+//! fails to install instead of exhausting it. It is apart from the
+//! budget of the buffers, as the decompressors of the usual packages
+//! need more than the buffers do.
+
+use std::collections::HashMap;
+use std::mem;
+use std::ops::{Deref, DerefMut};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Condvar, Mutex};
+use std::thread::{self, ThreadId};
+
+/// Size of the buffers of the pool.
+pub const BUFFER_SIZE: usize = 64 * 1024;
+
+/// Budget used until one is configured.
+pub const DEFAULT_LIMIT: usize = 32 * 1024 * 1024;
+
+/// Memory of the decompressors until a limit is configured, enough for
+/// the `xz -9` presets.
+pub const DEFAULT_DECOMPRESSOR_LIMIT: usize = 128 * 1024 * 1024;
+
+/// Pool of buffers bound by a memory budget.
+pub struct Pool {
+    state: Mutex<State>,
+    available: Condvar,
+}
+
+struct State {
+    limit: usize,
+    allocated: usize,
+    free: Vec<Vec<u8>>,
+    /// Buffers held by each thread.
+    held: HashMap<ThreadId, usize>,
+}
+
+lazy_static! {
+    static ref POOL: Pool = Pool::new(DEFAULT_LIMIT);
+}
+
+static DECOMPRESSOR_LIMIT: AtomicUsize = AtomicUsize::new(DEFAULT_DECOMPRESSOR_LIMIT);
+
+/// Buffer of a pool, given back when dropped.
+pub struct Buffer<'a> {
+    data: Vec<u8>,
+    pool: &'a Pool,
+    thread: ThreadId,
+}
+
+impl<'a> Deref for Buffer<'a> {
+    type Target = [u8];
+
+    fn deref(&self) -> &[u8] {
+        &self.data
+    }
+}
+
+impl<'a> DerefMut for Buffer<'a> {
+    fn deref_mut(&mut self) -> &mut [u8] {
+        &mut self.data
+    }
+}
+
+impl<'a> Drop for Buffer<'a> {
+    fn drop(&mut self) {
+        let data = mem::replace(&mut self.data, Vec::new());
+        let mut state = self.pool.state.lock().unwrap();
+        let last = match state.held.get_mut(&self.thread) {
+            Some(held) => {
+                *held -= 1;
+                *held == 0
+            }
+            None => false,
+        };
+        if last {
+            state.held.remove(&self.thread);
+        }
+
+        if state.allocated > state.limit {
+            state.allocated -= data.len();
+        } else {
+            state.free.push(data);
+        }
+        self.pool.available.notify_one();
+    }
+}
+
+impl Pool {
+    /// Creates a pool holding up to `limit` bytes.
+    pub fn new(limit: usize) -> Pool {
+        Pool {
+            state: Mutex::new(State {
+                limit,
+                allocated: 0,
+                free: Vec::new(),
+                held: HashMap::new(),
+            }),
+            available: Condvar::new(),
+        }
+    }
+
+    /// Sets the memory budget, in bytes. The buffers beyond it are
+    /// freed as they are given back.
+    pub fn set_limit(&self, limit: usize) {
+        let mut state = self.state.lock().unwrap();
+        state.limit = limit;
+        while state.allocated > limit {
+            match state.free.pop() {
+                Some(data) => state.allocated -= data.len(),
+                None => break,
+            }
+        }
+        self.available.notify_all();
+    }
+
+    /// Returns the memory budget, in bytes.
+    pub fn limit(&self) -> usize {
+        self.state.lock().unwrap().limit
+    }
+
+    /// Returns a buffer of `BUFFER_SIZE` bytes, waiting for one to be
+    /// given back when the budget is used up. A buffer is always
+    /// allocated when there is none, however low the budget is, or
+    /// when the thread holds one already.
+    pub fn buffer(&self) -> Buffer {
+        let thread = thread::current().id();
+        let mut state = self.state.lock().unwrap();
+        let data = loop {
+            if let Some(data) = state.free.pop() {
+                break data;
+            }
+
+            let holding = state.held.contains_key(&thread);
+            if holding || state.allocated == 0 || state.allocated + BUFFER_SIZE <= state.limit {
+                state.allocated += BUFFER_SIZE;
+                break vec![0; BUFFER_SIZE];
+            }
+
+            state = self.available.wait(state).unwrap();
+        };
+
+        *state.held.entry(thread).or_insert(0) += 1;
+        Buffer {
+            data,
+            pool: self,
+            thread,
+        }
+    }
+}
+
+/// Sets the memory budget of the agent, in bytes.
+pub fn set_limit(limit: usize) {
+    POOL.set_limit(limit)
+}
+
+/// Returns the memory budget of the agent, in bytes.
+pub fn limit() -> usize {
+    POOL.limit()
+}
+
+/// Returns a buffer from the pool of the agent.
+pub fn buffer() -> Buffer<'static> {
+    POOL.buffer()
+}
+
+/// Sets the memory the decompressors may use, in bytes.
+pub fn set_decompressor_limit(limit: usize) {
+    DECOMPRESSOR_LIMIT.store(limit, Ordering::SeqCst)
+}
+
+/// Returns the memory the decompressors may use, in bytes.
+pub fn decompressor_limit() -> usize {
+    DECOMPRESSOR_LIMIT.load(Ordering::SeqCst)
+}
+
+#[test]
+fn pool() {
+    use std::sync::mpsc::channel;
+    use std::thread;
+    use std::time::Duration;
+
+    let pool: &'static Pool = Box::leak(Box::new(Pool::new(2 * BUFFER_SIZE)));
+    let first = pool.buffer();
+    let second = pool.buffer();
+    assert_eq!(first.len(), BUFFER_SIZE);
+
+    // The budget is used up, so the next buffer waits for one
+    let (sender, receiver) = channel();
+    let waiting = thread::spawn(move || {
+        let buffer = pool.buffer();
+        sender.send(()).unwrap();
+        buffer.len()
+    });
+    assert!(receiver.recv_timeout(Duration::from_millis(100)).is_err());
+    drop(first);
+    assert_eq!(waiting.join().unwrap(), BUFFER_SIZE);
+
+    // The buffers beyond a lower budget are freed
+    pool.set_limit(BUFFER_SIZE);
+    drop(second);
+    assert_eq!(pool.state.lock().unwrap().allocated, BUFFER_SIZE);
+    assert_eq!(pool.limit(), BUFFER_SIZE);
+
+    // A thread holding a buffer gets another over the budget
+    let first = pool.buffer();
+    let second = pool.buffer();
+    assert_eq!(pool.state.lock().unwrap().allocated, 2 * BUFFER_SIZE);
+    drop(first);
+    drop(second);
+    assert_eq!(pool.state.lock().unwrap().allocated, BUFFER_SIZE);
+    assert!(pool.state.lock().unwrap().held.is_empty());
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Class of the network connection
+//!
+//! Devices switching between WiFi or Ethernet and a cellular link pay
+//! for the bytes received over the latter. The connection is metered
+//! when the interface of the default route, of IPv4 or IPv6, is one of
+//! `Network/MeteredInterfaces`, and the probe still happens on it, but
+//! updates larger than `Network/MeteredDownloadLimit` are only
+//! downloaded once the device is back on an unmetered network.
+
+use std::fs;
+
+use settings::Network;
+
+/// IPv4 routing table of the kernel.
+const ROUTE_TABLE: &str = "/proc/net/route";
+
+/// IPv6 routing table of the kernel.
+const IPV6_ROUTE_TABLE: &str = "/proc/net/ipv6_route";
+
+/// Flags of the IPv6 routes, as in `linux/route.h`.
+const RTF_UP: u32 = 0x0001;
+const RTF_REJECT: u32 = 0x0200;
+
+/// Returns the interface of the default route in the routing table
+/// `content`, as found in `/proc/net/route`, preferring the one of the
+/// lowest metric.
+fn default_interface(content: &str) -> Option<String> {
+    content
+        .lines()
+        .skip(1)
+        .filter_map(|line| {
+            let fields = line.split_whitespace().collect::<Vec<_>>();
+            match (fields.get(0), fields.get(1), fields.get(6)) {
+                (Some(iface), Some(&"00000000"), Some(metric)) => {
+                    Some((metric.parse::<u32>().unwrap_or(u32::max_value()), *iface))
+                }
+                _ => None,
+            }
+        }).min()
+        .map(|(_, iface)| iface.to_string())
+}
+
+/// Returns the interface of the default route in the IPv6 routing
+/// table `content`, as found in `/proc/net/ipv6_route`, preferring the
+/// one of the lowest metric. The routes which are down or reject the
+/// packets, as the one of `lo` without IPv6 connectivity, are skipped.
+fn default_ipv6_interface(content: &str) -> Option<String> {
+    content
+        .lines()
+        .filter_map(|line| {
+            let fields = line.split_whitespace().collect::<Vec<_>>();
+            if fields.len() < 10 || fields[0].bytes().any(|b| b != b'0') || fields[1] != "00" {
+                return None;
+            }
+
+            let flags = u32::from_str_radix(fields[8], 16).ok()?;
+            if flags & RTF_UP == 0 || flags & RTF_REJECT != 0 {
+                return None;
+            }
+
+            let metric = u32::from_str_radix(fields[5], 16).unwrap_or(u32::max_value());
+            Some((metric, fields[9]))
+        }).min()
+        .map(|(_, iface)| iface.to_string())
+}
+
+/// Returns whether the device is connected through a metered network,
+/// according to `settings`: when the default route of either IPv4 or
+/// IPv6 goes through a metered interface.
+pub fn is_metered(settings: &Network) -> bool {
+    if settings.metered_interfaces.is_empty() {
+        return false;
+    }
+
+    let ipv4 = fs::read_to_string(ROUTE_TABLE)
+        .ok()
+        .and_then(|table| default_interface(&table));
+    let ipv6 = fs::read_to_string(IPV6_ROUTE_TABLE)
+        .ok()
+        .and_then(|table| default_ipv6_interface(&table));
+    ipv4.into_iter()
+        .chain(ipv6)
+        .any(|iface| settings.metered_interfaces.contains(&iface))
+}
+
+/// Returns whether downloading `size` bytes must wait for an unmetered
+/// network, according to `settings`, when the connection is `metered`.
+pub fn defers_download(settings: &Network, metered: bool, size: u64) -> bool {
+    let limit = settings.metered_download_limit;
+    metered && limit.map_or(false, |limit| size > limit)
+}
+
+#[test]
+fn route_table() {
+    let table = "\
+Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT
+wwan0\t00000000\t0100A8C0\t0003\t0\t0\t700\t00000000\t0\t0\t0
+eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0
+eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0
+";
+    assert_eq!(default_interface(table), Some("eth0".to_string()));
+    assert_eq!(default_interface("Iface\tDestination\n"), None);
+
+    let table = "\
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 \
+00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 \
+fe800000000000000000000000000001 00000400 00000001 00000000 00450003    wwan0
+fd000000000000000000000000000000 40 00000000000000000000000000000000 00 \
+00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+";
+    assert_eq!(default_ipv6_interface(table), Some("wwan0".to_string()));
+    assert_eq!(default_ipv6_interface(""), None);
+
+    let mut settings = Network::default();
+    settings.metered_download_limit = Some(1024);
+    assert!(defers_download(&settings, true, 2048));
+    assert!(!defers_download(&settings, true, 512));
+    assert!(!defers_download(&settings, false, 2048));
+}
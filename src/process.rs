@@ -0,0 +1,551 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Execution of external commands
+//!
+//! Every external command run by the agent (hooks, reboot, ...) goes
+//! through `run` so it can be recorded in the audit log when one is
+//! configured. The hooks and install tools go through `run_limited`
+//! instead, bounded by the limits of the `limits` module.
+//!
+//! The output of the commands is logged line by line as they run,
+//! prefixed by the name of the command and capped at `MAX_LOGGED_LINES`
+//! for each of them, and the last lines of a failed command are included
+//! in its error.
+//!
+//! The audit log is a file with one JSON entry per line. Each entry
+//! carries the HMAC-SHA256 of the previous line, keyed with the device
+//! secret of `Storage/AuditLogKey`, so removing or changing a recorded
+//! entry breaks the chain and is detected by `verify`, which the
+//! `audit verify` command runs. Without a key the entries carry the
+//! plain SHA256 of the previous line, and the chain can be rebuilt by
+//! whoever rewrites the log. The last entries can be attached to the
+//! error reports, see `Report/AuditEntries`.
+
+use {Error, Result};
+
+use cancel;
+use chrono::{DateTime, Utc};
+use crypto_hash::{digest, Algorithm};
+use easy_process::{self, Output};
+use health;
+use hex;
+use limits;
+use redact::redact;
+use serde_json;
+
+use std::collections::VecDeque;
+use std::ffi::OsStr;
+use std::fs::{self, File, OpenOptions};
+use std::io::{BufRead, BufReader, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// Maximum number of bytes of stdout and stderr kept for each entry.
+const MAX_OUTPUT_LEN: usize = 1024;
+
+/// Maximum number of lines of stdout and stderr logged for each
+/// command.
+const MAX_LOGGED_LINES: usize = 50;
+
+/// Number of lines of the output included in the error of a failed
+/// command.
+const ERROR_TAIL_LINES: usize = 5;
+
+/// Block size of SHA256, the HMAC key is padded to.
+const HMAC_BLOCK_LEN: usize = 64;
+
+lazy_static! {
+    static ref AUDIT_LOG: Mutex<Option<AuditLog>> = Mutex::new(None);
+}
+
+#[derive(Debug, Fail)]
+pub enum AuditLogError {
+    #[fail(display = "Audit log entry {} is malformed", _0)]
+    MalformedEntry(usize),
+    #[fail(display = "Audit log chain is broken at entry {}", _0)]
+    BrokenChain(usize),
+    #[fail(display = "Audit log key '{}' is empty", _0)]
+    EmptyKey(String),
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+pub struct AuditEntry {
+    pub timestamp: DateTime<Utc>,
+    pub command: String,
+    pub duration_ms: u64,
+    pub exit_code: Option<i32>,
+    pub stdout: String,
+    pub stderr: String,
+    pub previous: String,
+}
+
+/// Append-only, hash chained log of the executed commands.
+pub struct AuditLog {
+    path: PathBuf,
+    key: Option<Vec<u8>>,
+    last_hash: String,
+}
+
+impl AuditLog {
+    /// Opens the audit log at `path`, creating it if it does not
+    /// exist yet, and resumes the chain from its last entry. The chain
+    /// is keyed with `key`, when given.
+    pub fn open(path: &Path, key: Option<Vec<u8>>) -> Result<AuditLog> {
+        let mut last_hash = String::new();
+
+        if path.exists() {
+            for line in BufReader::new(File::open(path)?).lines() {
+                last_hash = link(key.as_ref().map(Vec::as_slice), &line?);
+            }
+        }
+
+        Ok(AuditLog {
+            path: path.to_path_buf(),
+            key,
+            last_hash,
+        })
+    }
+
+    /// Appends a new entry to the log.
+    pub fn record(
+        &mut self,
+        command: &str,
+        duration: Duration,
+        exit_code: Option<i32>,
+        output: Option<&Output>,
+    ) -> Result<()> {
+        let (stdout, stderr) = output
+            .map(|o| (truncate(&o.stdout), truncate(&o.stderr)))
+            .unwrap_or(("", ""));
+
+        let entry = AuditEntry {
+            timestamp: Utc::now(),
+            command: redact(command).into_owned(),
+            duration_ms: duration.as_secs() * 1000 + u64::from(duration.subsec_millis()),
+            exit_code,
+            stdout: redact(stdout).into_owned(),
+            stderr: redact(stderr).into_owned(),
+            previous: self.last_hash.clone(),
+        };
+
+        let line = serde_json::to_string(&entry)?;
+        writeln!(
+            OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(&self.path)?,
+            "{}",
+            line
+        )?;
+
+        self.last_hash = link(self.key.as_ref().map(Vec::as_slice), &line);
+        Ok(())
+    }
+}
+
+/// Returns the hash the entry following `line` carries: its
+/// HMAC-SHA256 keyed with `key`, or its SHA256 without a key.
+fn link(key: Option<&[u8]>, line: &str) -> String {
+    match key {
+        Some(key) => hex::encode(hmac_sha256(key, line.as_bytes())),
+        None => hex::encode(digest(Algorithm::SHA256, line.as_bytes())),
+    }
+}
+
+/// Returns the HMAC-SHA256 of `message` keyed with `key`, as in RFC 2104.
+fn hmac_sha256(key: &[u8], message: &[u8]) -> Vec<u8> {
+    let mut block = if key.len() > HMAC_BLOCK_LEN {
+        digest(Algorithm::SHA256, key)
+    } else {
+        key.to_vec()
+    };
+    block.resize(HMAC_BLOCK_LEN, 0);
+
+    let mut inner = block.iter().map(|b| b ^ 0x36).collect::<Vec<_>>();
+    inner.extend_from_slice(message);
+    let mut outer = block.iter().map(|b| b ^ 0x5c).collect::<Vec<_>>();
+    outer.extend(digest(Algorithm::SHA256, &inner));
+
+    digest(Algorithm::SHA256, &outer)
+}
+
+/// Reads the device secret the audit log is keyed with from `path`,
+/// without its trailing newline.
+pub fn read_key(path: &Path) -> Result<Vec<u8>> {
+    let mut key = fs::read(path)?;
+    while key.last().map_or(false, |&b| b == b'\n' || b == b'\r') {
+        key.pop();
+    }
+
+    if key.is_empty() {
+        return Err(AuditLogError::EmptyKey(path.display().to_string()).into());
+    }
+
+    Ok(key)
+}
+
+/// Configures the audit log used by `run`, keyed with the secret read
+/// from `key`. Passing `None` as `path` disables the recording of the
+/// commands.
+pub fn set_audit_log(path: Option<&Path>, key: Option<&Path>) -> Result<()> {
+    let key = match key {
+        Some(key) => Some(read_key(key)?),
+        None => None,
+    };
+    let log = match path {
+        Some(p) => Some(AuditLog::open(p, key)?),
+        None => None,
+    };
+
+    *AUDIT_LOG.lock().unwrap() = log;
+    Ok(())
+}
+
+/// Returns up to the `count` last entries of the audit log in use,
+/// none when there is no audit log.
+pub fn recent_entries(count: usize) -> Vec<AuditEntry> {
+    let path = match *AUDIT_LOG.lock().unwrap() {
+        Some(ref log) if count > 0 => log.path.clone(),
+        _ => return Vec::new(),
+    };
+
+    last_entries(&path, count).unwrap_or_else(|e| {
+        warn!("Failed to read the audit log: {}", e);
+        Vec::new()
+    })
+}
+
+/// Returns up to the `count` last entries of the audit log stored in
+/// `path`, skipping the malformed ones.
+fn last_entries(path: &Path, count: usize) -> Result<Vec<AuditEntry>> {
+    let mut entries = VecDeque::with_capacity(count);
+    for line in BufReader::new(File::open(path)?).lines() {
+        if let Ok(entry) = serde_json::from_str::<AuditEntry>(&line?) {
+            if entries.len() == count {
+                entries.pop_front();
+            }
+            entries.push_back(entry);
+        }
+    }
+
+    Ok(entries.into_iter().collect())
+}
+
+/// Checks the chain of the audit log stored in `path`, keyed with
+/// `key` when given, returning the number of entries it has.
+pub fn verify(path: &Path, key: Option<&[u8]>) -> Result<usize> {
+    let mut previous = String::new();
+    let mut count = 0;
+
+    for (n, line) in BufReader::new(File::open(path)?).lines().enumerate() {
+        let line = line?;
+        let entry = serde_json::from_str::<AuditEntry>(&line)
+            .map_err(|_| AuditLogError::MalformedEntry(n + 1))?;
+
+        if entry.previous != previous {
+            return Err(AuditLogError::BrokenChain(n + 1).into());
+        }
+
+        previous = link(key, &line);
+        count += 1;
+    }
+
+    Ok(count)
+}
+
+/// Runs the `cmd` command, recording its execution in the audit log.
+pub(crate) fn run(cmd: &str) -> Result<Output> {
+    execute(cmd, limits::run_command)
+}
+
+/// Runs the `cmd` hook or install tool, within the resource limits,
+/// recording its execution in the audit log.
+pub(crate) fn run_limited(cmd: &str) -> Result<Output> {
+    execute(cmd, limits::run)
+}
+
+fn execute<F>(cmd: &str, run: F) -> Result<Output>
+where
+    F: FnOnce(&str, limits::OnLine) -> ::std::result::Result<Output, easy_process::Error>,
+{
+    cancel::check()?;
+    health::beat(&format!("running '{}'", redact(cmd)));
+
+    let mut logger = Logger::new(cmd);
+    let start = Instant::now();
+    let result = run(cmd, &mut |stream, line| logger.log(stream, line));
+    let duration = start.elapsed();
+    logger.finish();
+
+    if let Some(ref mut log) = *AUDIT_LOG.lock().unwrap() {
+        let recorded = match result {
+            Ok(ref output) => log.record(cmd, duration, Some(0), Some(output)),
+            Err(easy_process::Error::Failure(ref status, ref output)) => {
+                log.record(cmd, duration, status.code(), Some(output))
+            }
+            Err(_) => log.record(cmd, duration, None, None),
+        };
+
+        if let Err(e) = recorded {
+            error!("Failed to record '{}' in the audit log: {}", redact(cmd), e);
+        }
+    }
+
+    match result {
+        Err(easy_process::Error::Failure(status, output)) => {
+            let tail = tail(&output);
+            let context = if tail.is_empty() {
+                format!("Running '{}'", redact(cmd))
+            } else {
+                format!("Running '{}', which output: {}", redact(cmd), redact(&tail))
+            };
+            let error: Error = easy_process::Error::Failure(status, output).into();
+            Err(error.context(context).into())
+        }
+        result => Ok(result?),
+    }
+}
+
+/// Returns `word` quoted, when needed, to be given as a single word of
+/// a command line run by `run` or `run_limited`.
+pub(crate) fn quote<S: AsRef<OsStr>>(word: S) -> String {
+    let word = word.as_ref().to_string_lossy();
+    let plain = |c: char| c.is_ascii_alphanumeric() || "-_./=:@,+%".contains(c);
+    if !word.is_empty() && word.chars().all(plain) {
+        return word.into_owned();
+    }
+
+    format!("'{}'", word.replace('\'', r"'\''"))
+}
+
+/// Returns the name `cmd` is logged with, the file name of its program.
+fn name(cmd: &str) -> String {
+    let program = limits::words(cmd).into_iter().next().unwrap_or_default();
+    program.rsplit('/').next().unwrap_or_default().to_string()
+}
+
+/// Returns the lines of `text` which are not blank.
+fn lines(text: &str) -> Vec<&str> {
+    text.lines().filter(|l| !l.trim().is_empty()).collect()
+}
+
+/// Logs the output of a command, line by line as it runs.
+struct Logger {
+    name: String,
+    stdout: usize,
+    stderr: usize,
+}
+
+impl Logger {
+    fn new(cmd: &str) -> Logger {
+        Logger {
+            name: name(cmd),
+            stdout: 0,
+            stderr: 0,
+        }
+    }
+
+    /// Logs the `line` output to `stream`, unless blank or past the
+    /// first `MAX_LOGGED_LINES` of the stream.
+    fn log(&mut self, stream: &str, line: &str) {
+        if line.trim().is_empty() {
+            return;
+        }
+
+        let line = line.trim_right_matches(|c| c == '\n' || c == '\r');
+        match stream {
+            "stderr" => {
+                self.stderr += 1;
+                if self.stderr <= MAX_LOGGED_LINES {
+                    info!("{} (stderr): {}", self.name, redact(line));
+                }
+            }
+            _ => {
+                self.stdout += 1;
+                if self.stdout <= MAX_LOGGED_LINES {
+                    debug!("{}: {}", self.name, redact(line));
+                }
+            }
+        }
+    }
+
+    /// Logs how many lines were not logged, once the command exited.
+    fn finish(&self) {
+        for &(stream, count) in &[("stdout", self.stdout), ("stderr", self.stderr)] {
+            if count > MAX_LOGGED_LINES {
+                debug!(
+                    "{}: {} more lines of {} are not logged",
+                    self.name,
+                    count - MAX_LOGGED_LINES,
+                    stream
+                );
+            }
+        }
+    }
+}
+
+/// Returns the last lines of the `output` of a failed command, from
+/// stderr unless there are none.
+fn tail(output: &Output) -> String {
+    let text = if output.stderr.trim().is_empty() {
+        &output.stdout
+    } else {
+        &output.stderr
+    };
+    let lines = lines(text);
+    let skip = lines.len().saturating_sub(ERROR_TAIL_LINES);
+
+    truncate(&lines[skip..].join(" / ")).to_string()
+}
+
+fn truncate(s: &str) -> &str {
+    if s.len() <= MAX_OUTPUT_LEN {
+        return s;
+    }
+
+    let mut end = MAX_OUTPUT_LEN;
+    while !s.is_char_boundary(end) {
+        end -= 1;
+    }
+
+    &s[..end]
+}
+
+#[test]
+fn chain() {
+    use tempfile::tempdir;
+
+    let tmpdir = tempdir().unwrap();
+    let path = tmpdir.path().join("audit.log");
+    let output = Output {
+        stdout: "out".into(),
+        stderr: "".into(),
+    };
+
+    let mut log = AuditLog::open(&path, None).unwrap();
+    log.record("cmd1", Duration::from_millis(10), Some(0), Some(&output))
+        .unwrap();
+    log.record("cmd2", Duration::from_millis(20), Some(1), Some(&output))
+        .unwrap();
+
+    // Reopening the log must continue the same chain
+    let mut log = AuditLog::open(&path, None).unwrap();
+    log.record("cmd3", Duration::from_millis(0), None, None)
+        .unwrap();
+
+    assert_eq!(verify(&path, None).unwrap(), 3);
+
+    let recent = last_entries(&path, 2).unwrap();
+    let commands = recent
+        .iter()
+        .map(|e| e.command.as_str())
+        .collect::<Vec<_>>();
+    assert_eq!(commands, ["cmd2", "cmd3"]);
+    assert_eq!(last_entries(&path, 5).unwrap().len(), 3);
+}
+
+#[test]
+fn keyed_chain() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    // Test case 2 of RFC 4231
+    assert_eq!(
+        hex::encode(hmac_sha256(b"Jefe", b"what do ya want for nothing?")),
+        "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+    );
+
+    let tmpdir = tempdir().unwrap();
+    let path = tmpdir.path().join("audit.log");
+    let key = tmpdir.path().join("audit.key");
+    fs::write(&key, "device secret\n").unwrap();
+    assert_eq!(read_key(&key).unwrap(), b"device secret");
+
+    let mut log = AuditLog::open(&path, Some(read_key(&key).unwrap())).unwrap();
+    log.record("cmd1", Duration::from_millis(10), Some(0), None)
+        .unwrap();
+    let mut log = AuditLog::open(&path, Some(read_key(&key).unwrap())).unwrap();
+    log.record("cmd2", Duration::from_millis(20), Some(0), None)
+        .unwrap();
+    assert_eq!(verify(&path, Some(b"device secret")).unwrap(), 2);
+
+    // A chain rebuilt without the secret is not taken
+    let content = fs::read_to_string(&path).unwrap();
+    let first = content.lines().next().unwrap().replacen("cmd1", "evil", 1);
+    let second = content.lines().nth(1).unwrap();
+    let mut second = serde_json::from_str::<AuditEntry>(second).unwrap();
+    second.previous = link(None, &first);
+    let second = serde_json::to_string(&second).unwrap();
+    fs::write(&path, format!("{}\n{}\n", first, second)).unwrap();
+    assert!(verify(&path, None).is_ok());
+    assert!(verify(&path, Some(b"device secret")).is_err());
+
+    fs::write(&key, "\n").unwrap();
+    assert!(read_key(&key).is_err());
+}
+
+#[test]
+fn tampered_chain() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let tmpdir = tempdir().unwrap();
+    let path = tmpdir.path().join("audit.log");
+
+    let mut log = AuditLog::open(&path, None).unwrap();
+    log.record("cmd1", Duration::from_millis(10), Some(0), None)
+        .unwrap();
+    log.record("cmd2", Duration::from_millis(20), Some(0), None)
+        .unwrap();
+
+    let content = fs::read_to_string(&path).unwrap();
+    fs::write(&path, content.replacen("cmd1", "evil", 1)).unwrap();
+
+    assert!(verify(&path, None).is_err());
+}
+
+#[test]
+fn failed_command() {
+    let output = Output {
+        stdout: "progress\n".into(),
+        stderr: (1..10).map(|n| format!("error {}\n", n)).collect(),
+    };
+    assert_eq!(
+        tail(&output),
+        "error 5 / error 6 / error 7 / error 8 / error 9"
+    );
+    assert_eq!(name("/usr/bin/flash_erase /dev/mtd0 0 0"), "flash_erase");
+    assert_eq!(name("'/opt/my hooks/check' a"), "check");
+    assert_eq!(quote("/dev/mmcblk0p2"), "/dev/mmcblk0p2");
+    assert_eq!(quote("LABEL=it's a disk"), r"'LABEL=it'\''s a disk'");
+    assert_eq!(quote(""), "''");
+    assert_eq!(limits::words(&quote("a 'b' \\c")), ["a 'b' \\c"]);
+
+    let error = run("false").unwrap_err();
+    assert_eq!(error.to_string(), "Running 'false'");
+    assert!(error.downcast_ref::<::failure::Context<String>>().is_some());
+}
+
+#[test]
+fn logged_lines() {
+    let mut logger = Logger::new("/bin/flash_erase /dev/mtd0 0 0");
+    assert_eq!(logger.name, "flash_erase");
+    for n in 0..MAX_LOGGED_LINES + 10 {
+        logger.log("stdout", &format!("erased {}\n", n));
+    }
+    logger.log("stderr", "\n");
+    logger.log("stderr", "bad block\n");
+    assert_eq!(logger.stdout, MAX_LOGGED_LINES + 10);
+    assert_eq!(logger.stderr, 1);
+}
+
+#[test]
+fn truncate_output() {
+    let long = "a".repeat(MAX_OUTPUT_LEN + 10);
+    assert_eq!(truncate(&long).len(), MAX_OUTPUT_LEN);
+    assert_eq!(truncate("short"), "short");
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Progress of the update
+//!
+//! Tracks the bytes processed of each object, and of the whole update,
+//! for the download and write phases. The progress is logged, every
+//! ten percent, and exported to the hooks through the
+//! `UPDATEHUB_PROGRESS` environment variable, as
+//! `<phase> <percent> <object>`. The variable is set on each command
+//! run, from the progress of the thread running it, as changing the
+//! environment of the agent would race with the other threads.
+//!
+//! Each change of the percentage is published as an event as well.
+//!
+//! The ETA is computed from the throughput of the last seconds, so it
+//! follows changes on the network or flash speed.
+
+use events::{self, Event};
+use health;
+
+use std::cell::RefCell;
+use std::collections::VecDeque;
+use std::fmt;
+use std::time::{Duration, Instant};
+
+/// Environment variable holding the progress for the hooks.
+pub const PROGRESS_ENV: &str = "UPDATEHUB_PROGRESS";
+
+/// Time window used to compute the throughput.
+const THROUGHPUT_WINDOW: Duration = Duration::from_secs(10);
+
+thread_local! {
+    static CURRENT: RefCell<Option<String>> = RefCell::new(None);
+}
+
+/// Returns the value of `PROGRESS_ENV` for the commands run by the
+/// current thread, the progress it made last.
+pub fn current() -> Option<String> {
+    CURRENT.with(|c| c.borrow().clone())
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Phase {
+    Download,
+    Write,
+}
+
+impl fmt::Display for Phase {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match *self {
+            Phase::Download => write!(f, "download"),
+            Phase::Write => write!(f, "write"),
+        }
+    }
+}
+
+#[derive(Debug)]
+pub struct Progress {
+    phase: Phase,
+    total: u64,
+    done: u64,
+    object: String,
+    object_total: u64,
+    object_done: u64,
+    samples: VecDeque<(Instant, u64)>,
+    reported: u64,
+    published: Option<u64>,
+}
+
+impl Progress {
+    /// Starts tracking `phase`, which processes `total` bytes.
+    pub fn new(phase: Phase, total: u64) -> Self {
+        Progress {
+            phase,
+            total,
+            done: 0,
+            object: String::new(),
+            object_total: 0,
+            object_done: 0,
+            samples: VecDeque::new(),
+            reported: 0,
+            published: None,
+        }
+    }
+
+    /// Starts processing `object`, of `size` bytes, from which `done`
+    /// bytes were already processed, as when resuming a download.
+    pub fn start_object(&mut self, object: &str, size: u64, done: u64) {
+        self.object = object.to_string();
+        self.object_total = size;
+        self.object_done = 0;
+        self.advance(done);
+    }
+
+    /// Returns the bytes of the current object left to process.
+    pub fn object_remaining(&self) -> u64 {
+        self.object_total.saturating_sub(self.object_done)
+    }
+
+    /// Accounts `bytes` more of the current object as processed.
+    pub fn advance(&mut self, bytes: u64) {
+        self.advance_at(bytes, Instant::now());
+    }
+
+    fn advance_at(&mut self, bytes: u64, now: Instant) {
+        self.done += bytes;
+        self.object_done += bytes;
+
+        self.samples.push_back((now, self.done));
+        while self.samples.len() > 2 && now.duration_since(self.samples[0].0) > THROUGHPUT_WINDOW {
+            self.samples.pop_front();
+        }
+
+        let value = self.env_value();
+        health::beat(&value);
+        CURRENT.with(|c| *c.borrow_mut() = Some(value));
+
+        let percent = self.percent();
+        if self.published != Some(percent) {
+            self.published = Some(percent);
+            events::publish(&Event::Progress {
+                phase: self.phase,
+                percent,
+                object: self.object.clone(),
+            });
+        }
+
+        if percent >= self.reported + 10 || (percent == 100 && self.reported < 100) {
+            self.reported = percent - percent % 10;
+            info!("{}", self);
+        }
+    }
+
+    /// Returns the percentage of the total bytes processed.
+    pub fn percent(&self) -> u64 {
+        if self.total == 0 {
+            return 100;
+        }
+
+        (self.done * 100 / self.total).min(100)
+    }
+
+    fn env_value(&self) -> String {
+        format!("{} {} {}", self.phase, self.percent(), self.object)
+    }
+
+    /// Returns the estimated time to finish the phase, based on the
+    /// recent throughput.
+    pub fn eta(&self) -> Option<Duration> {
+        let (first, last) = (self.samples.front()?, self.samples.back()?);
+        let elapsed = last.0.duration_since(first.0);
+        let bytes = last.1 - first.1;
+        let millis = elapsed.as_secs() * 1000 + u64::from(elapsed.subsec_millis());
+        if bytes == 0 || millis == 0 {
+            return None;
+        }
+
+        let remaining = self.total.saturating_sub(self.done);
+        Some(Duration::from_millis(remaining * millis / bytes))
+    }
+}
+
+impl fmt::Display for Progress {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(
+            f,
+            "{} {}% ({}: {}/{} bytes",
+            self.phase,
+            self.percent(),
+            self.object,
+            self.object_done,
+            self.object_total
+        )?;
+
+        match self.eta() {
+            Some(eta) => write!(f, ", ETA {}s)", eta.as_secs()),
+            None => write!(f, ")"),
+        }
+    }
+}
+
+#[test]
+fn percent_and_eta() {
+    let start = Instant::now();
+    let mut progress = Progress::new(Phase::Download, 1000);
+    assert_eq!(progress.eta(), None);
+
+    progress.object = "object".into();
+    progress.object_total = 1000;
+    progress.advance_at(0, start);
+    progress.advance_at(100, start + Duration::from_secs(1));
+    assert_eq!(progress.percent(), 10);
+    assert_eq!(progress.eta(), Some(Duration::from_secs(9)));
+
+    // Only the recent throughput is used
+    progress.advance_at(400, start + Duration::from_secs(20));
+    progress.advance_at(400, start + Duration::from_secs(21));
+    assert_eq!(progress.percent(), 90);
+    assert_eq!(progress.eta(), Some(Duration::from_millis(250)));
+    assert_eq!(progress.object_remaining(), 100);
+    assert_eq!(
+        progress.to_string(),
+        "download 90% (object: 900/1000 bytes, ETA 0s)"
+    );
+    assert_eq!(progress.env_value(), "download 90 object");
+    assert_eq!(current(), Some("download 90 object".into()));
+}
+
+#[test]
+fn empty_phase() {
+    let progress = Progress::new(Phase::Write, 0);
+    assert_eq!(progress.percent(), 100);
+    assert_eq!(progress.eta(), None);
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Redaction of sensitive values
+//!
+//! Values are hidden either by their key, for `<key>=<value>` lines as
+//! output by the firmware hooks, or by registering the secret value
+//! itself (tokens, credentials, ...) so it is hidden wherever it
+//! shows up.
+
+use std::borrow::Cow;
+use std::sync::RwLock;
+
+const REDACTED: &str = "<redacted>";
+
+lazy_static! {
+    static ref KEYS: RwLock<Vec<String>> = RwLock::new(Vec::new());
+    static ref SECRETS: RwLock<Vec<String>> = RwLock::new(Vec::new());
+}
+
+/// Sets the keys whose values must be hidden.
+pub fn set_keys(keys: &[String]) {
+    *KEYS.write().unwrap() = keys
+        .iter()
+        .map(|k| k.trim().to_string())
+        .filter(|k| !k.is_empty())
+        .collect();
+}
+
+/// Registers a secret value which must never be shown in clear text.
+pub fn add_secret(secret: &str) {
+    if secret.is_empty() {
+        return;
+    }
+
+    let mut secrets = SECRETS.write().unwrap();
+    if !secrets.iter().any(|s| s == secret) {
+        secrets.push(secret.to_string());
+    }
+}
+
+/// Returns `text` with all the sensitive values hidden.
+pub fn redact(text: &str) -> Cow<str> {
+    redact_with(text, &KEYS.read().unwrap(), &SECRETS.read().unwrap())
+}
+
+fn redact_with<'a>(text: &'a str, keys: &[String], secrets: &[String]) -> Cow<'a, str> {
+    let mut text = Cow::Borrowed(text);
+
+    if !keys.is_empty() {
+        let sensitive = |line: &str| {
+            line.splitn(2, '=')
+                .next()
+                .map(|k| keys.iter().any(|key| key == k.trim()))
+                .unwrap_or(false)
+                && line.contains('=')
+        };
+
+        if text.lines().any(&sensitive) {
+            text = Cow::Owned(
+                text.lines()
+                    .map(|line| {
+                        if sensitive(line) {
+                            format!("{}={}", line.splitn(2, '=').next().unwrap(), REDACTED)
+                        } else {
+                            line.to_string()
+                        }
+                    }).collect::<Vec<_>>()
+                    .join("\n"),
+            );
+        }
+    }
+
+    for secret in secrets {
+        if text.contains(secret.as_str()) {
+            text = Cow::Owned(text.replace(secret.as_str(), REDACTED));
+        }
+    }
+
+    text
+}
+
+#[test]
+fn keys() {
+    let keys = vec!["serial".to_string(), "customer".to_string()];
+
+    assert_eq!(
+        redact_with("serial=1234\nmac=00:11\ncustomer = ACME", &keys, &[]),
+        "serial=<redacted>\nmac=00:11\ncustomer =<redacted>"
+    );
+    assert_eq!(redact_with("serial number", &keys, &[]), "serial number");
+}
+
+#[test]
+fn secrets() {
+    let secrets = vec!["s3cr3t".to_string()];
+
+    assert_eq!(
+        redact_with("token s3cr3t rejected", &[], &secrets),
+        "token <redacted> rejected"
+    );
+    assert_eq!(redact_with("nothing here", &[], &secrets), "nothing here");
+}
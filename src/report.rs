@@ -0,0 +1,427 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Reports of the update events
+//!
+//! The events are mirrored to every sink added to a `Fanout`, as the
+//! local file set by `Report/File` or the webhook set by
+//! `Report/Webhook`, so the update can be followed from other systems.
+//! Each sink takes the events from a queue of its own, in a thread of
+//! its own, so a slow sink holds neither the agent nor the other sinks.
+//! An event a sink fails to take is retried, before the newer ones,
+//! when the next event comes. Once the queue is full, the events are
+//! dropped.
+//!
+//! The error events carry the last `Report/AuditEntries` entries of the
+//! audit log, so the commands which led to the failure are reported
+//! along with it.
+
+use Result;
+
+use chrono::{DateTime, Utc};
+use reqwest::header::Headers;
+use reqwest::Client;
+use serde_json;
+
+use std::collections::VecDeque;
+use std::fs::OpenOptions;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::mpsc::{self, SyncSender, TrySendError};
+use std::thread;
+use std::time::Duration;
+
+use client;
+use events::{self, Event, Subscription};
+use process::{self, AuditEntry};
+use settings::Report;
+
+/// Events kept for each sink while it fails.
+const MAX_QUEUED: usize = 100;
+
+/// Destination of the events.
+pub trait Reporter: Send {
+    /// Returns the name of the sink, for the logs.
+    fn name(&self) -> String;
+
+    fn report(&mut self, event: &Event) -> Result<()>;
+}
+
+#[derive(Serialize)]
+struct Entry<'a> {
+    timestamp: DateTime<Utc>,
+    #[serde(flatten)]
+    event: &'a Event,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    audit: Vec<AuditEntry>,
+}
+
+impl<'a> Entry<'a> {
+    /// Returns the entry of `event`, with the `audit_entries` last
+    /// entries of the audit log when it is an error.
+    fn new(event: &'a Event, audit_entries: usize) -> Self {
+        let audit = match *event {
+            Event::StateFailed { .. } => process::recent_entries(audit_entries),
+            _ => Vec::new(),
+        };
+
+        Entry {
+            timestamp: Utc::now(),
+            event,
+            audit,
+        }
+    }
+}
+
+/// Appends the events to a file, one JSON entry per line.
+pub struct FileReporter {
+    path: PathBuf,
+    audit_entries: usize,
+}
+
+impl FileReporter {
+    pub fn new(path: &Path) -> Self {
+        FileReporter {
+            path: path.to_path_buf(),
+            audit_entries: 0,
+        }
+    }
+
+    /// Attaches the `count` last audit log entries to the error events.
+    pub fn with_audit_entries(self, count: usize) -> Self {
+        FileReporter {
+            audit_entries: count,
+            ..self
+        }
+    }
+}
+
+impl Reporter for FileReporter {
+    fn name(&self) -> String {
+        format!("file '{}'", self.path.display())
+    }
+
+    fn report(&mut self, event: &Event) -> Result<()> {
+        let entry = Entry::new(event, self.audit_entries);
+        let mut file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&self.path)?;
+        writeln!(file, "{}", serde_json::to_string(&entry)?)?;
+        Ok(())
+    }
+}
+
+/// Posts the events, as JSON, to a local service, so co-located
+/// applications can prepare for the update without polling the agent.
+pub struct WebhookReporter {
+    client: Client,
+    url: String,
+    headers: Headers,
+    events: Vec<String>,
+    audit_entries: usize,
+}
+
+impl WebhookReporter {
+    /// Creates the webhook calling `url` with the `headers`, given as
+    /// `<name>: <value>`, on the `events` named, or on every event when
+    /// none is.
+    pub fn new(url: &str, headers: &[String], events: &[String]) -> Result<Self> {
+        let mut parsed = Headers::new();
+        client::add_headers(&mut parsed, headers)?;
+
+        Ok(WebhookReporter {
+            client: Client::builder().timeout(Duration::from_secs(5)).build()?,
+            url: url.to_string(),
+            headers: parsed,
+            events: events.to_vec(),
+            audit_entries: 0,
+        })
+    }
+
+    /// Attaches the `count` last audit log entries to the error events.
+    pub fn with_audit_entries(self, count: usize) -> Self {
+        WebhookReporter {
+            audit_entries: count,
+            ..self
+        }
+    }
+}
+
+impl Reporter for WebhookReporter {
+    fn name(&self) -> String {
+        format!("webhook {}", self.url)
+    }
+
+    fn report(&mut self, event: &Event) -> Result<()> {
+        if !self.events.is_empty() && !self.events.iter().any(|e| e == event.name()) {
+            return Ok(());
+        }
+
+        let entry = Entry::new(event, self.audit_entries);
+        let response = self
+            .client
+            .post(&self.url)
+            .headers(self.headers.clone())
+            .json(&entry)
+            .send()?;
+        if !response.status().is_success() {
+            bail!("Webhook replied with status {}", response.status());
+        }
+
+        Ok(())
+    }
+}
+
+struct Sink {
+    reporter: Box<Reporter>,
+    queue: VecDeque<Event>,
+}
+
+impl Sink {
+    /// Passes `event` to the reporter, after the events it failed to
+    /// take before.
+    fn report(&mut self, event: &Event) {
+        if self.queue.len() == MAX_QUEUED {
+            warn!(
+                "Dropping the oldest event queued for {}",
+                self.reporter.name()
+            );
+            self.queue.pop_front();
+        }
+        self.queue.push_back(event.clone());
+
+        while let Some(event) = self.queue.pop_front() {
+            if let Err(e) = self.reporter.report(&event) {
+                debug!("Failed to report to {}: {}", self.reporter.name(), e);
+                self.queue.push_front(event);
+                break;
+            }
+        }
+    }
+}
+
+/// Queue of the events to a sink, taken by its thread.
+struct Queue {
+    name: String,
+    sender: SyncSender<Event>,
+}
+
+/// Passes the events to several sinks.
+#[derive(Default)]
+pub struct Fanout {
+    sinks: Vec<Sink>,
+}
+
+impl Fanout {
+    pub fn new() -> Self {
+        Fanout::default()
+    }
+
+    /// Creates the fan-out to the sinks configured in `settings`.
+    pub fn from_settings(settings: &Report) -> Result<Self> {
+        let mut fanout = Fanout::new();
+        if let Some(ref path) = settings.file {
+            fanout.add(Box::new(
+                FileReporter::new(path).with_audit_entries(settings.audit_entries),
+            ));
+        }
+
+        if let Some(ref url) = settings.webhook {
+            fanout.add(Box::new(
+                WebhookReporter::new(url, &settings.webhook_headers, &settings.webhook_events)?
+                    .with_audit_entries(settings.audit_entries),
+            ));
+        }
+
+        Ok(fanout)
+    }
+
+    pub fn add(&mut self, reporter: Box<Reporter>) {
+        self.sinks.push(Sink {
+            reporter,
+            queue: VecDeque::new(),
+        });
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.sinks.is_empty()
+    }
+
+    /// Passes `event` to every sink, after the events they failed to
+    /// take before, waiting for each of them.
+    pub fn report(&mut self, event: &Event) {
+        for sink in &mut self.sinks {
+            sink.report(event);
+        }
+    }
+
+    /// Reports the events published from then on, each sink from its
+    /// own thread.
+    pub fn subscribe(self) -> Result<Subscription> {
+        let queues = self.start()?;
+        Ok(events::subscribe(move |e| dispatch(&queues, e)))
+    }
+
+    /// Starts the thread of every sink, returning their queues.
+    fn start(self) -> Result<Vec<Queue>> {
+        let mut queues = Vec::new();
+        for mut sink in self.sinks {
+            let name = sink.reporter.name();
+            let (sender, events) = mpsc::sync_channel::<Event>(MAX_QUEUED);
+            thread::Builder::new()
+                .name("report".into())
+                .spawn(move || {
+                    for event in events {
+                        sink.report(&event);
+                    }
+                })?;
+            queues.push(Queue { name, sender });
+        }
+
+        Ok(queues)
+    }
+}
+
+/// Queues `event` to every sink, dropping it for the sinks whose queue
+/// is full.
+fn dispatch(queues: &[Queue], event: &Event) {
+    for queue in queues {
+        if let Err(TrySendError::Full(_)) = queue.sender.try_send(event.clone()) {
+            warn!("Dropping an event for {}, its queue is full", queue.name);
+        }
+    }
+}
+
+#[test]
+fn fanout() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    struct Failing(usize);
+
+    impl Reporter for Failing {
+        fn name(&self) -> String {
+            "failing".into()
+        }
+
+        fn report(&mut self, _: &Event) -> Result<()> {
+            if self.0 > 0 {
+                self.0 -= 1;
+                bail!("Unavailable");
+            }
+            Ok(())
+        }
+    }
+
+    let dir = tempdir().unwrap();
+    let path = dir.path().join("events");
+    let mut fanout = Fanout::from_settings(&Report {
+        file: Some(path.clone()),
+        ..Report::default()
+    }).unwrap();
+    fanout.add(Box::new(Failing(2)));
+
+    let event = Event::StateChanged {
+        from: "idle",
+        to: "poll",
+    };
+    fanout.report(&event);
+    fanout.report(&event);
+    assert_eq!(fanout.sinks[1].queue.len(), 2);
+
+    // The failing sink catches up once it recovers
+    fanout.report(&event);
+    assert!(fanout.sinks[1].queue.is_empty());
+
+    let content = fs::read_to_string(&path).unwrap();
+    assert_eq!(content.lines().count(), 3);
+    assert!(content.contains(r#""event":"state-changed","from":"idle","to":"poll""#));
+}
+
+#[test]
+fn slow_sink() {
+    use std::sync::mpsc::{Receiver, Sender};
+
+    struct Blocked {
+        release: Receiver<()>,
+        taken: Sender<()>,
+    }
+
+    impl Reporter for Blocked {
+        fn name(&self) -> String {
+            "blocked".into()
+        }
+
+        fn report(&mut self, _: &Event) -> Result<()> {
+            self.release.recv()?;
+            self.taken.send(())?;
+            Ok(())
+        }
+    }
+
+    let (release, released) = mpsc::channel();
+    let (sender, taken) = mpsc::channel();
+    let mut fanout = Fanout::new();
+    fanout.add(Box::new(Blocked {
+        release: released,
+        taken: sender,
+    }));
+    let queues = fanout.start().unwrap();
+
+    // Queueing returns although the sink takes nothing
+    let event = Event::StateChanged {
+        from: "idle",
+        to: "poll",
+    };
+    for _ in 0..MAX_QUEUED + 10 {
+        dispatch(&queues, &event);
+    }
+    for _ in 0..MAX_QUEUED + 10 {
+        release.send(()).unwrap();
+    }
+
+    for _ in 0..MAX_QUEUED {
+        taken.recv_timeout(Duration::from_secs(5)).unwrap();
+    }
+
+    // The sink may have taken the first event before the queue filled,
+    // the others were dropped
+    let _ = taken.recv_timeout(Duration::from_millis(200));
+    assert!(taken.recv_timeout(Duration::from_millis(200)).is_err());
+}
+
+#[test]
+fn webhook() {
+    use mockito::{mock, Matcher, SERVER_URL};
+
+    let mock = mock("POST", "/hooks/updatehub")
+        .match_header("X-Token", "s3cr3t")
+        .match_body(Matcher::Regex(
+            r#""event":"state-changed","from":"download","to":"install""#.into(),
+        ))
+        .with_status(200)
+        .expect(1)
+        .create();
+
+    let headers = vec!["X-Token: s3cr3t".to_string()];
+    let events = vec!["install".to_string()];
+    let url = format!("{}/hooks/updatehub", SERVER_URL);
+    let mut webhook = WebhookReporter::new(&url, &headers, &events).unwrap();
+
+    let install = Event::StateChanged {
+        from: "download",
+        to: "install",
+    };
+    let reboot = Event::StateChanged {
+        from: "install",
+        to: "reboot",
+    };
+    webhook.report(&reboot).unwrap();
+    assert!(webhook.report(&install).is_ok());
+    mock.assert();
+
+    assert!(WebhookReporter::new(&url, &["invalid".into()], &[]).is_err());
+}
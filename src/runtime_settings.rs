@@ -6,19 +6,46 @@
 use Result;
 
 use chrono::{DateTime, Duration, Utc};
+use crypto_hash::{hex_digest, Algorithm};
 use serde_ini;
 
-use std::io;
+use std::fs::{self, File};
+use std::io::{self, Write};
 use std::path::Path;
 use std::path::PathBuf;
 
+use schema::{self, Migration, SchemaError};
 use serde_helpers::{de, ser};
 
+/// Version of the runtime settings schema, increased whenever the keys
+/// change incompatibly.
+pub const SCHEMA_VERSION: u32 = 1;
+
+/// Migrations of the runtime settings to each schema version after the
+/// first.
+const MIGRATIONS: &[Migration] = &[];
+
+/// Prefix of the last line of the runtime settings file, holding the
+/// SHA256 of the content before it.
+const CHECKSUM_PREFIX: &str = "; Checksum: ";
+
 #[derive(Debug, Default, Deserialize, PartialEq, Serialize)]
 #[serde(rename_all = "PascalCase")]
 pub struct RuntimeSettings {
     pub polling: RuntimePolling,
     pub update: RuntimeUpdate,
+    #[serde(default)]
+    pub enrollment: RuntimeEnrollment,
+    #[serde(default)]
+    pub rollout: RuntimeRollout,
+    #[serde(default)]
+    pub metrics: RuntimeMetrics,
+    #[serde(default)]
+    pub usage: RuntimeUsage,
+    /// Version of the remote settings in use. It is not stored, as
+    /// the remote settings are fetched again after a restart.
+    #[serde(skip)]
+    pub remote_settings: Option<String>,
     #[serde(skip)]
     path: PathBuf,
 }
@@ -29,9 +56,6 @@ impl RuntimeSettings {
     }
 
     pub fn load(mut self, path: &str) -> Result<Self> {
-        use std::fs::File;
-        use std::io::Read;
-
         let path = Path::new(path);
 
         if path.exists() {
@@ -40,9 +64,20 @@ impl RuntimeSettings {
                 path.to_string_lossy()
             );
 
-            let mut content = String::new();
-            File::open(path)?.read_to_string(&mut content)?;
-            self = RuntimeSettings::parse(&content)?;
+            self = match RuntimeSettings::read(path) {
+                Ok(settings) => settings,
+                // A newer schema is not a corruption to recover from
+                Err(ref e)
+                    if backup_path(path).exists() && e.downcast_ref::<SchemaError>().is_none() =>
+                {
+                    warn!(
+                        "Runtime settings are unreadable ({}), using the previous version",
+                        e
+                    );
+                    RuntimeSettings::read(&backup_path(path))?
+                }
+                Err(e) => return Err(e),
+            };
         } else {
             debug!(
                 "Runtime settings file {} does not exists.",
@@ -55,25 +90,100 @@ impl RuntimeSettings {
         Ok(self)
     }
 
+    fn read(path: &Path) -> Result<Self> {
+        let content = fs::read_to_string(path)?;
+        RuntimeSettings::parse(verified(path, &content)?)
+    }
+
     fn parse(content: &str) -> Result<Self> {
-        Ok(serde_ini::from_str::<RuntimeSettings>(content)?)
+        let content = schema::migrate("Runtime settings", content, SCHEMA_VERSION, MIGRATIONS)?;
+        Ok(serde_ini::from_str::<RuntimeSettings>(&content)?)
     }
 
+    /// Saves the runtime settings atomically, so a power cut leaves
+    /// either the previous or the new version, with the checksum of
+    /// the content. The previous version is kept aside to recover from
+    /// a corruption of the storage.
     pub fn save(&self) -> Result<usize> {
-        use std::fs::File;
-        use std::io::Write;
-
         debug!(
             "Saving runtime settings from '{}'...",
             &self.path.to_string_lossy()
         );
 
-        Ok(File::create(&self.path)?.write(self.serialize()?.as_bytes())?)
+        let body = self.serialize()?;
+        let content = format!(
+            "{}{}{}\n",
+            body,
+            CHECKSUM_PREFIX,
+            hex_digest(Algorithm::SHA256, body.as_bytes())
+        );
+
+        let new = PathBuf::from(format!("{}.new", self.path.display()));
+        let mut file = File::create(&new)?;
+        file.write_all(content.as_bytes())?;
+        file.sync_all()?;
+
+        if self.path.exists() {
+            let backup = backup_path(&self.path);
+            let _ = fs::remove_file(&backup);
+            fs::hard_link(&self.path, &backup)
+                .or_else(|_| fs::copy(&self.path, &backup).map(|_| ()))?;
+        }
+        fs::rename(&new, &self.path)?;
+        if let Some(dir) = self.path.parent().filter(|d| !d.as_os_str().is_empty()) {
+            File::open(dir)?.sync_all()?;
+        }
+
+        Ok(content.len())
     }
 
     fn serialize(&self) -> Result<String> {
-        Ok(serde_ini::to_string(&self)?)
+        Ok(schema::stamp(&serde_ini::to_string(&self)?, SCHEMA_VERSION))
+    }
+}
+
+/// Returns the file keeping the previous version of the runtime
+/// settings stored at `path`.
+fn backup_path(path: &Path) -> PathBuf {
+    PathBuf::from(format!("{}.previous", path.display()))
+}
+
+/// Returns the `content` of the runtime settings stored at `path`
+/// without its checksum, failing when it does not match. The content
+/// saved without a checksum, by previous versions, is taken as is,
+/// unless blank: a file which was truncated or zeroed is corrupted too.
+fn verified<'a>(path: &Path, content: &'a str) -> Result<&'a str> {
+    if content
+        .trim_matches(|c: char| c.is_whitespace() || c == '\0')
+        .is_empty()
+    {
+        return Err(RuntimeSettingsError::Corrupted(path.display().to_string()).into());
+    }
+
+    let pos = match content.rfind(CHECKSUM_PREFIX) {
+        Some(pos) => pos,
+        None => return Ok(content),
+    };
+
+    let (body, checksum) = (&content[..pos], &content[pos + CHECKSUM_PREFIX.len()..]);
+    if hex_digest(Algorithm::SHA256, body.as_bytes()) != checksum.trim() {
+        return Err(RuntimeSettingsError::Corrupted(path.display().to_string()).into());
     }
+
+    Ok(body)
+}
+
+/// Removes the runtime settings stored at `path`, along with their
+/// previous version.
+pub fn remove(path: &str) -> Result<()> {
+    let path = Path::new(path);
+    for file in &[path.to_path_buf(), backup_path(path)] {
+        if file.exists() {
+            fs::remove_file(file)?;
+        }
+    }
+
+    Ok(())
 }
 
 #[derive(Debug, Fail)]
@@ -87,6 +197,8 @@ pub enum RuntimeSettingsError {
     #[cause]
     #[fail(display = "Fail generating the INI file")]
     IniSerialize(serde_ini::ser::Error),
+    #[fail(display = "Runtime settings '{}' do not match their checksum", _0)]
+    Corrupted(String),
 }
 
 #[derive(Debug, Deserialize, PartialEq, Serialize)]
@@ -123,6 +235,27 @@ pub struct RuntimeUpdate {
     pub upgrading_to: i8,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub applied_package_uid: Option<String>,
+    /// Whether the downloaded objects are to be removed once the
+    /// device reaches the server after the reboot.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub pending_cleanup: bool,
+    /// Failed attempts to download `retried_object`.
+    #[serde(default)]
+    pub download_retries: usize,
+    /// Object whose download is being retried.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub retried_object: Option<String>,
+    /// Agent binary installed by the update, which is rolled back to
+    /// the previous one unless it reaches the server.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub pending_agent: Option<PathBuf>,
+    /// Starts of the pending agent binary so far.
+    #[serde(default)]
+    pub pending_agent_starts: usize,
 }
 
 impl Default for RuntimeUpdate {
@@ -130,10 +263,91 @@ impl Default for RuntimeUpdate {
         RuntimeUpdate {
             upgrading_to: -1,
             applied_package_uid: None,
+            pending_cleanup: false,
+            download_retries: 0,
+            retried_object: None,
+            pending_agent: None,
+            pending_agent_starts: 0,
         }
     }
 }
 
+#[derive(Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct RuntimeEnrollment {
+    /// Credential issued by the server when enrolling the device.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub device_token: Option<String>,
+}
+
+#[derive(Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct RuntimeRollout {
+    /// Whether the device was opted into the canary phase of the
+    /// rollouts, overriding its rollout group.
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub canary: bool,
+}
+
+/// Metrics of the last update, used to spot regressions of the
+/// package size or of the network and flash performance.
+#[derive(Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct RuntimeMetrics {
+    /// Bytes downloaded for the update.
+    pub download_size: u64,
+    pub download_duration_ms: u64,
+    pub install_duration_ms: u64,
+}
+
+impl RuntimeMetrics {
+    /// Returns the download speed, in bytes per second.
+    pub fn download_speed(&self) -> u64 {
+        if self.download_duration_ms == 0 {
+            return self.download_size;
+        }
+
+        self.download_size * 1000 / self.download_duration_ms
+    }
+}
+
+/// Data used by the agent in the current calendar month.
+#[derive(Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct RuntimeUsage {
+    /// Month the usage is counted for, as `2018-07`.
+    pub month: String,
+    pub sent: u64,
+    pub received: u64,
+}
+
+impl RuntimeUsage {
+    /// Adds the bytes `sent` and `received` to the usage of the month
+    /// of `now`, starting it over on a new month.
+    pub fn add(&mut self, now: DateTime<Utc>, (sent, received): (u64, u64)) {
+        let month = now.format("%Y-%m").to_string();
+        if self.month != month {
+            *self = RuntimeUsage {
+                month,
+                ..RuntimeUsage::default()
+            };
+        }
+
+        self.sent += sent;
+        self.received += received;
+    }
+
+    /// Returns the bytes used in the month of `now`.
+    pub fn used(&self, now: DateTime<Utc>) -> u64 {
+        if self.month != now.format("%Y-%m").to_string() {
+            return 0;
+        }
+
+        self.sent + self.received
+    }
+}
+
 #[test]
 fn de() {
     let ini = r"
@@ -156,6 +370,11 @@ UpgradeToInstallation=1
         update: RuntimeUpdate {
             upgrading_to: 1,
             applied_package_uid: None,
+            pending_cleanup: false,
+            download_retries: 0,
+            retried_object: None,
+            pending_agent: None,
+            pending_agent_starts: 0,
         },
         ..Default::default()
     };
@@ -183,7 +402,25 @@ fn default() {
         update: RuntimeUpdate {
             upgrading_to: -1,
             applied_package_uid: None,
+            pending_cleanup: false,
+            download_retries: 0,
+            retried_object: None,
+            pending_agent: None,
+            pending_agent_starts: 0,
+        },
+        enrollment: RuntimeEnrollment { device_token: None },
+        rollout: RuntimeRollout { canary: false },
+        metrics: RuntimeMetrics {
+            download_size: 0,
+            download_duration_ms: 0,
+            install_duration_ms: 0,
+        },
+        usage: RuntimeUsage {
+            month: String::new(),
+            sent: 0,
+            received: 0,
         },
+        remote_settings: None,
         path: PathBuf::new(),
     };
 
@@ -202,10 +439,30 @@ fn ser() {
         update: RuntimeUpdate {
             upgrading_to: 1,
             applied_package_uid: Some("package-uid".to_string()),
+            pending_cleanup: true,
+            download_retries: 2,
+            retried_object: Some("object".to_string()),
+            pending_agent: Some("/usr/bin/updatehub".into()),
+            pending_agent_starts: 1,
+        },
+        enrollment: RuntimeEnrollment {
+            device_token: Some("device-token".to_string()),
+        },
+        rollout: RuntimeRollout { canary: true },
+        metrics: RuntimeMetrics {
+            download_size: 2048,
+            download_duration_ms: 500,
+            install_duration_ms: 1500,
+        },
+        usage: RuntimeUsage {
+            month: "2017-01".to_string(),
+            sent: 1024,
+            received: 4096,
         },
         ..Default::default()
     };
 
+    assert_eq!(settings.metrics.download_speed(), 4096);
     assert_eq!(
         serde_ini::from_str(&settings.serialize().unwrap()).ok(),
         Some(settings)
@@ -239,3 +496,81 @@ fn load_and_save() {
 
     assert_eq!(settings.update, new_settings.update);
 }
+
+#[test]
+fn monthly_usage() {
+    let mut usage = RuntimeUsage::default();
+    let july = "2018-07-31T23:00:00Z".parse::<DateTime<Utc>>().unwrap();
+    let august = "2018-08-01T01:00:00Z".parse::<DateTime<Utc>>().unwrap();
+
+    usage.add(july, (100, 1000));
+    usage.add(july, (50, 500));
+    assert_eq!(usage.used(july), 1650);
+    assert_eq!(usage.used(august), 0);
+
+    usage.add(august, (10, 20));
+    assert_eq!(usage.month, "2018-08");
+    assert_eq!(usage.used(august), 30);
+}
+
+#[test]
+fn recover_previous_version() {
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let path = dir.path().join("runtime.conf");
+    let path = path.to_str().unwrap();
+
+    let mut settings = RuntimeSettings::new().load(path).unwrap();
+    settings.update.applied_package_uid = Some("first".into());
+    settings.save().unwrap();
+    settings.update.applied_package_uid = Some("second".into());
+    settings.save().unwrap();
+    assert!(!Path::new(&format!("{}.new", path)).exists());
+
+    let loaded = RuntimeSettings::new().load(path).unwrap();
+    assert_eq!(loaded.update.applied_package_uid, Some("second".into()));
+
+    // A power cut zeroed the file
+    let len = fs::metadata(path).unwrap().len() as usize;
+    fs::write(path, vec![0; len]).unwrap();
+    let loaded = RuntimeSettings::new().load(path).unwrap();
+    assert_eq!(loaded.update.applied_package_uid, Some("first".into()));
+
+    // Or truncated it, which would otherwise load as the defaults
+    for content in &["", " \n\n", "\0\0\n"] {
+        fs::write(path, content).unwrap();
+        let loaded = RuntimeSettings::new().load(path).unwrap();
+        assert_eq!(loaded.update.applied_package_uid, Some("first".into()));
+    }
+
+    // A change which still parses is caught by the checksum
+    let content = fs::read_to_string(backup_path(Path::new(path))).unwrap();
+    fs::write(path, content.replace("first", "third")).unwrap();
+    fs::remove_file(backup_path(Path::new(path))).unwrap();
+    assert!(RuntimeSettings::new().load(path).is_err());
+
+    // Files saved without a checksum are still loaded
+    fs::write(path, settings.serialize().unwrap()).unwrap();
+    assert!(RuntimeSettings::new().load(path).is_ok());
+}
+
+#[test]
+fn newer_schema() {
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let path = dir.path().join("runtime.conf");
+    let path = path.to_str().unwrap();
+
+    let settings = RuntimeSettings::new().load(path).unwrap();
+    settings.save().unwrap();
+    settings.save().unwrap();
+
+    // The previous version is not taken in place of a newer schema
+    let body = schema::stamp(&settings.serialize().unwrap(), SCHEMA_VERSION + 1);
+    let checksum = hex_digest(Algorithm::SHA256, body.as_bytes());
+    fs::write(path, format!("{}{}{}\n", body, CHECKSUM_PREFIX, checksum)).unwrap();
+    let e = RuntimeSettings::new().load(path).unwrap_err();
+    assert!(e.downcast_ref::<SchemaError>().is_some());
+}
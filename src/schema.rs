@@ -0,0 +1,153 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Schema versions of the settings files
+//!
+//! The system and runtime settings files start with their schema
+//! version, as `SchemaVersion=1`, files without one being of the first
+//! version. An older file is migrated on load, through the migration of
+//! each version to the next, so settings written by a previous release
+//! keep working. A newer file was written for a release which knows
+//! keys this one does not, and is refused with `SchemaError::Newer`
+//! rather than partially understood.
+
+use Result;
+
+/// Key, before the first section, holding the schema version.
+const VERSION_KEY: &str = "SchemaVersion";
+
+/// Converts the content of a settings file from a schema version to
+/// the next one.
+pub type Migration = fn(&str) -> String;
+
+#[derive(Debug, Fail)]
+pub enum SchemaError {
+    #[fail(
+        display = "{} are of schema version {}, newer than the version {} this agent supports",
+        _0, _1, _2
+    )]
+    Newer(String, u32, u32),
+    #[fail(display = "{} have an invalid schema version '{}'", _0, _1)]
+    Invalid(String, String),
+}
+
+/// Returns the schema version declared by `content`, if any.
+fn declared(content: &str) -> Option<&str> {
+    content
+        .lines()
+        .map(|l| l.trim())
+        .take_while(|l| !l.starts_with('['))
+        .filter_map(|l| {
+            let mut parts = l.splitn(2, '=');
+            match (parts.next(), parts.next()) {
+                (Some(key), Some(value)) if key.trim() == VERSION_KEY => Some(value.trim()),
+                _ => None,
+            }
+        }).next()
+}
+
+/// Returns the schema version of `content`, the settings `name`,
+/// failing when it is newer than `supported`.
+pub fn version(name: &str, content: &str, supported: u32) -> Result<u32> {
+    let version = match declared(content) {
+        Some(v) => v
+            .parse::<u32>()
+            .ok()
+            .filter(|&v| v > 0)
+            .ok_or_else(|| SchemaError::Invalid(name.to_string(), v.to_string()))?,
+        None => 1,
+    };
+
+    if version > supported {
+        return Err(SchemaError::Newer(name.to_string(), version, supported).into());
+    }
+
+    Ok(version)
+}
+
+/// Migrates `content`, the settings `name`, to the `supported` schema
+/// version, where `migrations[n]` converts from version `n + 1`.
+pub fn migrate(
+    name: &str,
+    content: &str,
+    supported: u32,
+    migrations: &[Migration],
+) -> Result<String> {
+    let version = version(name, content, supported)?;
+
+    let mut content = content.to_string();
+    for (from, migration) in migrations
+        .iter()
+        .enumerate()
+        .map(|(n, m)| (n as u32 + 1, m))
+        .skip_while(|&(from, _)| from < version)
+    {
+        info!(
+            "Migrating the {} from schema version {} to {}",
+            name,
+            from,
+            from + 1
+        );
+        content = migration(&content);
+    }
+
+    Ok(content)
+}
+
+/// Returns `content` declaring the schema `version`.
+pub fn stamp(content: &str, version: u32) -> String {
+    let body = content
+        .lines()
+        .filter(|l| l.splitn(2, '=').next().map(|k| k.trim()) != Some(VERSION_KEY))
+        .collect::<Vec<_>>()
+        .join("\n");
+
+    format!("{}={}\n\n{}\n", VERSION_KEY, version, body.trim_left())
+}
+
+#[test]
+fn versions() {
+    let ini = "[Polling]\nEnabled=true\n";
+    assert_eq!(version("settings", ini, 1).unwrap(), 1);
+
+    let stamped = stamp(ini, 2);
+    assert_eq!(stamped, "SchemaVersion=2\n\n[Polling]\nEnabled=true\n");
+    assert_eq!(stamp(&stamped, 2), stamped);
+    assert_eq!(version("settings", &stamped, 2).unwrap(), 2);
+    assert!(version("settings", &stamped, 1).is_err());
+    assert!(version("settings", "SchemaVersion=two\n", 1).is_err());
+    assert!(version("settings", "SchemaVersion=0\n", 1).is_err());
+
+    // Only the key before the sections is the version
+    assert_eq!(
+        version("settings", "[Polling]\nSchemaVersion=3\n", 1).unwrap(),
+        1
+    );
+}
+
+#[test]
+fn migrations() {
+    fn rename_interval(content: &str) -> String {
+        content.replace("Period=", "Interval=")
+    }
+    fn enable(content: &str) -> String {
+        content.replace("[Polling]\n", "[Polling]\nEnabled=true\n")
+    }
+    let migrations: &[Migration] = &[rename_interval, enable];
+
+    assert_eq!(
+        migrate("settings", "[Polling]\nPeriod=1h\n", 3, migrations).unwrap(),
+        "[Polling]\nEnabled=true\nInterval=1h\n"
+    );
+    assert_eq!(
+        migrate(
+            "settings",
+            "SchemaVersion=2\n[Polling]\nPeriod=1h\n",
+            3,
+            migrations
+        ).unwrap(),
+        "SchemaVersion=2\n[Polling]\nEnabled=true\nPeriod=1h\n"
+    );
+}
@@ -15,6 +15,20 @@ pub mod ser {
         Ok(serializer.serialize_str(if *v { "true" } else { "false" })?)
     }
 
+    pub fn duration_to_string<S>(v: &Duration, serializer: S) -> Result<S::Ok, S::Error>
+    where
+        S: Serializer,
+    {
+        serializer.serialize_str(&format!("{}s", v.num_seconds()))
+    }
+
+    pub fn vec_to_string<S>(v: &[String], serializer: S) -> Result<S::Ok, S::Error>
+    where
+        S: Serializer,
+    {
+        serializer.serialize_str(&v.join(","))
+    }
+
     pub fn duration_to_int<S>(v: &Option<Duration>, serializer: S) -> Result<S::Ok, S::Error>
     where
         S: Serializer,
@@ -34,9 +48,8 @@ pub mod de {
         use parse_duration::parse;
 
         let s = String::deserialize(deserializer)?;
-        // FIXME: We must deal with the error when converting from
-        // std::time::Duration to chrono::Duration.
-        Ok(Duration::from_std(parse(&s).map_err(de::Error::custom)?).unwrap())
+        Duration::from_std(parse(&s).map_err(de::Error::custom)?)
+            .map_err(|_| de::Error::custom(format!("duration '{}' is too long", s)))
     }
 
     pub fn duration_from_int<'de, D>(deserializer: D) -> Result<Option<Duration>, D::Error>
@@ -67,6 +80,7 @@ pub mod de {
     {
         Ok(String::deserialize(deserializer)?
             .split(',')
+            .filter(|s| !s.is_empty())
             .map(|s| s.to_string())
             .collect())
     }
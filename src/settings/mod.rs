@@ -0,0 +1,1047 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+use Result;
+
+use chrono::Duration;
+use reqwest::Url;
+use serde_ini;
+
+use std::io;
+use std::path::{Path, PathBuf};
+
+use memory;
+use schema::{self, Migration};
+use serde_helpers::{de, ser};
+
+mod overrides;
+mod paths;
+mod remote;
+mod validate;
+mod watch;
+pub use self::paths::check_paths;
+pub use self::validate::{validate, Issue};
+pub use self::watch::{reload, set_remote, watch};
+
+/// Default location of the system settings file.
+pub const SYSTEM_SETTINGS_PATH: &str = "/etc/updatehub.conf";
+
+/// Version of the settings schema, increased whenever the keys change
+/// incompatibly. It is reported to the server when probing.
+pub const SCHEMA_VERSION: u32 = 1;
+
+/// Migrations of the settings to each schema version after the first.
+const MIGRATIONS: &[Migration] = &[];
+
+/// Minimum polling interval, in seconds, unless short intervals are
+/// explicitly allowed for development.
+const MIN_POLLING_INTERVAL: i64 = 60;
+
+/// Polling interval, in days, above which a warning is issued.
+const MAX_SANE_POLLING_INTERVAL: i64 = 30;
+
+/// Largest settings accepted, along with their fragments and overrides,
+/// some of them being set by the server.
+const MAX_SETTINGS_SIZE: usize = 256 * 1024;
+
+#[cfg(not(test))]
+const SERVER_URL: &str = "https://api.updatehub.io";
+
+// When running inside a test environment we default to the mock
+// server
+#[cfg(test)]
+use mockito;
+#[cfg(test)]
+const SERVER_URL: &str = mockito::SERVER_URL;
+
+#[derive(Debug, Default, PartialEq, Deserialize, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct Settings {
+    pub polling: Polling,
+    pub storage: Storage,
+    pub update: Update,
+    pub network: Network,
+    pub firmware: Firmware,
+    #[serde(default)]
+    pub report: Report,
+    #[serde(skip)]
+    path: PathBuf,
+}
+
+impl Settings {
+    pub fn new() -> Self {
+        Settings::default()
+    }
+
+    /// Returns the file the settings were loaded from, empty when they
+    /// were not.
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Loads the settings from `path`, falling back to the current
+    /// values if it does not exist, and applies the fragments in the
+    /// `.d` directory next to it and the overrides set in the
+    /// environment and the kernel command line. The directories set up
+    /// by systemd are used for the paths `path` does not set.
+    pub fn load(self, path: &Path) -> Result<Self> {
+        use std::fs::File;
+        use std::io::Read;
+
+        let mut content = String::new();
+        if path.exists() {
+            info!(
+                "Loading system settings from '{}'...",
+                path.to_string_lossy()
+            );
+            File::open(path)?.read_to_string(&mut content)?;
+        } else {
+            debug!(
+                "System settings file {} does not exists.",
+                path.to_string_lossy()
+            );
+            info!("Using default system settings...");
+        }
+
+        let mut overrides = overrides::directories(&content);
+        overrides.extend(overrides::fragments(&path.with_extension("d"))?);
+        overrides.extend(overrides::system());
+
+        if !path.exists() {
+            if overrides.is_empty() {
+                return Ok(Settings {
+                    path: path.to_path_buf(),
+                    ..self
+                });
+            }
+            content = self.dump()?;
+        }
+
+        let settings = Settings::parse(&overrides::apply(&content, &overrides))?;
+        Ok(Settings {
+            path: path.to_path_buf(),
+            ..settings
+        })
+    }
+
+    /// Returns the settings in the INI format used by the settings
+    /// file.
+    pub fn dump(&self) -> Result<String> {
+        Ok(schema::stamp(&serde_ini::to_string(self)?, SCHEMA_VERSION))
+    }
+
+    /// Returns the warnings about suspicious, but valid, settings.
+    pub fn warnings(&self) -> Vec<String> {
+        let mut warnings = Vec::new();
+
+        if !self.polling.enabled {
+            warnings.push(
+                "Polling is disabled, so updates are not looked for automatically".to_string(),
+            );
+        }
+
+        if self.polling.interval < Duration::seconds(MIN_POLLING_INTERVAL) {
+            warnings.push(format!(
+                "Polling interval of {}s is meant for development only",
+                self.polling.interval.num_seconds()
+            ));
+        } else if self.polling.interval > Duration::days(MAX_SANE_POLLING_INTERVAL) {
+            warnings.push(format!(
+                "Polling interval of {} days delays updates considerably",
+                self.polling.interval.num_days()
+            ));
+        }
+
+        if !self.update.local_sources.is_empty() && self.update.local_sources_key.is_none() {
+            warnings.push(
+                "Local sources have no key to check their packages with, so they are ignored"
+                    .to_string(),
+            );
+        }
+
+        if self.network.server_address.starts_with("http://") {
+            warnings.push(format!(
+                "Server address {} does not use HTTPS",
+                self.network.server_address
+            ));
+        }
+
+        warnings
+    }
+
+    pub(crate) fn parse(content: &str) -> Result<Self> {
+        if content.len() > MAX_SETTINGS_SIZE {
+            return Err(SettingsError::TooLarge(content.len()).into());
+        }
+
+        let content = schema::migrate("System settings", content, SCHEMA_VERSION, MIGRATIONS)?;
+        let settings = serde_ini::from_str::<Settings>(&content)?;
+
+        let min_interval = if settings.polling.allow_short_interval {
+            Duration::seconds(1)
+        } else {
+            Duration::seconds(MIN_POLLING_INTERVAL)
+        };
+
+        if settings.polling.interval < min_interval {
+            error!(
+                "Invalid setting for polling interval. The interval cannot be less than {} seconds",
+                min_interval.num_seconds()
+            );
+            return Err(SettingsError::InvalidInterval.into());
+        }
+
+        if !&settings.network.server_address.starts_with("http://")
+            && !&settings.network.server_address.starts_with("https://")
+        {
+            error!("Invalid setting for server address. The server address must use the protocol prefix");
+            return Err(SettingsError::InvalidServerAddress.into());
+        }
+
+        // IPv6 addresses must be bracketed, as `http://[2001:db8::1]:8080`,
+        // to be told apart from the port
+        if Url::parse(&settings.network.server_address)
+            .ok()
+            .and_then(|u| u.host_str().map(|h| !h.is_empty()))
+            != Some(true)
+        {
+            error!(
+                "Invalid setting for server address. {} is not a valid URL",
+                settings.network.server_address
+            );
+            return Err(SettingsError::InvalidServerAddress.into());
+        }
+
+        if let Some(ref source) = settings.network.object_source {
+            if !source.starts_with("sftp://") {
+                error!("Invalid setting for object source. Only sftp:// URLs are supported");
+                return Err(SettingsError::InvalidObjectSource.into());
+            }
+        }
+
+        for warning in settings.warnings() {
+            warn!("{}", warning);
+        }
+
+        Ok(settings)
+    }
+}
+
+#[derive(Debug, Fail)]
+pub enum SettingsError {
+    #[cause]
+    #[fail(display = "IO error")]
+    Io(io::Error),
+    #[cause]
+    #[fail(display = "Invalid INI fail")]
+    Ini(serde_ini::de::Error),
+    #[fail(display = "Invalid interval")]
+    InvalidInterval,
+    #[fail(display = "Invalid server address")]
+    InvalidServerAddress,
+    #[fail(display = "Invalid object source")]
+    InvalidObjectSource,
+    #[fail(display = "Invalid line {} in settings fragment {:?}", _1, _0)]
+    InvalidFragment(PathBuf, usize),
+    #[fail(display = "The {} directory {} is not writable", _0, _1)]
+    NotWritable(String, String),
+    #[fail(display = "Settings of {} bytes are too large", _0)]
+    TooLarge(usize),
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct Polling {
+    #[serde(deserialize_with = "de::duration_from_str")]
+    #[serde(serialize_with = "ser::duration_to_string")]
+    pub interval: Duration,
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub enabled: bool,
+    /// Allows polling intervals shorter than a minute, which is only
+    /// meant for development.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub allow_short_interval: bool,
+    /// Probes right away on the first boot, instead of at a random
+    /// time within the polling interval.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub probe_on_first_boot: bool,
+    /// RTC wake alarm, as `/sys/class/rtc/rtc0/wakealarm`, programmed
+    /// for the next probe so a device powered down meanwhile wakes up
+    /// for it.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub wake_alarm: Option<PathBuf>,
+}
+
+impl Default for Polling {
+    fn default() -> Self {
+        Polling {
+            interval: Duration::days(1),
+            enabled: true,
+            allow_short_interval: false,
+            probe_on_first_boot: false,
+            wake_alarm: None,
+        }
+    }
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct Storage {
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub read_only: bool,
+    pub runtime_settings: String,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub audit_log: Option<PathBuf>,
+    /// File with the device secret the chain of the audit log is keyed
+    /// with.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub audit_log_key: Option<PathBuf>,
+    #[serde(default = "default_lock_file")]
+    pub lock_file: PathBuf,
+    /// Where the reason the agent stopped on is written.
+    #[serde(default = "default_crash_record")]
+    pub crash_record: PathBuf,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub factory_reset_script: Option<PathBuf>,
+    /// SHA256 of the only hooks allowed to run, in the `sha256sum`
+    /// format.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hook_manifest: Option<PathBuf>,
+}
+
+fn default_lock_file() -> PathBuf {
+    "/run/updatehub.lock".into()
+}
+
+fn default_crash_record() -> PathBuf {
+    "/var/lib/updatehub-crash.json".into()
+}
+
+impl Default for Storage {
+    fn default() -> Self {
+        Storage {
+            read_only: false,
+            runtime_settings: "/var/lib/updatehub.conf".into(),
+            audit_log: None,
+            audit_log_key: None,
+            lock_file: default_lock_file(),
+            crash_record: default_crash_record(),
+            factory_reset_script: None,
+            hook_manifest: None,
+        }
+    }
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct Update {
+    pub download_dir: PathBuf,
+    #[serde(rename = "SupportedInstallModes")]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub install_modes: Vec<String>,
+    /// Simulates the installation, writing the objects to a scratch
+    /// file and skipping the reboot.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub dry_run: bool,
+    /// Unmounts the mounted install targets, instead of refusing to
+    /// install onto them.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub unmount_targets: bool,
+    /// When the downloaded objects are removed.
+    #[serde(default)]
+    pub cleanup: Cleanup,
+    /// Days the objects are retained for, with the retain cleanup.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub retention_days: Option<u64>,
+    /// Size, in bytes, up to which objects are retained, with the
+    /// retain cleanup. The oldest ones are removed first.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub retention_max_size: Option<u64>,
+    /// Attempts to download the objects, after the first one, before
+    /// giving up the update until the next probe.
+    #[serde(default = "default_download_retries")]
+    pub download_retries: usize,
+    /// Mount points watched for update packages on removable media, as
+    /// `<mount point>/updatehub/metadata.json`.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub local_sources: Vec<String>,
+    /// Public key, in PEM, the packages of the local sources must be
+    /// signed with. They are all ignored without it.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub local_sources_key: Option<PathBuf>,
+    /// Memory, in bytes, the buffers of the update may use.
+    #[serde(default = "default_memory_limit")]
+    pub memory_limit: usize,
+    /// Memory, in bytes, each decompressor honoring a limit may use.
+    #[serde(default = "default_decompressor_memory_limit")]
+    pub decompressor_memory_limit: usize,
+    /// Where the objects are transformed before being installed, the
+    /// download directory when unset.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub temp_dir: Option<PathBuf>,
+    /// Executable called when entering and leaving each state, run
+    /// only when it exists.
+    #[serde(default = "default_state_change_callback")]
+    pub state_change_callback: PathBuf,
+    /// Memory, in bytes, each hook and install tool may use.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hook_memory_limit: Option<u64>,
+    /// Percentage of a CPU each hook and install tool may use.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hook_cpu_quota: Option<u64>,
+    /// Seconds after which a hook or install tool is killed, never
+    /// when set to 0.
+    #[serde(default = "default_hook_timeout")]
+    pub hook_timeout: u64,
+    /// Cgroup v2 directory, delegated to the agent, the cgroups of the
+    /// hooks and install tools are created in.
+    #[serde(default = "default_hook_cgroup")]
+    pub hook_cgroup: PathBuf,
+    /// Seconds after which the other external commands are stopped,
+    /// never when set to 0.
+    #[serde(default = "default_command_timeout")]
+    pub command_timeout: u64,
+}
+
+impl Update {
+    /// Returns the directory the objects are transformed in.
+    pub fn temp_dir(&self) -> &Path {
+        self.temp_dir.as_ref().unwrap_or(&self.download_dir)
+    }
+}
+
+fn default_download_retries() -> usize {
+    5
+}
+
+fn default_memory_limit() -> usize {
+    memory::DEFAULT_LIMIT
+}
+
+fn default_decompressor_memory_limit() -> usize {
+    memory::DEFAULT_DECOMPRESSOR_LIMIT
+}
+
+fn default_state_change_callback() -> PathBuf {
+    "/usr/share/updatehub/state-change-callback".into()
+}
+
+fn default_hook_cgroup() -> PathBuf {
+    "/sys/fs/cgroup/updatehub".into()
+}
+
+/// Long enough for an install tool writing a whole image to slow flash.
+fn default_hook_timeout() -> u64 {
+    1800
+}
+
+fn default_command_timeout() -> u64 {
+    300
+}
+
+/// When the downloaded objects are removed from the download directory.
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Cleanup {
+    /// Right after the install.
+    AfterInstall,
+    /// Once the device reaches the server after the reboot.
+    AfterReboot,
+    /// Kept according to the retention settings, forever when there
+    /// are none.
+    Retain,
+}
+
+impl Default for Cleanup {
+    fn default() -> Self {
+        Cleanup::Retain
+    }
+}
+
+impl Default for Update {
+    fn default() -> Self {
+        Update {
+            download_dir: "/tmp/updatehub".into(),
+            install_modes: [
+                "dry-run", "copy", "flash", "imxkobs", "raw", "tarball", "ubifs",
+            ]
+                .iter()
+                .map(|i| i.to_string())
+                .collect(),
+            dry_run: false,
+            unmount_targets: false,
+            cleanup: Cleanup::Retain,
+            retention_days: None,
+            retention_max_size: None,
+            download_retries: default_download_retries(),
+            local_sources: Vec::new(),
+            local_sources_key: None,
+            memory_limit: default_memory_limit(),
+            decompressor_memory_limit: default_decompressor_memory_limit(),
+            temp_dir: None,
+            state_change_callback: default_state_change_callback(),
+            hook_memory_limit: None,
+            hook_cpu_quota: None,
+            hook_timeout: default_hook_timeout(),
+            hook_cgroup: default_hook_cgroup(),
+            command_timeout: default_command_timeout(),
+        }
+    }
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct Network {
+    pub server_address: String,
+    /// Settings which the server is allowed to change, as
+    /// `<Section>/<Key>`.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub remote_settings: Vec<String>,
+    /// Token used to enroll the device on its first boot.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub provisioning_token: Option<String>,
+    /// Rollout group reported to the server when probing.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub rollout_group: Option<String>,
+    /// Server the objects are downloaded from instead, as
+    /// `sftp://<user>@<host>[:<port>]/<path>`.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub object_source: Option<String>,
+    /// Private key the device authenticates with on the object source.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub ssh_key: Option<PathBuf>,
+    /// Known host keys the key of the object source is checked
+    /// against, instead of the ones of the system.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub ssh_known_hosts: Option<PathBuf>,
+    /// Sends the hardware and firmware version in the User-Agent of
+    /// the requests, besides the agent version.
+    #[serde(default = "default_user_agent_details")]
+    #[serde(deserialize_with = "de::bool_from_str")]
+    #[serde(serialize_with = "ser::bool_to_string")]
+    pub user_agent_details: bool,
+    /// Headers sent on every request to the server, as
+    /// `<name>: <value>`, to tell device populations apart.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub context_headers: Vec<String>,
+    /// URL whose `Date` header sets the system clock when it is
+    /// invalid, as on devices without an RTC.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub time_source: Option<String>,
+    /// Interfaces whose connection is metered, as cellular links, when
+    /// they hold the default route.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub metered_interfaces: Vec<String>,
+    /// Size, in bytes, above which the objects of an update are only
+    /// downloaded over unmetered connections.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub metered_download_limit: Option<u64>,
+    /// Bytes the agent may use per calendar month. Downloads which
+    /// would exceed it are deferred to the next month.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub monthly_data_cap: Option<u64>,
+}
+
+fn default_user_agent_details() -> bool {
+    true
+}
+
+impl Default for Network {
+    fn default() -> Self {
+        Network {
+            server_address: SERVER_URL.into(),
+            remote_settings: Vec::new(),
+            provisioning_token: None,
+            rollout_group: None,
+            object_source: None,
+            ssh_key: None,
+            ssh_known_hosts: None,
+            user_agent_details: default_user_agent_details(),
+            context_headers: Vec::new(),
+            time_source: None,
+            metered_interfaces: Vec::new(),
+            metered_download_limit: None,
+            monthly_data_cap: None,
+        }
+    }
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct Firmware {
+    pub metadata_path: PathBuf,
+    #[serde(default)]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub redacted_keys: Vec<String>,
+}
+
+impl Default for Firmware {
+    fn default() -> Self {
+        Firmware {
+            metadata_path: "/usr/share/updatehub".into(),
+            redacted_keys: Vec::new(),
+        }
+    }
+}
+
+/// Sinks the update events are reported to.
+#[derive(Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct Report {
+    /// File the events are appended to, as JSON lines.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub file: Option<PathBuf>,
+    /// URL the events are posted to.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub webhook: Option<String>,
+    /// Headers of the webhook requests, as `<name>: <value>`.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub webhook_headers: Vec<String>,
+    /// Events the webhook is called on, every one when empty: the
+    /// state entered, as `download` once an update is available,
+    /// `install` or `reboot`, and `error`.
+    #[serde(default)]
+    #[serde(deserialize_with = "de::vec_from_str")]
+    #[serde(serialize_with = "ser::vec_to_string")]
+    pub webhook_events: Vec<String>,
+    /// Number of the last audit log entries attached to the error
+    /// events, none by default.
+    #[serde(default)]
+    pub audit_entries: usize,
+}
+
+#[test]
+fn ok() {
+    let ini = r"
+[Polling]
+Interval=60s
+Enabled=false
+ProbeOnFirstBoot=true
+WakeAlarm=/sys/class/rtc/rtc0/wakealarm
+
+[Storage]
+ReadOnly=true
+RuntimeSettings=/run/updatehub/state
+AuditLog=/run/updatehub/audit.log
+AuditLogKey=/etc/updatehub/audit.key
+LockFile=/run/updatehub/lock
+CrashRecord=/run/updatehub/crash.json
+FactoryResetScript=/usr/share/updatehub/wipe-data
+HookManifest=/usr/share/updatehub/hooks.sha256
+
+[Update]
+DownloadDir=/tmp/download
+SupportedInstallModes=mode1,mode2
+DryRun=true
+UnmountTargets=true
+Cleanup=retain
+RetentionDays=7
+RetentionMaxSize=104857600
+DownloadRetries=3
+LocalSources=/media/usb0,/media/usb1
+LocalSourcesKey=/etc/updatehub/local-sources.pem
+MemoryLimit=16777216
+DecompressorMemoryLimit=67108864
+TempDir=/var/tmp/updatehub
+StateChangeCallback=/usr/share/updatehub/callbacks/state-change
+HookMemoryLimit=8388608
+HookCpuQuota=50
+HookTimeout=600
+HookCgroup=/sys/fs/cgroup/system.slice/updatehub.service/hooks
+CommandTimeout=300
+
+[Network]
+ServerAddress=http://localhost
+RemoteSettings=Polling/Interval
+ProvisioningToken=s3cr3t
+RolloutGroup=lab
+ObjectSource=sftp://updates@artifacts.local/srv/updatehub
+SshKey=/etc/updatehub/id_ed25519
+SshKnownHosts=/etc/updatehub/known_hosts
+UserAgentDetails=false
+ContextHeaders=X-Fleet: lab
+TimeSource=http://time.local
+MeteredInterfaces=wwan0,ppp0
+MeteredDownloadLimit=1048576
+MonthlyDataCap=104857600
+
+[Firmware]
+MetadataPath=/tmp/metadata
+RedactedKeys=serial,customer
+
+[Report]
+File=/var/log/updatehub-events.log
+Webhook=http://localhost:8080/updatehub
+WebhookHeaders=X-Token: s3cr3t
+WebhookEvents=download,install,reboot,error
+AuditEntries=10
+";
+
+    let expected = Settings {
+        polling: Polling {
+            interval: Duration::seconds(60),
+            enabled: false,
+            allow_short_interval: false,
+            probe_on_first_boot: true,
+            wake_alarm: Some("/sys/class/rtc/rtc0/wakealarm".into()),
+        },
+        storage: Storage {
+            read_only: true,
+            runtime_settings: "/run/updatehub/state".into(),
+            audit_log: Some("/run/updatehub/audit.log".into()),
+            audit_log_key: Some("/etc/updatehub/audit.key".into()),
+            lock_file: "/run/updatehub/lock".into(),
+            crash_record: "/run/updatehub/crash.json".into(),
+            factory_reset_script: Some("/usr/share/updatehub/wipe-data".into()),
+            hook_manifest: Some("/usr/share/updatehub/hooks.sha256".into()),
+        },
+        update: Update {
+            download_dir: "/tmp/download".into(),
+            install_modes: ["mode1", "mode2"].iter().map(|i| i.to_string()).collect(),
+            dry_run: true,
+            unmount_targets: true,
+            cleanup: Cleanup::Retain,
+            retention_days: Some(7),
+            retention_max_size: Some(104857600),
+            download_retries: 3,
+            local_sources: vec!["/media/usb0".into(), "/media/usb1".into()],
+            local_sources_key: Some("/etc/updatehub/local-sources.pem".into()),
+            memory_limit: 16777216,
+            decompressor_memory_limit: 67108864,
+            temp_dir: Some("/var/tmp/updatehub".into()),
+            state_change_callback: "/usr/share/updatehub/callbacks/state-change".into(),
+            hook_memory_limit: Some(8388608),
+            hook_cpu_quota: Some(50),
+            hook_timeout: 600,
+            hook_cgroup: "/sys/fs/cgroup/system.slice/updatehub.service/hooks".into(),
+            command_timeout: 300,
+        },
+        network: Network {
+            server_address: "http://localhost".into(),
+            remote_settings: vec!["Polling/Interval".into()],
+            provisioning_token: Some("s3cr3t".into()),
+            rollout_group: Some("lab".into()),
+            object_source: Some("sftp://updates@artifacts.local/srv/updatehub".into()),
+            ssh_key: Some("/etc/updatehub/id_ed25519".into()),
+            ssh_known_hosts: Some("/etc/updatehub/known_hosts".into()),
+            user_agent_details: false,
+            context_headers: vec!["X-Fleet: lab".into()],
+            time_source: Some("http://time.local".into()),
+            metered_interfaces: vec!["wwan0".into(), "ppp0".into()],
+            metered_download_limit: Some(1048576),
+            monthly_data_cap: Some(104857600),
+        },
+        firmware: Firmware {
+            metadata_path: "/tmp/metadata".into(),
+            redacted_keys: vec!["serial".into(), "customer".into()],
+        },
+        report: Report {
+            file: Some("/var/log/updatehub-events.log".into()),
+            webhook: Some("http://localhost:8080/updatehub".into()),
+            webhook_headers: vec!["X-Token: s3cr3t".into()],
+            webhook_events: ["download", "install", "reboot", "error"]
+                .iter()
+                .map(|e| e.to_string())
+                .collect(),
+            audit_entries: 10,
+        },
+        path: PathBuf::new(),
+    };
+
+    assert_eq!(
+        serde_ini::from_str::<Settings>(ini)
+            .map_err(|e| println!("{}", e))
+            .ok(),
+        Some(expected)
+    );
+}
+
+#[test]
+fn invalid_polling_interval() {
+    let ini = r"
+[Polling]
+Interval=59s
+Enabled=false
+
+[Storage]
+ReadOnly=true
+RuntimeSettings=/run/updatehub/state
+
+[Update]
+DownloadDir=/tmp/download
+SupportedInstallModes=mode1,mode2
+
+[Network]
+ServerAddress=http://localhost
+
+[Firmware]
+MetadataPath=/tmp/metadata
+";
+    assert!(Settings::parse(ini).is_err());
+}
+
+#[test]
+fn invalid_network_server_address() {
+    let ini = r"
+[Polling]
+Interval=60s
+Enabled=false
+
+[Storage]
+ReadOnly=true
+RuntimeSettings=/run/updatehub/state
+
+[Update]
+DownloadDir=/tmp/download
+SupportedInstallModes=mode1,mode2
+
+[Network]
+ServerAddress=localhost
+
+[Firmware]
+MetadataPath=/tmp/metadata
+";
+    assert!(Settings::parse(ini).is_err());
+}
+
+#[test]
+fn ipv6_server_address() {
+    let ini = |address| {
+        format!(
+            r"
+[Polling]
+Interval=60s
+Enabled=false
+
+[Storage]
+ReadOnly=true
+RuntimeSettings=/run/updatehub/state
+
+[Update]
+DownloadDir=/tmp/download
+SupportedInstallModes=mode1,mode2
+
+[Network]
+ServerAddress={}
+
+[Firmware]
+MetadataPath=/tmp/metadata
+",
+            address
+        )
+    };
+
+    let settings = Settings::parse(&ini("https://[2001:db8::1]:8443")).unwrap();
+    assert_eq!(
+        settings.network.server_address,
+        "https://[2001:db8::1]:8443"
+    );
+    assert!(Settings::parse(&ini("https://[::1]")).is_ok());
+    assert!(Settings::parse(&ini("https://2001:db8::1")).is_err());
+    assert!(Settings::parse(&ini("https://[2001:db8::1")).is_err());
+}
+
+#[test]
+fn short_polling_interval() {
+    let ini = r"
+[Polling]
+Interval=30s
+Enabled=true
+AllowShortInterval=true
+
+[Storage]
+ReadOnly=false
+RuntimeSettings=/run/updatehub/state
+
+[Update]
+DownloadDir=/tmp/download
+SupportedInstallModes=mode1,mode2
+
+[Network]
+ServerAddress=https://localhost
+
+[Firmware]
+MetadataPath=/tmp/metadata
+";
+    let settings = Settings::parse(ini).unwrap();
+    assert_eq!(settings.polling.interval, Duration::seconds(30));
+    assert_eq!(settings.warnings().len(), 1);
+
+    assert!(Settings::parse(&ini.replace("Interval=30s", "Interval=0s")).is_err());
+    assert!(Settings::parse(&ini.replace("AllowShortInterval=true", "")).is_err());
+}
+
+#[test]
+fn warnings() {
+    let mut settings = Settings::default();
+    settings.network.server_address = "https://localhost".into();
+    assert!(settings.warnings().is_empty());
+
+    settings.polling.enabled = false;
+    settings.polling.interval = Duration::days(90);
+    settings.network.server_address = "http://localhost".into();
+    assert_eq!(settings.warnings().len(), 3);
+
+    settings.update.local_sources = vec!["/media/usb0".into()];
+    assert_eq!(settings.warnings().len(), 4);
+    settings.update.local_sources_key = Some("/etc/updatehub/local-sources.pem".into());
+    assert_eq!(settings.warnings().len(), 3);
+}
+
+#[test]
+fn default() {
+    let settings = Settings::new();
+    let expected = Settings {
+        polling: Polling {
+            interval: Duration::days(1),
+            enabled: true,
+            allow_short_interval: false,
+            probe_on_first_boot: false,
+            wake_alarm: None,
+        },
+        storage: Storage {
+            read_only: false,
+            runtime_settings: "/var/lib/updatehub.conf".into(),
+            audit_log: None,
+            audit_log_key: None,
+            lock_file: "/run/updatehub.lock".into(),
+            crash_record: "/var/lib/updatehub-crash.json".into(),
+            factory_reset_script: None,
+            hook_manifest: None,
+        },
+        update: Update {
+            download_dir: "/tmp/updatehub".into(),
+            install_modes: [
+                "dry-run", "copy", "flash", "imxkobs", "raw", "tarball", "ubifs",
+            ]
+                .iter()
+                .map(|i| i.to_string())
+                .collect(),
+            dry_run: false,
+            unmount_targets: false,
+            cleanup: Cleanup::Retain,
+            retention_days: None,
+            retention_max_size: None,
+            download_retries: 5,
+            local_sources: Vec::new(),
+            local_sources_key: None,
+            memory_limit: 33554432,
+            decompressor_memory_limit: 134217728,
+            temp_dir: None,
+            state_change_callback: "/usr/share/updatehub/state-change-callback".into(),
+            hook_memory_limit: None,
+            hook_cpu_quota: None,
+            hook_timeout: 1800,
+            hook_cgroup: "/sys/fs/cgroup/updatehub".into(),
+            command_timeout: 300,
+        },
+        network: Network {
+            server_address: SERVER_URL.into(),
+            remote_settings: Vec::new(),
+            provisioning_token: None,
+            rollout_group: None,
+            object_source: None,
+            ssh_key: None,
+            ssh_known_hosts: None,
+            user_agent_details: true,
+            context_headers: Vec::new(),
+            time_source: None,
+            metered_interfaces: Vec::new(),
+            metered_download_limit: None,
+            monthly_data_cap: None,
+        },
+        firmware: Firmware {
+            metadata_path: "/usr/share/updatehub".into(),
+            redacted_keys: Vec::new(),
+        },
+        report: Report {
+            file: None,
+            webhook: None,
+            webhook_headers: Vec::new(),
+            webhook_events: Vec::new(),
+            audit_entries: 0,
+        },
+        path: PathBuf::new(),
+    };
+
+    assert_eq!(Some(settings), Some(expected));
+}
+
+#[test]
+fn schema_version() {
+    use schema::SchemaError;
+
+    let settings = Settings::default();
+    let dump = settings.dump().unwrap();
+    assert!(dump.starts_with(&format!("SchemaVersion={}\n", SCHEMA_VERSION)));
+    assert_eq!(Settings::parse(&dump).unwrap(), settings);
+
+    let newer = dump.replacen(
+        &format!("SchemaVersion={}", SCHEMA_VERSION),
+        &format!("SchemaVersion={}", SCHEMA_VERSION + 1),
+        1,
+    );
+    let e = Settings::parse(&newer).unwrap_err();
+    match e.downcast::<SchemaError>() {
+        Ok(SchemaError::Newer(..)) => {}
+        e => panic!("Unexpected result: {:?}", e),
+    }
+}
+
+#[test]
+fn disabled_timeouts() {
+    let mut settings = Settings::default();
+    settings.update.hook_timeout = 0;
+    settings.update.command_timeout = 0;
+
+    // Disabled is dumped as such, not as the default
+    let dump = settings.dump().unwrap();
+    assert!(dump.contains("HookTimeout=0\n"));
+    assert!(dump.contains("CommandTimeout=0\n"));
+    assert_eq!(Settings::parse(&dump).unwrap(), settings);
+}
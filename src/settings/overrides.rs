@@ -0,0 +1,414 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Settings overrides from drop-in fragments, the environment and the
+//! kernel command line
+//!
+//! Allows reconfiguring the agent without editing the settings file.
+//! Fragments in `<settings>.d/*.conf` let different layers own
+//! separate pieces of the configuration, while the environment and the
+//! kernel command line cover recovery environments with a read-only
+//! rootfs or containerized tests.
+//!
+//! The fragments are merged over the settings file in the lexical
+//! order of their names, the kernel command line overrides them and
+//! the environment overrides all of them.
+//!
+//! The directories systemd sets up for the service, given as
+//! `STATE_DIRECTORY` and `CACHE_DIRECTORY`, hold the runtime settings,
+//! the crash record and the downloads unless the settings file places
+//! them elsewhere.
+
+use Result;
+
+use std::fs;
+use std::path::Path;
+
+use super::SettingsError;
+
+const KERNEL_CMDLINE: &str = "/proc/cmdline";
+const CMDLINE_PREFIX: &str = "updatehub.";
+
+/// Settings which can be overridden, as (section, key, environment
+/// variable, kernel command line parameter).
+const OVERRIDES: &[(&str, &str, &str, &str)] = &[
+    (
+        "Polling",
+        "Interval",
+        "UPDATEHUB_POLLING_INTERVAL",
+        "polling_interval",
+    ),
+    ("Polling", "Enabled", "UPDATEHUB_POLLING_ENABLED", "polling"),
+    ("Storage", "ReadOnly", "UPDATEHUB_READ_ONLY", "read_only"),
+    (
+        "Storage",
+        "RuntimeSettings",
+        "UPDATEHUB_RUNTIME_SETTINGS",
+        "runtime_settings",
+    ),
+    (
+        "Update",
+        "DownloadDir",
+        "UPDATEHUB_DOWNLOAD_DIR",
+        "download_dir",
+    ),
+    (
+        "Network",
+        "ServerAddress",
+        "UPDATEHUB_SERVER_ADDRESS",
+        "server",
+    ),
+    ("Update", "TempDir", "UPDATEHUB_TEMP_DIR", "temp_dir"),
+    (
+        "Firmware",
+        "MetadataPath",
+        "UPDATEHUB_METADATA_PATH",
+        "metadata_path",
+    ),
+];
+
+/// Settings placed in the directories set up by systemd, as (section,
+/// key, environment variable, path in the directory).
+const DIRECTORIES: &[(&str, &str, &str, &str)] = &[
+    (
+        "Storage",
+        "RuntimeSettings",
+        "STATE_DIRECTORY",
+        "runtime-settings.conf",
+    ),
+    ("Storage", "CrashRecord", "STATE_DIRECTORY", "crash.json"),
+    ("Update", "DownloadDir", "CACHE_DIRECTORY", ""),
+];
+
+/// Value to be used in place of the one of the settings file.
+#[derive(Debug, PartialEq)]
+pub(super) struct Override {
+    pub section: String,
+    pub key: String,
+    pub value: String,
+    pub source: String,
+}
+
+/// Returns the overrides set in the environment and in the kernel
+/// command line of the running system.
+pub(super) fn system() -> Vec<Override> {
+    let cmdline = fs::read_to_string(KERNEL_CMDLINE).unwrap_or_default();
+    collect(::std::env::vars(), &cmdline)
+}
+
+/// Returns the settings placed in the directories systemd set up for
+/// the service which are not set in `content`.
+pub(super) fn directories(content: &str) -> Vec<Override> {
+    directories_from(::std::env::vars(), content)
+}
+
+fn directories_from<I>(vars: I, content: &str) -> Vec<Override>
+where
+    I: IntoIterator<Item = (String, String)>,
+{
+    let vars = vars.into_iter().collect::<Vec<_>>();
+    let mut overrides = Vec::new();
+
+    for &(section, key, var, path) in DIRECTORIES {
+        if is_set(content, section, key) {
+            continue;
+        }
+
+        // Several directories are separated by colons, the first one
+        // being the service's own
+        let dir = vars
+            .iter()
+            .find(|(k, _)| k == var)
+            .and_then(|(_, v)| v.split(':').next())
+            .filter(|d| !d.is_empty());
+        if let Some(dir) = dir {
+            let value = match path {
+                "" => dir.to_string(),
+                _ => Path::new(dir).join(path).to_string_lossy().into_owned(),
+            };
+            overrides.push(Override {
+                section: section.to_string(),
+                key: key.to_string(),
+                value,
+                source: format!("environment variable {}", var),
+            });
+        }
+    }
+
+    overrides
+}
+
+/// Returns whether `key` is set in the `section` of `content`.
+fn is_set(content: &str, section: &str, key: &str) -> bool {
+    let header = format!("[{}]", section);
+    content
+        .lines()
+        .map(|l| l.trim())
+        .skip_while(|l| *l != header)
+        .skip(1)
+        .take_while(|l| !l.starts_with('['))
+        .any(|l| l.splitn(2, '=').next().map(|k| k.trim()) == Some(key))
+}
+
+fn collect<I>(vars: I, cmdline: &str) -> Vec<Override>
+where
+    I: IntoIterator<Item = (String, String)>,
+{
+    let vars = vars.into_iter().collect::<Vec<_>>();
+    let mut overrides = Vec::new();
+
+    for &(section, key, var, param) in OVERRIDES {
+        let from_env = vars
+            .iter()
+            .find(|(k, _)| k == var)
+            .map(|(_, v)| (v.to_string(), format!("environment variable {}", var)));
+
+        let param = format!("{}{}", CMDLINE_PREFIX, param);
+        let from_cmdline = cmdline
+            .split_whitespace()
+            .filter_map(|arg| {
+                let mut parts = arg.splitn(2, '=');
+                match (parts.next(), parts.next()) {
+                    (Some(name), Some(value)) if name == param => {
+                        Some((value.to_string(), format!("kernel parameter {}", name)))
+                    }
+                    _ => None,
+                }
+            }).last();
+
+        if let Some((value, source)) = from_env.or(from_cmdline) {
+            overrides.push(Override {
+                section: section.to_string(),
+                key: key.to_string(),
+                value,
+                source,
+            });
+        }
+    }
+
+    overrides
+}
+
+/// Returns the settings set by the fragments in `dir`, in the order
+/// they must be applied.
+pub(super) fn fragments(dir: &Path) -> Result<Vec<Override>> {
+    let mut overrides = Vec::new();
+
+    if !dir.is_dir() {
+        return Ok(overrides);
+    }
+
+    let mut paths = fs::read_dir(dir)?
+        .map(|e| e.map(|e| e.path()))
+        .collect::<::std::io::Result<Vec<_>>>()?;
+    paths.retain(|p| p.extension().map_or(false, |e| e == "conf"));
+    paths.sort();
+
+    for path in paths {
+        let mut section = None;
+
+        for (n, line) in fs::read_to_string(&path)?.lines().enumerate() {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with(';') || line.starts_with('#') {
+                continue;
+            }
+
+            if line.starts_with('[') && line.ends_with(']') {
+                section = Some(line[1..line.len() - 1].to_string());
+                continue;
+            }
+
+            let invalid = || SettingsError::InvalidFragment(path.clone(), n + 1);
+            let section = section.clone().ok_or_else(invalid)?;
+            let i = line.find('=').ok_or_else(invalid)?;
+
+            overrides.push(Override {
+                section,
+                key: line[..i].trim().to_string(),
+                value: line[i + 1..].trim().to_string(),
+                source: format!("fragment {}", path.to_string_lossy()),
+            });
+        }
+    }
+
+    Ok(overrides)
+}
+
+/// Returns the `content` of a settings file with the `overrides`
+/// applied, adding the keys and sections which are missing.
+pub(super) fn apply(content: &str, overrides: &[Override]) -> String {
+    let mut lines = content.lines().map(|l| l.to_string()).collect::<Vec<_>>();
+
+    for o in overrides {
+        info!("Overriding {}/{} from {}", o.section, o.key, o.source);
+
+        let entry = format!("{}={}", o.key, o.value);
+        let header = format!("[{}]", o.section);
+        let start = match lines.iter().position(|l| l.trim() == header) {
+            Some(i) => i + 1,
+            None => {
+                lines.push(String::new());
+                lines.push(header);
+                lines.push(entry);
+                continue;
+            }
+        };
+
+        let end = lines[start..]
+            .iter()
+            .position(|l| l.trim().starts_with('['))
+            .map(|i| start + i)
+            .unwrap_or(lines.len());
+
+        match lines[start..end]
+            .iter()
+            .position(|l| l.splitn(2, '=').next().map(|k| k.trim()) == Some(o.key.as_str()))
+        {
+            Some(i) => lines[start + i] = entry,
+            None => lines.insert(start, entry),
+        }
+    }
+
+    let mut content = lines.join("\n");
+    content.push('\n');
+    content
+}
+
+#[test]
+fn collect_sources() {
+    let vars = vec![
+        (
+            "UPDATEHUB_SERVER_ADDRESS".to_string(),
+            "http://env".to_string(),
+        ),
+        ("HOME".to_string(), "/root".to_string()),
+    ];
+    let cmdline = "console=ttyS0 updatehub.server=http://cmdline updatehub.polling=false quiet";
+
+    assert_eq!(
+        collect(vars, cmdline)
+            .iter()
+            .map(|o| (o.key.as_str(), o.value.as_str()))
+            .collect::<Vec<_>>(),
+        [("Enabled", "false"), ("ServerAddress", "http://env")]
+    );
+}
+
+#[test]
+fn systemd_directories() {
+    let vars = vec![
+        (
+            "STATE_DIRECTORY".to_string(),
+            "/var/lib/updatehub:/var/lib/other".to_string(),
+        ),
+        (
+            "CACHE_DIRECTORY".to_string(),
+            "/var/cache/updatehub".to_string(),
+        ),
+    ];
+    let ini = "[Storage]\nCrashRecord=/data/crash.json\n\n[Update]\nTempDir=/tmp\n";
+
+    assert_eq!(
+        directories_from(vars.clone(), ini)
+            .iter()
+            .map(|o| (o.key.as_str(), o.value.as_str()))
+            .collect::<Vec<_>>(),
+        [
+            (
+                "RuntimeSettings",
+                "/var/lib/updatehub/runtime-settings.conf"
+            ),
+            ("DownloadDir", "/var/cache/updatehub"),
+        ]
+    );
+    assert!(directories_from(vec![], ini).is_empty());
+    assert!(is_set(ini, "Update", "TempDir"));
+    assert!(!is_set(ini, "Storage", "TempDir"));
+}
+
+#[test]
+fn apply_overrides() {
+    let ini = r"
+[Polling]
+Interval=60s
+Enabled=true
+
+[Network]
+ServerAddress=http://localhost
+";
+
+    let overrides = vec![
+        Override {
+            section: "Polling".into(),
+            key: "Enabled".into(),
+            value: "false".into(),
+            source: "test".into(),
+        },
+        Override {
+            section: "Network".into(),
+            key: "ServerAddress".into(),
+            value: "http://override".into(),
+            source: "test".into(),
+        },
+        Override {
+            section: "Firmware".into(),
+            key: "MetadataPath".into(),
+            value: "/tmp/metadata".into(),
+            source: "test".into(),
+        },
+    ];
+
+    assert_eq!(
+        apply(ini, &overrides),
+        r"
+[Polling]
+Interval=60s
+Enabled=false
+
+[Network]
+ServerAddress=http://override
+
+[Firmware]
+MetadataPath=/tmp/metadata
+"
+    );
+}
+
+#[test]
+fn fragments_order() {
+    use tempfile::tempdir;
+
+    let tmpdir = tempdir().unwrap();
+    let dir = tmpdir.path();
+    fs::write(
+        dir.join("20-server.conf"),
+        "[Network]\nServerAddress=http://last\n",
+    ).unwrap();
+    fs::write(
+        dir.join("10-server.conf"),
+        "; Set by the BSP layer\n[Network]\nServerAddress=http://first\n\n[Polling]\nEnabled=false\n",
+    ).unwrap();
+    fs::write(
+        dir.join("30-ignored.conf.orig"),
+        "[Polling]\nEnabled=true\n",
+    ).unwrap();
+
+    let overrides = fragments(dir).unwrap();
+    assert_eq!(
+        overrides
+            .iter()
+            .map(|o| (o.key.as_str(), o.value.as_str()))
+            .collect::<Vec<_>>(),
+        [
+            ("ServerAddress", "http://first"),
+            ("Enabled", "false"),
+            ("ServerAddress", "http://last"),
+        ]
+    );
+    assert!(apply("", &overrides).contains("ServerAddress=http://last"));
+
+    fs::write(dir.join("40-invalid.conf"), "Enabled=false\n").unwrap();
+    assert!(fragments(dir).is_err());
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Startup checks of the writable paths
+//!
+//! On a read-only rootfs every path the agent writes to has to be moved
+//! to a writable filesystem, and a forgotten one only shows up when it
+//! is first written to, late in an update. The directories are checked
+//! when the agent starts instead: one which is not writable fails the
+//! startup, and one holding state on volatile storage, which is lost on
+//! reboot, is warned about.
+
+use Result;
+
+use libc;
+
+use std::env;
+use std::ffi::CString;
+#[cfg(target_os = "linux")]
+use std::mem;
+use std::os::unix::ffi::OsStrExt;
+use std::path::{Path, PathBuf};
+
+use super::{Settings, SettingsError};
+
+/// Filesystems kept in memory only.
+#[cfg(target_os = "linux")]
+const VOLATILE_FILESYSTEMS: &[u32] = &[
+    0x0102_1994, // tmpfs
+    0x8584_58f6, // ramfs
+];
+
+/// Returns the directories written to by the agent, as (name,
+/// directory, whether it must survive reboots).
+fn writable_paths(settings: &Settings) -> Vec<(&'static str, PathBuf, bool)> {
+    let mut paths = Vec::new();
+    if !settings.storage.read_only {
+        paths.push((
+            "runtime settings",
+            parent_of(Path::new(&settings.storage.runtime_settings)),
+            true,
+        ));
+    }
+    paths.push((
+        "crash record",
+        parent_of(&settings.storage.crash_record),
+        true,
+    ));
+    paths.push(("download", absolute(&settings.update.download_dir), false));
+    paths.push(("temporary", absolute(settings.update.temp_dir()), false));
+    if let Some(ref log) = settings.storage.audit_log {
+        paths.push(("audit log", parent_of(log), true));
+    }
+    if let Some(ref log) = settings.report.file {
+        paths.push(("event log", parent_of(log), true));
+    }
+
+    paths
+}
+
+/// Resolves a relative path against the working directory, as it is
+/// opened by the agent.
+fn absolute(path: &Path) -> PathBuf {
+    if path.is_absolute() {
+        return path.to_path_buf();
+    }
+
+    match env::current_dir() {
+        Ok(dir) => dir.join(path),
+        Err(_) => path.to_path_buf(),
+    }
+}
+
+fn parent_of(path: &Path) -> PathBuf {
+    let path = absolute(path);
+    path.parent()
+        .map(Path::to_path_buf)
+        .unwrap_or_else(|| PathBuf::from("/"))
+}
+
+/// Returns the closest existing ancestor of `dir`, where it is to be
+/// created.
+fn existing(dir: &Path) -> &Path {
+    dir.ancestors()
+        .find(|d| d.exists())
+        .unwrap_or_else(|| Path::new("/"))
+}
+
+fn is_writable(dir: &Path) -> bool {
+    let dir = existing(dir);
+    if !dir.is_dir() {
+        return false;
+    }
+
+    match CString::new(dir.as_os_str().as_bytes()) {
+        Ok(path) => unsafe { libc::access(path.as_ptr(), libc::W_OK) == 0 },
+        Err(_) => false,
+    }
+}
+
+#[cfg(target_os = "linux")]
+fn is_volatile(dir: &Path) -> bool {
+    let path = match CString::new(existing(dir).as_os_str().as_bytes()) {
+        Ok(path) => path,
+        Err(_) => return false,
+    };
+
+    let mut stat: libc::statfs = unsafe { mem::zeroed() };
+    if unsafe { libc::statfs(path.as_ptr(), &mut stat) } != 0 {
+        return false;
+    }
+
+    VOLATILE_FILESYSTEMS.contains(&(stat.f_type as u32))
+}
+
+/// Filesystems are only told apart on Linux.
+#[cfg(not(target_os = "linux"))]
+fn is_volatile(_: &Path) -> bool {
+    false
+}
+
+/// Checks the directories the agent writes to are writable, returning
+/// the warnings about the ones which are not persistent.
+pub fn check_paths(settings: &Settings) -> Result<Vec<String>> {
+    let mut warnings = Vec::new();
+
+    for (name, dir, persistent) in writable_paths(settings) {
+        if !is_writable(&dir) {
+            return Err(
+                SettingsError::NotWritable(name.to_string(), dir.display().to_string()).into(),
+            );
+        }
+
+        if persistent && is_volatile(&dir) {
+            warnings.push(format!(
+                "The {} directory {} is on volatile storage, so it is lost on reboot",
+                name,
+                dir.display()
+            ));
+        }
+    }
+
+    Ok(warnings)
+}
+
+#[test]
+fn writable() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let mut settings = Settings::default();
+    settings.storage.runtime_settings = dir
+        .path()
+        .join("state/runtime.conf")
+        .to_string_lossy()
+        .into();
+    settings.storage.crash_record = dir.path().join("crash.json");
+    settings.update.download_dir = dir.path().join("download");
+    assert!(check_paths(&settings).is_ok());
+
+    // A file in the way of a directory to be created
+    let file = dir.path().join("file");
+    fs::write(&file, "").unwrap();
+    settings.update.temp_dir = Some(file.join("temp"));
+    assert!(check_paths(&settings).is_err());
+
+    // A bare file name is in the working directory, not at the root
+    assert_eq!(
+        parent_of(Path::new("crash.json")),
+        env::current_dir().unwrap()
+    );
+}
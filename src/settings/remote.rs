@@ -0,0 +1,97 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Settings managed by the server
+//!
+//! The server can send new values for the settings, identified as
+//! `<Section>/<Key>`, which are only applied when listed in the local
+//! `Network/RemoteSettings` allow-list. `Log/Level` is also accepted to
+//! change the log level of the agent, lowering or raising it, as the
+//! agent's logger passes every record the maximum level lets through.
+
+use Result;
+
+use log::LevelFilter;
+
+use std::collections::BTreeMap;
+
+use super::overrides::{self, Override};
+use super::Settings;
+
+const LOG_LEVEL: &str = "Log/Level";
+
+impl Settings {
+    /// Returns the settings with the `remote` values allowed by the
+    /// allow-list applied. Nothing is applied if any of them is
+    /// invalid.
+    pub fn apply_remote(&self, remote: &BTreeMap<String, String>) -> Result<Settings> {
+        let mut changes = Vec::new();
+        let mut log_level = None;
+
+        for (name, value) in remote {
+            if !self.network.remote_settings.iter().any(|s| s == name) {
+                warn!("Ignoring remote setting {}, as it is not allowed", name);
+                continue;
+            }
+
+            if name == LOG_LEVEL {
+                log_level = Some(
+                    value
+                        .parse::<LevelFilter>()
+                        .map_err(|_| format_err!("Invalid remote log level: {}", value))?,
+                );
+                continue;
+            }
+
+            let mut parts = name.splitn(2, '/');
+            match (parts.next(), parts.next()) {
+                (Some(section), Some(key)) => changes.push(Override {
+                    section: section.to_string(),
+                    key: key.to_string(),
+                    value: value.to_string(),
+                    source: "server".to_string(),
+                }),
+                _ => bail!("Invalid remote setting name: {}", name),
+            }
+        }
+
+        let settings = Settings::parse(&overrides::apply(&self.dump()?, &changes))?;
+
+        if let Some(level) = log_level {
+            info!("Using log level {} as set by the server", level);
+            ::log::set_max_level(level);
+        }
+
+        Ok(settings)
+    }
+}
+
+#[test]
+fn allow_list() {
+    use chrono::Duration;
+
+    let mut settings = Settings::default();
+    settings.network.remote_settings = vec!["Polling/Interval".into()];
+
+    let mut remote = BTreeMap::new();
+    remote.insert("Polling/Interval".to_string(), "2h".to_string());
+    remote.insert("Network/ServerAddress".to_string(), "http://evil".to_string());
+
+    let new = settings.apply_remote(&remote).unwrap();
+    assert_eq!(new.polling.interval, Duration::hours(2));
+    assert_eq!(new.network.server_address, settings.network.server_address);
+}
+
+#[test]
+fn invalid_remote_value() {
+    let mut settings = Settings::default();
+    settings.network.remote_settings = vec!["Polling/Interval".into(), "Polling/Enabled".into()];
+
+    let mut remote = BTreeMap::new();
+    remote.insert("Polling/Enabled".to_string(), "false".to_string());
+    remote.insert("Polling/Interval".to_string(), "1s".to_string());
+
+    assert!(settings.apply_remote(&remote).is_err());
+}
@@ -0,0 +1,320 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+use std::fmt;
+use std::str::FromStr;
+
+use parse_duration::parse;
+
+use super::{Settings, SettingsError};
+
+#[derive(Clone, Copy)]
+enum Kind {
+    Bool,
+    Duration,
+    Text,
+}
+
+/// Known sections and keys of the system settings file.
+const SCHEMA: &[(&str, &[(&str, Kind)])] = &[
+    (
+        "Polling",
+        &[
+            ("Interval", Kind::Duration),
+            ("Enabled", Kind::Bool),
+            ("AllowShortInterval", Kind::Bool),
+            ("ProbeOnFirstBoot", Kind::Bool),
+            ("WakeAlarm", Kind::Text),
+        ],
+    ),
+    (
+        "Storage",
+        &[
+            ("ReadOnly", Kind::Bool),
+            ("RuntimeSettings", Kind::Text),
+            ("AuditLog", Kind::Text),
+            ("AuditLogKey", Kind::Text),
+            ("LockFile", Kind::Text),
+            ("CrashRecord", Kind::Text),
+            ("FactoryResetScript", Kind::Text),
+            ("HookManifest", Kind::Text),
+        ],
+    ),
+    (
+        "Update",
+        &[
+            ("DownloadDir", Kind::Text),
+            ("SupportedInstallModes", Kind::Text),
+            ("DryRun", Kind::Bool),
+            ("UnmountTargets", Kind::Bool),
+            ("Cleanup", Kind::Text),
+            ("RetentionDays", Kind::Text),
+            ("RetentionMaxSize", Kind::Text),
+            ("DownloadRetries", Kind::Text),
+            ("LocalSources", Kind::Text),
+            ("LocalSourcesKey", Kind::Text),
+            ("MemoryLimit", Kind::Text),
+            ("DecompressorMemoryLimit", Kind::Text),
+            ("TempDir", Kind::Text),
+            ("StateChangeCallback", Kind::Text),
+            ("HookMemoryLimit", Kind::Text),
+            ("HookCpuQuota", Kind::Text),
+            ("HookTimeout", Kind::Text),
+            ("HookCgroup", Kind::Text),
+            ("CommandTimeout", Kind::Text),
+        ],
+    ),
+    (
+        "Network",
+        &[
+            ("ServerAddress", Kind::Text),
+            ("RemoteSettings", Kind::Text),
+            ("ProvisioningToken", Kind::Text),
+            ("RolloutGroup", Kind::Text),
+            ("ObjectSource", Kind::Text),
+            ("SshKey", Kind::Text),
+            ("SshKnownHosts", Kind::Text),
+            ("UserAgentDetails", Kind::Bool),
+            ("ContextHeaders", Kind::Text),
+            ("TimeSource", Kind::Text),
+            ("MeteredInterfaces", Kind::Text),
+            ("MeteredDownloadLimit", Kind::Text),
+            ("MonthlyDataCap", Kind::Text),
+        ],
+    ),
+    (
+        "Firmware",
+        &[("MetadataPath", Kind::Text), ("RedactedKeys", Kind::Text)],
+    ),
+    (
+        "Report",
+        &[
+            ("File", Kind::Text),
+            ("Webhook", Kind::Text),
+            ("WebhookHeaders", Kind::Text),
+            ("WebhookEvents", Kind::Text),
+            ("AuditEntries", Kind::Text),
+        ],
+    ),
+];
+
+/// Problem found in a settings file.
+#[derive(Debug, PartialEq)]
+pub struct Issue {
+    /// Line, starting from 1, where the problem has been found, if it
+    /// can be tracked to a single line.
+    pub line: Option<usize>,
+
+    /// Description of the problem.
+    pub message: String,
+}
+
+impl fmt::Display for Issue {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self.line {
+            Some(line) => write!(f, "line {}: {}", line, self.message),
+            None => write!(f, "{}", self.message),
+        }
+    }
+}
+
+/// Validates the content of a system settings file, returning every
+/// problem found. An empty list means the settings are valid.
+pub fn validate(content: &str) -> Vec<Issue> {
+    let mut issues = Vec::new();
+    let mut section = None;
+
+    for (n, line) in content.lines().enumerate().map(|(n, l)| (n + 1, l.trim())) {
+        let issue = |message: String| Issue {
+            line: Some(n),
+            message,
+        };
+
+        if line.is_empty() || line.starts_with(';') || line.starts_with('#') {
+            continue;
+        }
+
+        if line.starts_with('[') && line.ends_with(']') {
+            let name = &line[1..line.len() - 1];
+            section = SCHEMA.iter().find(|(s, _)| *s == name);
+            if section.is_none() {
+                issues.push(issue(format!("unknown section '{}'", name)));
+            }
+            continue;
+        }
+
+        let (key, value) = match line.find('=') {
+            Some(i) => (line[..i].trim(), line[i + 1..].trim()),
+            None => {
+                issues.push(issue(format!(
+                    "expected '[Section]' or 'Key=Value', found '{}'",
+                    line
+                )));
+                continue;
+            }
+        };
+
+        let (name, keys) = match section {
+            Some(s) => s,
+            // Keys of unknown sections were already reported with the
+            // section itself.
+            None => continue,
+        };
+
+        match keys.iter().find(|(k, _)| *k == key) {
+            None => issues.push(issue(format!(
+                "unknown key '{}' in section '{}'",
+                key, name
+            ))),
+            Some((_, Kind::Bool)) => {
+                if bool::from_str(value).is_err() {
+                    issues.push(issue(format!(
+                        "'{}' must be 'true' or 'false', found '{}'",
+                        key, value
+                    )));
+                }
+            }
+            Some((_, Kind::Duration)) => {
+                if let Err(e) = parse(value) {
+                    issues.push(issue(format!("'{}' is not a valid duration: {}", key, e)));
+                }
+            }
+            Some((_, Kind::Text)) => {}
+        }
+    }
+
+    // Only check the values as a whole when every line is valid, as
+    // otherwise the errors would be duplicated.
+    if issues.is_empty() {
+        if let Err(e) = Settings::parse(content) {
+            let line = match e.downcast_ref::<SettingsError>() {
+                Some(SettingsError::InvalidInterval) => line_of(content, "Polling", "Interval"),
+                Some(SettingsError::InvalidServerAddress) => {
+                    line_of(content, "Network", "ServerAddress")
+                }
+                Some(SettingsError::InvalidObjectSource) => {
+                    line_of(content, "Network", "ObjectSource")
+                }
+                _ => None,
+            };
+
+            issues.push(Issue {
+                line,
+                message: e.to_string(),
+            });
+        }
+    }
+
+    issues
+}
+
+fn line_of(content: &str, section: &str, key: &str) -> Option<usize> {
+    let mut current = "";
+
+    for (n, line) in content.lines().enumerate().map(|(n, l)| (n + 1, l.trim())) {
+        if line.starts_with('[') && line.ends_with(']') {
+            current = &line[1..line.len() - 1];
+        } else if current == section && line.splitn(2, '=').next().map(|k| k.trim()) == Some(key) {
+            return Some(n);
+        }
+    }
+
+    None
+}
+
+#[test]
+fn valid() {
+    let ini = r"
+[Polling]
+Interval=60s
+Enabled=false
+
+[Storage]
+ReadOnly=true
+RuntimeSettings=/run/updatehub/state
+
+[Update]
+DownloadDir=/tmp/download
+SupportedInstallModes=mode1,mode2
+
+[Network]
+ServerAddress=http://localhost
+
+[Firmware]
+MetadataPath=/tmp/metadata
+";
+
+    assert_eq!(validate(ini), vec![]);
+}
+
+#[test]
+fn invalid_lines() {
+    let ini = r"
+[Polling]
+Interval=forever
+Enabled=maybe
+Unknown=1
+
+[Unknown]
+Key=Value
+
+[Storage]
+ReadOnly
+";
+
+    assert_eq!(
+        validate(ini)
+            .iter()
+            .map(|i| i.line.unwrap())
+            .collect::<Vec<_>>(),
+        [3, 4, 5, 7, 11]
+    );
+}
+
+#[test]
+fn invalid_value() {
+    let ini = r"
+[Polling]
+Interval=59s
+Enabled=false
+
+[Storage]
+ReadOnly=true
+RuntimeSettings=/run/updatehub/state
+
+[Update]
+DownloadDir=/tmp/download
+SupportedInstallModes=mode1,mode2
+
+[Network]
+ServerAddress=http://localhost
+
+[Firmware]
+MetadataPath=/tmp/metadata
+";
+
+    let issues = validate(ini);
+    assert_eq!(issues.len(), 1);
+    assert_eq!(issues[0].line, Some(3));
+}
+
+#[test]
+fn schema_covers_settings() {
+    let mut settings = Settings::default();
+    settings.storage.audit_log = Some("/tmp/audit.log".into());
+    settings.storage.audit_log_key = Some("/tmp/audit.key".into());
+    settings.network.provisioning_token = Some("token".into());
+
+    let dump = settings.dump().unwrap();
+    assert_eq!(
+        validate(&dump)
+            .iter()
+            .filter(|i| i.message.starts_with("unknown"))
+            .count(),
+        0,
+        "Settings schema is missing keys of:\n{}",
+        dump
+    );
+}
@@ -0,0 +1,295 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Live reload of the system settings
+//!
+//! The directory holding the settings file, and its fragments one, is
+//! watched with inotify, as editors usually replace the file instead of
+//! writing to it. When they change, the settings which are safe to
+//! change at runtime are applied on the next state change and the
+//! others are reported as requiring a restart of the agent. The values
+//! last set by the server are applied again over the changed file, so a
+//! local change leaves them in place. Other systems than Linux, where
+//! the agent only runs for development, compare the modification times
+//! instead.
+
+use Result;
+
+#[cfg(target_os = "linux")]
+use libc;
+
+#[cfg(not(target_os = "linux"))]
+use std::cell::Cell;
+use std::collections::BTreeMap;
+#[cfg(target_os = "linux")]
+use std::ffi::CString;
+#[cfg(target_os = "linux")]
+use std::io;
+#[cfg(target_os = "linux")]
+use std::os::unix::ffi::OsStrExt;
+#[cfg(target_os = "linux")]
+use std::os::unix::io::RawFd;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+#[cfg(not(target_os = "linux"))]
+use std::time::SystemTime;
+
+use super::Settings;
+
+lazy_static! {
+    static ref WATCHER: Mutex<Option<Watcher>> = Mutex::new(None);
+    static ref REMOTE: Mutex<BTreeMap<String, String>> = Mutex::new(BTreeMap::new());
+}
+
+/// Watcher of changes to a settings file.
+#[cfg(target_os = "linux")]
+pub struct Watcher {
+    path: PathBuf,
+    fd: RawFd,
+}
+
+#[cfg(target_os = "linux")]
+impl Watcher {
+    pub fn new(path: &Path) -> Result<Watcher> {
+        let dir = match path.parent() {
+            Some(p) if !p.as_os_str().is_empty() => p,
+            _ => Path::new("."),
+        };
+        let dir = CString::new(dir.as_os_str().as_bytes())?;
+        let fragments = CString::new(path.with_extension("d").as_os_str().as_bytes())?;
+
+        let fd = unsafe { libc::inotify_init1(libc::IN_NONBLOCK | libc::IN_CLOEXEC) };
+        if fd < 0 {
+            return Err(io::Error::last_os_error().into());
+        }
+
+        // Closes the file descriptor on errors
+        let watcher = Watcher {
+            path: path.to_path_buf(),
+            fd,
+        };
+
+        let mask = libc::IN_CLOSE_WRITE | libc::IN_MOVED_TO | libc::IN_CREATE | libc::IN_DELETE;
+        if unsafe { libc::inotify_add_watch(fd, dir.as_ptr(), mask) } < 0 {
+            return Err(io::Error::last_os_error().into());
+        }
+
+        // The fragments directory is optional, so failing to watch it
+        // is fine.
+        unsafe { libc::inotify_add_watch(fd, fragments.as_ptr(), mask) };
+
+        Ok(watcher)
+    }
+
+    /// Returns whether the settings file may have changed since the
+    /// last call.
+    pub fn changed(&self) -> bool {
+        let mut buf = [0u8; 4096];
+        let buf_ptr = buf.as_mut_ptr() as *mut libc::c_void;
+        let mut changed = false;
+
+        // Drain all the pending events, the other files of the
+        // directory are filtered by comparing the settings later.
+        while unsafe { libc::read(self.fd, buf_ptr, buf.len()) } > 0 {
+            changed = true;
+        }
+
+        changed
+    }
+}
+
+#[cfg(target_os = "linux")]
+impl Drop for Watcher {
+    fn drop(&mut self) {
+        unsafe { libc::close(self.fd) };
+    }
+}
+
+/// Watcher of changes to a settings file.
+#[cfg(not(target_os = "linux"))]
+pub struct Watcher {
+    path: PathBuf,
+    modified: Cell<Option<SystemTime>>,
+}
+
+#[cfg(not(target_os = "linux"))]
+impl Watcher {
+    pub fn new(path: &Path) -> Result<Watcher> {
+        let watcher = Watcher {
+            path: path.to_path_buf(),
+            modified: Cell::new(None),
+        };
+        watcher.modified.set(watcher.last_modified());
+
+        Ok(watcher)
+    }
+
+    /// Returns the last time the settings file or its fragments
+    /// directory were modified.
+    fn last_modified(&self) -> Option<SystemTime> {
+        [self.path.clone(), self.path.with_extension("d")]
+            .iter()
+            .filter_map(|p| p.metadata().and_then(|m| m.modified()).ok())
+            .max()
+    }
+
+    /// Returns whether the settings file may have changed since the
+    /// last call.
+    pub fn changed(&self) -> bool {
+        let modified = self.last_modified();
+        modified != self.modified.replace(modified)
+    }
+}
+
+/// Starts watching the settings file in `path` for changes, which are
+/// then applied by `reload`.
+pub fn watch(path: &Path) -> Result<()> {
+    *WATCHER.lock().unwrap() = Some(Watcher::new(path)?);
+    debug!("Watching '{}' for changes", path.to_string_lossy());
+    Ok(())
+}
+
+/// Keeps the `remote` values applied by the server, so they are
+/// applied again over a changed settings file.
+pub fn set_remote(remote: &BTreeMap<String, String>) {
+    *REMOTE.lock().unwrap() = remote.clone();
+}
+
+/// Applies the changes made to the watched settings file since the
+/// last call.
+pub fn reload(settings: &mut Settings) {
+    let path = match *WATCHER.lock().unwrap() {
+        Some(ref w) if w.changed() => w.path.clone(),
+        _ => return,
+    };
+
+    match load(&path, &REMOTE.lock().unwrap()) {
+        Ok(new) => {
+            for section in apply(settings, new) {
+                warn!(
+                    "Changes to the {} settings will be used after restarting the agent",
+                    section
+                );
+            }
+        }
+        Err(e) => error!("Ignoring the changed settings, as they are invalid: {}", e),
+    }
+}
+
+/// Loads the settings file in `path`, with the `remote` values of the
+/// server applied over it.
+fn load(path: &Path, remote: &BTreeMap<String, String>) -> Result<Settings> {
+    let settings = Settings::new().load(path)?;
+    if remote.is_empty() {
+        return Ok(settings);
+    }
+
+    settings.apply_remote(remote)
+}
+
+/// Applies the settings which are safe to change at runtime from
+/// `new` into `current`, returning the sections with changes which
+/// require a restart.
+fn apply(current: &mut Settings, new: Settings) -> Vec<&'static str> {
+    let mut restart = Vec::new();
+
+    if current.polling != new.polling {
+        info!(
+            "Using new polling settings (interval: {}s, enabled: {})",
+            new.polling.interval.num_seconds(),
+            new.polling.enabled
+        );
+        current.polling = new.polling;
+    }
+
+    if current.network != new.network {
+        info!("Using new server address: {}", new.network.server_address);
+        current.network = new.network;
+    }
+
+    if current.storage != new.storage {
+        restart.push("Storage");
+    }
+
+    if current.update != new.update {
+        restart.push("Update");
+    }
+
+    if current.firmware != new.firmware {
+        restart.push("Firmware");
+    }
+
+    // The reporters are subscribed once, when the agent starts
+    if current.report != new.report {
+        restart.push("Report");
+    }
+
+    restart
+}
+
+#[test]
+fn scoping() {
+    use chrono::Duration;
+
+    let mut current = Settings::default();
+    let mut new = Settings::default();
+    new.polling.interval = Duration::hours(1);
+    new.network.server_address = "http://localhost".into();
+    new.update.download_dir = "/tmp/other".into();
+
+    assert_eq!(apply(&mut current, new), ["Update"]);
+    assert_eq!(current.polling.interval, Duration::hours(1));
+    assert_eq!(current.network.server_address, "http://localhost");
+    assert_eq!(current.update, Settings::default().update);
+
+    let mut new = Settings::default();
+    new.report.webhook_events = vec!["error".into()];
+    assert_eq!(apply(&mut current, new), ["Report"]);
+    assert_eq!(current.report, Settings::default().report);
+}
+
+#[test]
+fn remote_layer() {
+    use chrono::Duration;
+    use std::fs;
+    use tempfile::tempdir;
+
+    let tmpdir = tempdir().unwrap();
+    let path = tmpdir.path().join("updatehub.conf");
+    let mut local = Settings::default();
+    local.polling.interval = Duration::hours(1);
+    local.polling.enabled = false;
+    local.network.remote_settings = vec!["Polling/Interval".into()];
+    fs::write(&path, local.dump().unwrap()).unwrap();
+
+    let mut remote = BTreeMap::new();
+    remote.insert("Polling/Interval".to_string(), "2h".to_string());
+    let settings = load(&path, &remote).unwrap();
+    assert_eq!(settings.polling.interval, Duration::hours(2));
+    assert!(!settings.polling.enabled);
+
+    // Once out of the allow-list the file value is used
+    local.network.remote_settings = Vec::new();
+    fs::write(&path, local.dump().unwrap()).unwrap();
+    let settings = load(&path, &remote).unwrap();
+    assert_eq!(settings.polling.interval, Duration::hours(1));
+}
+
+#[test]
+fn watcher() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let tmpdir = tempdir().unwrap();
+    let path = tmpdir.path().join("updatehub.conf");
+    fs::write(&path, "").unwrap();
+
+    let watcher = Watcher::new(&path).unwrap();
+    assert!(!watcher.changed());
+
+    fs::write(&path, "[Polling]\nEnabled=false\n").unwrap();
+    assert!(watcher.changed());
+    assert!(!watcher.changed());
+}
@@ -5,11 +5,20 @@
 
 use Result;
 
-use client::Api;
-use states::{Idle, Install, State, StateChangeImpl, StateMachine};
+use cancel;
+use cleanup;
+use client::source;
+use clock;
+use fault;
+use health;
+use metered;
+use progress::{Phase, Progress};
+use states::{backoff, Idle, Install, State, StateChangeImpl, StateMachine};
 use std::fs;
-use update_package::{ObjectStatus, UpdatePackage};
-use walkdir::WalkDir;
+use std::io::Write;
+use std::time::Instant;
+use update_package::{space, ObjectStatus, UpdatePackage};
+use usage;
 
 #[derive(Debug, PartialEq)]
 pub struct Download {
@@ -20,71 +29,212 @@ create_state_step!(Download => Idle);
 create_state_step!(Download => Install(update_package));
 
 impl StateChangeImpl for State<Download> {
-    fn handle(self) -> Result<StateMachine> {
+    fn handle(mut self) -> Result<StateMachine> {
         // Prune left over from previous installations
-        for entry in WalkDir::new(&self.settings.update.download_dir)
-            .follow_links(true)
-            .min_depth(1)
-            .into_iter()
-            .filter_entry(|e| e.file_type().is_file())
-            .filter_map(|e| e.ok())
-            .filter(|e| {
-                !self
-                    .state
-                    .update_package
-                    .objects()
-                    .iter()
-                    .map(|o| o.sha256sum())
-                    .collect::<Vec<_>>()
-                    .contains(&e.file_name().to_str().unwrap_or(""))
-            }) {
-            fs::remove_file(entry.path())?;
-        }
+        let objects = self
+            .state
+            .update_package
+            .objects()
+            .iter()
+            .map(|o| o.sha256sum())
+            .collect::<Vec<_>>();
+        cleanup::prune(&self.settings.update, &objects)?;
 
-        // Prune corrupted files
-        for object in self
+        // Prune corrupted files, and download them again along with the
+        // missing or incomplete objects
+        let mut objects = Vec::new();
+        for (object, status) in self
             .state
             .update_package
-            .filter_objects(&self.settings, &ObjectStatus::Corrupted)
+            .objects_status(&self.settings.update.download_dir)
         {
-            fs::remove_file(&self.settings.update.download_dir.join(object.sha256sum()))?;
+            match status {
+                ObjectStatus::Ready => continue,
+                ObjectStatus::Corrupted => {
+                    fs::remove_file(&self.settings.update.download_dir.join(object.sha256sum()))?
+                }
+                ObjectStatus::Missing | ObjectStatus::Incomplete => {}
+            }
+            objects.push((object.sha256sum().to_string(), object.len()));
         }
 
-        // Download the missing or incomplete objects
-        for object in self
-            .state
-            .update_package
-            .filter_objects(&self.settings, &ObjectStatus::Missing)
-            .into_iter()
-            .chain(
-                self.state
-                    .update_package
-                    .filter_objects(&self.settings, &ObjectStatus::Incomplete),
-            ) {
-            Api::new(&self.settings, &self.runtime_settings, &self.firmware)
-                .download_object(&self.state.update_package.package_uid(), object.sha256sum())?;
+        let total = objects.iter().map(|o| o.1).sum();
+        self.check_space();
+        if let Some(reason) = self.deferral(total) {
+            info!("Deferring the download of {} bytes {}", total, reason);
+            return Ok(StateMachine::Idle(self.into()));
         }
 
-        if self
-            .state
+        let start = Instant::now();
+        let mut size = 0;
+        let mut progress = Progress::new(Phase::Download, total);
+        for (sha256sum, len) in objects {
+            let file = self.settings.update.download_dir.join(&sha256sum);
+            let downloaded = file.metadata().map(|m| m.len()).unwrap_or(0);
+            progress.start_object(&sha256sum, len, downloaded);
+            size += len.saturating_sub(downloaded);
+
+            if !self.download_object(&sha256sum, &mut progress)? {
+                debug!("Moving to Idle state as the download failed.");
+                return Ok(StateMachine::Idle(self.into()));
+            }
+        }
+        let elapsed = start.elapsed();
+
+        if fault::armed(fault::SHA_MISMATCH).is_some() {
+            for object in self.state.update_package.objects() {
+                let file = self.settings.update.download_dir.join(object.sha256sum());
+                fs::OpenOptions::new()
+                    .append(true)
+                    .open(file)?
+                    .write_all(b"corrupted")?;
+            }
+        }
+
+        let metrics = &mut self.runtime_settings.metrics;
+        metrics.download_size = size;
+        metrics.download_duration_ms =
+            elapsed.as_secs() * 1000 + u64::from(elapsed.subsec_millis());
+        if size > 0 {
+            info!(
+                "Downloaded {} bytes in {}ms ({} bytes/s)",
+                size,
+                metrics.download_duration_ms,
+                metrics.download_speed()
+            );
+        }
+
+        self.runtime_settings.usage.add(clock::now(), usage::take());
+        self.state
             .update_package
-            .objects()
-            .iter()
-            .all(|o| o.status(&self.settings.update.download_dir).ok() == Some(ObjectStatus::Ready))
-        {
-            Ok(StateMachine::Install(self.into()))
-        } else {
-            bail!("Not all objects are ready for use")
+            .ensure_objects_ready(&self.settings.update.download_dir)?;
+
+        Ok(StateMachine::Install(self.into()))
+    }
+}
+
+impl State<Download> {
+    /// Warns when the update is not expected to fit in the space left
+    /// for the downloads, which is then likely to run out.
+    fn check_space(&self) {
+        let download_dir = &self.settings.update.download_dir;
+        match space::forecast(&self.state.update_package, download_dir) {
+            Ok(ref f) if !f.fits() => warn!(
+                "Update needs {} bytes and {} inodes, but only {} bytes and {} inodes are left",
+                f.required.bytes, f.required.inodes, f.available.bytes, f.available.inodes
+            ),
+            Ok(_) => {}
+            Err(e) => warn!("Failed to forecast the space of the update: {}", e),
+        }
+    }
+
+    /// Returns why downloading `size` bytes must wait, if it must: for
+    /// an unmetered network, or for the next month when it would exceed
+    /// the data cap.
+    fn deferral(&mut self, size: u64) -> Option<&'static str> {
+        let network = &self.settings.network;
+        if metered::defers_download(network, metered::is_metered(network), size) {
+            return Some("until the device is on an unmetered network");
+        }
+
+        let now = clock::now();
+        self.runtime_settings.usage.add(now, usage::take());
+        match network.monthly_data_cap {
+            Some(cap) if self.runtime_settings.usage.used(now) + size > cap => {
+                Some("to the next month, as it exceeds the data cap")
+            }
+            _ => None,
+        }
+    }
+
+    /// Downloads the object `sha256sum`, retrying with an increasing
+    /// delay when it fails. It returns whether the object has been
+    /// downloaded before running out of retries, in which case the
+    /// update is given up until the next probe.
+    ///
+    /// The retries are counted for each object, and kept across
+    /// restarts of the agent until the object is downloaded or given
+    /// up.
+    fn download_object(&mut self, sha256sum: &str, progress: &mut Progress) -> Result<bool> {
+        let package_uid = self.state.update_package.package_uid();
+
+        // The retries kept for another object, as when the agent was
+        // stopped while retrying it, do not count for this one
+        let update = &mut self.runtime_settings.update;
+        if update.retried_object.as_ref().map(String::as_str) != Some(sha256sum) {
+            update.retried_object = None;
+            update.download_retries = 0;
+        }
+
+        loop {
+            let result =
+                source::from_settings(&self.settings, &self.runtime_settings, &self.firmware)
+                    .and_then(|s| s.download_object(&package_uid, sha256sum, progress));
+            let e = match result {
+                Ok(()) => {
+                    self.reset_download_retries();
+                    return Ok(true);
+                }
+                Err(e) => e,
+            };
+            cancel::check()?;
+
+            let retries = self.runtime_settings.update.download_retries + 1;
+            self.runtime_settings.update.download_retries = retries;
+            self.runtime_settings.update.retried_object = Some(sha256sum.to_string());
+
+            let max_retries = self.settings.update.download_retries;
+            if retries > max_retries {
+                error!(
+                    "Giving up the download after {} retries: {}",
+                    max_retries, e
+                );
+                self.reset_download_retries();
+                return Ok(false);
+            }
+            self.save_download_retries();
+
+            warn!(
+                "Failed to download the object {} (retry {} of {}): {}",
+                sha256sum, retries, max_retries, e
+            );
+            health::beat("waiting to retry the download");
+            clock::sleep(backoff(retries));
+        }
+    }
+
+    /// Clears the retries of the object, which was downloaded or given
+    /// up, so the next one, or the next attempt, gets them all.
+    fn reset_download_retries(&mut self) {
+        let update = &mut self.runtime_settings.update;
+        if update.download_retries == 0 && update.retried_object.is_none() {
+            return;
+        }
+
+        update.download_retries = 0;
+        update.retried_object = None;
+        self.save_download_retries();
+    }
+
+    fn save_download_retries(&self) {
+        if self.settings.storage.read_only {
+            return;
+        }
+
+        if let Err(e) = self.runtime_settings.save() {
+            error!("Failed to save the download retries: {}", e);
         }
     }
 }
 
 #[test]
+#[cfg(feature = "mode-test")]
 fn skip_download_if_ready() {
     use super::*;
     use firmware::tests::{create_fake_metadata, FakeDevice};
     use std::fs::create_dir_all;
     use update_package::tests::{create_fake_object, create_fake_settings, get_update_package};
+    use walkdir::WalkDir;
 
     let settings = create_fake_settings();
     let tmpdir = settings.update.download_dir.clone();
@@ -115,23 +265,27 @@ fn skip_download_if_ready() {
 }
 
 #[test]
+#[cfg(feature = "mode-test")]
 fn download_objects() {
     use super::*;
     use crypto_hash::{hex_digest, Algorithm};
     use firmware::tests::{create_fake_metadata, FakeDevice};
     use mockito::mock;
+    use settings::Cleanup;
     use std::fs::create_dir_all;
     use std::fs::File;
     use std::io::Read;
     use update_package::tests::{create_fake_settings, get_update_package};
+    use walkdir::WalkDir;
 
-    let settings = create_fake_settings();
+    let mut settings = create_fake_settings();
+    settings.update.cleanup = Cleanup::AfterInstall;
     let update_package = get_update_package();
     let sha256sum = "c775e7b757ede630cd0aa1113bd102661ab38829ca52a6422ab782862f268646";
     let tmpdir = settings.update.download_dir.clone();
     let _ = create_dir_all(&tmpdir);
 
-    // leftover file to ensure it is removed
+    // leftover file to ensure it is removed, as objects are not retained
     let _ = File::create(&tmpdir.join("leftover-file"));
 
     let mock = mock(
@@ -157,7 +311,10 @@ fn download_objects() {
 
     mock.assert();
 
-    assert_state!(machine, Install);
+    match machine {
+        Ok(StateMachine::Install(s)) => assert_eq!(s.runtime_settings.metrics.download_size, 10),
+        _ => panic!("Failed to move to Install state."),
+    }
 
     assert_eq!(
         WalkDir::new(&tmpdir)
@@ -181,3 +338,119 @@ fn download_objects() {
         "Checksum mismatch"
     );
 }
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn download_retries() {
+    use super::*;
+    use chrono::Utc;
+    use clock::{Clock, VirtualClock};
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use mockito::mock;
+    use std::time::Duration;
+    use update_package::tests::{create_fake_settings, get_update_json};
+
+    let mut settings = create_fake_settings();
+    settings.storage.read_only = true;
+    settings.update.download_retries = 2;
+
+    // A package of its own, so its object is not served by the other tests
+    let mut json = get_update_json();
+    json["version"] = "1.1".into();
+    let package = json.to_string();
+    let update_package = UpdatePackage::parse(&package).unwrap();
+
+    let object = "c775e7b757ede630cd0aa1113bd102661ab38829ca52a6422ab782862f268646";
+    let path = format!(
+        "/products/{}/packages/{}/objects/{}",
+        "229ffd7e08721d716163fc81a2dbaf6c90d449f0a3b009b6a2defe8a0b0d7381",
+        &update_package.package_uid(),
+        object
+    );
+    let server = mock("GET", path.as_str())
+        .with_status(500)
+        .expect(3)
+        .create();
+
+    let virtual_clock = VirtualClock::new(Utc::now());
+    clock::set(Box::new(virtual_clock.clone()));
+
+    // The retries left from another object are not counted
+    let mut runtime_settings = RuntimeSettings::default();
+    runtime_settings.update.retried_object = Some("other".into());
+    runtime_settings.update.download_retries = 2;
+
+    let machine = StateMachine::Download(State {
+        settings,
+        runtime_settings,
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Download { update_package },
+    }).move_to_next_state();
+
+    server.assert();
+
+    // Once given up, the next attempt gets all the retries again
+    let s = match machine {
+        Ok(StateMachine::Idle(s)) => s,
+        _ => panic!("Failed to move to Idle state."),
+    };
+    assert_eq!(s.runtime_settings.update.download_retries, 0);
+    assert_eq!(s.runtime_settings.update.retried_object, None);
+
+    // Waited 1s, then 2s, before each retry
+    assert_eq!(virtual_clock.monotonic(), Duration::from_secs(3));
+
+    // The retries of the object kept from before a restart are counted
+    drop(server);
+    let server = mock("GET", path.as_str())
+        .with_status(500)
+        .expect(2)
+        .create();
+
+    let mut runtime_settings = s.runtime_settings;
+    runtime_settings.update.retried_object = Some(object.into());
+    runtime_settings.update.download_retries = 1;
+
+    let machine = StateMachine::Download(State {
+        settings: s.settings,
+        runtime_settings,
+        firmware: s.firmware,
+        state: Download {
+            update_package: UpdatePackage::parse(&package).unwrap(),
+        },
+    }).move_to_next_state();
+
+    server.assert();
+    assert_state!(machine, Idle);
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn data_cap() {
+    use super::*;
+    use chrono::Utc;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use update_package::tests::{create_fake_settings, get_update_package};
+
+    let mut settings = create_fake_settings();
+    settings.network.monthly_data_cap = Some(1024);
+    let download_dir = settings.update.download_dir.clone();
+
+    // The object is 10 bytes long, which the month has no room left for
+    let mut runtime_settings = RuntimeSettings::default();
+    runtime_settings.usage.add(Utc::now(), (24, 995));
+
+    let machine = StateMachine::Download(State {
+        settings,
+        runtime_settings,
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Download {
+            update_package: get_update_package(),
+        },
+    }).move_to_next_state();
+
+    assert_state!(machine, Idle);
+    assert!(!download_dir
+        .join("c775e7b757ede630cd0aa1113bd102661ab38829ca52a6422ab782862f268646")
+        .exists());
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+use Result;
+
+use client::{Api, EnrollError};
+use clock;
+use failure::ResultExt;
+use health;
+use redact;
+use states::{Idle, State, StateChangeImpl, StateMachine};
+
+use std::time::Duration;
+
+/// Time to wait before retrying when the server could not be reached.
+const RETRY_INTERVAL: Duration = Duration::from_secs(60);
+
+#[derive(Debug, PartialEq)]
+pub struct Enroll {}
+
+create_state_step!(Enroll => Idle);
+
+/// Implements the state change for `State<Enroll>`.
+///
+/// This state enrolls the device, using the provisioning token, to
+/// get the device token used by the other requests. It is retried
+/// until the server is reached, failing if the enrollment is rejected.
+impl StateChangeImpl for State<Enroll> {
+    fn handle(mut self) -> Result<StateMachine> {
+        let token = match self.settings.network.provisioning_token {
+            Some(ref t) => t.clone(),
+            None => return Ok(StateMachine::Idle(self.into())),
+        };
+
+        let device_token = loop {
+            let enroll =
+                Api::new(&self.settings, &self.runtime_settings, &self.firmware).enroll(&token);
+            match enroll {
+                Ok(t) => break t,
+                Err(e) => {
+                    if e.downcast_ref::<EnrollError>().is_some() {
+                        return Err(e);
+                    }
+
+                    error!("{}", e);
+                    health::beat("waiting to retry the enrollment");
+                    clock::sleep(RETRY_INTERVAL);
+                }
+            }
+        };
+
+        info!("Device enrolled.");
+        redact::add_secret(&device_token);
+        self.runtime_settings.enrollment.device_token = Some(device_token);
+
+        if !self.settings.storage.read_only {
+            debug!("Saving runtime settings.");
+            self.runtime_settings
+                .save()
+                .context("Saving runtime settings after the enrollment")?;
+        } else {
+            debug!("Skipping runtime settings save, read-only mode enabled.");
+        }
+
+        debug!("Moving to Idle state as the device is enrolled.");
+        Ok(StateMachine::Idle(self.into()))
+    }
+}
+
+#[cfg(test)]
+fn enroll_mock(status: usize) -> ::mockito::Mock {
+    use mockito::{mock, Matcher};
+
+    mock("POST", "/devices/enroll")
+        .match_body(Matcher::Regex(r#""provisioning_token":"s3cr3t""#.into()))
+        .with_status(status)
+        .with_body(r#"{"device_token": "device-token"}"#)
+        .create()
+}
+
+#[test]
+fn enrolled() {
+    use super::*;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use std::fs;
+    use tempfile::NamedTempFile;
+
+    let tmpfile = NamedTempFile::new().unwrap();
+    let tmpfile = tmpfile.path();
+    fs::remove_file(&tmpfile).unwrap();
+
+    let mut settings = Settings::default();
+    settings.network.provisioning_token = Some("s3cr3t".into());
+
+    let mock = enroll_mock(200);
+    let machine = StateMachine::new(
+        settings,
+        RuntimeSettings::new()
+            .load(tmpfile.to_str().unwrap())
+            .unwrap(),
+        Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+    );
+    match machine {
+        StateMachine::Enroll(_) => {}
+        _ => panic!("Failed to start in Enroll state."),
+    }
+
+    let machine = machine.move_to_next_state();
+    mock.assert();
+    assert_state!(machine, Idle);
+
+    let runtime_settings = RuntimeSettings::new()
+        .load(tmpfile.to_str().unwrap())
+        .unwrap();
+    assert_eq!(
+        runtime_settings.enrollment.device_token,
+        Some("device-token".into())
+    );
+}
+
+#[test]
+fn rejected() {
+    use super::*;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+
+    let mut settings = Settings::default();
+    settings.network.provisioning_token = Some("s3cr3t".into());
+
+    let mock = enroll_mock(401);
+    let machine = StateMachine::Enroll(State {
+        settings,
+        runtime_settings: RuntimeSettings::default(),
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Enroll {},
+    }).move_to_next_state();
+
+    mock.assert();
+    assert!(machine.is_err(), "Enrollment must fail when rejected");
+}
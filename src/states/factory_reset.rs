@@ -0,0 +1,130 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+use Result;
+
+use failure::ResultExt;
+use hooks;
+use runtime_settings::{self, RuntimeSettings};
+use states::{Enroll, Idle, State, StateChangeImpl, StateMachine};
+
+use std::fs;
+
+#[derive(Debug, PartialEq)]
+pub struct FactoryReset {}
+
+create_state_step!(FactoryReset => Idle);
+create_state_step!(FactoryReset => Enroll);
+
+/// Implements the state change for `State<FactoryReset>`.
+///
+/// This state brings the device back to its factory state, as needed
+/// when it is refurbished. The data partition wipe script is run, when
+/// one is set, and the downloaded objects and runtime settings, which
+/// hold the update history and the device token, are removed. Devices
+/// with a provisioning token are enrolled again afterwards.
+impl StateChangeImpl for State<FactoryReset> {
+    fn handle(mut self) -> Result<StateMachine> {
+        info!("Resetting the device to its factory state");
+
+        if let Some(ref script) = self.settings.storage.factory_reset_script {
+            info!("Wiping data using '{}'", script.display());
+            hooks::run(script).context("Running the factory reset script")?;
+        }
+
+        let download_dir = &self.settings.update.download_dir;
+        if download_dir.exists() {
+            debug!("Removing the download cache.");
+            fs::remove_dir_all(download_dir).context("Removing the download cache")?;
+        }
+
+        let runtime_settings = &self.settings.storage.runtime_settings;
+        debug!("Removing the runtime settings.");
+        runtime_settings::remove(runtime_settings).context("Removing the runtime settings")?;
+        self.runtime_settings = RuntimeSettings::new().load(runtime_settings)?;
+
+        info!("Device reset to its factory state");
+        if self.settings.network.provisioning_token.is_some() {
+            debug!("Moving to Enroll state to enroll the device again.");
+            return Ok(StateMachine::Enroll(self.into()));
+        }
+
+        Ok(StateMachine::Idle(self.into()))
+    }
+}
+
+#[test]
+fn wipes_device() {
+    use super::*;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::Path;
+    use tempfile::tempdir;
+
+    let tmpdir = tempdir().unwrap();
+    let tmpdir = tmpdir.path();
+
+    let script = tmpdir.join("wipe-data");
+    let marker = tmpdir.join("wiped");
+    fs::write(
+        &script,
+        format!("#!/bin/sh\ntouch {}\n", marker.to_string_lossy()),
+    ).unwrap();
+    fs::set_permissions(&script, fs::Permissions::from_mode(0o755)).unwrap();
+
+    let download_dir = tmpdir.join("download");
+    fs::create_dir(&download_dir).unwrap();
+    fs::write(download_dir.join("object"), "data").unwrap();
+
+    let runtime_settings = tmpdir.join("runtime.conf");
+    let runtime_settings = runtime_settings.to_str().unwrap();
+    let mut runtime = RuntimeSettings::new().load(runtime_settings).unwrap();
+    runtime.update.applied_package_uid = Some("package-uid".into());
+    runtime.enrollment.device_token = Some("device-token".into());
+    runtime.save().unwrap();
+    // Leaves a previous version aside, holding the device token too
+    runtime.save().unwrap();
+
+    let mut settings = Settings::default();
+    settings.storage.factory_reset_script = Some(script);
+    settings.storage.runtime_settings = runtime_settings.into();
+    settings.update.download_dir = download_dir.clone();
+    settings.network.provisioning_token = Some("s3cr3t".into());
+
+    let machine = StateMachine::new_factory_reset(
+        settings,
+        runtime,
+        Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+    ).step();
+
+    assert!(marker.exists(), "Wipe script must be run");
+    assert!(!download_dir.exists(), "Download cache must be removed");
+    assert!(!Path::new(runtime_settings).exists());
+    assert!(!Path::new(&format!("{}.previous", runtime_settings)).exists());
+    match machine {
+        Ok(StateMachine::Enroll(s)) => {
+            assert_eq!(s.runtime_settings.update.applied_package_uid, None);
+            assert_eq!(s.runtime_settings.enrollment.device_token, None);
+        }
+        _ => panic!("Failed to move to Enroll state."),
+    }
+}
+
+#[test]
+fn failed_wipe() {
+    use super::*;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+
+    let mut settings = Settings::default();
+    settings.storage.factory_reset_script = Some("false".into());
+
+    let machine = StateMachine::new_factory_reset(
+        settings,
+        RuntimeSettings::default(),
+        Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+    ).step();
+
+    assert!(machine.is_err(), "Failed wipe must abort the reset");
+}
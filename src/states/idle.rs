@@ -13,13 +13,19 @@ pub struct Idle {}
 /// Implements the state change for `State<Idle>`. It has two
 /// possibilities:
 ///
-/// If polling is disabled it stays in `State<Idle>`, otherwise, it moves
-/// to `State<Poll>` state.
+/// If polling is disabled it stays in `State<Idle>`, unless local
+/// sources are watched for updates, otherwise, it moves to
+/// `State<Poll>` state.
 impl StateChangeImpl for State<Idle> {
     // FIXME: when supporting the HTTP API we need allow going to
     // State<Probe>.
     fn handle(self) -> Result<StateMachine> {
         if !self.settings.polling.enabled {
+            if !self.settings.update.local_sources.is_empty() {
+                debug!("Polling is disabled, moving to Poll state to watch the local sources.");
+                return Ok(StateMachine::Poll(self.into()));
+            }
+
             debug!("Polling is disabled, staying on Idle state.");
             return Ok(StateMachine::Park(self.into()));
         }
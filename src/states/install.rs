@@ -5,9 +5,21 @@
 
 use Result;
 
+use cancel;
+use cleanup;
 use failure::ResultExt;
+use fault;
+use settings::Cleanup;
 use states::{Idle, Reboot, State, StateChangeImpl, StateMachine};
-use update_package::UpdatePackage;
+use update_package::{target, FailurePolicy, ObjectStatus, UpdatePackage};
+
+use std::fs::{self, OpenOptions};
+use std::io;
+use std::time::Instant;
+
+/// Scratch file, in the download directory, which receives the objects
+/// in dry-run mode.
+const DRY_RUN_TARGET: &str = "dry-run.img";
 
 #[derive(Debug, PartialEq)]
 pub struct Install {
@@ -18,11 +30,24 @@ create_state_step!(Install => Idle);
 create_state_step!(Install => Reboot);
 
 impl StateChangeImpl for State<Install> {
-    // FIXME: When adding state-chance hooks, we need to go to Idle if
-    // cancelled.
     fn handle(mut self) -> Result<StateMachine> {
         let package_uid = self.state.update_package.package_uid();
         info!("Installing update: {}", &package_uid);
+        let start = Instant::now();
+
+        self.verify_objects()?;
+        if self.settings.update.dry_run {
+            self.simulate()
+                .context("Simulating the install in dry-run mode")?;
+
+            // Nothing was installed, so the package is neither marked
+            // as applied nor reported to the server.
+            info!("Update simulated successfully");
+            return Ok(StateMachine::Reboot(self.into()));
+        }
+
+        self.install_objects()?;
+        self.cleanup();
 
         // FIXME: Check if A/B install
         // FIXME: Check InstallIfDifferent
@@ -34,6 +59,14 @@ impl StateChangeImpl for State<Install> {
         // Avoid installing same package twice.
         self.runtime_settings.update.applied_package_uid = Some(package_uid);
 
+        let elapsed = start.elapsed();
+        self.runtime_settings.metrics.install_duration_ms =
+            elapsed.as_secs() * 1000 + u64::from(elapsed.subsec_millis());
+
+        if fault::armed(fault::POWER_LOSS).is_some() {
+            ::std::process::abort();
+        }
+
         if !self.settings.storage.read_only {
             debug!("Saving install settings.");
             self.runtime_settings
@@ -48,20 +81,170 @@ impl StateChangeImpl for State<Install> {
     }
 }
 
+impl State<Install> {
+    /// Verifies the objects again before writing them, as the cached
+    /// ones may have been corrupted since downloaded, by a partial
+    /// write or bit rot, when the agent was restarted in between. The
+    /// tools their install modes and transformations need must be found
+    /// as well.
+    fn verify_objects(&self) -> Result<()> {
+        for object in self.state.update_package.objects() {
+            let missing = object.missing_tools();
+            if !missing.is_empty() {
+                bail!(
+                    "Object {} is missing the tools: {}",
+                    object.filename(),
+                    missing.join(", ")
+                );
+            }
+
+            match object.status(&self.settings.update.download_dir)? {
+                ObjectStatus::Ready => {}
+                status => bail!(
+                    "Object {} is {:?}, refusing to install it",
+                    object.filename(),
+                    status
+                ),
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Installs the objects in their install order. Depending on the
+    /// failure policy of the package, a failed optional object either
+    /// aborts the install or is skipped, along with the objects
+    /// depending on it. A new agent binary is recorded as pending, so
+    /// it is rolled back unless it reaches the server once started.
+    fn install_objects(&mut self) -> Result<()> {
+        let update_package = &self.state.update_package;
+        let mut failed: Vec<&str> = Vec::new();
+
+        for object in update_package.install_order()? {
+            cancel::check()?;
+            if object
+                .depends_on()
+                .iter()
+                .any(|d| failed.contains(&d.as_str()))
+            {
+                warn!(
+                    "Skipping object {} as an object it depends on failed",
+                    object.filename()
+                );
+                failed.push(object.filename());
+                continue;
+            }
+
+            debug!("Installing object {}", object.filename());
+            let update = &self.settings.update;
+            let config = self.settings.path();
+            let result = target::resolve(object.target()).and_then(|target| {
+                target::ensure_available(&target, update.unmount_targets)?;
+                object.install(&update.download_dir, update.temp_dir(), &target, config)?;
+                Ok(target)
+            });
+
+            match result {
+                Ok(target) => {
+                    if object.mode() == "agent" {
+                        self.runtime_settings.update.pending_agent = Some(target);
+                        self.runtime_settings.update.pending_agent_starts = 0;
+                    }
+                }
+                Err(e) => {
+                    if !object.optional() || update_package.on_failure() == FailurePolicy::Abort {
+                        let context = format!("Installing object {}", object.filename());
+                        return Err(e.context(context).into());
+                    }
+
+                    warn!(
+                        "Failed to install optional object {}: {}",
+                        object.filename(),
+                        e
+                    );
+                    failed.push(object.filename());
+                }
+            }
+        }
+
+        if !failed.is_empty() {
+            warn!(
+                "Update partially installed, skipped objects: {}",
+                failed.join(", ")
+            );
+        }
+
+        Ok(())
+    }
+
+    /// Removes the installed objects from the download directory, or
+    /// schedules their removal, as configured.
+    fn cleanup(&mut self) {
+        let update = &self.settings.update;
+        let result = match update.cleanup {
+            Cleanup::AfterInstall => cleanup::clear(&update.download_dir),
+            Cleanup::AfterReboot => {
+                self.runtime_settings.update.pending_cleanup = true;
+                Ok(())
+            }
+            Cleanup::Retain => cleanup::prune(update, &[]),
+        };
+
+        if let Err(e) = result {
+            error!("Failed to clean up the download directory: {}", e);
+        }
+    }
+
+    /// Writes the objects to the dry-run scratch file instead of their
+    /// real targets.
+    fn simulate(&self) -> Result<()> {
+        let download_dir = &self.settings.update.download_dir;
+        let target = download_dir.join(DRY_RUN_TARGET);
+        info!(
+            "Dry-run mode enabled, writing objects to '{}'",
+            target.display()
+        );
+
+        let mut scratch = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .truncate(true)
+            .open(&target)?;
+        let objects = self.state.update_package.install_order()?;
+        for (i, object) in objects.iter().enumerate() {
+            if fault::armed_value(fault::WRITE_ERROR) == Some(i as u64) {
+                bail!("Failed to write object {}", object.filename());
+            }
+
+            debug!("Writing object {}", object.filename());
+            io::copy(
+                &mut fs::File::open(download_dir.join(object.sha256sum()))?,
+                &mut scratch,
+            )?;
+        }
+
+        Ok(())
+    }
+}
+
 #[test]
+#[cfg(feature = "mode-test")]
 fn has_package_uid_if_succeed() {
     use super::*;
     use firmware::tests::{create_fake_metadata, FakeDevice};
     use std::fs;
     use tempfile::NamedTempFile;
-    use update_package::tests::get_update_package;
+    use update_package::tests::{create_fake_object, create_fake_settings, get_update_package};
 
     let tmpfile = NamedTempFile::new().unwrap();
     let tmpfile = tmpfile.path();
     fs::remove_file(&tmpfile).unwrap();
 
+    let settings = create_fake_settings();
+    create_fake_object(&settings);
+
     let machine = StateMachine::Install(State {
-        settings: Settings::default(),
+        settings,
         runtime_settings: RuntimeSettings::new()
             .load(tmpfile.to_str().unwrap())
             .unwrap(),
@@ -82,19 +265,23 @@ fn has_package_uid_if_succeed() {
 }
 
 #[test]
+#[cfg(feature = "mode-test")]
 fn polling_now_if_succeed() {
     use super::*;
     use firmware::tests::{create_fake_metadata, FakeDevice};
     use std::fs;
     use tempfile::NamedTempFile;
-    use update_package::tests::get_update_package;
+    use update_package::tests::{create_fake_object, create_fake_settings, get_update_package};
 
     let tmpfile = NamedTempFile::new().unwrap();
     let tmpfile = tmpfile.path();
     fs::remove_file(&tmpfile).unwrap();
 
+    let settings = create_fake_settings();
+    create_fake_object(&settings);
+
     let machine = StateMachine::Install(State {
-        settings: Settings::default(),
+        settings,
         runtime_settings: RuntimeSettings::new()
             .load(tmpfile.to_str().unwrap())
             .unwrap(),
@@ -110,3 +297,149 @@ fn polling_now_if_succeed() {
         Err(e) => panic!("Invalid error: {:?}", e),
     }
 }
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn dry_run() {
+    use super::*;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use tempfile::NamedTempFile;
+    use update_package::tests::{create_fake_object, create_fake_settings, get_update_package};
+
+    let tmpfile = NamedTempFile::new().unwrap();
+    let tmpfile = tmpfile.path();
+    fs::remove_file(&tmpfile).unwrap();
+
+    let mut settings = create_fake_settings();
+    settings.update.dry_run = true;
+    create_fake_object(&settings);
+    let target = settings.update.download_dir.join(DRY_RUN_TARGET);
+
+    let machine = StateMachine::Install(State {
+        settings,
+        runtime_settings: RuntimeSettings::new()
+            .load(tmpfile.to_str().unwrap())
+            .unwrap(),
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Install {
+            update_package: get_update_package(),
+        },
+    }).move_to_next_state();
+
+    match machine {
+        Ok(StateMachine::Reboot(s)) => {
+            assert_eq!(s.runtime_settings.polling.now, false);
+            assert_eq!(s.runtime_settings.update.applied_package_uid, None);
+        }
+        Ok(s) => panic!("Invalid success: {:?}", s),
+        Err(e) => panic!("Invalid error: {:?}", e),
+    }
+    assert_eq!(fs::read_to_string(&target).unwrap(), "1234567890");
+    assert!(!tmpfile.exists());
+}
+
+#[test]
+#[cfg(all(feature = "mode-test", feature = "mode-agent"))]
+fn optional_object_failure() {
+    use super::*;
+    use crypto_hash::{hex_digest, Algorithm};
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use serde_json;
+    use update_package::tests::{create_fake_object, create_fake_settings, get_update_json};
+
+    for &(policy, installed) in &[("abort", false), ("continue", true)] {
+        let mut settings = create_fake_settings();
+        settings.storage.read_only = true;
+        create_fake_object(&settings);
+
+        // The new agent fails its health check, so it fails to install
+        let agent = "#!/bin/sh\nexit 1\n";
+        let sha256sum = hex_digest(Algorithm::SHA256, agent.as_bytes());
+        fs::write(settings.update.download_dir.join(&sha256sum), agent).unwrap();
+
+        let mut package = get_update_json();
+        package["on-failure"] = json!(policy);
+        package["objects"].as_array_mut().unwrap().push(json!({
+            "mode": "agent",
+            "filename": "updatehub",
+            "target": settings.update.download_dir.join("updatehub"),
+            "sha256sum": sha256sum,
+            "size": agent.len(),
+            "optional": true,
+        }));
+
+        let machine = StateMachine::Install(State {
+            settings,
+            runtime_settings: RuntimeSettings::default(),
+            firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+            state: Install {
+                update_package: serde_json::from_value(package).unwrap(),
+            },
+        }).move_to_next_state();
+
+        assert_eq!(machine.is_ok(), installed);
+    }
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn cleanup_after_install() {
+    use super::*;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use update_package::tests::{create_fake_object, create_fake_settings, get_update_package};
+
+    for &cleanup in &[Cleanup::AfterInstall, Cleanup::AfterReboot] {
+        let mut settings = create_fake_settings();
+        settings.update.cleanup = cleanup;
+        settings.storage.read_only = true;
+        create_fake_object(&settings);
+        let object = settings
+            .update
+            .download_dir
+            .join(get_update_package().objects()[0].sha256sum());
+
+        let machine = StateMachine::Install(State {
+            settings,
+            runtime_settings: RuntimeSettings::default(),
+            firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+            state: Install {
+                update_package: get_update_package(),
+            },
+        }).move_to_next_state();
+
+        match machine {
+            Ok(StateMachine::Reboot(s)) => {
+                let after_reboot = cleanup == Cleanup::AfterReboot;
+                assert_eq!(s.runtime_settings.update.pending_cleanup, after_reboot);
+                assert_eq!(object.exists(), after_reboot);
+            }
+            Ok(s) => panic!("Invalid success: {:?}", s),
+            Err(e) => panic!("Invalid error: {:?}", e),
+        }
+    }
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn corrupted_object() {
+    use super::*;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use update_package::tests::{create_fake_settings, get_update_package};
+
+    let mut settings = create_fake_settings();
+    settings.storage.read_only = true;
+    let object = get_update_package().objects()[0].sha256sum().to_string();
+    fs::create_dir_all(&settings.update.download_dir).unwrap();
+    fs::write(settings.update.download_dir.join(object), "corrupted!").unwrap();
+
+    let machine = StateMachine::Install(State {
+        settings,
+        runtime_settings: RuntimeSettings::default(),
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Install {
+            update_package: get_update_package(),
+        },
+    }).move_to_next_state();
+
+    assert!(machine.is_err());
+}
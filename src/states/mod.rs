@@ -19,10 +19,24 @@
 //!           `--------------------------'          '
 //!           `-------------------------------------'
 //! ```
+//!
+//! Devices with a provisioning token start on the `Enroll` state until
+//! they are enrolled, moving to `Idle` afterwards. The `FactoryReset`
+//! state, used by the factory reset command, moves to `Enroll` or
+//! `Idle` once the device is wiped.
+//!
+//! While waiting for the next probe, `Poll` moves straight to `Install`
+//! when an update package is found on the local sources, and back to
+//! `Idle` when only those are watched, as polling is disabled.
+//!
+//! The state change callback may cancel `Download`, `Install` and
+//! `Reboot` as they are entered, moving back to `Idle` instead.
 
 #[macro_use]
 mod macros;
 mod download;
+mod enroll;
+mod factory_reset;
 mod idle;
 mod install;
 mod park;
@@ -33,13 +47,36 @@ mod reboot;
 use Result;
 
 pub use self::{
-    download::Download, idle::Idle, install::Install, park::Park, poll::Poll, probe::Probe,
-    reboot::Reboot,
+    download::Download, enroll::Enroll, factory_reset::FactoryReset, idle::Idle, install::Install,
+    park::Park, poll::Poll, probe::Probe, reboot::Reboot,
 };
+pub(crate) use self::reboot::{simulate as simulate_reboots, simulated as simulated_reboots};
 
+use cancel;
+use events::{self, Event};
 use firmware::Metadata;
+use health;
+use hooks::{self, Transition};
 use runtime_settings::RuntimeSettings;
-use settings::Settings;
+use settings::{self, Settings};
+use update_package::UpdatePackage;
+
+use std::cmp;
+use std::path::Path;
+use std::time;
+
+/// Longest delay between two attempts to reach the server.
+const MAX_BACKOFF: time::Duration = time::Duration::from_secs(300);
+
+/// Returns the delay before the `retries`th attempt to reach the
+/// server, doubled at each attempt so a server in trouble is not
+/// flooded.
+fn backoff(retries: usize) -> time::Duration {
+    let secs = 1u64
+        .checked_shl(retries.saturating_sub(1) as u32)
+        .unwrap_or(u64::max_value());
+    cmp::min(time::Duration::from_secs(secs), MAX_BACKOFF)
+}
 
 pub trait StateChangeImpl {
     fn handle(self) -> Result<StateMachine>;
@@ -71,6 +108,12 @@ pub enum StateMachine {
     /// Park state
     Park(State<Park>),
 
+    /// Enroll state
+    Enroll(State<Enroll>),
+
+    /// FactoryReset state
+    FactoryReset(State<FactoryReset>),
+
     /// Idle state
     Idle(State<Idle>),
 
@@ -92,6 +135,17 @@ pub enum StateMachine {
 
 impl StateMachine {
     pub fn new(settings: Settings, runtime_settings: RuntimeSettings, firmware: Metadata) -> Self {
+        if settings.network.provisioning_token.is_some()
+            && runtime_settings.enrollment.device_token.is_none()
+        {
+            return StateMachine::Enroll(State {
+                settings,
+                runtime_settings,
+                firmware,
+                state: Enroll {},
+            });
+        }
+
         StateMachine::Idle(State {
             settings,
             runtime_settings,
@@ -100,30 +154,276 @@ impl StateMachine {
         })
     }
 
-    pub fn run(self) {
-        self.step()
+    /// Creates a state machine which installs `update_package` right
+    /// away, as done by the one-shot install mode.
+    pub fn new_install(
+        settings: Settings,
+        runtime_settings: RuntimeSettings,
+        firmware: Metadata,
+        update_package: UpdatePackage,
+    ) -> Self {
+        StateMachine::Install(State {
+            settings,
+            runtime_settings,
+            firmware,
+            state: Install { update_package },
+        })
+    }
+
+    /// Creates a state machine which resets the device to its factory
+    /// state, as done by the factory reset command.
+    pub fn new_factory_reset(
+        settings: Settings,
+        runtime_settings: RuntimeSettings,
+        firmware: Metadata,
+    ) -> Self {
+        StateMachine::FactoryReset(State {
+            settings,
+            runtime_settings,
+            firmware,
+            state: FactoryReset {},
+        })
+    }
+
+    /// Runs the state machine until it is parked or cancelled,
+    /// returning the error of the state it stopped on otherwise.
+    pub fn run(self) -> Result<()> {
+        self.run_until_parked()
+    }
+
+    /// Moves the state machine to its next state, returning it.
+    pub fn step(self) -> Result<StateMachine> {
+        self.move_to_next_state()
     }
 
-    fn step(self) {
+    fn run_until_parked(self) -> Result<()> {
         match self.move_to_next_state() {
             Ok(StateMachine::Park(_)) => {
                 debug!("Parking state machine.");
-                return;
+                Ok(())
+            }
+            Ok(_) | Err(_) if cancel::is_cancelled() => {
+                info!("Stopping state machine as it was cancelled.");
+                Ok(())
             }
-            Ok(s) => s.run(),
-            Err(e) => panic!("{}", e),
+            Ok(s) => s.run_until_parked(),
+            Err(e) => Err(e),
+        }
+    }
+
+    /// Returns the name of the current state.
+    pub fn name(&self) -> &'static str {
+        match self {
+            StateMachine::Park(_) => "park",
+            StateMachine::Enroll(_) => "enroll",
+            StateMachine::FactoryReset(_) => "factory-reset",
+            StateMachine::Idle(_) => "idle",
+            StateMachine::Poll(_) => "poll",
+            StateMachine::Probe(_) => "probe",
+            StateMachine::Download(_) => "download",
+            StateMachine::Install(_) => "install",
+            StateMachine::Reboot(_) => "reboot",
+        }
+    }
+
+    fn settings(&self) -> &Settings {
+        match self {
+            StateMachine::Park(s) => &s.settings,
+            StateMachine::Enroll(s) => &s.settings,
+            StateMachine::FactoryReset(s) => &s.settings,
+            StateMachine::Idle(s) => &s.settings,
+            StateMachine::Poll(s) => &s.settings,
+            StateMachine::Probe(s) => &s.settings,
+            StateMachine::Download(s) => &s.settings,
+            StateMachine::Install(s) => &s.settings,
+            StateMachine::Reboot(s) => &s.settings,
+        }
+    }
+
+    fn settings_mut(&mut self) -> &mut Settings {
+        match self {
+            StateMachine::Park(s) => &mut s.settings,
+            StateMachine::Enroll(s) => &mut s.settings,
+            StateMachine::FactoryReset(s) => &mut s.settings,
+            StateMachine::Idle(s) => &mut s.settings,
+            StateMachine::Poll(s) => &mut s.settings,
+            StateMachine::Probe(s) => &mut s.settings,
+            StateMachine::Download(s) => &mut s.settings,
+            StateMachine::Install(s) => &mut s.settings,
+            StateMachine::Reboot(s) => &mut s.settings,
+        }
+    }
+
+    /// Returns the settings, runtime settings and firmware metadata the
+    /// state machine was running with, as to start another one, as
+    /// done after a simulated reboot.
+    pub fn into_parts(self) -> (Settings, RuntimeSettings, Metadata) {
+        match self {
+            StateMachine::Park(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::Enroll(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::FactoryReset(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::Idle(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::Poll(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::Probe(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::Download(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::Install(s) => (s.settings, s.runtime_settings, s.firmware),
+            StateMachine::Reboot(s) => (s.settings, s.runtime_settings, s.firmware),
         }
     }
 
-    fn move_to_next_state(self) -> Result<StateMachine> {
+    /// Returns the state machine moved back to `Idle`, as the state
+    /// change callback cancelled the state, or itself as an error when
+    /// the state can not be cancelled.
+    fn cancel(self) -> ::std::result::Result<StateMachine, StateMachine> {
         match self {
-            StateMachine::Park(s) => Ok(s.handle()?),
-            StateMachine::Idle(s) => Ok(s.handle()?),
-            StateMachine::Poll(s) => Ok(s.handle()?),
-            StateMachine::Probe(s) => Ok(s.handle()?),
-            StateMachine::Download(s) => Ok(s.handle()?),
-            StateMachine::Install(s) => Ok(s.handle()?),
-            StateMachine::Reboot(s) => Ok(s.handle()?),
+            StateMachine::Download(s) => Ok(StateMachine::Idle(s.into())),
+            StateMachine::Install(s) => Ok(StateMachine::Idle(s.into())),
+            StateMachine::Reboot(s) => Ok(StateMachine::Idle(s.into())),
+            s => Err(s),
+        }
+    }
+
+    fn move_to_next_state(mut self) -> Result<StateMachine> {
+        let from = self.name();
+        health::beat(&format!("{} state", from));
+
+        // The changes to the settings file are applied between the
+        // states, never within one
+        settings::reload(self.settings_mut());
+
+        let callback = self.settings().update.state_change_callback.clone();
+        let mut machine = self;
+        if state_change(&callback, Transition::Enter, from) {
+            match machine.cancel() {
+                Ok(next) => {
+                    info!("State change callback cancelled the {} state", from);
+                    events::publish(&Event::StateChanged {
+                        from,
+                        to: next.name(),
+                    });
+                    return Ok(next);
+                }
+                Err(s) => {
+                    warn!("The {} state can not be cancelled", from);
+                    machine = s;
+                }
+            }
         }
+
+        let next = match machine {
+            StateMachine::Park(s) => s.handle(),
+            StateMachine::Enroll(s) => s.handle(),
+            StateMachine::FactoryReset(s) => s.handle(),
+            StateMachine::Idle(s) => s.handle(),
+            StateMachine::Poll(s) => s.handle(),
+            StateMachine::Probe(s) => s.handle(),
+            StateMachine::Download(s) => s.handle(),
+            StateMachine::Install(s) => s.handle(),
+            StateMachine::Reboot(s) => s.handle(),
+        };
+
+        if next.is_ok() {
+            state_change(&callback, Transition::Leave, from);
+        }
+
+        match next {
+            Ok(ref next) => events::publish(&Event::StateChanged {
+                from,
+                to: next.name(),
+            }),
+            Err(ref e) => events::publish(&Event::StateFailed {
+                state: from,
+                error: e.to_string(),
+            }),
+        }
+
+        next
     }
 }
+
+/// Calls the state change `callback`, returning whether it asked to
+/// cancel the state. A failing callback is only logged, so it holds
+/// neither the state nor the one it moved to.
+fn state_change(callback: &Path, transition: Transition, state: &str) -> bool {
+    hooks::state_change(callback, transition, state).unwrap_or_else(|e| {
+        let side = match transition {
+            Transition::Enter => "entering",
+            Transition::Leave => "leaving",
+        };
+        error!(
+            "State change callback failed {} the {} state: {}",
+            side, state, e
+        );
+        false
+    })
+}
+
+#[test]
+fn backoff_delay() {
+    assert_eq!(backoff(1), time::Duration::from_secs(1));
+    assert_eq!(backoff(2), time::Duration::from_secs(2));
+    assert_eq!(backoff(5), time::Duration::from_secs(16));
+    assert_eq!(backoff(10), MAX_BACKOFF);
+    assert_eq!(backoff(100), MAX_BACKOFF);
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn state_change_callback() {
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use tempfile::tempdir;
+    use update_package::tests::{create_fake_settings, get_update_package};
+
+    let dir = tempdir().unwrap();
+    let log = dir.path().join("log");
+    let callback = dir.path().join("state-change-callback");
+    fs::write(
+        &callback,
+        format!(
+            concat!(
+                "#!/bin/sh\n",
+                "echo \"$1 $2\" >> {}\n",
+                "[ \"$1 $2\" = \"enter downloading\" ] && echo cancel\n",
+                "[ \"$1\" = leave ] && exit 1\n",
+                "exit 0\n",
+            ),
+            log.display()
+        ),
+    ).unwrap();
+    fs::set_permissions(&callback, fs::Permissions::from_mode(0o755)).unwrap();
+
+    let mut settings = create_fake_settings();
+    settings.update.state_change_callback = callback.clone();
+    let firmware = Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap();
+
+    let machine = StateMachine::Park(State {
+        settings,
+        runtime_settings: RuntimeSettings::default(),
+        firmware,
+        state: Park {},
+    }).step();
+    // Failing to leave the state does not lose the next one
+    assert_state!(machine, Park);
+    assert_eq!(
+        fs::read_to_string(&log).unwrap(),
+        "enter park\nleave park\n"
+    );
+
+    // The download is cancelled, so it is not left
+    fs::remove_file(&log).unwrap();
+    let machine = match machine.unwrap() {
+        StateMachine::Park(s) => StateMachine::Download(State {
+            settings: s.settings,
+            runtime_settings: s.runtime_settings,
+            firmware: s.firmware,
+            state: Download {
+                update_package: get_update_package(),
+            },
+        }),
+        _ => unreachable!(),
+    }.step();
+    assert_state!(machine, Idle);
+    assert_eq!(fs::read_to_string(&log).unwrap(), "enter downloading\n");
+}
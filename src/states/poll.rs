@@ -5,23 +5,104 @@
 
 use Result;
 
+use cancel;
 use chrono::{DateTime, Duration, Utc};
+use clock;
+use health;
 use rand::{self, Rng};
-use states::{Probe, State, StateChangeImpl, StateMachine};
-use std::sync::{Arc, Condvar, Mutex};
-use std::thread;
+use states::{Idle, Install, Probe, State, StateChangeImpl, StateMachine};
+use update_package::UpdatePackage;
+use usb;
+
+use std::cmp;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time;
+
+/// Longest time slept at once, so a jump of the wall clock is noticed
+/// while waiting for the next probe.
+const MAX_SLEEP: time::Duration = time::Duration::from_secs(60);
+
+/// Difference, in seconds, between the wall-clock and monotonic
+/// elapsed times above which the wall clock is taken as jumped.
+const MAX_CLOCK_DRIFT: i64 = 10;
 
 #[derive(Debug, PartialEq)]
 pub struct Poll {}
 
+create_state_step!(Poll => Idle);
 create_state_step!(Poll => Probe);
 
+/// Waits until the wall-clock `deadline`, or until `interrupted`
+/// returns true, as checked between the sleeps.
+///
+/// The wait is counted with the monotonic clock, so a wall clock
+/// moved backwards, by NTP for instance, does not delay the probe. As
+/// the monotonic clock does not advance while the device is suspended,
+/// a wall clock moved forwards re-plans the wait from the deadline.
+fn wait_until<F>(deadline: DateTime<Utc>, interrupted: F) -> Result<()>
+where
+    F: Fn() -> bool,
+{
+    let mut remaining = deadline.signed_duration_since(clock::now());
+    let (mut wall, mut monotonic) = (clock::now(), clock::monotonic());
+
+    while remaining > Duration::zero() {
+        cancel::check()?;
+        if interrupted() {
+            return Ok(());
+        }
+        health::beat("waiting for the next probe");
+        clock::sleep(cmp::min(remaining.to_std().unwrap_or_default(), MAX_SLEEP));
+
+        let (now, now_monotonic) = (clock::now(), clock::monotonic());
+        let slept =
+            Duration::from_std(now_monotonic - monotonic).unwrap_or_else(|_| Duration::zero());
+        let drift = now.signed_duration_since(wall) - slept;
+        remaining = remaining - slept;
+
+        if drift.num_seconds().abs() > MAX_CLOCK_DRIFT {
+            info!(
+                "Clock jumped by {}s, re-planning the next probe.",
+                drift.num_seconds()
+            );
+            remaining = cmp::min(remaining, deadline.signed_duration_since(now));
+        }
+
+        wall = now;
+        monotonic = now_monotonic;
+    }
+
+    Ok(())
+}
+
+/// Programs the RTC wake alarm at `path` for `time`. An armed alarm
+/// cannot be replaced, so it is cleared first.
+fn set_wake_alarm(path: &Path, time: DateTime<Utc>) -> Result<()> {
+    fs::write(path, "0")?;
+    fs::write(path, time.timestamp().to_string())?;
+    Ok(())
+}
+
 /// Implements the state change for `State<Poll>`.
 ///
 /// This state is used to control when to go to the `State<Probe>`.
 impl StateChangeImpl for State<Poll> {
     fn handle(self) -> Result<StateMachine> {
-        let current_time: DateTime<Utc> = Utc::now();
+        let current_time: DateTime<Utc> = clock::now();
+
+        if let Some((dir, update_package)) = self.local_update() {
+            return self.install_local(&dir, update_package);
+        }
+
+        if !self.settings.polling.enabled {
+            debug!("Polling is disabled, only watching the local sources.");
+            self.wait(current_time + self.settings.polling.interval)?;
+            return match self.local_update() {
+                Some((dir, update_package)) => self.install_local(&dir, update_package),
+                None => Ok(StateMachine::Idle(self.into())),
+            };
+        }
 
         let probe_now = self.runtime_settings.polling.now;
         if probe_now {
@@ -29,45 +110,98 @@ impl StateChangeImpl for State<Poll> {
             return Ok(StateMachine::Probe(self.into()));
         }
 
-        let last_poll = self.runtime_settings.polling.last.unwrap_or_else(|| {
-            // When no polling has been done before, we choose an
-            // offset between current time and the intended polling
-            // interval and use it as last_poll
-            let mut rnd = rand::thread_rng();
-            let interval = self.settings.polling.interval.num_seconds();
-            let offset = Duration::seconds(rnd.gen_range(0, interval));
-
-            current_time + offset
-        });
+        let last_poll = match self.runtime_settings.polling.last {
+            Some(last) => last,
+            None if self.settings.polling.probe_on_first_boot => {
+                debug!("Moving to Probe state as no polling has been done before.");
+                return Ok(StateMachine::Probe(self.into()));
+            }
+            None => {
+                // When no polling has been done before, we choose an
+                // offset between current time and the intended polling
+                // interval and use it as last_poll
+                let mut rnd = rand::thread_rng();
+                let interval = self.settings.polling.interval.num_seconds();
+                let offset = Duration::seconds(rnd.gen_range(0, interval));
+
+                current_time - offset
+            }
+        };
 
         if last_poll > current_time {
             info!("Forcing to Probe state as last polling seems to happened in future.");
             return Ok(StateMachine::Probe(self.into()));
         }
 
-        let extra_interval = self.runtime_settings.polling.extra_interval;
-        if last_poll + extra_interval.unwrap_or_else(|| Duration::seconds(0)) < current_time {
-            debug!("Moving to Probe state as the polling's due extra interval.");
+        let interval = self
+            .runtime_settings
+            .polling
+            .extra_interval
+            .unwrap_or(self.settings.polling.interval);
+        if last_poll + interval <= current_time {
+            debug!("Moving to Probe state as the polling is due.");
             return Ok(StateMachine::Probe(self.into()));
         }
 
-        let probe = Arc::new((Mutex::new(()), Condvar::new()));
-        let probe2 = probe.clone();
-        let interval = self.settings.polling.interval;
-        thread::spawn(move || {
-            let (_, ref cvar) = *probe2;
-            thread::sleep(interval.to_std().unwrap());
-            cvar.notify_one();
-        });
+        if let Some(ref alarm) = self.settings.polling.wake_alarm {
+            debug!("Programming the wake alarm for the next probe.");
+            if let Err(e) = set_wake_alarm(alarm, last_poll + interval) {
+                error!("Failed to program the wake alarm: {}", e);
+            }
+        }
 
-        let (ref lock, ref cvar) = *probe;
-        let _ = cvar.wait(lock.lock().unwrap());
+        self.wait(last_poll + interval)?;
+        if let Some((dir, update_package)) = self.local_update() {
+            return self.install_local(&dir, update_package);
+        }
 
         debug!("Moving to Probe state.");
         Ok(StateMachine::Probe(self.into()))
     }
 }
 
+impl State<Poll> {
+    /// Waits until `deadline`, or until an update package is found on
+    /// the local sources.
+    fn wait(&self, deadline: DateTime<Utc>) -> Result<()> {
+        wait_until(deadline, || self.local_update().is_some())
+    }
+
+    /// Returns the update package to install from the local sources,
+    /// with the directory it was found in, if there is one.
+    fn local_update(&self) -> Option<(PathBuf, UpdatePackage)> {
+        if self.settings.update.local_sources.is_empty() {
+            return None;
+        }
+
+        usb::pending(
+            &self.settings.update.local_sources,
+            self.settings
+                .update
+                .local_sources_key
+                .as_ref()
+                .map(|k| k.as_path()),
+            self.settings.update.temp_dir(),
+            &self.firmware,
+            &self.runtime_settings,
+        )
+    }
+
+    /// Moves to the install of `update_package`, found in `dir`, once
+    /// its objects are copied from there.
+    fn install_local(self, dir: &Path, update_package: UpdatePackage) -> Result<StateMachine> {
+        info!("Installing the update package found in '{}'", dir.display());
+        update_package.fetch_local(dir, &self.settings.update.download_dir)?;
+
+        Ok(StateMachine::Install(State {
+            settings: self.settings,
+            runtime_settings: self.runtime_settings,
+            firmware: self.firmware,
+            state: Install { update_package },
+        }))
+    }
+}
+
 #[test]
 fn extra_poll_in_past() {
     use super::*;
@@ -134,16 +268,21 @@ fn last_poll_in_future() {
 }
 
 #[test]
-fn interval_1_second() {
+fn interval_1_day() {
     use super::*;
+    use clock::{Clock, VirtualClock};
     use firmware::tests::{create_fake_metadata, FakeDevice};
 
+    let start = Utc::now();
+    let virtual_clock = VirtualClock::new(start);
+    clock::set(Box::new(virtual_clock.clone()));
+
     let mut settings = Settings::default();
     settings.polling.enabled = true;
-    settings.polling.interval = Duration::seconds(1);
+    settings.polling.interval = Duration::days(1);
 
     let mut runtime_settings = RuntimeSettings::default();
-    runtime_settings.polling.last = Some(Utc::now());
+    runtime_settings.polling.last = Some(start);
 
     let machine = StateMachine::Poll(State {
         settings,
@@ -153,6 +292,180 @@ fn interval_1_second() {
     }).move_to_next_state();
 
     assert_state!(machine, Probe);
+    assert_eq!(virtual_clock.now(), start + Duration::days(1));
+}
+
+#[test]
+fn wake_alarm() {
+    use super::*;
+    use clock::VirtualClock;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use tempfile::NamedTempFile;
+
+    let start = Utc::now();
+    clock::set(Box::new(VirtualClock::new(start)));
+    let alarm = NamedTempFile::new().unwrap();
+
+    let mut settings = Settings::default();
+    settings.polling.interval = Duration::days(1);
+    settings.polling.wake_alarm = Some(alarm.path().to_path_buf());
+
+    let mut runtime_settings = RuntimeSettings::default();
+    runtime_settings.polling.last = Some(start);
+
+    let machine = StateMachine::Poll(State {
+        settings,
+        runtime_settings,
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Poll {},
+    }).move_to_next_state();
+
+    assert_state!(machine, Probe);
+    assert_eq!(
+        fs::read_to_string(alarm.path()).unwrap(),
+        (start + Duration::days(1)).timestamp().to_string()
+    );
+}
+
+#[test]
+fn first_boot() {
+    use super::*;
+    use clock::{Clock, VirtualClock};
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+
+    for &probe_on_first_boot in &[false, true] {
+        let start = Utc::now();
+        let virtual_clock = VirtualClock::new(start);
+        clock::set(Box::new(virtual_clock.clone()));
+
+        let mut settings = Settings::default();
+        settings.polling.interval = Duration::days(1);
+        settings.polling.probe_on_first_boot = probe_on_first_boot;
+
+        let machine = StateMachine::Poll(State {
+            settings,
+            runtime_settings: RuntimeSettings::default(),
+            firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+            state: Poll {},
+        }).move_to_next_state();
+
+        assert_state!(machine, Probe);
+        let waited = virtual_clock.now() - start;
+        if probe_on_first_boot {
+            assert_eq!(waited, Duration::zero());
+        } else {
+            // The first probe is spread over the polling interval
+            assert!(waited > Duration::zero() && waited <= Duration::days(1));
+        }
+    }
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn local_update() {
+    use super::*;
+    use clock::{Clock, VirtualClock};
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use tempfile::tempdir;
+    use update_package::tests::{create_fake_object, get_update_json};
+
+    let start = Utc::now();
+    let virtual_clock = VirtualClock::new(start);
+    clock::set(Box::new(virtual_clock.clone()));
+
+    let media = tempdir().unwrap();
+    let download_dir = tempdir().unwrap();
+    let keys = tempdir().unwrap();
+    let (private, public) = usb::create_fake_keys(keys.path());
+    let settings = || {
+        let mut settings = Settings::default();
+        settings.polling.enabled = false;
+        settings.update.download_dir = download_dir.path().to_path_buf();
+        settings.update.local_sources = vec![media.path().to_string_lossy().into()];
+        settings.update.local_sources_key = Some(public.clone());
+        settings
+    };
+
+    let state = || State {
+        settings: settings(),
+        runtime_settings: RuntimeSettings::default(),
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Poll {},
+    };
+
+    // Nothing found for a whole interval
+    let machine = StateMachine::Poll(state()).move_to_next_state();
+    assert_state!(machine, Idle);
+    assert_eq!(virtual_clock.now(), start + Duration::days(1));
+
+    let dir = media.path().join(usb::PACKAGE_DIR);
+    fs::create_dir(&dir).unwrap();
+    fs::write(dir.join(usb::METADATA_FILE), get_update_json().to_string()).unwrap();
+    usb::sign(&dir.join(usb::METADATA_FILE), &private).unwrap();
+    let mut package_settings = Settings::default();
+    package_settings.update.download_dir = dir.clone();
+    create_fake_object(&package_settings);
+
+    match StateMachine::Poll(state()).move_to_next_state() {
+        Ok(StateMachine::Install(s)) => s
+            .state
+            .update_package
+            .ensure_objects_ready(download_dir.path())
+            .unwrap(),
+        Ok(s) => panic!("Invalid success: {:?}", s),
+        Err(e) => panic!("Invalid error: {:?}", e),
+    }
+}
+
+#[cfg(test)]
+fn wait_with_clock_jump(jump: Duration) -> (Duration, time::Duration) {
+    use clock::{Clock, VirtualClock};
+    use std::cell::Cell;
+
+    // Clock which jumps on the first sleep
+    struct JumpingClock(VirtualClock, Cell<Option<Duration>>);
+
+    impl Clock for JumpingClock {
+        fn now(&self) -> DateTime<Utc> {
+            self.0.now()
+        }
+
+        fn monotonic(&self) -> time::Duration {
+            self.0.monotonic()
+        }
+
+        fn sleep(&self, duration: time::Duration) {
+            self.0.sleep(duration);
+            if let Some(jump) = self.1.take() {
+                self.0.jump(jump);
+            }
+        }
+    }
+
+    let start = Utc::now();
+    let virtual_clock = VirtualClock::new(start);
+    let jump = Cell::new(Some(jump));
+    clock::set(Box::new(JumpingClock(virtual_clock.clone(), jump)));
+
+    wait_until(start + Duration::days(1), || false).unwrap();
+
+    (virtual_clock.now() - start, virtual_clock.monotonic())
+}
+
+#[test]
+fn suspended_while_waiting() {
+    // The hours spent suspended count for the interval
+    let (wall, monotonic) = wait_with_clock_jump(Duration::hours(12));
+    assert_eq!(wall, Duration::days(1));
+    assert_eq!(monotonic, time::Duration::from_secs(12 * 3600));
+}
+
+#[test]
+fn clock_set_back_while_waiting() {
+    // A wall clock set back does not delay the probe
+    let (wall, monotonic) = wait_with_clock_jump(-Duration::hours(1));
+    assert_eq!(wall, Duration::hours(23));
+    assert_eq!(monotonic, time::Duration::from_secs(24 * 3600));
 }
 
 #[test]
@@ -173,3 +486,19 @@ fn never_polled() {
 
     assert_state!(machine, Probe);
 }
+
+#[test]
+fn cancelled_while_waiting() {
+    use clock::{Clock, VirtualClock};
+
+    let start = Utc::now();
+    let virtual_clock = VirtualClock::new(start);
+    clock::set(Box::new(virtual_clock.clone()));
+
+    let token = cancel::Token::new();
+    cancel::set(token.clone());
+    token.cancel();
+
+    assert!(wait_until(start + Duration::days(1), || false).is_err());
+    assert_eq!(virtual_clock.now(), start);
+}
@@ -5,9 +5,15 @@
 
 use Result;
 
+use cancel;
+use cleanup;
 use client::Api;
 use failure::ResultExt;
-use states::{Download, Idle, Poll, State, StateChangeImpl, StateMachine};
+use health;
+use settings;
+use states::{backoff, Download, Idle, Poll, State, StateChangeImpl, StateMachine};
+use time_sanity;
+use usage;
 
 #[derive(Debug, PartialEq)]
 pub struct Probe {}
@@ -20,28 +26,69 @@ impl StateChangeImpl for State<Probe> {
     fn handle(mut self) -> Result<StateMachine> {
         use chrono::Duration;
         use client::ProbeResponse;
-        use std::thread;
+        use clock;
 
         let r = loop {
-            let probe = Api::new(&self.settings, &self.runtime_settings, &self.firmware).probe();
+            cancel::check()?;
+            let time_source = self.settings.network.time_source.as_ref();
+            let probe = time_sanity::ensure(time_source.map(|s| s.as_str())).and_then(|_| {
+                Api::new(&self.settings, &self.runtime_settings, &self.firmware).probe()
+            });
             if let Err(e) = probe {
                 error!("{}", e);
                 self.runtime_settings.polling.retries += 1;
-                thread::sleep(Duration::seconds(1).to_std().unwrap());
+                // The server may be unreachable for longer than the
+                // watchdog waits for any activity
+                health::beat("waiting to retry the probe");
+                clock::sleep(backoff(self.runtime_settings.polling.retries));
             } else {
                 self.runtime_settings.polling.retries = 0;
+                self.runtime_settings.polling.last = Some(clock::now());
+                self.runtime_settings.polling.now = false;
                 break probe?;
             }
         };
 
+        // Reaching the server validates the installed update
+        if self.runtime_settings.update.pending_cleanup {
+            match cleanup::clear(&self.settings.update.download_dir) {
+                Ok(()) => self.runtime_settings.update.pending_cleanup = false,
+                Err(e) => error!("Failed to clean up the download directory: {}", e),
+            }
+        }
+
+        // As does it for a new agent binary, once started
+        if self.runtime_settings.update.pending_agent_starts > 0 {
+            if let Some(agent) = self.runtime_settings.update.pending_agent.take() {
+                info!("New agent at '{}' reached the server", agent.display());
+            }
+            self.runtime_settings.update.pending_agent_starts = 0;
+        }
+
+        if !self.settings.network.remote_settings.is_empty() {
+            if let Err(e) = self.update_remote_settings() {
+                error!("Failed to update the remote settings: {}", e);
+            }
+        }
+
         self.runtime_settings.polling.extra_interval = match r {
             ProbeResponse::ExtraPoll(s) => {
                 info!("Delaying the probing as requested by the server.");
                 Some(Duration::seconds(s))
             }
+            ProbeResponse::RolloutWait { ref phase, wait } => {
+                info!(
+                    "Waiting {}s for the rollout phase {} of the device.",
+                    wait,
+                    phase.as_ref().map_or("(unnamed)", |p| p.as_str())
+                );
+                Some(Duration::seconds(wait))
+            }
             _ => None,
         };
 
+        self.runtime_settings.usage.add(clock::now(), usage::take());
+
         // Save any changes we due the probing
         if !self.settings.storage.read_only {
             debug!("Saving runtime settings.");
@@ -58,11 +105,22 @@ impl StateChangeImpl for State<Probe> {
                 Ok(StateMachine::Idle(self.into()))
             }
 
-            ProbeResponse::ExtraPoll(_) => {
+            ProbeResponse::ExtraPoll(_) | ProbeResponse::RolloutWait { .. } => {
                 debug!("Moving to Poll state due the extra polling interval.");
                 Ok(StateMachine::Poll(self.into()))
             }
 
+            ProbeResponse::InvalidUpdate { package_uid, error } => {
+                error!("Invalid update package {}: {}", package_uid, error);
+                let api = Api::new(&self.settings, &self.runtime_settings, &self.firmware);
+                if let Err(e) = api.report("error", &package_uid, &error.to_string()) {
+                    error!("Failed to report the invalid update package: {}", e);
+                }
+
+                debug!("Moving to Idle state as the update package is invalid.");
+                Ok(StateMachine::Idle(self.into()))
+            }
+
             ProbeResponse::Update(u) => {
                 // Ensure the package is compatible
                 u.compatible_with(&self.firmware)?;
@@ -87,6 +145,63 @@ impl StateChangeImpl for State<Probe> {
     }
 }
 
+impl State<Probe> {
+    /// Applies the settings managed by the server, when they have
+    /// changed.
+    fn update_remote_settings(&mut self) -> Result<()> {
+        let api = Api::new(&self.settings, &self.runtime_settings, &self.firmware);
+        let remote = match api.remote_settings()? {
+            Some(r) => r,
+            None => return Ok(()),
+        };
+
+        self.settings = self.settings.apply_remote(&remote.settings)?;
+        settings::set_remote(&remote.settings);
+        info!("Using remote settings version {}", remote.version);
+        self.runtime_settings.remote_settings = Some(remote.version);
+
+        Ok(())
+    }
+}
+
+#[test]
+fn pending_cleanup() {
+    use super::*;
+    use client::tests::{create_mock_server, FakeServer};
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use std::fs;
+    use update_package::tests::{create_fake_object, create_fake_settings};
+
+    let mut settings = create_fake_settings();
+    settings.storage.read_only = true;
+    create_fake_object(&settings);
+    let download_dir = settings.update.download_dir.clone();
+
+    let mut runtime_settings = RuntimeSettings::default();
+    runtime_settings.update.pending_cleanup = true;
+    runtime_settings.update.pending_agent = Some("/usr/bin/updatehub".into());
+    runtime_settings.update.pending_agent_starts = 1;
+
+    let mock = create_mock_server(FakeServer::NoUpdate);
+    let machine = StateMachine::Probe(State {
+        settings,
+        runtime_settings,
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Probe {},
+    }).move_to_next_state();
+    mock.assert();
+
+    match machine {
+        Ok(StateMachine::Idle(s)) => {
+            assert!(!s.runtime_settings.update.pending_cleanup);
+            assert_eq!(s.runtime_settings.update.pending_agent, None);
+        }
+        Ok(s) => panic!("Invalid success: {:?}", s),
+        Err(e) => panic!("Invalid error: {:?}", e),
+    }
+    assert_eq!(fs::read_dir(&download_dir).unwrap().count(), 0);
+}
+
 #[test]
 fn update_not_available() {
     use super::*;
@@ -116,6 +231,7 @@ fn update_not_available() {
 }
 
 #[test]
+#[cfg(feature = "mode-test")]
 fn update_available() {
     use super::*;
     use client::tests::{create_mock_server, FakeServer};
@@ -144,6 +260,7 @@ fn update_available() {
 }
 
 #[test]
+#[cfg(feature = "mode-test")]
 fn invalid_hardware() {
     use super::*;
     use client::tests::{create_mock_server, FakeServer};
@@ -199,6 +316,48 @@ fn extra_poll_interval() {
     assert_state!(machine, Poll);
 }
 
+#[test]
+fn rollout_wait() {
+    use super::*;
+    use chrono::Duration;
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use mockito::mock;
+    use std::fs;
+    use tempfile::NamedTempFile;
+
+    let tmpfile = NamedTempFile::new().unwrap();
+    let tmpfile = tmpfile.path();
+    fs::remove_file(&tmpfile).unwrap();
+
+    let mut settings = Settings::default();
+    settings.network.rollout_group = Some("late-adopters".into());
+
+    let mock = mock("POST", "/upgrades")
+        .match_header("Rollout-Group", "late-adopters")
+        .with_status(200)
+        .with_header("Rollout-Wait", "600")
+        .create();
+
+    let machine = StateMachine::Probe(State {
+        settings,
+        runtime_settings: RuntimeSettings::new()
+            .load(tmpfile.to_str().unwrap())
+            .unwrap(),
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Probe {},
+    }).move_to_next_state();
+
+    mock.assert();
+
+    match machine {
+        Ok(StateMachine::Poll(s)) => assert_eq!(
+            s.runtime_settings.polling.extra_interval,
+            Some(Duration::seconds(600))
+        ),
+        _ => panic!("Failed to move to Poll state."),
+    }
+}
+
 #[test]
 fn skip_same_package_uid() {
     use super::*;
@@ -280,3 +439,99 @@ fn error() {
 
     assert_state!(machine, Idle);
 }
+
+#[test]
+fn long_outage() {
+    use super::*;
+    use chrono::Utc;
+    use clock::{self, Clock, SystemClock, VirtualClock};
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use health::{WatchedClock, STALL_TIMEOUT};
+    use mockito::mock;
+    use states::MAX_BACKOFF;
+    use update_package::tests::create_fake_settings;
+
+    let watched = WatchedClock::new(VirtualClock::new(Utc::now()));
+    clock::set(Box::new(watched.clone()));
+
+    // The server is only reached once retried for hours
+    let mock = mock("POST", "/upgrades")
+        .match_header("Api-Retries", "20")
+        .with_status(404)
+        .create();
+    let mut settings = create_fake_settings();
+    settings.storage.read_only = true;
+    let machine = StateMachine::Probe(State {
+        settings,
+        runtime_settings: RuntimeSettings::default(),
+        firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+        state: Probe {},
+    }).move_to_next_state();
+    clock::set(Box::new(SystemClock));
+    mock.assert();
+
+    assert_state!(machine, Idle);
+    assert!(watched.monotonic() > STALL_TIMEOUT);
+    assert!(watched.longest_idle() <= MAX_BACKOFF);
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn invalid_update() {
+    use super::*;
+    use crypto_hash::{hex_digest, Algorithm};
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use mockito::{mock, Matcher};
+    use update_package::tests::{create_fake_settings, get_update_json};
+
+    let mut unsupported = get_update_json();
+    unsupported["objects"][0]["mode"] = json!("ubifs");
+    let mut incomplete = get_update_json();
+    incomplete["objects"][0]
+        .as_object_mut()
+        .unwrap()
+        .remove("target");
+
+    for &(ref package, error) in &[
+        (
+            unsupported.to_string(),
+            "objects\\[0\\]: unsupported install mode 'ubifs'",
+        ),
+        (
+            incomplete.to_string(),
+            "objects\\[0\\].target: missing field",
+        ),
+        ("{\"objects\": [".to_string(), ""),
+        ("[".repeat(100), "Metadata is nested too deeply"),
+    ] {
+        let upgrades = mock("POST", "/upgrades")
+            .match_header("Rollout-Group", "invalid-update")
+            .with_status(200)
+            .with_body(package)
+            .expect(1)
+            .create();
+        let report = mock("POST", "/report")
+            .match_body(Matcher::Regex(format!(
+                r#""status":"error","package-uid":"{}","error-message":"{}"#,
+                hex_digest(Algorithm::SHA256, package.as_bytes()),
+                error
+            )))
+            .with_status(200)
+            .expect(1)
+            .create();
+
+        let mut settings = create_fake_settings();
+        settings.storage.read_only = true;
+        settings.network.rollout_group = Some("invalid-update".into());
+        let machine = StateMachine::Probe(State {
+            settings,
+            runtime_settings: RuntimeSettings::default(),
+            firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+            state: Probe {},
+        }).move_to_next_state();
+        upgrades.assert();
+        report.assert();
+
+        assert_state!(machine, Idle);
+    }
+}
@@ -5,26 +5,48 @@
 
 use Result;
 
-use easy_process;
+use process;
 use states::{Idle, State, StateChangeImpl, StateMachine};
 
+use std::cell::Cell;
+
 #[derive(Debug, PartialEq)]
 pub struct Reboot {}
 
 create_state_step!(Reboot => Idle);
 
+thread_local! {
+    /// Number of reboots simulated by the current thread, which runs
+    /// the reboot command when it simulates none.
+    static SIMULATED: Cell<Option<usize>> = Cell::new(None);
+}
+
+/// Makes the reboots of the current thread simulated, or run the
+/// reboot command again.
+pub(crate) fn simulate(simulated: bool) {
+    SIMULATED.with(|s| s.set(if simulated { Some(0) } else { None }));
+}
+
+/// Returns the number of reboots simulated by the current thread.
+pub(crate) fn simulated() -> usize {
+    SIMULATED.with(|s| s.get().unwrap_or(0))
+}
+
 impl StateChangeImpl for State<Reboot> {
-    // FIXME: When adding state-chance hooks, we need to go to Idle if
-    // cancelled.
     fn handle(self) -> Result<StateMachine> {
-        info!("Triggering reboot");
-        let output = easy_process::run("reboot")?;
-        if !output.stdout.is_empty() || !output.stderr.is_empty() {
-            info!(
-                "  reboot output: stdout: {}, stderr: {}",
-                output.stdout, output.stderr
-            );
+        if self.settings.update.dry_run {
+            info!("Skipping reboot, dry-run mode enabled.");
+            return Ok(StateMachine::Idle(self.into()));
         }
+
+        if let Some(reboots) = SIMULATED.with(Cell::get) {
+            info!("Simulating reboot");
+            SIMULATED.with(|s| s.set(Some(reboots + 1)));
+            return Ok(StateMachine::Idle(self.into()));
+        }
+
+        info!("Triggering reboot");
+        process::run("reboot")?;
         Ok(StateMachine::Idle(self.into()))
     }
 }
@@ -65,16 +87,41 @@ mod test {
         let tmpdir = tempdir().unwrap();
         let tmpdir = tmpdir.path();
         create_reboot(&tmpdir);
-        env::set_var("PATH", format!("{}", &tmpdir.to_string_lossy()));
+        // Other tests run commands of their own from PATH
+        let path = env::var("PATH").unwrap_or_default();
+        env::set_var("PATH", format!("{}:{}", &tmpdir.to_string_lossy(), path));
+
+        let machine = StateMachine::Reboot(State {
+            settings: Settings::default(),
+            runtime_settings: RuntimeSettings::default(),
+            firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
+            state: Reboot {},
+        }).move_to_next_state();
+
+        assert!(machine.is_ok(), "Error: {:?}", machine);
+        assert_state!(machine, Idle);
+    }
+
+    #[test]
+    fn simulated_reboot() {
+        use firmware::tests::{create_fake_metadata, FakeDevice};
+        use firmware::Metadata;
+        use runtime_settings::RuntimeSettings;
+        use settings::Settings;
 
+        // Counted instead of running the reboot command
+        simulate(true);
         let machine = StateMachine::Reboot(State {
             settings: Settings::default(),
             runtime_settings: RuntimeSettings::default(),
             firmware: Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap(),
             state: Reboot {},
         }).move_to_next_state();
+        let reboots = simulated();
+        simulate(false);
 
         assert!(machine.is_ok(), "Error: {:?}", machine);
         assert_state!(machine, Idle);
+        assert_eq!(reboots, 1);
     }
 }
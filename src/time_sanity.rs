@@ -0,0 +1,167 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Sanity of the system clock
+//!
+//! Devices without an RTC boot with their clock in 1970, and every
+//! certificate of the server is then taken as not valid yet. Before
+//! probing, the clock is checked against the build time of the agent,
+//! which it cannot be earlier than. An invalid clock is set from the
+//! `Date` header returned by `Network/TimeSource`, when configured and
+//! passing the same check, and the probe fails with a `TimeError`
+//! otherwise, so the problem is reported as such instead of as a TLS
+//! failure.
+
+use Result;
+
+use chrono::{DateTime, Utc};
+#[cfg(target_os = "linux")]
+use libc;
+use reqwest::Client;
+
+#[cfg(target_os = "linux")]
+use std::io;
+use std::time::Duration;
+
+use build_info;
+use clock;
+
+#[derive(Debug, Fail)]
+pub enum TimeError {
+    #[fail(
+        display = "System clock is invalid, {} is before the agent was built",
+        _0
+    )]
+    InvalidClock(DateTime<Utc>),
+    #[fail(
+        display = "Time source {} replied {}, which is before the agent was built",
+        _0, _1
+    )]
+    InvalidSource(String, DateTime<Utc>),
+}
+
+/// Returns whether `now` can be the current time, as it is not before
+/// the build time of the agent.
+pub fn is_sane(now: DateTime<Utc>) -> bool {
+    DateTime::parse_from_rfc3339(build_info::build_time())
+        .map(|built| now >= built)
+        .unwrap_or(true)
+}
+
+/// Ensures the system clock is valid, setting it from `time_source`,
+/// if any, when it is not.
+pub fn ensure(time_source: Option<&str>) -> Result<()> {
+    let now = clock::now();
+    if is_sane(now) {
+        return Ok(());
+    }
+
+    let source = match time_source {
+        Some(source) => source,
+        None => return Err(TimeError::InvalidClock(now).into()),
+    };
+
+    warn!(
+        "System clock is invalid ({}), fetching the time from {}",
+        now, source
+    );
+    let time = fetch(source)?;
+    if !is_sane(time) {
+        return Err(TimeError::InvalidSource(source.to_string(), time).into());
+    }
+    set_system_time(time)?;
+    info!("System clock set to {}", time);
+
+    Ok(())
+}
+
+/// Returns the time given by the `Date` header of the reply of `url`.
+/// It is meant to be a plain HTTP URL, as no certificate can be
+/// validated until the clock is set.
+fn fetch(url: &str) -> Result<DateTime<Utc>> {
+    let response = Client::builder()
+        .timeout(Duration::from_secs(10))
+        .build()?
+        .head(url)
+        .send()?;
+
+    let date = response
+        .headers()
+        .get_raw("Date")
+        .and_then(|d| d.one())
+        .map(|d| String::from_utf8_lossy(d).into_owned())
+        .ok_or_else(|| format_err!("Time source {} replied without a date", url))?;
+
+    Ok(DateTime::parse_from_rfc2822(&date)
+        .map_err(|_| format_err!("Time source {} replied an invalid date: {}", url, date))?
+        .with_timezone(&Utc))
+}
+
+#[cfg(target_os = "linux")]
+fn set_system_time(time: DateTime<Utc>) -> Result<()> {
+    let spec = libc::timespec {
+        tv_sec: time.timestamp() as libc::time_t,
+        tv_nsec: 0,
+    };
+
+    if unsafe { libc::clock_settime(libc::CLOCK_REALTIME, &spec) } != 0 {
+        return Err(io::Error::last_os_error().into());
+    }
+
+    Ok(())
+}
+
+/// The clock is only stepped on Linux, the other systems running the
+/// agent for development only.
+#[cfg(not(target_os = "linux"))]
+fn set_system_time(time: DateTime<Utc>) -> Result<()> {
+    bail!(
+        "Setting the system clock to {} is only supported on Linux",
+        time
+    )
+}
+
+#[test]
+fn sanity() {
+    use chrono::TimeZone;
+
+    assert!(is_sane(Utc::now()));
+    assert!(!is_sane(Utc.ymd(1970, 1, 1).and_hms(0, 0, 0)));
+}
+
+#[test]
+fn time_source() {
+    use mockito::{mock, SERVER_URL};
+
+    let _mock = mock("HEAD", "/time")
+        .with_header("Date", "Tue, 15 Nov 1994 08:12:31 GMT")
+        .create();
+    let time = fetch(&format!("{}/time", SERVER_URL)).unwrap();
+    assert_eq!(time.to_rfc3339(), "1994-11-15T08:12:31+00:00");
+
+    let _mock = mock("HEAD", "/time-invalid")
+        .with_header("Date", "yesterday")
+        .create();
+    assert!(fetch(&format!("{}/time-invalid", SERVER_URL)).is_err());
+}
+
+#[test]
+fn invalid_time_source() {
+    use chrono::TimeZone;
+    use clock::VirtualClock;
+    use mockito::{mock, SERVER_URL};
+
+    // A time source which is off as well is not used to set the clock
+    let epoch = Utc.ymd(1970, 1, 1).and_hms(0, 0, 0);
+    clock::set(Box::new(VirtualClock::new(epoch)));
+    let _mock = mock("HEAD", "/time-before-build")
+        .with_header("Date", "Tue, 15 Nov 1994 08:12:31 GMT")
+        .create();
+    let error = ensure(Some(&format!("{}/time-before-build", SERVER_URL))).unwrap_err();
+    match error.downcast_ref::<TimeError>() {
+        Some(TimeError::InvalidSource(..)) => {}
+        _ => panic!("Unexpected error: {}", error),
+    }
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Digests the objects are verified with
+//!
+//! Objects are named after their SHA-256, which they are verified with
+//! unless their metadata declares another digest, as `sha512sum`, which
+//! is faster to compute than SHA-256 on 64-bit CPUs without SHA
+//! extensions. The hashing is done by the system crypto library, which
+//! picks the SHA extensions of the CPU (SHA-NI, ARMv8 crypto) at
+//! runtime when there are some.
+//!
+//! The objects already downloaded are verified in parallel, by up to a
+//! worker per CPU, and no more than `MAX_JOBS` reading at once so the
+//! storage is not thrashed, shortening the resume of an update on
+//! multi-core gateways.
+
+use Result;
+
+use crypto_hash::{self, Hasher};
+use hex;
+
+use libc;
+
+use std::cmp;
+use std::fs::File;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::mpsc::channel;
+use std::sync::{Arc, Mutex};
+use std::thread;
+
+use memory;
+
+/// Maximum number of files verified at once.
+const MAX_JOBS: usize = 4;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Algorithm {
+    Sha256,
+    Sha512,
+}
+
+impl Algorithm {
+    fn hasher(self) -> Hasher {
+        Hasher::new(match self {
+            Algorithm::Sha256 => crypto_hash::Algorithm::SHA256,
+            Algorithm::Sha512 => crypto_hash::Algorithm::SHA512,
+        })
+    }
+}
+
+/// Returns the hex encoded digest of the file at `path`.
+pub fn file_digest(path: &Path, algorithm: Algorithm) -> Result<String> {
+    let mut buf = memory::buffer();
+    let mut file = File::open(path)?;
+    let mut hasher = algorithm.hasher();
+    loop {
+        let len = file.read(&mut buf)?;
+        if len == 0 {
+            break;
+        }
+        hasher.write_all(&buf[..len])?;
+    }
+
+    Ok(hex::encode(hasher.finish()))
+}
+
+/// Returns whether the file at `path` has the `expected` digest.
+pub fn verify(path: &Path, algorithm: Algorithm, expected: &str) -> Result<bool> {
+    let digest = file_digest(path, algorithm)?;
+    if digest != expected {
+        debug!(
+            "{:?} of '{}' is {}, expected {}",
+            algorithm,
+            path.display(),
+            digest,
+            expected
+        );
+        return Ok(false);
+    }
+
+    Ok(true)
+}
+
+/// Returns whether each of the `files`, with the algorithm and the
+/// digest it is expected to have, is valid, checking them in parallel.
+pub fn verify_all(files: Vec<(PathBuf, Algorithm, String)>) -> Vec<Result<bool>> {
+    let count = files.len();
+    let cpus = unsafe { libc::sysconf(libc::_SC_NPROCESSORS_ONLN) };
+    let jobs = cmp::min(cmp::min(cmp::max(cpus, 1) as usize, MAX_JOBS), count);
+
+    let queue = Arc::new(Mutex::new(files.into_iter().enumerate()));
+    let (sender, receiver) = channel();
+    for _ in 0..jobs {
+        let queue = queue.clone();
+        let sender = sender.clone();
+        thread::spawn(move || loop {
+            let next = queue.lock().unwrap().next();
+            let (i, (path, algorithm, expected)) = match next {
+                Some(file) => file,
+                None => break,
+            };
+            let result = verify(&path, algorithm, &expected);
+            if sender.send((i, result)).is_err() {
+                break;
+            }
+        });
+    }
+    drop(sender);
+
+    let mut results = receiver.iter().collect::<Vec<_>>();
+    results.sort_by_key(|&(i, _)| i);
+    results.into_iter().map(|(_, result)| result).collect()
+}
+
+#[test]
+fn parallel_verify() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let files = (0..10)
+        .map(|i| {
+            let path = dir.path().join(i.to_string());
+            fs::write(&path, i.to_string()).unwrap();
+            let mut digest = file_digest(&path, Algorithm::Sha256).unwrap();
+            if i % 3 == 0 {
+                digest = "0".repeat(64);
+            }
+            (path, Algorithm::Sha256, digest)
+        }).collect::<Vec<_>>();
+
+    let results = verify_all(files)
+        .into_iter()
+        .map(|r| r.unwrap())
+        .collect::<Vec<_>>();
+    assert_eq!(results, (0..10).map(|i| i % 3 != 0).collect::<Vec<_>>());
+
+    let missing = vec![(dir.path().join("missing"), Algorithm::Sha512, String::new())];
+    assert!(verify_all(missing)[0].is_err());
+    assert!(verify_all(Vec::new()).is_empty());
+}
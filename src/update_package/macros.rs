@@ -4,29 +4,104 @@
 //
 
 macro_rules! impl_object_for_object_types {
-    ( $( $objtype:ident ),* ) => {
+    ( $( $objtype:ident : $feature:tt ),* ) => {
         impl Object {
             pub fn status(&self, download_dir: &Path) -> Result<ObjectStatus> {
                 match *self {
-                    $( Object::$objtype(ref o) => Ok(o.status(download_dir)?), )*
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => Ok(o.status(download_dir)?),
+                    )*
+                }
+            }
+
+            pub fn stored_status(&self, download_dir: &Path) -> Result<Option<ObjectStatus>> {
+                match *self {
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.stored_status(download_dir),
+                    )*
+                }
+            }
+
+            pub fn digest(&self) -> (Algorithm, &str) {
+                match *self {
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.digest(),
+                    )*
                 }
             }
 
             pub fn filename(&self) -> &str {
                 match *self {
-                    $( Object::$objtype(ref o) => o.filename(), )*
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.filename(),
+                    )*
                 }
             }
 
             pub fn len(&self) -> u64 {
                 match *self {
-                    $( Object::$objtype(ref o) => o.len(), )*
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.len(),
+                    )*
                 }
             }
 
             pub fn sha256sum(&self) -> &str {
                 match *self {
-                    $( Object::$objtype(ref o) => o.sha256sum(), )*
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.sha256sum(),
+                    )*
+                }
+            }
+
+            pub fn depends_on(&self) -> &[String] {
+                match *self {
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.depends_on(),
+                    )*
+                }
+            }
+
+            pub fn optional(&self) -> bool {
+                match *self {
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.optional(),
+                    )*
+                }
+            }
+
+            pub fn url(&self) -> Option<&str> {
+                match *self {
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.url(),
+                    )*
+                }
+            }
+
+            pub fn transforms(&self) -> &[Transform] {
+                match *self {
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.transforms(),
+                    )*
+                }
+            }
+
+            pub fn uncompressed_size(&self) -> Option<u64> {
+                match *self {
+                    $(
+                        #[cfg(feature = $feature)]
+                        Object::$objtype(ref o) => o.uncompressed_size(),
+                    )*
                 }
             }
         }
@@ -47,6 +122,30 @@ macro_rules! impl_object_type {
             fn sha256sum(&self) -> &str {
                 &self.sha256sum
             }
+
+            fn sha512sum(&self) -> Option<&str> {
+                self.sha512sum.as_ref().map(String::as_str)
+            }
+
+            fn depends_on(&self) -> &[String] {
+                &self.depends_on
+            }
+
+            fn optional(&self) -> bool {
+                self.optional
+            }
+
+            fn url(&self) -> Option<&str> {
+                self.url.as_ref().map(String::as_str)
+            }
+
+            fn transforms(&self) -> &[Transform] {
+                &self.transforms
+            }
+
+            fn uncompressed_size(&self) -> Option<u64> {
+                self.uncompressed_size
+            }
         }
     };
 }
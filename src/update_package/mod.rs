@@ -5,25 +5,49 @@
 
 use Result;
 
+use cancel;
 use crypto_hash::{hex_digest, Algorithm};
+use failure::{Error, ResultExt};
+use memory;
 use serde_json;
 
 use firmware::Metadata;
+use progress::{Phase, Progress};
 use settings::Settings;
 
+use std::fs::{self, File};
+use std::io::{Read, Write};
+use std::path::Path;
+
 mod supported_hardware;
 use self::supported_hardware::SupportedHardware;
 
 #[macro_use]
 mod macros;
 
+mod digest;
 mod object;
+#[cfg(feature = "mode-agent")]
+pub use self::object::rollback_agent;
 use self::object::Object;
 pub use self::object::ObjectStatus;
 
+pub mod space;
+pub mod target;
+pub mod tools;
+pub mod transform;
+pub mod validate;
+
 #[cfg(test)]
 pub mod tests;
 
+/// Largest metadata accepted, as it comes from the server.
+const MAX_METADATA_SIZE: usize = 1024 * 1024;
+
+/// Deepest nesting of the metadata accepted, the valid metadata being
+/// only a few levels deep.
+const MAX_METADATA_DEPTH: usize = 16;
+
 // CHECK: https://play.rust-lang.org/?gist=b7bc6ad2c073692f96007928aac75768&version=stable
 // It does show how to match the different object types
 
@@ -38,6 +62,9 @@ pub struct UpdatePackage {
 
     objects: Vec<Object>,
 
+    #[serde(default)]
+    on_failure: FailurePolicy,
+
     #[serde(skip_deserializing)]
     raw: String,
 }
@@ -46,20 +73,113 @@ pub struct UpdatePackage {
 pub enum UpdatePackageError {
     #[fail(display = "Incompatible with hardware: {}", _0)]
     IncompatibleHardware(String),
+    #[fail(display = "Not all objects are ready for use")]
+    ObjectsNotReady,
+    #[fail(display = "Object {} depends on the unknown object {}", _0, _1)]
+    UnknownDependency(String, String),
+    #[fail(display = "Objects have circular dependencies")]
+    CircularDependency,
+    #[fail(display = "Metadata of {} bytes is too large", _0)]
+    TooLarge(usize),
+    #[fail(display = "Metadata is nested too deeply")]
+    TooDeep,
+    #[cause]
+    #[fail(display = "Metadata is not valid JSON: {}", _0)]
+    Json(serde_json::Error),
+}
+
+/// What to do when an optional object fails to install. A failure of
+/// any other object always aborts the install.
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum FailurePolicy {
+    /// Aborts the install.
+    Abort,
+    /// Installs the remaining objects, leaving a partial update.
+    Continue,
+}
+
+impl Default for FailurePolicy {
+    fn default() -> Self {
+        FailurePolicy::Abort
+    }
+}
+
+/// Returns the deepest nesting of the arrays and objects of the JSON
+/// `content`.
+fn depth(content: &str) -> usize {
+    let (mut depth, mut deepest) = (0usize, 0);
+    let (mut in_string, mut escaped) = (false, false);
+
+    for c in content.bytes() {
+        match c {
+            _ if escaped => escaped = false,
+            b'\\' if in_string => escaped = true,
+            b'"' => in_string = !in_string,
+            _ if in_string => {}
+            b'[' | b'{' => {
+                depth += 1;
+                deepest = deepest.max(depth);
+            }
+            b']' | b'}' => depth = depth.saturating_sub(1),
+            _ => {}
+        }
+    }
+
+    deepest
 }
 
 impl UpdatePackage {
+    /// Parses the metadata `content`. It comes from the server, so it
+    /// is refused before parsing when too large or too deeply nested,
+    /// and validated before it is decoded.
     pub fn parse(content: &str) -> Result<Self> {
-        let mut update_package = serde_json::from_str::<UpdatePackage>(content)?;
+        if content.len() > MAX_METADATA_SIZE {
+            return Err(UpdatePackageError::TooLarge(content.len()).into());
+        }
+        if depth(content) > MAX_METADATA_DEPTH {
+            return Err(UpdatePackageError::TooDeep.into());
+        }
+
+        validate::validate(&serde_json::from_str(content).map_err(UpdatePackageError::Json)?)?;
+        let mut update_package =
+            serde_json::from_str::<UpdatePackage>(content).map_err(UpdatePackageError::Json)?;
         update_package.raw = content.into();
 
         Ok(update_package)
     }
 
+    pub fn load(path: &Path) -> Result<Self> {
+        use std::fs::File;
+        use std::io::Read;
+
+        let mut content = String::new();
+        File::open(path)?.read_to_string(&mut content)?;
+
+        UpdatePackage::parse(&content)
+    }
+
     pub fn package_uid(&self) -> String {
         hex_digest(Algorithm::SHA256, self.raw.as_bytes())
     }
 
+    pub fn product_uid(&self) -> &str {
+        &self.product_uid
+    }
+
+    pub fn version(&self) -> &str {
+        &self.version
+    }
+
+    /// Returns the hardware supported by the package, or `None` when
+    /// it supports any.
+    pub fn supported_hardware(&self) -> Option<&[String]> {
+        match self.supported_hardware {
+            SupportedHardware::Any => None,
+            SupportedHardware::HardwareList(ref l) => Some(l),
+        }
+    }
+
     pub fn compatible_with(&self, firmware: &Metadata) -> Result<()> {
         self.supported_hardware.compatible_with(&firmware.hardware)
     }
@@ -68,15 +188,154 @@ impl UpdatePackage {
         &self.objects
     }
 
-    pub fn filter_objects(&self, settings: &Settings, filter: &ObjectStatus) -> Vec<&Object> {
-        self.objects
+    pub fn on_failure(&self) -> FailurePolicy {
+        self.on_failure
+    }
+
+    /// Returns the objects in the order they are installed: the order
+    /// they are declared in, except that each object comes after the
+    /// ones it depends on. Depending on a filename several objects
+    /// share means depending on all of them.
+    pub fn install_order(&self) -> Result<Vec<&Object>> {
+        let known = |name: &str| self.objects.iter().any(|o| o.filename() == name);
+        for o in &self.objects {
+            if let Some(d) = o.depends_on().iter().find(|d| !known(d)) {
+                let e = UpdatePackageError::UnknownDependency(o.filename().into(), d.clone());
+                return Err(e.into());
+            }
+        }
+
+        // The objects are told apart by their index, as the filenames
+        // may be repeated
+        let mut scheduled = vec![false; self.objects.len()];
+        let mut order: Vec<&Object> = Vec::with_capacity(self.objects.len());
+        while order.len() < self.objects.len() {
+            let installed = |name: &str| {
+                self.objects
+                    .iter()
+                    .zip(&scheduled)
+                    .all(|(o, &scheduled)| scheduled || o.filename() != name)
+            };
+            let next = (0..self.objects.len()).find(|&i| {
+                !scheduled[i] && self.objects[i].depends_on().iter().all(|d| installed(d))
+            });
+
+            match next {
+                Some(i) => {
+                    scheduled[i] = true;
+                    order.push(&self.objects[i]);
+                }
+                None => return Err(UpdatePackageError::CircularDependency.into()),
+            }
+        }
+
+        Ok(order)
+    }
+
+    /// Returns the status of each object in `download_dir`. The digests
+    /// of the complete objects are checked in parallel. An object which
+    /// cannot be accessed is missing.
+    pub fn objects_status(&self, download_dir: &Path) -> Vec<(&Object, ObjectStatus)> {
+        let missing = |o: &Object, e: Error| {
+            error!("Fail accessing the object: {} (err: {})", o.sha256sum(), e);
+            ObjectStatus::Missing
+        };
+
+        let stored = self
+            .objects
+            .iter()
+            .map(|o| match o.stored_status(download_dir) {
+                Ok(status) => (o, status),
+                Err(e) => (o, Some(missing(o, e))),
+            }).collect::<Vec<_>>();
+
+        let files = stored
             .iter()
-            .filter(|o| {
-                o.status(&settings.update.download_dir)
-                    .map_err(|e| {
-                        error!("Fail accessing the object: {} (err: {})", o.sha256sum(), e)
-                    }).unwrap_or(ObjectStatus::Missing)
-                    .eq(filter)
+            .filter(|&&(_, ref status)| status.is_none())
+            .map(|&(o, _)| {
+                let (algorithm, expected) = o.digest();
+                let file = download_dir.join(o.sha256sum());
+                (file, algorithm, expected.to_string())
+            }).collect();
+        let mut verified = digest::verify_all(files).into_iter();
+
+        stored
+            .into_iter()
+            .map(|(o, status)| match status {
+                Some(status) => (o, status),
+                None => match verified.next() {
+                    Some(Ok(true)) => (o, ObjectStatus::Ready),
+                    Some(Ok(false)) => (o, ObjectStatus::Corrupted),
+                    Some(Err(e)) => (o, missing(o, e)),
+                    None => unreachable!(),
+                },
             }).collect()
     }
+
+    /// Ensures every object is stored, complete and not corrupted,
+    /// in `download_dir`.
+    pub fn ensure_objects_ready(&self, download_dir: &Path) -> Result<()> {
+        if self
+            .objects_status(download_dir)
+            .iter()
+            .all(|&(_, ref status)| *status == ObjectStatus::Ready)
+        {
+            Ok(())
+        } else {
+            Err(UpdatePackageError::ObjectsNotReady.into())
+        }
+    }
+
+    /// Copies the objects of the local update package stored in
+    /// `package_dir` to `download_dir`, as the objects of the server
+    /// are downloaded there, reporting the progress and verifying them.
+    /// The objects already there are kept.
+    pub fn fetch_local(&self, package_dir: &Path, download_dir: &Path) -> Result<()> {
+        fs::create_dir_all(download_dir)?;
+
+        let objects = self
+            .objects_status(download_dir)
+            .into_iter()
+            .filter(|&(_, ref status)| *status != ObjectStatus::Ready)
+            .map(|(o, _)| o)
+            .collect::<Vec<_>>();
+        let mut progress = Progress::new(Phase::Download, objects.iter().map(|o| o.len()).sum());
+        for object in objects {
+            let source = object.source(package_dir)?;
+            let file = download_dir.join(object.sha256sum());
+            if source == file {
+                continue;
+            }
+
+            debug!(
+                "Copying object {} from '{}'",
+                object.filename(),
+                source.display()
+            );
+            progress.start_object(object.sha256sum(), object.len(), 0);
+            let mut reader =
+                File::open(&source).context(format!("Opening the object {}", object.filename()))?;
+            let mut writer = File::create(&file)?;
+            let mut buf = memory::buffer();
+            loop {
+                cancel::check()?;
+                let len = reader.read(&mut buf)?;
+                if len == 0 {
+                    break;
+                }
+                writer.write_all(&buf[..len])?;
+                progress.advance(len as u64);
+            }
+        }
+
+        self.ensure_objects_ready(download_dir)
+    }
+
+    pub fn filter_objects(&self, settings: &Settings, filter: &ObjectStatus) -> Vec<&Object> {
+        self.objects_status(&settings.update.download_dir)
+            .into_iter()
+            .filter(|&(_, ref status)| status == filter)
+            .map(|(o, _)| o)
+            .collect()
+    }
 }
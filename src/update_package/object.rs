@@ -5,19 +5,36 @@
 
 use Result;
 
-use crypto_hash::{Algorithm, Hasher};
-use hex;
+#[cfg(feature = "mode-agent")]
+use process;
+use std::fs;
+#[cfg(feature = "mode-agent")]
 use std::fs::File;
-use std::io::BufReader;
-use std::io::Read;
-use std::io::Write;
-use std::path::Path;
+#[cfg(feature = "mode-agent")]
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
 
+use super::digest::{self, Algorithm};
+use super::tools;
+use super::transform::{self, Transform};
+
+#[cfg(not(any(feature = "mode-test", feature = "mode-agent")))]
+compile_error!("At least one install mode must be enabled, as the mode-test feature");
+
+/// Scheme of the URLs of the objects stored in local files.
+const FILE_SCHEME: &str = "file://";
+
+/// Object of an update package, by its install mode. Each mode is only
+/// built in when its `mode-<name>` feature is enabled, so those the
+/// device does not use can be left out of the binary.
 #[derive(Deserialize, PartialEq, Debug)]
 #[serde(tag = "mode")]
 #[serde(rename_all = "lowercase")]
 pub enum Object {
+    #[cfg(feature = "mode-test")]
     Test(Test),
+    #[cfg(feature = "mode-agent")]
+    Agent(Agent),
 }
 
 #[derive(PartialEq, Debug)]
@@ -30,49 +47,259 @@ pub enum ObjectStatus {
 
 trait ObjectType {
     fn status(&self, download_dir: &Path) -> Result<ObjectStatus> {
+        if let Some(status) = self.stored_status(download_dir)? {
+            return Ok(status);
+        }
+
+        let (algorithm, expected) = self.digest();
+        if digest::verify(&download_dir.join(self.sha256sum()), algorithm, expected)? {
+            Ok(ObjectStatus::Ready)
+        } else {
+            Ok(ObjectStatus::Corrupted)
+        }
+    }
+
+    /// Returns the status of the object when it is missing or
+    /// incomplete, and `None` when its digest is left to be checked.
+    fn stored_status(&self, download_dir: &Path) -> Result<Option<ObjectStatus>> {
         let object = download_dir.join(self.sha256sum());
 
         if !object.exists() {
-            return Ok(ObjectStatus::Missing);
+            return Ok(Some(ObjectStatus::Missing));
         }
 
         if object.metadata()?.len() < self.len() {
-            return Ok(ObjectStatus::Incomplete);
+            return Ok(Some(ObjectStatus::Incomplete));
         }
 
-        let mut buf = [0; 1024];
-        let mut reader = BufReader::new(File::open(object)?);
-        let mut hasher = Hasher::new(Algorithm::SHA256);
-        loop {
-            let len = reader.read(&mut buf)?;
-            hasher.write_all(&buf[..len])?;
-
-            if len == 0 {
-                break;
-            }
-        }
+        Ok(None)
+    }
 
-        if hex::encode(hasher.finish()) != self.sha256sum() {
-            println!("{:?} {:?}", &self.sha256sum(), hex::encode(hasher.finish()));
-            return Ok(ObjectStatus::Corrupted);
+    /// Returns the algorithm the object is verified with and the
+    /// digest it must have.
+    fn digest(&self) -> (Algorithm, &str) {
+        match self.sha512sum() {
+            Some(sha512sum) => (Algorithm::Sha512, sha512sum),
+            None => (Algorithm::Sha256, self.sha256sum()),
         }
-
-        Ok(ObjectStatus::Ready)
     }
 
     fn filename(&self) -> &str;
     fn len(&self) -> u64;
     fn sha256sum(&self) -> &str;
+    fn sha512sum(&self) -> Option<&str>;
+    fn depends_on(&self) -> &[String];
+    fn optional(&self) -> bool;
+    fn url(&self) -> Option<&str>;
+    fn transforms(&self) -> &[Transform];
+    fn uncompressed_size(&self) -> Option<u64>;
 }
 
+#[cfg(feature = "mode-test")]
 #[derive(Deserialize, PartialEq, Debug)]
 #[serde(rename_all = "kebab-case")]
 pub struct Test {
     filename: String,
     sha256sum: String,
+    #[serde(default)]
+    sha512sum: Option<String>,
     target: String,
     size: u64,
+    #[serde(default)]
+    depends_on: Vec<String>,
+    #[serde(default)]
+    optional: bool,
+    #[serde(default)]
+    url: Option<String>,
+    #[serde(default)]
+    transforms: Vec<Transform>,
+    #[serde(default)]
+    uncompressed_size: Option<u64>,
 }
 
-impl_object_for_object_types!(Test);
+impl_object_for_object_types!(Test: "mode-test", Agent: "mode-agent");
+#[cfg(feature = "mode-test")]
 impl_object_type!(Test);
+
+/// New binary of the agent itself, replacing the one at `target`.
+#[cfg(feature = "mode-agent")]
+#[derive(Deserialize, PartialEq, Debug)]
+#[serde(rename_all = "kebab-case")]
+pub struct Agent {
+    filename: String,
+    sha256sum: String,
+    #[serde(default)]
+    sha512sum: Option<String>,
+    target: PathBuf,
+    size: u64,
+    #[serde(default)]
+    depends_on: Vec<String>,
+    #[serde(default)]
+    optional: bool,
+    #[serde(default)]
+    url: Option<String>,
+    #[serde(default)]
+    transforms: Vec<Transform>,
+    #[serde(default)]
+    uncompressed_size: Option<u64>,
+}
+
+#[cfg(feature = "mode-agent")]
+impl_object_type!(Agent);
+
+#[cfg(feature = "mode-agent")]
+impl Agent {
+    /// Replaces the agent binary at `target` by `source`
+    /// transactionally. The new binary is written beside the target
+    /// and must reach the server, with the `config` settings of the
+    /// running one, before it takes its place. The running one is
+    /// kept as `<target>.previous`, and restored by `rollback_agent`
+    /// when the new one does not reach the server once started.
+    fn install(&self, source: &Path, target: &Path, config: &Path) -> Result<()> {
+        let new = PathBuf::from(format!("{}.new", target.display()));
+        let previous = previous_agent(target);
+
+        fs::copy(source, &new)?;
+        fs::set_permissions(&new, fs::Permissions::from_mode(0o755))?;
+        File::open(&new)?.sync_all()?;
+
+        // The running agent holds the instance lock, which the health
+        // check does not take
+        info!("Checking the health of the new agent");
+        let check = if config.as_os_str().is_empty() {
+            format!("{} health-check", process::quote(&new))
+        } else {
+            format!(
+                "{} --config {} health-check",
+                process::quote(&new),
+                process::quote(config)
+            )
+        };
+        if let Err(e) = process::run_limited(&check) {
+            fs::remove_file(&new)?;
+            bail!("New agent failed its health check: {}", e);
+        }
+
+        if target.exists() {
+            fs::rename(target, &previous)?;
+        }
+
+        if let Err(e) = fs::rename(&new, target) {
+            error!("Rolling back to the previous agent: {}", e);
+            fs::rename(&previous, target)?;
+            return Err(e.into());
+        }
+
+        if let Some(dir) = target.parent() {
+            File::open(dir)?.sync_all()?;
+        }
+
+        Ok(())
+    }
+}
+
+/// Returns where the agent binary replaced at `target` is kept.
+#[cfg(feature = "mode-agent")]
+fn previous_agent(target: &Path) -> PathBuf {
+    PathBuf::from(format!("{}.previous", target.display()))
+}
+
+/// Restores the agent binary at `target`, replaced by an update, to
+/// its previous version.
+#[cfg(feature = "mode-agent")]
+pub fn rollback_agent(target: &Path) -> Result<()> {
+    fs::rename(previous_agent(target), target)?;
+    if let Some(dir) = target.parent() {
+        File::open(dir)?.sync_all()?;
+    }
+    Ok(())
+}
+
+impl Object {
+    /// Returns the install mode of the object.
+    pub fn mode(&self) -> &'static str {
+        match *self {
+            #[cfg(feature = "mode-test")]
+            Object::Test(_) => "test",
+            #[cfg(feature = "mode-agent")]
+            Object::Agent(_) => "agent",
+        }
+    }
+
+    /// Returns where the object is installed to.
+    pub fn target(&self) -> &Path {
+        match *self {
+            #[cfg(feature = "mode-test")]
+            Object::Test(ref o) => Path::new(&o.target),
+            #[cfg(feature = "mode-agent")]
+            Object::Agent(ref o) => &o.target,
+        }
+    }
+
+    /// Returns the file of the object in the local update package
+    /// stored in `package_dir`. It is given by the `url` of the object,
+    /// either a path relative to the package or a `file://` URL, and
+    /// it is named after its checksum in the package otherwise.
+    pub fn source(&self, package_dir: &Path) -> Result<PathBuf> {
+        let url = match self.url() {
+            Some(url) => url,
+            None => return Ok(package_dir.join(self.sha256sum())),
+        };
+
+        if url.starts_with(FILE_SCHEME) {
+            return Ok(PathBuf::from(&url[FILE_SCHEME.len()..]));
+        }
+        if url.contains("://") {
+            bail!(
+                "Unsupported URL '{}' for the local object {}",
+                url,
+                self.filename()
+            );
+        }
+
+        Ok(package_dir.join(url))
+    }
+
+    /// Returns the tools needed by the install mode and the
+    /// transformations of the object which are missing.
+    pub fn missing_tools(&self) -> Vec<&'static str> {
+        let mut missing = tools::missing(self.mode());
+        missing.extend(
+            self.transforms()
+                .iter()
+                .map(|t| t.tool())
+                .filter(|t| !tools::found(t)),
+        );
+        missing
+    }
+
+    /// Installs the object, downloaded to `download_dir`, to
+    /// `target`, which is its own target once resolved. Its
+    /// transformations are applied first, in `temp_dir`, and their
+    /// result is removed once installed. The new agent binaries are
+    /// checked with the `config` system settings file.
+    #[cfg_attr(not(feature = "mode-agent"), allow(unused_variables))]
+    pub fn install(
+        &self,
+        download_dir: &Path,
+        temp_dir: &Path,
+        target: &Path,
+        config: &Path,
+    ) -> Result<()> {
+        let object = download_dir.join(self.sha256sum());
+        let source = transform::apply(self.transforms(), &object, temp_dir)?;
+
+        let result = match *self {
+            #[cfg(feature = "mode-test")]
+            Object::Test(_) => Ok(()),
+            #[cfg(feature = "mode-agent")]
+            Object::Agent(ref o) => o.install(&source, target, config),
+        };
+
+        if source != object {
+            fs::remove_file(&source)?;
+        }
+
+        result
+    }
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Forecast of the storage an update needs
+//!
+//! The objects left to download and the largest result of their
+//! transformations, given by the `uncompressed-size` of the object, or
+//! its size when it is not declared, have to fit in the filesystem of
+//! the download directory, in bytes and in inodes. The forecast tells
+//! the devices an update will fail on for lack of space before it is
+//! rolled out to them.
+
+use Result;
+
+use libc;
+
+use std::ffi::CString;
+use std::mem;
+use std::os::unix::ffi::OsStrExt;
+use std::path::Path;
+
+use super::UpdatePackage;
+
+/// Storage space, in bytes and inodes.
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+pub struct Space {
+    pub bytes: u64,
+    pub inodes: u64,
+}
+
+#[derive(Debug, PartialEq, Serialize)]
+pub struct Forecast {
+    pub required: Space,
+    pub available: Space,
+}
+
+impl Forecast {
+    /// Returns whether the update fits in the available space.
+    pub fn fits(&self) -> bool {
+        self.required.bytes <= self.available.bytes && self.required.inodes <= self.available.inodes
+    }
+}
+
+/// Returns the space available to unprivileged users in the filesystem
+/// of `dir`, or of its closest existing parent.
+pub fn available(dir: &Path) -> Result<Space> {
+    let dir = dir
+        .ancestors()
+        .find(|d| d.exists())
+        .unwrap_or_else(|| Path::new("/"));
+    let path = CString::new(dir.as_os_str().as_bytes())?;
+
+    let mut stat: libc::statvfs = unsafe { mem::zeroed() };
+    if unsafe { libc::statvfs(path.as_ptr(), &mut stat) } != 0 {
+        return Err(::std::io::Error::last_os_error().into());
+    }
+
+    Ok(Space {
+        bytes: stat.f_bavail as u64 * stat.f_frsize as u64,
+        inodes: stat.f_favail as u64,
+    })
+}
+
+/// Returns the space `update_package` still needs in `download_dir`.
+pub fn required(update_package: &UpdatePackage, download_dir: &Path) -> Space {
+    let mut required = Space {
+        bytes: 0,
+        inodes: 0,
+    };
+
+    for object in update_package.objects() {
+        match download_dir.join(object.sha256sum()).metadata() {
+            Ok(m) => required.bytes += object.len().saturating_sub(m.len()),
+            Err(_) => {
+                required.bytes += object.len();
+                required.inodes += 1;
+            }
+        }
+    }
+
+    // The results of the transformations are removed once installed,
+    // so only the largest one is stored at a time
+    let transformed = update_package
+        .objects()
+        .iter()
+        .filter(|o| !o.transforms().is_empty())
+        .map(|o| o.uncompressed_size().unwrap_or_else(|| o.len()))
+        .max();
+    if let Some(size) = transformed {
+        required.bytes += size;
+        required.inodes += 2;
+    }
+
+    required
+}
+
+/// Returns the forecast of the space `update_package` needs in
+/// `download_dir`.
+pub fn forecast(update_package: &UpdatePackage, download_dir: &Path) -> Result<Forecast> {
+    Ok(Forecast {
+        required: required(update_package, download_dir),
+        available: available(download_dir)?,
+    })
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Checks of the install targets, so objects are never written over a
+//! live filesystem.
+
+use Result;
+
+use libc;
+
+use std::fs::{self, OpenOptions};
+use std::os::unix::fs::{FileTypeExt, OpenOptionsExt};
+use std::path::{Path, PathBuf};
+
+use process;
+
+/// Table of the mounted filesystems.
+const MOUNTS: &str = "/proc/mounts";
+
+/// Directory where udev links the disks by their identifiers.
+const DISKS_DIR: &str = "/dev/disk";
+
+/// Identifiers targets can be given by, as `<tag>=<value>`, with the
+/// directory of `DISKS_DIR` linking them.
+const TAGS: &[(&str, &str)] = &[
+    ("LABEL", "by-label"),
+    ("UUID", "by-uuid"),
+    ("PARTLABEL", "by-partlabel"),
+    ("PARTUUID", "by-partuuid"),
+];
+
+#[derive(Debug, Fail)]
+pub enum TargetError {
+    #[fail(display = "Target {} is mounted at {}", _0, _1)]
+    Mounted(String, String),
+    #[fail(display = "Target {} is in use", _0)]
+    Busy(String),
+    #[fail(display = "No device found for target {}", _0)]
+    NotFound(String),
+}
+
+/// Returns the device of `target` when it is given by an identifier,
+/// as `LABEL=rootfs-b` or `PARTUUID=...`, so one package works with
+/// whatever the devices are named on each board. Other targets are
+/// returned as they are.
+pub fn resolve(target: &Path) -> Result<PathBuf> {
+    resolve_in(target, Path::new(DISKS_DIR))
+}
+
+fn resolve_in(target: &Path, disks_dir: &Path) -> Result<PathBuf> {
+    let spec = target.to_string_lossy();
+    let mut parts = spec.splitn(2, '=');
+    let (tag, value) = match (parts.next(), parts.next()) {
+        (Some(t), Some(v)) => (t, v),
+        _ => return Ok(target.to_path_buf()),
+    };
+
+    let dir = match TAGS.iter().find(|&&(t, _)| t == tag) {
+        Some(&(_, dir)) => dir,
+        None => return Ok(target.to_path_buf()),
+    };
+
+    let link = disks_dir.join(dir).join(value);
+    if link.exists() {
+        let device = fs::canonicalize(link)?;
+        debug!("Target {} resolved to {}", spec, device.display());
+        return Ok(device);
+    }
+
+    // Without udev, the devices are looked up as blkid does
+    match process::run(&format!("blkid -o device -t {}", process::quote(&*spec))) {
+        Ok(ref output) if !output.stdout.trim().is_empty() => {
+            let device = output.stdout.lines().next().unwrap_or_default();
+            debug!("Target {} resolved to {}", spec, device);
+            Ok(PathBuf::from(device.trim()))
+        }
+        _ => Err(TargetError::NotFound(spec.into_owned()).into()),
+    }
+}
+
+/// Returns where `target` is mounted, according to the `mounts` table.
+fn mount_point(target: &Path, mounts: &str) -> Option<String> {
+    let target = canonical(target);
+    mounts
+        .lines()
+        .filter_map(|l| {
+            let mut fields = l.split_whitespace();
+            Some((fields.next()?, fields.next()?))
+        }).find(|&(device, _)| canonical(Path::new(device)) == target)
+        .map(|(_, point)| point.to_string())
+}
+
+/// Resolves the links to `path`, as `/dev/disk/by-label/...`.
+fn canonical(path: &Path) -> PathBuf {
+    fs::canonicalize(path).unwrap_or_else(|_| path.to_path_buf())
+}
+
+/// Ensures `target` is neither mounted nor opened exclusively by
+/// anyone else. Mounted targets are unmounted when `unmount` is set,
+/// otherwise refused.
+pub fn ensure_available(target: &Path, unmount: bool) -> Result<()> {
+    let mounts = fs::read_to_string(MOUNTS).unwrap_or_default();
+    if let Some(point) = mount_point(target, &mounts) {
+        if !unmount {
+            return Err(TargetError::Mounted(target.display().to_string(), point).into());
+        }
+
+        info!("Unmounting {} from {}", target.display(), point);
+        process::run(&format!("umount {}", process::quote(&point)))?;
+    }
+
+    let is_block_device = fs::metadata(target)
+        .map(|m| m.file_type().is_block_device())
+        .unwrap_or(false);
+    if is_block_device {
+        // Opening a block device exclusively fails while it is in use
+        let exclusive = OpenOptions::new()
+            .read(true)
+            .custom_flags(libc::O_EXCL)
+            .open(target);
+        if let Err(e) = exclusive {
+            if e.raw_os_error() == Some(libc::EBUSY) {
+                return Err(TargetError::Busy(target.display().to_string()).into());
+            }
+            return Err(e.into());
+        }
+    }
+
+    Ok(())
+}
+
+#[test]
+fn mounted_target() {
+    let mounts = "/dev/mmcblk0p2 / ext4 rw,relatime 0 0\n\
+                  proc /proc proc rw,nosuid 0 0\n\
+                  /dev/mmcblk0p1 /boot vfat rw 0 0\n";
+
+    assert_eq!(
+        mount_point(Path::new("/dev/mmcblk0p1"), mounts),
+        Some("/boot".into())
+    );
+    assert_eq!(mount_point(Path::new("/dev/mmcblk0p3"), mounts), None);
+    assert_eq!(mount_point(Path::new("/dev/mmcblk0p2"), ""), None);
+}
+
+#[test]
+fn resolve_target() {
+    use std::os::unix::fs::symlink;
+    use tempfile::tempdir;
+
+    let disks_dir = tempdir().unwrap();
+    let device = disks_dir.path().join("mmcblk1p3");
+    fs::write(&device, "").unwrap();
+    fs::create_dir(disks_dir.path().join("by-label")).unwrap();
+    symlink(&device, disks_dir.path().join("by-label/rootfs-b")).unwrap();
+
+    let resolve = |target: &str| resolve_in(Path::new(target), disks_dir.path());
+    assert_eq!(
+        resolve("LABEL=rootfs-b").unwrap(),
+        fs::canonicalize(&device).unwrap()
+    );
+    assert_eq!(
+        resolve("/dev/mmcblk0p2").unwrap(),
+        Path::new("/dev/mmcblk0p2")
+    );
+    assert_eq!(resolve("OTHER=value").unwrap(), Path::new("OTHER=value"));
+    assert!(resolve("PARTUUID=00000000-missing").is_err());
+}
+
+#[test]
+fn available_target() {
+    use tempfile::NamedTempFile;
+
+    let target = NamedTempFile::new().unwrap();
+    assert!(ensure_available(target.path(), false).is_ok());
+    assert!(ensure_available(Path::new("/dev/missing-device"), false).is_ok());
+}
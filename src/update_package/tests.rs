@@ -57,6 +57,7 @@ pub fn create_fake_settings() -> Settings {
 }
 
 #[test]
+#[cfg(feature = "mode-test")]
 fn missing_object_file() {
     let u = get_update_package();
     let settings = create_fake_settings();
@@ -65,6 +66,7 @@ fn missing_object_file() {
 }
 
 #[test]
+#[cfg(feature = "mode-test")]
 fn complete_object_file() {
     let u = get_update_package();
     let settings = create_fake_settings();
@@ -93,3 +95,309 @@ fn complete_object_file() {
         1
     );
 }
+
+#[test]
+#[cfg(feature = "mode-agent")]
+fn agent_object() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let download_dir = tempdir().unwrap();
+    let target_dir = tempdir().unwrap();
+    let target = target_dir.path().join("updatehub");
+    let new = target_dir.path().join("updatehub.new");
+    fs::write(&target, "old").unwrap();
+
+    // The new agents check they are given the settings of the running
+    // one, as done on the device
+    let config = target_dir.path().join("updatehub.conf");
+    let check = format!(
+        "#!/bin/sh\n[ \"$*\" = \"--config {} health-check\" ] || exit 2\n",
+        config.display()
+    );
+    let binaries = [
+        (format!("{}exit 1\n", check), false),
+        (format!("{}exit 0\n", check), true),
+    ];
+    for &(ref binary, healthy) in &binaries {
+        let sha256sum = hex_digest(Algorithm::SHA256, binary.as_bytes());
+        fs::write(download_dir.path().join(&sha256sum), binary).unwrap();
+        let object: Object = serde_json::from_value(json!({
+            "mode": "agent",
+            "filename": "updatehub",
+            "target": target,
+            "sha256sum": sha256sum,
+            "size": binary.len(),
+        })).unwrap();
+
+        let installed = object
+            .install(download_dir.path(), download_dir.path(), &target, &config)
+            .is_ok();
+        assert_eq!(installed, healthy);
+        assert!(!new.exists());
+        if !healthy {
+            assert_eq!(fs::read_to_string(&target).unwrap(), "old");
+        }
+    }
+
+    assert_eq!(fs::read_to_string(&target).unwrap(), binaries[1].0);
+    let previous = target_dir.path().join("updatehub.previous");
+    assert_eq!(fs::read_to_string(&previous).unwrap(), "old");
+
+    rollback_agent(&target).unwrap();
+    assert_eq!(fs::read_to_string(&target).unwrap(), "old");
+    assert!(!previous.exists());
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn install_order() {
+    fn order(objects: &[(&str, &[&str])]) -> Result<Vec<String>> {
+        let objects: Vec<_> = objects
+            .iter()
+            .map(|&(filename, depends_on)| {
+                json!({
+                    "mode": "test",
+                    "filename": filename,
+                    "target": "/dev/device1",
+                    "sha256sum": SHA256SUM,
+                    "size": 10,
+                    "depends-on": depends_on,
+                })
+            }).collect();
+        let mut package = get_update_json();
+        package["objects"] = json!(objects);
+
+        let package: UpdatePackage = serde_json::from_value(package).unwrap();
+        let order = package.install_order()?;
+        Ok(order.iter().map(|o| o.filename().to_string()).collect())
+    }
+
+    assert_eq!(
+        order(&[("a", &["b"]), ("b", &[]), ("c", &["a"]), ("d", &[])]).unwrap(),
+        ["b", "a", "c", "d"]
+    );
+    assert!(order(&[("a", &["missing"])]).is_err());
+    assert!(order(&[("a", &["b"]), ("b", &["a"])]).is_err());
+
+    // Objects may share their filename, as when written to several
+    // targets
+    assert_eq!(
+        order(&[("a", &[]), ("a", &[]), ("b", &[])]).unwrap(),
+        ["a", "a", "b"]
+    );
+    assert_eq!(
+        order(&[("b", &["a"]), ("a", &[]), ("a", &[])]).unwrap(),
+        ["a", "a", "b"]
+    );
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn local_objects() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let package_dir = tempdir().unwrap();
+    let download_dir = tempdir().unwrap();
+    fs::create_dir(package_dir.path().join("images")).unwrap();
+    fs::write(package_dir.path().join("images/rootfs.img"), "1234567890").unwrap();
+
+    let mut json = get_update_json();
+    json["objects"][0]["url"] = json!("images/rootfs.img");
+    let package: UpdatePackage = serde_json::from_value(json.clone()).unwrap();
+    assert_eq!(
+        package.objects()[0].source(package_dir.path()).unwrap(),
+        package_dir.path().join("images/rootfs.img")
+    );
+    package
+        .fetch_local(package_dir.path(), download_dir.path())
+        .unwrap();
+    assert!(download_dir.path().join(SHA256SUM).exists());
+
+    let absolute = package_dir.path().join("images/rootfs.img");
+    json["objects"][0]["url"] = json!(format!("file://{}", absolute.display()));
+    let package: UpdatePackage = serde_json::from_value(json.clone()).unwrap();
+    assert_eq!(
+        package.objects()[0].source(package_dir.path()).unwrap(),
+        absolute
+    );
+
+    json["objects"][0]["url"] = json!("http://localhost/rootfs.img");
+    let package: UpdatePackage = serde_json::from_value(json).unwrap();
+    assert!(package.objects()[0].source(package_dir.path()).is_err());
+
+    // A corrupted object is not taken
+    let package = get_update_package();
+    let other_dir = tempdir().unwrap();
+    fs::write(package_dir.path().join(SHA256SUM), "0000000000").unwrap();
+    assert!(package
+        .fetch_local(package_dir.path(), other_dir.path())
+        .is_err());
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn transforms() {
+    use self::transform::{self, Transform};
+    use process;
+    use std::fs;
+    use tempfile::tempdir;
+
+    let mut json = get_update_json();
+    json["objects"][0]["transforms"] = json!(["gzip", "xz"]);
+    let package: UpdatePackage = serde_json::from_value(json).unwrap();
+    assert_eq!(
+        package.objects()[0].transforms(),
+        &[Transform::Gzip, Transform::Xz]
+    );
+    assert!(get_update_package().objects()[0].transforms().is_empty());
+
+    let dir = tempdir().unwrap();
+    let object = dir.path().join("object");
+    fs::write(&object, "1234567890").unwrap();
+    assert_eq!(transform::apply(&[], &object, dir.path()).unwrap(), object);
+
+    if !tools::found("gzip") {
+        return;
+    }
+
+    process::run(&format!("gzip -n {}", process::quote(&object))).unwrap();
+    let compressed = dir.path().join("object.gz");
+    let plain = transform::apply(&[Transform::Gzip], &compressed, dir.path()).unwrap();
+    assert_eq!(fs::read_to_string(&plain).unwrap(), "1234567890");
+    assert!(compressed.exists());
+
+    // The transformations may be done in another directory
+    let temp_dir = dir.path().join("temp");
+    let plain = transform::apply(&[Transform::Gzip], &compressed, &temp_dir).unwrap();
+    assert_eq!(plain, temp_dir.join("object.gz.0"));
+    assert_eq!(fs::read_to_string(&plain).unwrap(), "1234567890");
+    fs::remove_dir_all(&temp_dir).unwrap();
+
+    fs::write(&compressed, "invalid").unwrap();
+    assert!(transform::apply(&[Transform::Gzip], &compressed, dir.path()).is_err());
+    assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 2);
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn sha512_digest() {
+    let settings = create_fake_settings();
+    create_fake_object(&settings);
+
+    let mut json = get_update_json();
+    json["objects"][0]["sha512sum"] = json!(
+        "12b03226a6d8be9c6e8cd5e55dc6c7920caaa39df14aab92d5e3ea9340d1c8a4\
+         d3d0b8e4314f1f6ef131ba4bf1ceb9186ab87c801af0d5c95b1befb8cedae2b9"
+    );
+    let u: UpdatePackage = serde_json::from_value(json.clone()).unwrap();
+    assert!(u
+        .ensure_objects_ready(&settings.update.download_dir)
+        .is_ok());
+
+    // The SHA-512 is checked instead of the SHA-256 when declared
+    json["objects"][0]["sha512sum"] = json!("0".repeat(128));
+    let u: UpdatePackage = serde_json::from_value(json).unwrap();
+    assert_eq!(
+        u.filter_objects(&settings, &ObjectStatus::Corrupted).len(),
+        1
+    );
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn space_forecast() {
+    use self::space::{self, Space};
+    use std::fs;
+
+    let settings = create_fake_settings();
+    let download_dir = &settings.update.download_dir;
+    let u = get_update_package();
+    assert_eq!(
+        space::required(&u, download_dir),
+        Space {
+            bytes: 10,
+            inodes: 1,
+        }
+    );
+
+    // A partial object only needs the rest of it
+    fs::create_dir_all(download_dir).unwrap();
+    fs::write(download_dir.join(SHA256SUM), "1234").unwrap();
+    assert_eq!(space::required(&u, download_dir).bytes, 6);
+
+    let mut json = get_update_json();
+    json["objects"][0]["transforms"] = json!(["xz"]);
+    json["objects"][0]["uncompressed-size"] = json!(40);
+    let u: UpdatePackage = serde_json::from_value(json).unwrap();
+    assert_eq!(
+        space::required(&u, download_dir),
+        Space {
+            bytes: 46,
+            inodes: 2,
+        }
+    );
+
+    let forecast = space::forecast(&u, &download_dir.join("missing")).unwrap();
+    assert!(forecast.available.bytes > 0);
+    assert!(forecast.fits());
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn metadata_validation() {
+    let parse = |json: serde_json::Value| UpdatePackage::parse(&json.to_string());
+    let error = |json: serde_json::Value| parse(json).unwrap_err().to_string();
+
+    assert!(parse(get_update_json()).is_ok());
+
+    let mut json = get_update_json();
+    json["objects"][0]["mode"] = json!("raw");
+    let supported = validate::modes().map(|m| m.name).collect::<Vec<_>>();
+    assert_eq!(
+        error(json),
+        format!(
+            "objects[0]: unsupported install mode 'raw' (supported: {})",
+            supported.join(", ")
+        )
+    );
+
+    let mut json = get_update_json();
+    json["objects"][0].as_object_mut().unwrap().remove("target");
+    assert_eq!(error(json), "objects[0].target: missing field");
+
+    let mut json = get_update_json();
+    json["objects"][0]["size"] = json!("10");
+    assert_eq!(
+        error(json),
+        "objects[0].size: must be a non-negative integer"
+    );
+
+    // The digests name the downloaded files
+    for sum in &["../x", "a;cmd", &"A".repeat(64), &"a".repeat(63)] {
+        let mut json = get_update_json();
+        json["objects"][0]["sha256sum"] = json!(sum);
+        assert_eq!(
+            error(json),
+            "objects[0].sha256sum: must be 64 lowercase hexadecimal characters"
+        );
+    }
+    let mut json = get_update_json();
+    json["objects"][0]["sha512sum"] = json!("a".repeat(64));
+    assert_eq!(
+        error(json),
+        "objects[0].sha512sum: must be 128 lowercase hexadecimal characters"
+    );
+
+    let mut json = get_update_json();
+    json["version"] = json!(1);
+    assert_eq!(error(json), "version: must be a string");
+
+    // Optional fields may be null or absent
+    let mut json = get_update_json();
+    json["objects"][0]["url"] = json!(null);
+    json["supported-hardware"] = json!("any");
+    assert!(parse(json).is_ok());
+    assert!(UpdatePackage::parse("[]").is_err());
+}
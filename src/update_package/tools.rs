@@ -0,0 +1,104 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! External tools the install modes depend on, checked upfront so a
+//! missing one is reported before anything is written.
+
+use Result;
+
+use std::env;
+use std::ffi::OsStr;
+use std::os::unix::fs::PermissionsExt;
+use std::path::Path;
+
+use update_package::validate;
+
+/// Tools needed by each install mode built in. The `test` and `agent`
+/// modes write their objects themselves.
+const REQUIRED_TOOLS: &[(&str, &[&str])] = &[("test", &[]), ("agent", &[])];
+
+/// Tools the targets of every install mode may need: `blkid` finds the
+/// targets given by identifier when udev does not link them, `umount`
+/// unmounts the mounted targets when allowed to.
+const TARGET_TOOLS: &[&str] = &["blkid", "umount"];
+
+#[derive(Debug, Fail)]
+pub enum ToolsError {
+    #[fail(display = "Install mode {} is missing the tools: {}", _0, _1)]
+    Missing(&'static str, String),
+}
+
+/// Returns whether the executable `tool` is found in `PATH`.
+pub fn found(tool: &str) -> bool {
+    env::var_os("PATH").map_or(false, |paths| found_in(tool, &paths))
+}
+
+fn found_in(tool: &str, paths: &OsStr) -> bool {
+    env::split_paths(paths).any(|dir| executable(&dir.join(tool)))
+}
+
+fn executable(path: &Path) -> bool {
+    path.metadata()
+        .map(|m| m.is_file() && m.permissions().mode() & 0o111 != 0)
+        .unwrap_or(false)
+}
+
+/// Returns the tools needed by the install `mode` which are missing.
+pub fn missing(mode: &str) -> Vec<&'static str> {
+    REQUIRED_TOOLS
+        .iter()
+        .filter(|&&(m, _)| m == mode)
+        .flat_map(|&(_, tools)| tools.iter().cloned())
+        .filter(|t| !found(t))
+        .collect()
+}
+
+/// Checks the tools of the install `modes` which are built in are
+/// found. The missing target tools are only warned about, as only some
+/// targets need them.
+pub fn preflight(modes: &[String]) -> Result<()> {
+    let missing_target_tools = TARGET_TOOLS
+        .iter()
+        .filter(|t| !found(t))
+        .cloned()
+        .collect::<Vec<_>>();
+    if !missing_target_tools.is_empty() {
+        warn!(
+            "Targets given by identifier or mounted may fail without: {}",
+            missing_target_tools.join(", ")
+        );
+    }
+
+    for mode in validate::modes().filter(|m| modes.iter().any(|n| n == m.name)) {
+        let missing = missing(mode.name);
+        if !missing.is_empty() {
+            return Err(ToolsError::Missing(mode.name, missing.join(", ")).into());
+        }
+    }
+
+    Ok(())
+}
+
+#[test]
+fn lookup() {
+    use std::fs;
+    use tempfile::tempdir;
+
+    let dir = tempdir().unwrap();
+    let tool = dir.path().join("kobs-ng");
+    fs::write(&tool, "#!/bin/sh\n").unwrap();
+    fs::write(dir.path().join("nandwrite"), "").unwrap();
+    fs::set_permissions(&tool, fs::Permissions::from_mode(0o755)).unwrap();
+
+    let paths = env::join_paths(&[Path::new("/nonexistent"), dir.path()]).unwrap();
+    assert!(found_in("kobs-ng", &paths));
+    assert!(!found_in("nandwrite", &paths));
+    assert!(!found_in("flashcp", &paths));
+
+    assert!(missing("test").is_empty());
+    assert!(missing("unknown").is_empty());
+    assert!(preflight(&[]).is_ok());
+    assert!(preflight(&["test".into(), "copy".into()]).is_ok());
+}
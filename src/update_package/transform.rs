@@ -0,0 +1,98 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Transformations of the objects before they are installed
+//!
+//! Objects are downloaded and verified as they are stored on the
+//! server, compressed for instance, and the `transforms` declared by
+//! their metadata are applied in order to the verified object right
+//! before it is installed, so the install modes always get the plain
+//! bytes. A new format is supported by adding it to `Transform`.
+
+use Result;
+
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use memory;
+use process;
+
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum Transform {
+    Gzip,
+    Xz,
+    Bzip2,
+    Zstd,
+}
+
+impl Transform {
+    /// Returns the tool applying the transformation.
+    pub fn tool(self) -> &'static str {
+        match self {
+            Transform::Gzip => "gzip",
+            Transform::Xz => "xz",
+            Transform::Bzip2 => "bzip2",
+            Transform::Zstd => "zstd",
+        }
+    }
+
+    /// Returns the extension of the files the tool takes as input.
+    fn extension(self) -> &'static str {
+        match self {
+            Transform::Gzip => "gz",
+            Transform::Xz => "xz",
+            Transform::Bzip2 => "bz2",
+            Transform::Zstd => "zst",
+        }
+    }
+
+    /// Returns the command replacing `input` by its transformation,
+    /// named as `input` without its extension, using up to
+    /// `memory_limit` bytes when the tool can be given a limit.
+    fn command(self, input: &Path, memory_limit: usize) -> String {
+        let args = match self {
+            Transform::Xz => format!("-d -f -M {}", memory_limit),
+            Transform::Zstd => format!("-d -f -q --rm --memory={}", memory_limit),
+            _ => "-d -f".to_string(),
+        };
+
+        format!("{} {} {}", self.tool(), args, process::quote(input))
+    }
+}
+
+/// Applies the `transforms`, in order, to the `object` file and returns
+/// the file holding the result, in `dir`, the object being kept. It is
+/// the object itself when there is no transformation.
+pub fn apply(transforms: &[Transform], object: &Path, dir: &Path) -> Result<PathBuf> {
+    let name = object.file_name().unwrap_or_default().to_string_lossy();
+    if !transforms.is_empty() {
+        fs::create_dir_all(dir)?;
+    }
+
+    let mut current = object.to_path_buf();
+    for (i, transform) in transforms.iter().enumerate() {
+        let output = dir.join(format!("{}.{}", name, i));
+        let input = PathBuf::from(format!("{}.{}", output.display(), transform.extension()));
+        if current == object {
+            // The directory may be on another filesystem than the object
+            if fs::hard_link(object, &input).is_err() {
+                fs::copy(object, &input)?;
+            }
+        } else {
+            fs::rename(&current, &input)?;
+        }
+
+        debug!("Applying {:?} to '{}'", transform, object.display());
+        if let Err(e) = process::run_limited(&transform.command(&input, memory::decompressor_limit())) {
+            let _ = fs::remove_file(&input);
+            let context = format!("Applying {:?} to '{}'", transform, object.display());
+            return Err(e.context(context).into());
+        }
+        current = output;
+    }
+
+    Ok(current)
+}
@@ -0,0 +1,291 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Validation of the update metadata
+//!
+//! The metadata is checked against the fields of the package and of
+//! the objects of each install mode before it is decoded. An unknown
+//! install mode, a missing field or a field of the wrong type is then
+//! reported naming it, as `objects[1].size`, rather than as a JSON
+//! decoding error or a failure deep inside the install. The digests of
+//! the objects name their files and the paths they are fetched from,
+//! so they must be lowercase hexadecimal of the length of the digest.
+//!
+//! The install modes, with the version of their fields, are advertised
+//! to the server when probing, so it offers only the packages the
+//! device can install. Only the modes built in, as selected by the
+//! `mode-*` features, are supported.
+
+use Result;
+
+use serde_json::{Map, Value};
+
+/// Type of the value of a field.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Kind {
+    String,
+    Integer,
+    Boolean,
+    Strings,
+    /// Either a string or a list of strings.
+    StringOrStrings,
+    /// A SHA256 digest, in lowercase hexadecimal. The digests name the
+    /// downloaded files, so nothing else may pass.
+    Sha256,
+    /// A SHA512 digest, in lowercase hexadecimal.
+    Sha512,
+}
+
+impl Kind {
+    fn matches(self, value: &Value) -> bool {
+        let strings = |v: &Value| {
+            v.as_array()
+                .map_or(false, |a| a.iter().all(|s| s.is_string()))
+        };
+        let digest = |v: &Value, len: usize| {
+            let hex = |b: u8| b.is_ascii_digit() || b'a' <= b && b <= b'f';
+            v.as_str()
+                .map_or(false, |s| s.len() == len && s.bytes().all(hex))
+        };
+        match self {
+            Kind::String => value.is_string(),
+            Kind::Integer => value.is_u64(),
+            Kind::Boolean => value.is_boolean(),
+            Kind::Strings => strings(value),
+            Kind::StringOrStrings => value.is_string() || strings(value),
+            Kind::Sha256 => digest(value, 64),
+            Kind::Sha512 => digest(value, 128),
+        }
+    }
+
+    /// Returns the description of the values, as `a string`.
+    pub fn description(self) -> &'static str {
+        match self {
+            Kind::String => "a string",
+            Kind::Integer => "a non-negative integer",
+            Kind::Boolean => "a boolean",
+            Kind::Strings => "a list of strings",
+            Kind::StringOrStrings => "a string or a list of strings",
+            Kind::Sha256 => "64 lowercase hexadecimal characters",
+            Kind::Sha512 => "128 lowercase hexadecimal characters",
+        }
+    }
+}
+
+/// Field of the metadata.
+#[derive(Debug)]
+pub struct Field {
+    pub name: &'static str,
+    pub kind: Kind,
+    pub required: bool,
+}
+
+/// Fields of the package.
+const PACKAGE_FIELDS: &[Field] = &[
+    Field {
+        name: "product-uid",
+        kind: Kind::String,
+        required: true,
+    },
+    Field {
+        name: "version",
+        kind: Kind::String,
+        required: true,
+    },
+    Field {
+        name: "supported-hardware",
+        kind: Kind::StringOrStrings,
+        required: false,
+    },
+    Field {
+        name: "on-failure",
+        kind: Kind::String,
+        required: false,
+    },
+];
+
+/// Fields of the objects taken by every install mode.
+const OBJECT_FIELDS: &[Field] = &[
+    Field {
+        name: "filename",
+        kind: Kind::String,
+        required: true,
+    },
+    Field {
+        name: "sha256sum",
+        kind: Kind::Sha256,
+        required: true,
+    },
+    Field {
+        name: "sha512sum",
+        kind: Kind::Sha512,
+        required: false,
+    },
+    Field {
+        name: "target",
+        kind: Kind::String,
+        required: true,
+    },
+    Field {
+        name: "size",
+        kind: Kind::Integer,
+        required: true,
+    },
+    Field {
+        name: "depends-on",
+        kind: Kind::Strings,
+        required: false,
+    },
+    Field {
+        name: "optional",
+        kind: Kind::Boolean,
+        required: false,
+    },
+    Field {
+        name: "url",
+        kind: Kind::String,
+        required: false,
+    },
+    Field {
+        name: "transforms",
+        kind: Kind::Strings,
+        required: false,
+    },
+    Field {
+        name: "uncompressed-size",
+        kind: Kind::Integer,
+        required: false,
+    },
+];
+
+/// Install mode the agent supports.
+#[derive(Debug)]
+pub struct Mode {
+    pub name: &'static str,
+    /// Version of the fields, increased whenever they change.
+    pub version: u32,
+    pub fields: &'static [Field],
+    /// Whether the mode is built in, by its `mode-<name>` feature.
+    pub enabled: bool,
+}
+
+pub const MODES: &[Mode] = &[
+    Mode {
+        name: "test",
+        version: 1,
+        fields: OBJECT_FIELDS,
+        enabled: cfg!(feature = "mode-test"),
+    },
+    Mode {
+        name: "agent",
+        version: 1,
+        fields: OBJECT_FIELDS,
+        enabled: cfg!(feature = "mode-agent"),
+    },
+];
+
+/// Returns the install modes built in.
+pub fn modes() -> impl Iterator<Item = &'static Mode> {
+    MODES.iter().filter(|m| m.enabled)
+}
+
+#[derive(Debug, Fail)]
+pub enum MetadataError {
+    #[fail(display = "{}: not a JSON object", _0)]
+    NotAnObject(String),
+    #[fail(display = "{}: missing field", _0)]
+    Missing(String),
+    #[fail(display = "{}: must be {}", _0, _1)]
+    InvalidType(String, &'static str),
+    #[fail(
+        display = "{}: unsupported install mode '{}' (supported: {})",
+        _0, _1, _2
+    )]
+    UnsupportedMode(String, String, String),
+}
+
+/// Checks `metadata` has the fields of the package and of the install
+/// modes of its objects, with the right types.
+pub fn validate(metadata: &Value) -> Result<()> {
+    let package = check_fields(metadata, "", PACKAGE_FIELDS)?;
+
+    let objects = match package.get("objects") {
+        Some(&Value::Array(ref objects)) => objects,
+        Some(_) => return Err(MetadataError::InvalidType("objects".into(), "a list").into()),
+        None => return Err(MetadataError::Missing("objects".into()).into()),
+    };
+
+    for (n, object) in objects.iter().enumerate() {
+        let path = format!("objects[{}]", n);
+        let mode = match object.get("mode") {
+            Some(&Value::String(ref mode)) => mode,
+            Some(_) => {
+                let kind = Kind::String.description();
+                return Err(MetadataError::InvalidType(format!("{}.mode", path), kind).into());
+            }
+            None => return Err(MetadataError::Missing(format!("{}.mode", path)).into()),
+        };
+
+        match modes().find(|m| m.name == mode) {
+            Some(m) => check_fields(object, &path, m.fields)?,
+            None => {
+                let supported = modes().map(|m| m.name).collect::<Vec<_>>().join(", ");
+                return Err(MetadataError::UnsupportedMode(path, mode.clone(), supported).into());
+            }
+        };
+    }
+
+    Ok(())
+}
+
+/// Returns the install modes, with the version of their fields, as
+/// advertised to the server, as `test=1, agent=1`.
+pub fn advertised() -> String {
+    modes()
+        .map(|m| format!("{}={}", m.name, m.version))
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
+/// Checks the `fields` of `value`, found at `path`, returning it as an
+/// object.
+fn check_fields<'a>(
+    value: &'a Value,
+    path: &str,
+    fields: &[Field],
+) -> Result<&'a Map<String, Value>> {
+    let join = |name: &str| {
+        if path.is_empty() {
+            name.to_string()
+        } else {
+            format!("{}.{}", path, name)
+        }
+    };
+
+    let object = match value.as_object() {
+        Some(object) => object,
+        None if path.is_empty() => return Err(MetadataError::NotAnObject("root".into()).into()),
+        None => return Err(MetadataError::NotAnObject(path.to_string()).into()),
+    };
+
+    for field in fields {
+        match object.get(field.name) {
+            // Optional fields may be given as null
+            None | Some(&Value::Null) => {
+                if field.required {
+                    return Err(MetadataError::Missing(join(field.name)).into());
+                }
+            }
+            Some(value) => {
+                if !field.kind.matches(value) {
+                    let kind = field.kind.description();
+                    return Err(MetadataError::InvalidType(join(field.name), kind).into());
+                }
+            }
+        }
+    }
+
+    Ok(object)
+}
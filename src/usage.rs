@@ -0,0 +1,36 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Data usage of the agent
+//!
+//! The bytes the agent sends to and receives from the server, objects
+//! included, are counted as they go through `sent` and `received`. The
+//! states add them, by `take`, to the usage of the current calendar
+//! month kept in the runtime settings, and with
+//! `Network/MonthlyDataCap` the downloads which would exceed the cap
+//! are deferred to the next month.
+
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+static SENT: AtomicUsize = AtomicUsize::new(0);
+static RECEIVED: AtomicUsize = AtomicUsize::new(0);
+
+/// Counts `bytes` as sent.
+pub fn sent(bytes: usize) {
+    SENT.fetch_add(bytes, Ordering::SeqCst);
+}
+
+/// Counts `bytes` as received.
+pub fn received(bytes: usize) {
+    RECEIVED.fetch_add(bytes, Ordering::SeqCst);
+}
+
+/// Returns the bytes sent and received since the last call.
+pub fn take() -> (u64, u64) {
+    (
+        SENT.swap(0, Ordering::SeqCst) as u64,
+        RECEIVED.swap(0, Ordering::SeqCst) as u64,
+    )
+}
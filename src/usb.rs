@@ -0,0 +1,242 @@
+// Copyright (C) 2018 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: MPL-2.0
+//
+
+//! Updates from removable media
+//!
+//! Devices which never reach the network are updated by plugging a
+//! media, as an USB stick, with an `updatehub` directory holding the
+//! update package as written by `updatehub-pkg --sign`: its metadata
+//! in `metadata.json`, its signature in `metadata.json.sig` and the
+//! objects alongside. The mount points listed in `Update/LocalSources`
+//! are looked at while waiting for the next probe, and a package found
+//! there is installed unless it already was.
+//!
+//! Anyone plugging a media must not be able to install with it, so the
+//! metadata must be signed with the key of `Update/LocalSourcesKey`,
+//! and a package whose signature is missing or does not match is
+//! ignored, as are all of them when there is no key. The metadata is
+//! read once, and its signature checked by OpenSSL on a copy, which is
+//! then the one parsed. Its objects are copied to the download
+//! directory first, and verified against the checksums of the signed
+//! metadata, so the install is followed, through the update events,
+//! as a downloaded one.
+
+use Result;
+
+use firmware::Metadata;
+use process;
+use runtime_settings::RuntimeSettings;
+use update_package::UpdatePackage;
+
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Directory, in the root of the media, holding the update package.
+pub const PACKAGE_DIR: &str = "updatehub";
+
+/// Name of the metadata file in the package directory.
+pub const METADATA_FILE: &str = "metadata.json";
+
+/// Name of the signature of the metadata in the package directory.
+pub const SIGNATURE_FILE: &str = "metadata.json.sig";
+
+/// Returns the directory of the first update package found on the
+/// `mount_points`, if any.
+pub fn find(mount_points: &[String]) -> Option<PathBuf> {
+    mount_points
+        .iter()
+        .map(|m| Path::new(m).join(PACKAGE_DIR))
+        .find(|d| d.join(METADATA_FILE).is_file())
+}
+
+/// Writes the signature of the `metadata` file beside it, made with
+/// the private `key`, in PEM.
+pub fn sign(metadata: &Path, key: &Path) -> Result<()> {
+    let signature = metadata.with_file_name(SIGNATURE_FILE);
+    process::run(&format!(
+        "openssl dgst -sha256 -sign {} -out {} {}",
+        process::quote(key),
+        process::quote(&signature),
+        process::quote(metadata)
+    ))?;
+    Ok(())
+}
+
+/// Returns the metadata of the package in `dir` once its signature is
+/// checked with the public `key`, the copies checked being kept in
+/// `scratch_dir`.
+fn verified_metadata(dir: &Path, key: &Path, scratch_dir: &Path) -> Result<String> {
+    let content = fs::read_to_string(dir.join(METADATA_FILE))?;
+    let signature = match fs::read(dir.join(SIGNATURE_FILE)) {
+        Ok(signature) => signature,
+        Err(_) => bail!("Package is not signed, {} is missing", SIGNATURE_FILE),
+    };
+
+    fs::create_dir_all(scratch_dir)?;
+    let (metadata, signature_copy) = (
+        scratch_dir.join(METADATA_FILE),
+        scratch_dir.join(SIGNATURE_FILE),
+    );
+    fs::write(&metadata, &content)?;
+    fs::write(&signature_copy, &signature)?;
+
+    let verified = process::run(&format!(
+        "openssl dgst -sha256 -verify {} -signature {} {}",
+        process::quote(key),
+        process::quote(&signature_copy),
+        process::quote(&metadata)
+    ));
+    fs::remove_file(&metadata)?;
+    fs::remove_file(&signature_copy)?;
+    if verified.is_err() {
+        bail!(
+            "Package signature does not match the key '{}'",
+            key.display()
+        );
+    }
+
+    Ok(content)
+}
+
+/// Returns the update package in `dir`, if it is not installed yet,
+/// checking it is signed with `key`, compatible with the `firmware`
+/// and its objects are there.
+pub fn load(
+    dir: &Path,
+    key: &Path,
+    scratch_dir: &Path,
+    firmware: &Metadata,
+    runtime_settings: &RuntimeSettings,
+) -> Result<Option<UpdatePackage>> {
+    let update_package = UpdatePackage::parse(&verified_metadata(dir, key, scratch_dir)?)?;
+    if runtime_settings.update.applied_package_uid.as_ref() == Some(&update_package.package_uid()) {
+        return Ok(None);
+    }
+
+    update_package.compatible_with(firmware)?;
+    for object in update_package.objects() {
+        let source = object.source(dir)?;
+        if !source.is_file() {
+            bail!(
+                "Object {} not found at '{}'",
+                object.filename(),
+                source.display()
+            );
+        }
+    }
+
+    Ok(Some(update_package))
+}
+
+/// Returns the directory and the update package to install from the
+/// `mount_points`, if there is one. A package which is invalid or not
+/// signed with `key` is ignored, as is any without a `key`.
+pub fn pending(
+    mount_points: &[String],
+    key: Option<&Path>,
+    scratch_dir: &Path,
+    firmware: &Metadata,
+    runtime_settings: &RuntimeSettings,
+) -> Option<(PathBuf, UpdatePackage)> {
+    let key = key?;
+    let dir = find(mount_points)?;
+    match load(&dir, key, scratch_dir, firmware, runtime_settings) {
+        Ok(update_package) => update_package.map(|u| (dir, u)),
+        Err(e) => {
+            warn!("Ignoring the update package in '{}': {}", dir.display(), e);
+            None
+        }
+    }
+}
+
+/// Creates a key pair in `dir`, returning the paths of its private and
+/// public keys.
+#[cfg(test)]
+pub fn create_fake_keys(dir: &Path) -> (PathBuf, PathBuf) {
+    let (private, public) = (dir.join("key.pem"), dir.join("key.pub.pem"));
+    process::run(&format!(
+        "openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -out {}",
+        process::quote(&private)
+    )).unwrap();
+    process::run(&format!(
+        "openssl pkey -in {} -pubout -out {}",
+        process::quote(&private),
+        process::quote(&public)
+    )).unwrap();
+    (private, public)
+}
+
+#[test]
+#[cfg(feature = "mode-test")]
+fn packages() {
+    use firmware::tests::{create_fake_metadata, FakeDevice};
+    use tempfile::tempdir;
+    use update_package::tests::{create_fake_object, create_fake_settings, get_update_json};
+
+    let empty = tempdir().unwrap();
+    let media = tempdir().unwrap();
+    let keys = tempdir().unwrap();
+    let scratch = tempdir().unwrap();
+    let mount_points = vec![
+        empty.path().to_string_lossy().into(),
+        media.path().to_string_lossy().into(),
+    ];
+    let firmware = Metadata::new(&create_fake_metadata(FakeDevice::NoUpdate)).unwrap();
+    let mut runtime_settings = RuntimeSettings::default();
+    let (private, public) = create_fake_keys(keys.path());
+    let key = Some(public.as_path());
+    let pending_signed = |runtime_settings: &RuntimeSettings| {
+        pending(
+            &mount_points,
+            key,
+            scratch.path(),
+            &firmware,
+            runtime_settings,
+        )
+    };
+    assert!(find(&mount_points).is_none());
+
+    let dir = media.path().join(PACKAGE_DIR);
+    fs::create_dir(&dir).unwrap();
+    fs::write(dir.join(METADATA_FILE), get_update_json().to_string()).unwrap();
+    assert_eq!(find(&mount_points), Some(dir.clone()));
+
+    let mut settings = create_fake_settings();
+    settings.update.download_dir = dir.clone();
+    create_fake_object(&settings);
+
+    // Not signed yet
+    assert!(pending_signed(&runtime_settings).is_none());
+
+    // Signed with another key
+    let (other, _) = create_fake_keys(scratch.path());
+    sign(&dir.join(METADATA_FILE), &other).unwrap();
+    assert!(pending_signed(&runtime_settings).is_none());
+
+    sign(&dir.join(METADATA_FILE), &private).unwrap();
+    let (found, update_package) = pending_signed(&runtime_settings).unwrap();
+    assert_eq!(found, dir);
+    assert!(!scratch.path().join(METADATA_FILE).exists());
+
+    // Without a key, no package is trusted
+    let untrusted = pending(
+        &mount_points,
+        None,
+        scratch.path(),
+        &firmware,
+        &runtime_settings,
+    );
+    assert!(untrusted.is_none());
+
+    // The metadata is changed once signed
+    let mut json = get_update_json();
+    json["version"] = json!("2.0");
+    fs::write(dir.join(METADATA_FILE), json.to_string()).unwrap();
+    assert!(pending_signed(&runtime_settings).is_none());
+    fs::write(dir.join(METADATA_FILE), get_update_json().to_string()).unwrap();
+
+    runtime_settings.update.applied_package_uid = Some(update_package.package_uid());
+    assert!(pending_signed(&runtime_settings).is_none());
+}